@@ -6,6 +6,7 @@ require (
 	github.com/HORNET-Storage/scionic-merkletree v0.0.0-20240616071419-536181913a36
 	github.com/btcsuite/btcd/btcutil v1.1.5
 	github.com/deroproject/graviton v0.0.0-20220130070622-2c248a53b2e1
+	github.com/fasthttp/websocket v1.5.9
 	github.com/fsnotify/fsnotify v1.7.0
 	github.com/fxamacker/cbor/v2 v2.6.0
 	github.com/gofiber/contrib/websocket v1.3.1
@@ -30,7 +31,6 @@ require (
 	github.com/decred/dcrd/crypto/blake256 v1.0.1 // indirect
 	github.com/docker/go-units v0.5.0 // indirect
 	github.com/elastic/gosigar v0.14.3 // indirect
-	github.com/fasthttp/websocket v1.5.9 // indirect
 	github.com/flynn/noise v1.1.0 // indirect
 	github.com/francoispqt/gojay v1.2.13 // indirect
 	github.com/go-task/slim-sprig/v3 v3.0.0 // indirect
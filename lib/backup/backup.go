@@ -0,0 +1,501 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/HORNET-Storage/hornet-storage/lib/blobs"
+	"github.com/HORNET-Storage/hornet-storage/lib/config"
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+	stores_graviton "github.com/HORNET-Storage/hornet-storage/lib/stores/graviton"
+)
+
+const (
+	manifestName = "manifest.json"
+	storeDir     = "store"
+	blobsDir     = "blobs"
+	statsName    = "relay_stats.db"
+	configName   = "config.json"
+
+	// Bumped whenever the layout of the archive changes
+	manifestVersion = 1
+)
+
+// Manifest describes what a backup archive holds, it is the first entry in every archive
+type Manifest struct {
+	Version   int      `json:"version"`
+	CreatedAt int64    `json:"created_at"`
+	Store     string   `json:"store"`
+	Files     []string `json:"files"`
+
+	// BlobDir names the directory blobs kept on the filesystem are restored to, it is empty when blobs live in the store
+	BlobDir string `json:"blob_dir,omitempty"`
+}
+
+// Create writes a single archive holding a consistent copy of the store, the relay stats database, the config and any
+// blobs kept on the filesystem while the relay keeps serving, the archive is written next to path and renamed into place so a failed backup never leaves
+// a partial archive behind
+func Create(store stores.Store, path string) (*Manifest, error) {
+	backuper, ok := store.(stores.Backuper)
+	if !ok {
+		return nil, fmt.Errorf("store does not support backups")
+	}
+
+	staging, err := os.MkdirTemp("", "hornet-backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	err = os.Mkdir(filepath.Join(staging, storeDir), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = backuper.Backup(filepath.Join(staging, storeDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to back up store: %w", err)
+	}
+
+	// VACUUM INTO writes a transactionally consistent copy of the stats database without blocking other connections
+	db, err := stores_graviton.InitGorm()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Exec("VACUUM INTO ?", filepath.Join(staging, statsName)).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to back up relay stats: %w", err)
+	}
+
+	if config := viper.ConfigFileUsed(); config != "" {
+		err = copyFile(config, filepath.Join(staging, configName))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to back up config: %w", err)
+		}
+	}
+
+	manifest := &Manifest{
+		Version:   manifestVersion,
+		CreatedAt: time.Now().Unix(),
+		Store:     viper.GetString("store"),
+		Files:     []string{},
+	}
+
+	// Archive names mapped to the files they are read from
+	sources := map[string]string{}
+
+	err = collectFiles(staging, "", sources)
+	if err != nil {
+		return nil, err
+	}
+
+	if viper.GetString("blossom_storage") == "filesystem" {
+		blobDir := config.Path("blossom_dir", "blobs")
+
+		linked, err := linkBlobs(blobDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to back up blobs: %w", err)
+		}
+		defer os.RemoveAll(linked)
+
+		err = collectFiles(linked, blobsDir, sources)
+		if err != nil {
+			return nil, err
+		}
+
+		manifest.BlobDir = filepath.Base(blobDir)
+	}
+
+	for name := range sources {
+		manifest.Files = append(manifest.Files, name)
+	}
+	sort.Strings(manifest.Files)
+
+	err = writeArchive(sources, manifest, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// collectFiles adds every file under dir to sources under its path relative to dir, placed inside prefix
+func collectFiles(dir string, prefix string, sources map[string]string) error {
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		relative, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+
+		sources[path.Join(prefix, filepath.ToSlash(relative))] = file
+
+		return nil
+	})
+}
+
+// linkBlobs hard links every blob into a new directory inside the blob directory's own temporary directory and
+// returns it, blobs are only ever written once by a rename so the links hold the blobs as they were even if they are
+// deleted while the archive is written, blobs are copied when the filesystem can't link them
+func linkBlobs(blobDir string) (string, error) {
+	temp := filepath.Join(blobDir, blobs.TempDir)
+
+	err := os.MkdirAll(temp, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	linked, err := os.MkdirTemp(temp, "backup-")
+	if err != nil {
+		return "", err
+	}
+
+	err = filepath.Walk(blobDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if file == temp {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		relative, err := filepath.Rel(blobDir, file)
+		if err != nil {
+			return err
+		}
+
+		destination := filepath.Join(linked, relative)
+
+		err = os.MkdirAll(filepath.Dir(destination), 0755)
+		if err != nil {
+			return err
+		}
+
+		if err := os.Link(file, destination); err != nil {
+			return copyFile(file, destination)
+		}
+
+		return nil
+	})
+	if err != nil {
+		os.RemoveAll(linked)
+		return "", err
+	}
+
+	return linked, nil
+}
+
+func writeArchive(sources map[string]string, manifest *Manifest, path string) error {
+	temp := path + ".tmp"
+
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp)
+
+	compressor := gzip.NewWriter(file)
+	archive := tar.NewWriter(compressor)
+
+	err = func() error {
+		manifestData, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		err = archive.WriteHeader(&tar.Header{
+			Name:    manifestName,
+			Mode:    0644,
+			Size:    int64(len(manifestData)),
+			ModTime: time.Unix(manifest.CreatedAt, 0),
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, err := archive.Write(manifestData); err != nil {
+			return err
+		}
+
+		for _, name := range manifest.Files {
+			err = addFile(archive, sources[name], name)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := archive.Close(); err != nil {
+			return err
+		}
+
+		if err := compressor.Close(); err != nil {
+			return err
+		}
+
+		return file.Sync()
+	}()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp, path)
+}
+
+func addFile(archive *tar.Writer, path string, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+
+	err = archive.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(archive, file)
+
+	return err
+}
+
+// Restore rebuilds a relay's files from an archive written by Create where the config expects them, so data_dir and the
+// per-store path overrides are honoured, the relay must not be running, existing files are only replaced when force is
+// set and nothing is moved into place until the whole archive has been read
+func Restore(path string, force bool) (*Manifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decompressor, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressor.Close()
+
+	dir := config.DataDir()
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	staging, err := os.MkdirTemp(dir, ".hornet-restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	var manifest *Manifest
+
+	archive := tar.NewReader(decompressor)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("archive entry %s is outside of the archive", header.Name)
+		}
+
+		if name == manifestName {
+			manifest = &Manifest{}
+			if err := json.NewDecoder(archive).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("invalid manifest: %w", err)
+			}
+
+			if manifest.Version != manifestVersion {
+				return nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+			}
+
+			continue
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		err = extractFile(archive, filepath.Join(staging, name), os.FileMode(header.Mode).Perm())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("archive has no manifest")
+	}
+
+	// The config is restored into the data directory and everything else to the location the config gives it
+	entries := map[string]string{
+		filepath.Join(staging, statsName):  config.StatsDatabasePath(),
+		filepath.Join(staging, configName): filepath.Join(dir, configName),
+	}
+
+	if manifest.BlobDir != "" {
+		if manifest.BlobDir != filepath.Base(manifest.BlobDir) || manifest.BlobDir == ".." || manifest.BlobDir == "." {
+			return nil, fmt.Errorf("invalid blob directory %s", manifest.BlobDir)
+		}
+
+		entries[filepath.Join(staging, blobsDir)] = config.Path("blossom_dir", manifest.BlobDir)
+	}
+
+	storeEntries, err := os.ReadDir(filepath.Join(staging, storeDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if len(storeEntries) > 1 {
+		return nil, fmt.Errorf("archive holds %d stores, expected one", len(storeEntries))
+	}
+
+	for _, entry := range storeEntries {
+		entries[filepath.Join(staging, storeDir, entry.Name())] = storePath(manifest.Store)
+	}
+
+	for source, destination := range entries {
+		if _, err := os.Stat(source); os.IsNotExist(err) {
+			delete(entries, source)
+			continue
+		}
+
+		if _, err := os.Stat(destination); err == nil && !force {
+			return nil, fmt.Errorf("%s already exists, restore with force to replace it", destination)
+		}
+	}
+
+	for source, destination := range entries {
+		if err := os.RemoveAll(destination); err != nil {
+			return nil, err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+			return nil, err
+		}
+
+		if err := move(source, destination); err != nil {
+			return nil, err
+		}
+	}
+
+	return manifest, nil
+}
+
+// storePath is where the files of the named store are kept, bbolt adds its own extension to the configured path
+func storePath(store string) string {
+	switch store {
+	case "bbolt":
+		return config.BBoltPath() + ".db"
+	default:
+		return config.GravitonPath()
+	}
+}
+
+// move renames source to destination and copies it instead when an override puts the destination on another device
+func move(source string, destination string) error {
+	err := os.Rename(source, destination)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(destination, relative)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+
+		return copyFile(path, target)
+	})
+}
+
+func extractFile(r io.Reader, path string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func copyFile(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+)
+
+const (
+	archivePrefix = "hornet-backup-"
+	archiveSuffix = ".tar.gz"
+)
+
+// Only one backup is written at a time whether it was scheduled or asked for
+var running sync.Mutex
+
+// CreateInDir writes a new timestamped archive to dir and then removes the oldest archives so at most retention
+// are kept, a retention of 0 keeps every archive
+func CreateInDir(store stores.Store, dir string, retention int) (string, *Manifest, error) {
+	running.Lock()
+	defer running.Unlock()
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", nil, err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%s%s%s", archivePrefix, time.Now().UTC().Format("20060102-150405"), archiveSuffix))
+
+	manifest, err := Create(store, path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if retention > 0 {
+		err = prune(dir, retention)
+		if err != nil {
+			log.Printf("Failed to remove old backups: %v", err)
+		}
+	}
+
+	return path, manifest, nil
+}
+
+// List returns the archives in dir oldest first, the timestamp in their names sorts in the order they were taken
+func List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	archives := []string{}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if !entry.IsDir() && strings.HasPrefix(name, archivePrefix) && strings.HasSuffix(name, archiveSuffix) {
+			archives = append(archives, name)
+		}
+	}
+
+	sort.Strings(archives)
+
+	return archives, nil
+}
+
+func prune(dir string, retention int) error {
+	archives, err := List(dir)
+	if err != nil {
+		return err
+	}
+
+	for len(archives) > retention {
+		err = os.Remove(filepath.Join(dir, archives[0]))
+		if err != nil {
+			return err
+		}
+
+		archives = archives[1:]
+	}
+
+	return nil
+}
+
+// StartScheduledBackups backs the relay up to dir on every interval until the returned func is called,
+// stores that can't be backed up or an interval of 0 disable it
+func StartScheduledBackups(store stores.Store, dir string, interval time.Duration, retention int) func() {
+	if _, ok := store.(stores.Backuper); !ok || interval <= 0 {
+		return func() {}
+	}
+
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				path, _, err := CreateInDir(store, dir, retention)
+				if err != nil {
+					log.Printf("Scheduled backup failed: %v", err)
+				} else {
+					log.Printf("Scheduled backup written to %s", path)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
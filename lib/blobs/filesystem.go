@@ -0,0 +1,130 @@
+package blobs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// TempDir is where uploads are written inside the blob directory so renaming them into place never crosses filesystems
+const TempDir = ".tmp"
+
+// FileStore keeps blob content on disk addressed by its sha256, blobs are sharded into two levels of directories
+// named after the first bytes of their hash so no single directory grows too large
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore opens the blob directory at dir, creating it when it doesn't exist
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(filepath.Join(dir, TempDir), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore{dir: dir}, nil
+}
+
+// Path returns where the blob with the hash is kept
+func (store *FileStore) Path(hash string) string {
+	return filepath.Join(store.dir, hash[0:2], hash[2:4], hash)
+}
+
+func validHash(hash string) error {
+	decoded, err := hex.DecodeString(hash)
+	if err != nil || len(decoded) != sha256.Size {
+		return fmt.Errorf("invalid blob hash: %s", hash)
+	}
+
+	return nil
+}
+
+// Write streams r to a temporary file while hashing it and renames it into place once it is complete and synced,
+// readers only ever see whole blobs and writing a blob that already exists leaves the existing file alone
+func (store *FileStore) Write(r io.Reader) (string, int64, error) {
+	file, err := os.CreateTemp(filepath.Join(store.dir, TempDir), "upload-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(file.Name())
+
+	hasher := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(file, hasher), r)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	path := store.Path(hash)
+
+	if _, err := os.Stat(path); err == nil {
+		return hash, size, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hash, size, nil
+}
+
+// Open returns the blob with the hash for reading along with its size
+func (store *FileStore) Open(hash string) (*os.File, int64, error) {
+	if err := validHash(hash); err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.Open(store.Path(hash))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, info.Size(), nil
+}
+
+// Has reports whether the blob with the hash is on disk
+func (store *FileStore) Has(hash string) bool {
+	if validHash(hash) != nil {
+		return false
+	}
+
+	_, err := os.Stat(store.Path(hash))
+
+	return err == nil
+}
+
+// Remove deletes the blob with the hash, removing a blob that isn't there is not an error
+func (store *FileStore) Remove(hash string) error {
+	if err := validHash(hash); err != nil {
+		return err
+	}
+
+	err := os.Remove(store.Path(hash))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
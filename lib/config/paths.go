@@ -0,0 +1,58 @@
+package config
+
+import (
+	"path/filepath"
+
+	"github.com/spf13/viper"
+)
+
+// DataDir is the directory the relay keeps its databases in, set with data_dir and the working directory when unset
+func DataDir() string {
+	dir := viper.GetString("data_dir")
+	if dir == "" {
+		return "."
+	}
+
+	return dir
+}
+
+// Path returns the location configured under key, or name when it isn't set, relative locations are inside the data
+// directory so several relays on one host only need a different data_dir while absolute locations are used as they are
+func Path(key string, name string) string {
+	path := viper.GetString(key)
+	if path == "" {
+		path = name
+	}
+
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(DataDir(), path)
+}
+
+// GravitonPath is the directory of the graviton store, graviton_dir overrides it
+func GravitonPath() string {
+	return Path("graviton_dir", "gravitondb")
+}
+
+// BBoltPath is the bbolt database without its .db extension, bbolt_db overrides it
+func BBoltPath() string {
+	return Path("bbolt_db", "bboltdb")
+}
+
+// StatsDatabasePath is the SQLite database holding the relay stats, relay_stats_db overrides it
+func StatsDatabasePath() string {
+	return Path("relay_stats_db", "relay_stats.db")
+}
+
+// WebRoot is the directory the panel is served from, it ships with the relay rather than being written by it so
+// it is found from the working directory unless web_dir says otherwise
+func WebRoot() string {
+	dir := viper.GetString("web_dir")
+	if dir == "" {
+		return "web"
+	}
+
+	return dir
+}
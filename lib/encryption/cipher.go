@@ -0,0 +1,158 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Values are sealed in segments of this many bytes so a large blob is never authenticated as one huge message
+const segmentSize = 64 * 1024
+
+// Every sealed value starts with this so plaintext written before encryption was enabled can still be read
+var magic = []byte{'H', 'N', 'E', 1}
+
+const headerSize = 4 + 4 + chacha20poly1305.NonceSizeX
+
+// Cipher seals values with XChaCha20-Poly1305 under the active data key and opens values sealed under any data key
+// still in the keyring, a nil Cipher leaves values as they are so stores can use it whether or not encryption is on
+type Cipher struct {
+	active uint32
+	keys   map[uint32]cipher.AEAD
+}
+
+func newCipher(active uint32, keys map[uint32][]byte) (*Cipher, error) {
+	c := &Cipher{
+		active: active,
+		keys:   map[uint32]cipher.AEAD{},
+	}
+
+	for id, key := range keys {
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, err
+		}
+
+		c.keys[id] = aead
+	}
+
+	if _, ok := c.keys[active]; !ok {
+		return nil, fmt.Errorf("active data key %d is missing", active)
+	}
+
+	return c, nil
+}
+
+// segmentNonce gives every segment of a value its own nonce by folding the segment number into the random base nonce
+func segmentNonce(base []byte, segment uint64) []byte {
+	nonce := bytes.Clone(base)
+
+	counter := binary.BigEndian.Uint64(nonce[len(nonce)-8:])
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter^segment)
+
+	return nonce
+}
+
+// segmentData binds each segment to the key the value is stored under and marks the last segment so a value can't be
+// moved to another key, reordered or cut short without failing to open
+func segmentData(key []byte, last bool) []byte {
+	data := append(bytes.Clone(key), 0)
+	if last {
+		data[len(data)-1] = 1
+	}
+
+	return data
+}
+
+// Seal encrypts value for storage under key
+func (c *Cipher) Seal(key []byte, value []byte) ([]byte, error) {
+	if c == nil {
+		return value, nil
+	}
+
+	aead := c.keys[c.active]
+
+	segments := (len(value) + segmentSize - 1) / segmentSize
+	if segments == 0 {
+		segments = 1
+	}
+
+	sealed := make([]byte, headerSize, headerSize+len(value)+segments*aead.Overhead())
+	copy(sealed, magic)
+	binary.BigEndian.PutUint32(sealed[4:8], c.active)
+
+	nonce := sealed[8:headerSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	for segment := 0; segment < segments; segment++ {
+		start := segment * segmentSize
+		end := min(start+segmentSize, len(value))
+
+		sealed = aead.Seal(sealed, segmentNonce(nonce, uint64(segment)), value[start:end], segmentData(key, segment == segments-1))
+	}
+
+	return sealed, nil
+}
+
+// IsSealed reports whether value was written by Seal
+func IsSealed(value []byte) bool {
+	return len(value) >= headerSize && bytes.Equal(value[:4], magic)
+}
+
+// KeyID returns the data key a sealed value was sealed under
+func KeyID(value []byte) (uint32, bool) {
+	if !IsSealed(value) {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint32(value[4:8]), true
+}
+
+// Open decrypts a value stored under key, values that were never sealed are returned as they are
+func (c *Cipher) Open(key []byte, value []byte) ([]byte, error) {
+	if c == nil || !IsSealed(value) {
+		return value, nil
+	}
+
+	id := binary.BigEndian.Uint32(value[4:8])
+
+	aead, ok := c.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("value was sealed with data key %d which is not in the keyring", id)
+	}
+
+	nonce := value[8:headerSize]
+	body := value[headerSize:]
+	chunk := segmentSize + aead.Overhead()
+
+	opened := make([]byte, 0, len(body))
+
+	for segment := 0; ; segment++ {
+		last := len(body) <= chunk
+		end := min(chunk, len(body))
+
+		plaintext, err := aead.Open(opened[len(opened):], segmentNonce(nonce, uint64(segment)), body[:end], segmentData(key, last))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt value: %w", err)
+		}
+
+		opened = opened[:len(opened)+len(plaintext)]
+		body = body[end:]
+
+		if last {
+			return opened, nil
+		}
+	}
+}
+
+// Active reports whether value is already sealed under the active data key
+func (c *Cipher) Active(value []byte) bool {
+	id, ok := KeyID(value)
+	return ok && id == c.active
+}
@@ -0,0 +1,269 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	keySize  = chacha20poly1305.KeySize
+	saltSize = 16
+
+	kdfPassphrase = "argon2id"
+	kdfKeyFile    = "hkdf-sha256"
+)
+
+// MasterKey is the secret the data keys are wrapped with, it never touches the disk itself
+type MasterKey struct {
+	secret []byte
+	kdf    string
+}
+
+// PassphraseKey derives the master key from a passphrase with argon2id
+func PassphraseKey(passphrase string) (*MasterKey, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase is empty")
+	}
+
+	return &MasterKey{secret: []byte(passphrase), kdf: kdfPassphrase}, nil
+}
+
+// KeyFileKey reads the master key from a file holding at least 32 random bytes, raw or hex encoded
+func KeyFileKey(path string) (*MasterKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if decoded, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		data = decoded
+	}
+
+	if len(data) < keySize {
+		return nil, fmt.Errorf("key file %s must hold at least %d bytes", path, keySize)
+	}
+
+	return &MasterKey{secret: data, kdf: kdfKeyFile}, nil
+}
+
+// GenerateKeyFile writes a new hex encoded key file readable only by its owner
+func GenerateKeyFile(path string) error {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600)
+}
+
+func (master *MasterKey) derive(salt []byte) ([]byte, error) {
+	switch master.kdf {
+	case kdfPassphrase:
+		return argon2.IDKey(master.secret, salt, 3, 64*1024, 4, keySize), nil
+	case kdfKeyFile:
+		key := make([]byte, keySize)
+		_, err := io.ReadFull(hkdf.New(sha256.New, master.secret, salt, []byte("hornet-storage keyring")), key)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unknown key derivation %s", master.kdf)
+	}
+}
+
+// wrappedKey is a data key sealed with the key derived from the master key
+type wrappedKey struct {
+	ID      uint32 `json:"id"`
+	Wrapped []byte `json:"wrapped"`
+}
+
+// Keyring holds the data keys that encrypt stored values, the keys are kept on disk wrapped by the master key so
+// rotating the master key only rewrites the keyring and never the data
+type Keyring struct {
+	path string
+
+	KDF    string       `json:"kdf"`
+	Salt   []byte       `json:"salt"`
+	Active uint32       `json:"active"`
+	Keys   []wrappedKey `json:"keys"`
+
+	dataKeys map[uint32][]byte
+}
+
+// OpenKeyring unwraps the keyring at path with the master key, a new keyring with a single data key is created
+// when there isn't one yet
+func OpenKeyring(path string, master *MasterKey) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		keyring := &Keyring{
+			path:     path,
+			dataKeys: map[uint32][]byte{},
+		}
+
+		if _, err := keyring.AddDataKey(); err != nil {
+			return nil, err
+		}
+
+		if err := keyring.Save(master); err != nil {
+			return nil, err
+		}
+
+		return keyring, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyring := &Keyring{
+		path:     path,
+		dataKeys: map[uint32][]byte{},
+	}
+
+	if err := json.Unmarshal(data, keyring); err != nil {
+		return nil, fmt.Errorf("invalid keyring %s: %w", path, err)
+	}
+
+	if keyring.KDF != master.kdf {
+		return nil, fmt.Errorf("keyring %s is protected by a %s master key", path, keyring.KDF)
+	}
+
+	kek, err := master.derive(keyring.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keyring.Keys {
+		if len(key.Wrapped) < aead.NonceSize() {
+			return nil, fmt.Errorf("data key %d is corrupt", key.ID)
+		}
+
+		nonce, sealed := key.Wrapped[:aead.NonceSize()], key.Wrapped[aead.NonceSize():]
+
+		dataKey, err := aead.Open(nil, nonce, sealed, keyData(key.ID))
+		if err != nil {
+			return nil, fmt.Errorf("wrong master key for keyring %s", path)
+		}
+
+		keyring.dataKeys[key.ID] = dataKey
+	}
+
+	return keyring, nil
+}
+
+func keyData(id uint32) []byte {
+	data := []byte("hornet-storage data key ")
+	return binary.BigEndian.AppendUint32(data, id)
+}
+
+// Cipher returns a cipher that seals with the active data key and opens with any key in the keyring
+func (keyring *Keyring) Cipher() (*Cipher, error) {
+	return newCipher(keyring.Active, keyring.dataKeys)
+}
+
+// AddDataKey generates a new data key and makes it the active one, the keyring has to be saved afterwards
+func (keyring *Keyring) AddDataKey() (uint32, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return 0, err
+	}
+
+	id := uint32(1)
+	for existing := range keyring.dataKeys {
+		if existing >= id {
+			id = existing + 1
+		}
+	}
+
+	keyring.dataKeys[id] = key
+	keyring.Active = id
+
+	return id, nil
+}
+
+// DropInactiveKeys removes every data key but the active one, values sealed with them can no longer be read
+func (keyring *Keyring) DropInactiveKeys() {
+	for id := range keyring.dataKeys {
+		if id != keyring.Active {
+			delete(keyring.dataKeys, id)
+		}
+	}
+}
+
+// Save wraps the data keys with the master key under a fresh salt and replaces the keyring on disk atomically,
+// saving with a different master key is how the master key is rotated
+func (keyring *Keyring) Save(master *MasterKey) error {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	kek, err := master.derive(salt)
+	if err != nil {
+		return err
+	}
+
+	aead, err := chacha20poly1305.NewX(kek)
+	if err != nil {
+		return err
+	}
+
+	keys := []wrappedKey{}
+
+	for id, dataKey := range keyring.dataKeys {
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+
+		keys = append(keys, wrappedKey{
+			ID:      id,
+			Wrapped: aead.Seal(nonce, nonce, dataKey, keyData(id)),
+		})
+	}
+
+	keyring.KDF = master.kdf
+	keyring.Salt = salt
+	keyring.Keys = keys
+
+	data, err := json.MarshalIndent(keyring, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(keyring.path), ".keyring-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), keyring.path)
+}
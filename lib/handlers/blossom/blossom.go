@@ -1,18 +1,30 @@
 package blossom
 
 import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/HORNET-Storage/hornet-storage/lib/stores"
 	"github.com/gofiber/fiber/v2"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nbd-wtf/go-nostr"
 )
 
+// Kind used by blossom clients to authorize requests
+const authorizationKind = 24242
+
 type Server struct {
-	storage stores.Store
+	store   stores.Store
+	storage Storage
 }
 
-func NewServer(store stores.Store) *Server {
-	return &Server{storage: store}
+// NewServer serves blobs whose content is kept by storage, the store keeps their descriptors and owners
+func NewServer(store stores.Store, storage Storage) *Server {
+	return &Server{store: store, storage: storage}
 }
 
 func (s *Server) SetupRoutes(app *fiber.App) {
@@ -25,34 +37,79 @@ func (s *Server) SetupRoutes(app *fiber.App) {
 
 func (s *Server) getBlob(c *fiber.Ctx) error {
 	sha256 := c.Params("sha256")
-	data, contentType, err := s.storage.GetBlob(sha256)
+	reader, descriptor, err := s.storage.Get(sha256)
 	if err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Blob not found"})
 	}
-	c.Set("Content-Type", *contentType)
-	return c.Send(data)
+	c.Set("Content-Type", descriptor.Type)
+
+	// The reader is closed once the response has been sent
+	return c.SendStream(reader, int(descriptor.Size))
 }
 
 func (s *Server) hasBlob(c *fiber.Ctx) error {
 	sha256 := c.Params("sha256")
-	_, _, err := s.storage.GetBlob(sha256)
-	if err != nil {
+	if !s.storage.Has(sha256) {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 	return c.SendStatus(fiber.StatusOK)
 }
 
+// authorizedPublicKey returns the public key of the signed authorization event sent in the Authorization header,
+// requests without the header are anonymous and return an empty public key
+func authorizedPublicKey(c *fiber.Ctx) (string, error) {
+	header := c.Get("Authorization")
+	if header == "" {
+		return "", nil
+	}
+
+	encoded, ok := strings.CutPrefix(header, "Nostr ")
+	if !ok {
+		return "", fmt.Errorf("unsupported authorization scheme")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("authorization event is not valid base64")
+	}
+
+	var event nostr.Event
+	if err := jsoniter.Unmarshal(data, &event); err != nil {
+		return "", fmt.Errorf("authorization event is not valid json")
+	}
+
+	if event.Kind != authorizationKind {
+		return "", fmt.Errorf("authorization event must be kind %d", authorizationKind)
+	}
+
+	success, err := event.CheckSignature()
+	if err != nil || !success {
+		return "", fmt.Errorf("authorization event signature failed to verify")
+	}
+
+	return event.PubKey, nil
+}
+
 func (s *Server) uploadBlob(c *fiber.Ctx) error {
-	// TODO: Implement authorization check
+	pubkey, err := authorizedPublicKey(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": err.Error()})
+	}
 
-	// Replace this with the public key from the nostr auth event when nip-42 is implemented
-	pubkey := c.Params("pubkey")
+	// Bodies are streamed when the server allows it so large blobs never have to fit in memory
+	var body io.Reader = c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
 
-	data := c.Body()
 	contentType := c.Get("Content-Type")
 
-	descriptor, err := s.storage.StoreBlob(data, contentType, pubkey)
+	descriptor, err := s.storage.Put(body, contentType, pubkey)
 	if err != nil {
+		if stores.IsQuotaError(err) {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"message": err.Error()})
+		}
+
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Failed to store blob"})
 	}
 
@@ -66,7 +123,7 @@ func (s *Server) listBlobs(c *fiber.Ctx) error {
 	since := c.QueryInt("since", 0)
 	until := c.QueryInt("until", int(time.Now().Unix()))
 
-	blobs, err := s.storage.ListBlobs(pubkey, int64(since), int64(until))
+	blobs, err := s.store.ListBlobs(pubkey, int64(since), int64(until))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Failed to list blobs"})
 	}
@@ -78,7 +135,7 @@ func (s *Server) deleteBlob(c *fiber.Ctx) error {
 	// TODO: Implement authorization check
 
 	sha256 := c.Params("sha256")
-	err := s.storage.DeleteBlob(sha256)
+	err := s.storage.Delete(sha256)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Failed to delete blob"})
 	}
@@ -0,0 +1,185 @@
+package blossom
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/blobs"
+	"github.com/HORNET-Storage/hornet-storage/lib/config"
+	"github.com/HORNET-Storage/hornet-storage/lib/stores"
+)
+
+// Storage holds the content of blossom blobs, descriptors and owners are always kept by the store
+type Storage interface {
+	Put(r io.Reader, contentType string, publicKey string) (*types.BlobDescriptor, error)
+	Get(sha256 string) (io.ReadCloser, *types.BlobDescriptor, error)
+	Has(sha256 string) bool
+	Delete(sha256 string) error
+}
+
+// NewStorage returns the blob storage selected by blossom_storage, "store" keeps blobs in the store itself
+// and "filesystem" keeps them in blossom_dir
+func NewStorage(store stores.Store) (Storage, error) {
+	switch viper.GetString("blossom_storage") {
+	case "", "store":
+		return &storeStorage{store: store}, nil
+	case "filesystem":
+		indexer, ok := store.(stores.BlobIndexer)
+		if !ok {
+			return nil, fmt.Errorf("store can not index blobs kept on the filesystem")
+		}
+
+		// Blobs on the filesystem are written as they are so they would bypass encryption at rest
+		if encrypted, ok := store.(stores.EncryptedStore); ok && encrypted.Encrypted() {
+			return nil, fmt.Errorf("filesystem blob storage can not be used with an encrypted store")
+		}
+
+		files, err := blobs.NewFileStore(config.Path("blossom_dir", "blobs"))
+		if err != nil {
+			return nil, err
+		}
+
+		return &fileStorage{store: store, indexer: indexer, files: files}, nil
+	default:
+		return nil, fmt.Errorf("unknown blossom storage %s", viper.GetString("blossom_storage"))
+	}
+}
+
+// storeStorage keeps blob content in the store's content tree
+type storeStorage struct {
+	store stores.Store
+}
+
+func (storage *storeStorage) Put(r io.Reader, contentType string, publicKey string) (*types.BlobDescriptor, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.store.StoreBlob(data, contentType, publicKey)
+}
+
+func (storage *storeStorage) Get(sha256 string) (io.ReadCloser, *types.BlobDescriptor, error) {
+	data, contentType, err := storage.store.GetBlob(sha256)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	descriptor := &types.BlobDescriptor{
+		SHA256: sha256,
+		Size:   int64(len(data)),
+		Type:   *contentType,
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), descriptor, nil
+}
+
+func (storage *storeStorage) Has(sha256 string) bool {
+	_, _, err := storage.store.GetBlob(sha256)
+	return err == nil
+}
+
+func (storage *storeStorage) Delete(sha256 string) error {
+	return storage.store.DeleteBlob(sha256)
+}
+
+// fileStorage streams blob content to and from the filesystem and only keeps descriptors in the store,
+// blobs stored before switching to it are still read from the store
+type fileStorage struct {
+	store   stores.Store
+	indexer stores.BlobIndexer
+	files   *blobs.FileStore
+}
+
+func (storage *fileStorage) Put(r io.Reader, contentType string, publicKey string) (*types.BlobDescriptor, error) {
+	hash, size, err := storage.files.Write(r)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, _ := storage.indexer.GetBlobDescriptor(hash)
+
+	descriptor := types.BlobDescriptor{
+		URL:      fmt.Sprintf("/%s", hash),
+		SHA256:   hash,
+		Size:     size,
+		Type:     contentType,
+		Uploaded: time.Now().Unix(),
+	}
+
+	err = storage.indexer.IndexBlob(descriptor, publicKey)
+	if err != nil {
+		// The file is only removed when no earlier upload of the same blob relies on it
+		if existing == nil {
+			storage.files.Remove(hash)
+		}
+
+		return nil, err
+	}
+
+	// A blob the store already holds keeps being served from the store so the copy on disk isn't needed
+	if existing != nil && !existing.External {
+		if err := storage.files.Remove(hash); err != nil {
+			log.Printf("Failed to remove duplicate blob %s: %v", hash, err)
+		}
+
+		return existing, nil
+	}
+
+	descriptor.External = true
+
+	return &descriptor, nil
+}
+
+func (storage *fileStorage) Get(sha256 string) (io.ReadCloser, *types.BlobDescriptor, error) {
+	descriptor, err := storage.indexer.GetBlobDescriptor(sha256)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !descriptor.External {
+		return (&storeStorage{store: storage.store}).Get(sha256)
+	}
+
+	file, size, err := storage.files.Open(sha256)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	descriptor.Size = size
+
+	return file, descriptor, nil
+}
+
+func (storage *fileStorage) Has(sha256 string) bool {
+	descriptor, err := storage.indexer.GetBlobDescriptor(sha256)
+	if err != nil {
+		return false
+	}
+
+	return !descriptor.External || storage.files.Has(sha256)
+}
+
+func (storage *fileStorage) Delete(sha256 string) error {
+	descriptor, err := storage.indexer.GetBlobDescriptor(sha256)
+	if err != nil {
+		return err
+	}
+
+	err = storage.store.DeleteBlob(sha256)
+	if err != nil {
+		return err
+	}
+
+	if descriptor.External {
+		return storage.files.Remove(sha256)
+	}
+
+	return nil
+}
@@ -12,8 +12,8 @@ import (
 
 // Not being used until the session system is finished to unify the transports
 // as the current listeners / subscriptions are dependant on the web socket connection
-func BuildAuthHandler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	return func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildAuthHandler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	return func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		data, err := read()
@@ -31,7 +31,7 @@ func BuildAuthHandler(store stores.Store) func(read lib_nostr.KindReader, write
 		}
 
 		if request.Event.Kind != 22242 {
-			write("OK", request.Event.ID, false, "Error auth event kind must be 22242")
+			lib_nostr.WriteRejected(write, request.Event.ID, lib_nostr.PrefixInvalid, "auth event kind must be 22242")
 			return
 		}
 
@@ -43,12 +43,12 @@ func BuildAuthHandler(store stores.Store) func(read lib_nostr.KindReader, write
 
 		result, err := request.Event.CheckSignature()
 		if err != nil {
-			write("OK", request.Event.ID, false, "Error checking event signature")
+			lib_nostr.WriteRejected(write, request.Event.ID, lib_nostr.PrefixError, "failed to check event signature")
 			return
 		}
 
 		if !result {
-			write("OK", request.Event.ID, false, "Error signature verification failed")
+			lib_nostr.WriteRejected(write, request.Event.ID, lib_nostr.PrefixInvalid, "signature failed to verify")
 			return
 		}
 
@@ -66,12 +66,12 @@ func BuildAuthHandler(store stores.Store) func(read lib_nostr.KindReader, write
 		}
 
 		if !hasRelayTag || !hasChallengeTag {
-			write("CLOSE", request.Event.ID, false, "Error event does not have required tags")
+			lib_nostr.WriteRejected(write, request.Event.ID, lib_nostr.PrefixInvalid, "auth event does not have the relay and challenge tags")
 			return
 		}
 
 		// GET SESSION AND SET IT TO AUTHORIZED
 
-		write("OK", request.Event.ID, true, "")
+		lib_nostr.WriteAccepted(write, request.Event.ID)
 	}
 }
@@ -0,0 +1,60 @@
+package nostr
+
+import (
+	"log"
+	"sync"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var (
+	broadcastersMutex sync.RWMutex
+	broadcasters      []func(event *nostr.Event)
+)
+
+// RegisterBroadcaster adds a transport that delivers events to its live subscriptions, events accepted on any
+// transport are passed to every broadcaster so subscribers see them wherever they were published
+func RegisterBroadcaster(broadcaster func(event *nostr.Event)) {
+	broadcastersMutex.Lock()
+	defer broadcastersMutex.Unlock()
+
+	broadcasters = append(broadcasters, broadcaster)
+}
+
+// Broadcast passes an accepted event to every registered broadcaster
+func Broadcast(event *nostr.Event) {
+	broadcastersMutex.RLock()
+	defer broadcastersMutex.RUnlock()
+
+	for _, broadcaster := range broadcasters {
+		broadcaster(event)
+	}
+}
+
+// BroadcastAccepted wraps a handler's reader and writer so the event the handler reads is broadcast once it is accepted,
+// transports that only pass raw messages to handlers use it so their events reach live subscriptions too
+func BroadcastAccepted(read KindReader, write KindWriter) (KindReader, KindWriter) {
+	var data []byte
+
+	wrappedRead := func() ([]byte, error) {
+		var err error
+		data, err = read()
+		return data, err
+	}
+
+	wrappedWrite := func(messageType string, params ...interface{}) {
+		if Accepted(messageType, params) {
+			var env nostr.EventEnvelope
+			if err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(data, &env); err != nil {
+				log.Printf("Error unmarshaling accepted event: %v", err)
+			} else {
+				Broadcast(&env.Event)
+			}
+		}
+
+		write(messageType, params...)
+	}
+
+	return wrappedRead, wrappedWrite
+}
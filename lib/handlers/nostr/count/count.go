@@ -10,8 +10,8 @@ import (
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 )
 
-func BuildCountsHandler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	return func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildCountsHandler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	return func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		data, err := read()
@@ -31,24 +31,44 @@ func BuildCountsHandler(store stores.Store) func(read lib_nostr.KindReader, writ
 		// Check if the request is for counting restricted content
 		if isRestrictedCountRequest(request.Filters) {
 			log.Printf("Refusing to count restricted content for subscription ID: %s\n", request.SubscriptionID)
-			write("CLOSED", request.SubscriptionID, "auth-required: cannot count other people's DMs")
+			write("CLOSED", request.SubscriptionID, lib_nostr.Reason(lib_nostr.PrefixAuthRequired, "cannot count other people's DMs"))
 			return
 		}
 
-		var totalCount int
-		for _, filter := range request.Filters {
-			count, err := store.QueryEvents(filter) //CountEvents(filter) // Assume QueryEvents now returns both events and counts or adjust accordingly
+		// Expensive filters are answered with an estimate when the store supports it (NIP-45), both the estimate and
+		// the exact count are of the union of the filters so an event matching more than one is counted once
+		approximate := false
+
+		var totalCount int64
+		if counter, ok := store.(stores.ApproximateCounter); ok {
+			estimate, estimated, err := counter.EstimateEvents(request.Filters...)
 			if err != nil {
-				log.Printf("Error counting events for filter: %v", err)
-				continue
+				log.Printf("Error estimating events for filters: %v", err)
+			} else if estimated {
+				totalCount = estimate
+				approximate = true
 			}
-			totalCount += len(count)
+		}
+
+		if !approximate {
+			count, err := store.CountEvents(request.Filters...)
+			if err != nil {
+				log.Printf("Error counting events for filters: %v", err)
+				write("CLOSED", request.SubscriptionID, lib_nostr.Reason(lib_nostr.PrefixError, "failed to count events"))
+				return
+			}
+
+			totalCount = count
 		}
 
 		log.Printf("Total count: %d", totalCount)
-		log.Println("Testing to see request.SubscriptionID:", request.SubscriptionID)
-		responseJSON, _ := json.Marshal(map[string]int{"count": totalCount})
-		write("COUNT", request.SubscriptionID, string(responseJSON))
+
+		response := map[string]interface{}{"count": totalCount}
+		if approximate {
+			response["approximate"] = true
+		}
+
+		write("COUNT", request.SubscriptionID, response)
 	}
 }
 
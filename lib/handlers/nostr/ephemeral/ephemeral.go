@@ -0,0 +1,45 @@
+package ephemeral
+
+import (
+	"fmt"
+
+	"github.com/HORNET-Storage/hornet-storage/lib/stores"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nbd-wtf/go-nostr"
+
+	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
+)
+
+// BuildEphemeralHandler accepts ephemeral events (kinds 20000-29999) without storing them, accepting an event is
+// what lets the transport pass it on to live subscriptions so it is only ever seen by clients that are listening
+func BuildEphemeralHandler() func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+		var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+		data, err := read()
+		if err != nil {
+			write("NOTICE", "Error reading from stream.")
+			return
+		}
+
+		var env nostr.EventEnvelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			write("NOTICE", "Error unmarshaling event.")
+			return
+		}
+
+		if !stores.IsEphemeralKind(env.Event.Kind) {
+			lib_nostr.WriteRejected(write, env.Event.ID, lib_nostr.PrefixInvalid, fmt.Sprintf("kind %d is not ephemeral", env.Event.Kind))
+			return
+		}
+
+		success := lib_nostr.ValidateEvent(write, env, -1, authenticated)
+		if !success {
+			return
+		}
+
+		lib_nostr.WriteAccepted(write, env.Event.ID)
+	}
+
+	return handler
+}
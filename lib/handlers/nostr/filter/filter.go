@@ -1,6 +1,7 @@
 package filter
 
 import (
+	"context"
 	"log"
 
 	"github.com/HORNET-Storage/hornet-storage/lib/stores"
@@ -10,8 +11,20 @@ import (
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 )
 
-func BuildFilterHandler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildFilterHandler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	stream := BuildFilterStreamHandler(store)
+
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+		stream(context.Background(), read, write)
+	}
+
+	return handler
+}
+
+// BuildFilterStreamHandler writes each event as the store finds it and stops as soon as the context is cancelled,
+// EOSE is only sent when every filter has been answered
+func BuildFilterStreamHandler(store stores.Store) lib_nostr.KindStreamHandler {
+	handler := func(ctx context.Context, read lib_nostr.KindReader, write lib_nostr.KindWriter) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		data, err := read()
@@ -28,29 +41,35 @@ func BuildFilterHandler(store stores.Store) func(read lib_nostr.KindReader, writ
 			return
 		}
 
-		// Ensure that we respond to the client after processing all filters
-		// defer responder(stream, "EOSE", request.SubscriptionID, "End of stored events")
-		var combinedEvents []*nostr.Event
+		// Events matching more than one filter are only sent once
+		seen := make(map[string]struct{})
+
 		for _, filter := range request.Filters {
-			events, err := store.QueryEvents(filter)
-			if err != nil {
-				log.Printf("Error querying events for filter: %v", err)
-				continue
-			}
-			combinedEvents = append(combinedEvents, events...)
-		}
+			err := store.IterateEvents(ctx, filter, func(event *nostr.Event) bool {
+				if _, exists := seen[event.ID]; exists {
+					return true
+				}
+				seen[event.ID] = struct{}{}
 
-		// Deduplicate events
-		uniqueEvents := deduplicateEvents(combinedEvents)
+				eventJSON, err := json.Marshal(event)
+				if err != nil {
+					log.Printf("Error marshaling event: %v", err)
+					return true
+				}
+
+				write("EVENT", request.SubscriptionID, string(eventJSON))
+
+				return true
+			})
+
+			if ctx.Err() != nil {
+				// The subscription was closed, the client has already been told so there is nothing left to send
+				return
+			}
 
-		// Send each unique event to the client
-		for _, event := range uniqueEvents {
-			eventJSON, err := json.Marshal(event)
 			if err != nil {
-				log.Printf("Error marshaling event: %v", err)
-				continue
+				log.Printf("Error querying events for filter: %v", err)
 			}
-			write("EVENT", request.SubscriptionID, string(eventJSON))
 		}
 
 		write("EOSE", request.SubscriptionID, "End of stored events")
@@ -58,17 +77,3 @@ func BuildFilterHandler(store stores.Store) func(read lib_nostr.KindReader, writ
 
 	return handler
 }
-
-func deduplicateEvents(events []*nostr.Event) []*nostr.Event {
-	seen := make(map[string]struct{})
-	var uniqueEvents []*nostr.Event
-
-	for _, event := range events {
-		if _, exists := seen[event.ID]; !exists {
-			seen[event.ID] = struct{}{}
-			uniqueEvents = append(uniqueEvents, event)
-		}
-	}
-
-	return uniqueEvents
-}
@@ -1,23 +1,31 @@
 package nostr
 
+import "context"
+
 var KindHandlers map[string]KindHandler
+var StreamHandlers map[string]KindStreamHandler
 
 type KindWriter func(messageType string, params ...interface{})
 type KindReader func() ([]byte, error)
 
-type KindHandler func(read KindReader, write KindWriter)
+type KindHandler func(read KindReader, write KindWriter, authenticated string)
+
+// KindStreamHandler is a handler that keeps writing results until its context is cancelled,
+// transports that can cancel a request part way through, such as on a CLOSE, use these when registered
+type KindStreamHandler func(ctx context.Context, read KindReader, write KindWriter)
 
 func init() {
 	KindHandlers = map[string]KindHandler{}
+	StreamHandlers = map[string]KindStreamHandler{}
 }
 
-func RegisterHandler(kind string, handler func(read KindReader, write KindWriter)) error {
+func RegisterHandler(kind string, handler func(read KindReader, write KindWriter, authenticated string)) error {
 	KindHandlers[kind] = handler
 
 	return nil
 }
 
-func GetHandler(kind string) func(read KindReader, write KindWriter) {
+func GetHandler(kind string) func(read KindReader, write KindWriter, authenticated string) {
 	handler, ok := KindHandlers[kind]
 
 	if !ok {
@@ -30,3 +38,19 @@ func GetHandler(kind string) func(read KindReader, write KindWriter) {
 func GetHandlers() map[string]KindHandler {
 	return KindHandlers
 }
+
+func RegisterStreamHandler(kind string, handler KindStreamHandler) error {
+	StreamHandlers[kind] = handler
+
+	return nil
+}
+
+func GetStreamHandler(kind string) KindStreamHandler {
+	handler, ok := StreamHandlers[kind]
+
+	if !ok {
+		return nil
+	}
+
+	return handler
+}
@@ -1,8 +1,6 @@
 package kind0
 
 import (
-	"log"
-
 	"github.com/HORNET-Storage/hornet-storage/lib/stores"
 	jsoniter "github.com/json-iterator/go"
 
@@ -11,8 +9,8 @@ import (
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 )
 
-func BuildKind0Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildKind0Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		// Use Jsoniter for JSON operations
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
@@ -31,41 +29,19 @@ func BuildKind0Handler(store stores.Store) func(read lib_nostr.KindReader, write
 		}
 
 		// Check relay settings for allowed events whilst also verifying signatures and kind number
-		success := lib_nostr.ValidateEvent(write, env, 0)
+		success := lib_nostr.ValidateEvent(write, env, 0, authenticated)
 		if !success {
 			return
 		}
 
-		// Retrieve existing kind 0 events for the pubkey
-		filter := nostr.Filter{
-			Authors: []string{env.Event.PubKey},
-			Kinds:   []int{0},
-		}
-		existingEvents, err := store.QueryEvents(filter)
-		if err != nil {
-			log.Printf("Error querying existing kind 0 events: %v", err)
-			write("NOTICE", "Error querying existing events")
-			return
-		}
-
-		// Delete existing kind 0 events if any
-		if len(existingEvents) > 0 {
-			for _, oldEvent := range existingEvents {
-				if err := store.DeleteEvent(oldEvent.ID); err != nil {
-					log.Printf("Error deleting old kind 0 event %s: %v", oldEvent.ID, err)
-					write("NOTICE", "Error deleting old kind 0 event %s: %v", oldEvent.ID, err)
-				}
-			}
-		}
-
-		// Store the new event
+		// Store the new event, the store replaces any older profile for the pubkey
 		if err := store.StoreEvent(&env.Event); err != nil {
-			write("NOTICE", "Failed to store the event")
+			lib_nostr.WriteStoreError(write, env.Event.ID, err)
 			return
 		}
 
 		// Successfully processed event
-		write("OK", env.Event.ID, true, "Event stored successfully")
+		lib_nostr.WriteAccepted(write, env.Event.ID)
 	}
 
 	return handler
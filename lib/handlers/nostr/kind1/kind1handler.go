@@ -9,8 +9,8 @@ import (
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 )
 
-func BuildKind1Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildKind1Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		// Use Jsoniter for JSON operations
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
@@ -29,19 +29,19 @@ func BuildKind1Handler(store stores.Store) func(read lib_nostr.KindReader, write
 		}
 
 		// Check relay settings for allowed events whilst also verifying signatures and kind number
-		success := lib_nostr.ValidateEvent(write, env, 1)
+		success := lib_nostr.ValidateEvent(write, env, 1, authenticated)
 		if !success {
 			return
 		}
 
 		// Store the new event
 		if err := store.StoreEvent(&env.Event); err != nil {
-			write("NOTICE", "Failed to store the event")
+			lib_nostr.WriteStoreError(write, env.Event.ID, err)
 			return
 		}
 
 		// Successfully processed event
-		write("OK", env.Event.ID, true, "Event stored successfully")
+		lib_nostr.WriteAccepted(write, env.Event.ID)
 	}
 
 	return handler
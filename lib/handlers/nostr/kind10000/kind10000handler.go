@@ -13,8 +13,8 @@ import (
 )
 
 // BuildKind10000Handler constructs and returns a handler function for kind 10000 (Mute List) events.
-func BuildKind10000Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildKind10000Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		// Read data from the stream.
@@ -32,7 +32,7 @@ func BuildKind10000Handler(store stores.Store) func(read lib_nostr.KindReader, w
 		}
 
 		// Check relay settings for allowed events whilst also verifying signatures and kind number
-		success := lib_nostr.ValidateEvent(write, env, 10000)
+		success := lib_nostr.ValidateEvent(write, env, 10000, authenticated)
 		if !success {
 			return
 		}
@@ -57,21 +57,14 @@ func BuildKind10000Handler(store stores.Store) func(read lib_nostr.KindReader, w
 			}
 		}
 
-		// Delete existing kind 10000 events if any
-		for _, oldEvent := range existingEvents {
-			if err := store.DeleteEvent(oldEvent.ID); err != nil {
-				log.Printf("Error deleting old kind 10000 event %s: %v", oldEvent.ID, err)
-			}
-		}
-
-		// Store the new event
+		// Store the new event, the store replaces any older list for the pubkey
 		if err := store.StoreEvent(&env.Event); err != nil {
-			write("NOTICE", "Failed to store the event")
+			lib_nostr.WriteStoreError(write, env.Event.ID, err)
 			return
 		}
 
 		// Successfully processed event
-		write("OK", env.Event.ID, true, "Event stored successfully")
+		lib_nostr.WriteAccepted(write, env.Event.ID)
 	}
 
 	return handler
@@ -2,7 +2,6 @@ package kind10002
 
 import (
 	"fmt"
-	"log"
 
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 	"github.com/HORNET-Storage/hornet-storage/lib/stores"
@@ -11,8 +10,8 @@ import (
 )
 
 // BuildKind10002Handler constructs and returns a handler function for kind 10002 (Relay List Metadata) events.
-func BuildKind10002Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildKind10002Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		// Read data from the stream.
@@ -30,7 +29,7 @@ func BuildKind10002Handler(store stores.Store) func(read lib_nostr.KindReader, w
 		}
 
 		// Check relay settings for allowed events whilst also verifying signatures and kind number
-		success := lib_nostr.ValidateEvent(write, env, 10002)
+		success := lib_nostr.ValidateEvent(write, env, 10002, authenticated)
 		if !success {
 			return
 		}
@@ -41,33 +40,14 @@ func BuildKind10002Handler(store stores.Store) func(read lib_nostr.KindReader, w
 			return
 		}
 
-		// Retrieve existing kind 10002 events for the pubkey to determine if this is an update
-		filter := nostr.Filter{
-			Authors: []string{env.Event.PubKey},
-			Kinds:   []int{10002},
-		}
-		existingEvents, err := store.QueryEvents(filter)
-		if err != nil {
-			log.Printf("Error querying existing kind 10002 events: %v", err)
-			write("NOTICE", fmt.Sprintf("Error querying existing events: %v", err))
-			return
-		}
-
-		// Delete existing kind 10002 events if any
-		for _, oldEvent := range existingEvents {
-			if err := store.DeleteEvent(oldEvent.ID); err != nil {
-				log.Printf("Error deleting old kind 10002 event %s: %v", oldEvent.ID, err)
-			}
-		}
-
-		// Store the new event
+		// Store the new event, the store replaces any older relay list for the pubkey
 		if err := store.StoreEvent(&env.Event); err != nil {
-			write("NOTICE", "Failed to store the event")
+			lib_nostr.WriteStoreError(write, env.Event.ID, err)
 			return
 		}
 
 		// Successfully processed event
-		write("OK", env.Event.ID, true, "Event stored successfully")
+		lib_nostr.WriteAccepted(write, env.Event.ID)
 	}
 
 	return handler
@@ -12,8 +12,8 @@ import (
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 )
 
-func BuildKind16Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildKind16Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		data, err := read()
@@ -30,7 +30,7 @@ func BuildKind16Handler(store stores.Store) func(read lib_nostr.KindReader, writ
 		}
 
 		// Validate the event
-		success := lib_nostr.ValidateEvent(write, env, 16)
+		success := lib_nostr.ValidateEvent(write, env, 16, authenticated)
 		if !success {
 			return
 		}
@@ -61,18 +61,18 @@ func BuildKind16Handler(store stores.Store) func(read lib_nostr.KindReader, writ
 		if err != nil || len(repostedEvents) == 0 {
 			errMsg := fmt.Sprintf("Reposted event %s not found", repostedEventID)
 			log.Println(errMsg)
-			write("OK", event.ID, false, errMsg)
+			lib_nostr.WriteRejected(write, event.ID, lib_nostr.PrefixInvalid, errMsg)
 			return
 		}
 
 		// Store the new event
 		if err := store.StoreEvent(&event); err != nil {
-			write("NOTICE", "Failed to store the event")
+			lib_nostr.WriteStoreError(write, event.ID, err)
 			return
 		}
 
 		// Successfully processed event
-		write("OK", event.ID, true, "Event stored successfully")
+		lib_nostr.WriteAccepted(write, event.ID)
 	}
 
 	return handler
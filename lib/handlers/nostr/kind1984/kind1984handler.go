@@ -10,8 +10,8 @@ import (
 )
 
 // BuildKind1984Handler constructs and returns a handler function for kind 1984 (Report) events.
-func BuildKind1984Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildKind1984Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		// Read data from the stream.
@@ -29,25 +29,25 @@ func BuildKind1984Handler(store stores.Store) func(read lib_nostr.KindReader, wr
 		}
 
 		// Check relay settings for allowed events whilst also verifying signatures and kind number
-		success := lib_nostr.ValidateEvent(write, env, 1984)
+		success := lib_nostr.ValidateEvent(write, env, 1984, authenticated)
 		if !success {
 			return
 		}
 
 		// Validate the report event's tags.
 		if errMsg := validateReportEventTags(env.Event.Tags); errMsg != "" {
-			write("OK", env.Event.ID, false, errMsg)
+			lib_nostr.WriteRejected(write, env.Event.ID, lib_nostr.PrefixInvalid, errMsg)
 			return
 		}
 
 		// Store the new event
 		if err := store.StoreEvent(&env.Event); err != nil {
-			write("NOTICE", "Failed to store the event")
+			lib_nostr.WriteStoreError(write, env.Event.ID, err)
 			return
 		}
 
 		// Successfully processed event
-		write("OK", env.Event.ID, true, "Event stored successfully")
+		lib_nostr.WriteAccepted(write, env.Event.ID)
 	}
 
 	return handler
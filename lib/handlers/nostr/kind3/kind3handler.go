@@ -1,9 +1,6 @@
 package kind3
 
 import (
-	"fmt"
-	"log"
-
 	jsoniter "github.com/json-iterator/go"
 
 	"github.com/HORNET-Storage/hornet-storage/lib/stores"
@@ -12,8 +9,8 @@ import (
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 )
 
-func BuildKind3Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildKind3Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		data, err := read()
@@ -30,41 +27,19 @@ func BuildKind3Handler(store stores.Store) func(read lib_nostr.KindReader, write
 		}
 
 		// Check relay settings for allowed events whilst also verifying signatures and kind number
-		success := lib_nostr.ValidateEvent(write, env, 3)
+		success := lib_nostr.ValidateEvent(write, env, 3, authenticated)
 		if !success {
 			return
 		}
 
-		// Retrieve existing contact list events for the user
-		filter := nostr.Filter{
-			Authors: []string{env.Event.PubKey},
-			Kinds:   []int{3},
-		}
-		existingEvents, err := store.QueryEvents(filter)
-		if err != nil {
-			log.Printf("Error querying existing contact list events: %v", err)
-			write("NOTICE", fmt.Sprintf("Error querying existing contact list events: %v", err))
-			return
-		}
-
-		// If there's an existing event, delete it
-		if len(existingEvents) > 0 {
-			for _, oldEvent := range existingEvents {
-				if err := store.DeleteEvent(oldEvent.ID); err != nil {
-					log.Printf("Error deleting old contact list event %s: %v", oldEvent.ID, err)
-					// Decide how to handle delete failures
-				}
-			}
-		}
-
-		// Store the new event
+		// Store the new event, the store replaces any older contact list for the pubkey
 		if err := store.StoreEvent(&env.Event); err != nil {
-			write("NOTICE", "Failed to store the event")
+			lib_nostr.WriteStoreError(write, env.Event.ID, err)
 			return
 		}
 
 		// Successfully processed event
-		write("OK", env.Event.ID, true, "Event stored successfully")
+		lib_nostr.WriteAccepted(write, env.Event.ID)
 	}
 	return handler
 }
@@ -1,9 +1,6 @@
 package kind30000
 
 import (
-	"fmt"
-	"log"
-
 	jsoniter "github.com/json-iterator/go"
 
 	"github.com/HORNET-Storage/hornet-storage/lib/stores"
@@ -13,8 +10,8 @@ import (
 )
 
 // BuildKind30000Handler constructs and returns a handler function for kind 30000 (Follow Sets) events.
-func BuildKind30000Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildKind30000Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		data, err := read()
@@ -31,7 +28,7 @@ func BuildKind30000Handler(store stores.Store) func(read lib_nostr.KindReader, w
 		}
 
 		// Check relay settings for allowed events whilst also verifying signatures and kind number
-		success := lib_nostr.ValidateEvent(write, env, 30000)
+		success := lib_nostr.ValidateEvent(write, env, 30000, authenticated)
 		if !success {
 			return
 		}
@@ -41,33 +38,14 @@ func BuildKind30000Handler(store stores.Store) func(read lib_nostr.KindReader, w
 			return
 		}
 
-		// Query and delete existing kind 30000 events for the pubkey
-		filter := nostr.Filter{
-			Authors: []string{env.Event.PubKey},
-			Kinds:   []int{30000},
-		}
-		existingEvents, err := store.QueryEvents(filter)
-		if err != nil {
-			log.Printf("Error querying existing kind 30000 events: %v", err)
-			write("NOTICE", fmt.Sprintf("Error querying existing events: %v", err))
-			return
-		}
-
-		for _, oldEvent := range existingEvents {
-			if err := store.DeleteEvent(oldEvent.ID); err != nil {
-				log.Printf("Error deleting old kind 30000 event %s: %v", oldEvent.ID, err)
-				// Optionally respond or handle delete failures
-			}
-		}
-
-		// Store the new event
+		// Store the new event, the store replaces any older follow set with the same d tag
 		if err := store.StoreEvent(&env.Event); err != nil {
-			write("NOTICE", "Failed to store the event")
+			lib_nostr.WriteStoreError(write, env.Event.ID, err)
 			return
 		}
 
 		// Successfully processed event
-		write("OK", env.Event.ID, true, "Event stored successfully")
+		lib_nostr.WriteAccepted(write, env.Event.ID)
 	}
 
 	return handler
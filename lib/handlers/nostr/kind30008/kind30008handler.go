@@ -12,8 +12,8 @@ import (
 )
 
 // BuildKind30008Handler constructs and returns a handler function for kind 30008 (Profile Badges) events.
-func BuildKind30008Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildKind30008Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		// Read data from the stream.
@@ -31,7 +31,7 @@ func BuildKind30008Handler(store stores.Store) func(read lib_nostr.KindReader, w
 		}
 
 		// Check relay settings for allowed events whilst also verifying signatures and kind number
-		success := lib_nostr.ValidateEvent(write, env, 30008)
+		success := lib_nostr.ValidateEvent(write, env, 30008, authenticated)
 		if !success {
 			return
 		}
@@ -40,18 +40,18 @@ func BuildKind30008Handler(store stores.Store) func(read lib_nostr.KindReader, w
 		isValid, errMsg := validateProfileBadgesEvent(env.Event)
 		if !isValid {
 			log.Println(errMsg)
-			write("OK", env.Event.ID, false, errMsg)
+			lib_nostr.WriteRejected(write, env.Event.ID, lib_nostr.PrefixInvalid, errMsg)
 			return
 		}
 
 		// Store the new event
 		if err := store.StoreEvent(&env.Event); err != nil {
-			write("NOTICE", "Failed to store the event")
+			lib_nostr.WriteStoreError(write, env.Event.ID, err)
 			return
 		}
 
 		// Successfully processed event
-		write("OK", env.Event.ID, true, "Event stored successfully")
+		lib_nostr.WriteAccepted(write, env.Event.ID)
 	}
 
 	return handler
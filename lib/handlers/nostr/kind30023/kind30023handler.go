@@ -12,8 +12,8 @@ import (
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 )
 
-func BuildKind30023Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildKind30023Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		// Read data from the stream.
@@ -32,12 +32,12 @@ func BuildKind30023Handler(store stores.Store) func(read lib_nostr.KindReader, w
 
 		// Validate the event kind.
 		if env.Event.Kind != 30023 && env.Event.Kind != 30024 {
-			write("OK", env.Event.ID, false, "Unsupported event kind for this handler.")
+			lib_nostr.WriteRejected(write, env.Event.ID, lib_nostr.PrefixInvalid, "unsupported event kind for this handler")
 			return
 		}
 
 		// Check relay settings for allowed events whilst also verifying signatures and kind number
-		success := lib_nostr.ValidateEvent(write, env, -1)
+		success := lib_nostr.ValidateEvent(write, env, -1, authenticated)
 		if !success {
 			return
 		}
@@ -62,33 +62,14 @@ func BuildKind30023Handler(store stores.Store) func(read lib_nostr.KindReader, w
 			return
 		}
 
-		// Create a filter to check for existing events with the same 'd' tag and author.
-		filter := nostr.Filter{
-			Authors: []string{env.Event.PubKey},
-			Tags:    map[string][]string{"d": {dTagValue}},
-		}
-		existingEvents, err := store.QueryEvents(filter)
-		if err != nil {
-			write("NOTICE", "Failed to query existing events.")
-			return
-		}
-
-		// Delete existing events if any.
-		for _, existingEvent := range existingEvents {
-			if err := store.DeleteEvent(existingEvent.ID); err != nil {
-				write("NOTICE", "Failed to delete an existing event.")
-				return
-			}
-		}
-
-		// Store the new event
+		// Store the new event, the store replaces any older article or draft with the same 'd' tag
 		if err := store.StoreEvent(&env.Event); err != nil {
-			write("NOTICE", "Failed to store the event")
+			lib_nostr.WriteStoreError(write, env.Event.ID, err)
 			return
 		}
 
 		// Successfully processed event
-		write("OK", env.Event.ID, true, "Event stored successfully")
+		lib_nostr.WriteAccepted(write, env.Event.ID)
 	}
 
 	return handler
@@ -13,8 +13,8 @@ import (
 )
 
 // BuildKind30079Handler constructs and returns a handler function for kind 30079 (Event Paths) events.
-func BuildKind30079Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildKind30079Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		log.Println("Handling event path event.")
@@ -33,7 +33,7 @@ func BuildKind30079Handler(store stores.Store) func(read lib_nostr.KindReader, w
 			return
 		}
 
-		success := lib_nostr.ValidateEvent(write, env, 30079)
+		success := lib_nostr.ValidateEvent(write, env, 30079, authenticated)
 		if !success {
 			return
 		}
@@ -42,36 +42,17 @@ func BuildKind30079Handler(store stores.Store) func(read lib_nostr.KindReader, w
 
 		// Validate the presence of 'd' and 'f' tags
 		if err := validateEventPathTags(event.Tags); err != nil {
-			write("NOTICE", err.Error())
+			lib_nostr.WriteRejected(write, event.ID, lib_nostr.PrefixInvalid, err.Error())
 			return
 		}
 
-		// Query for existing events of the same kind and pubkey
-		filter := nostr.Filter{
-			Authors: []string{event.PubKey},
-			Kinds:   []int{30079},
-		}
-		existingEvents, err := store.QueryEvents(filter)
-		if err != nil {
-			log.Printf("Error querying existing kind 30079 events: %v", err)
-			write("NOTICE", fmt.Sprintf("Error querying existing events: %v", err))
-			return
-		}
-
-		// Delete existing events of the same kind
-		for _, oldEvent := range existingEvents {
-			if err := store.DeleteEvent(oldEvent.ID); err != nil {
-				log.Printf("Error deleting old kind 30079 event %s: %v", oldEvent.ID, err)
-			}
-		}
-
-		// Store the new event
+		// Store the new event, the store replaces any older event path with the same 'd' tag
 		if err := store.StoreEvent(&event); err != nil {
-			write("OK", event.ID, false, fmt.Sprintf("Error storing event: %v", err))
+			lib_nostr.WriteStoreError(write, event.ID, err)
 			return
 		}
 
-		write("OK", event.ID, true, "Event path updated successfully")
+		lib_nostr.WriteAccepted(write, event.ID)
 	}
 
 	return handler
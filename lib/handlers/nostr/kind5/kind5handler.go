@@ -12,8 +12,8 @@ import (
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 )
 
-func BuildKind5Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildKind5Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		data, err := read()
@@ -30,7 +30,7 @@ func BuildKind5Handler(store stores.Store) func(read lib_nostr.KindReader, write
 		}
 
 		// Check relay settings for allowed events whilst also verifying signatures and kind number
-		success := lib_nostr.ValidateEvent(write, env, 5)
+		success := lib_nostr.ValidateEvent(write, env, 5, authenticated)
 		if !success {
 			return
 		}
@@ -55,8 +55,6 @@ func BuildKind5Handler(store stores.Store) func(read lib_nostr.KindReader, write
 					if err := store.DeleteEvent(eventID); err != nil {
 						log.Printf("Error deleting event %s: %v", eventID, err)
 						// Optionally, handle individual delete failures
-					} else {
-						write("OK", env.Event.ID, true, "Deletion processed")
 					}
 				} else {
 					log.Printf("Public key mismatch for event %s, deletion request ignored", eventID)
@@ -65,6 +63,8 @@ func BuildKind5Handler(store stores.Store) func(read lib_nostr.KindReader, write
 			}
 		}
 
+		// The deletion request is acknowledged once, failures for individual events have been reported as notices
+		lib_nostr.WriteAccepted(write, env.Event.ID)
 	}
 
 	return handler
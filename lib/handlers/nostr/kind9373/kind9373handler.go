@@ -12,8 +12,8 @@ import (
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 )
 
-func BuildKind9373Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildKind9373Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		data, err := read()
@@ -30,7 +30,7 @@ func BuildKind9373Handler(store stores.Store) func(read lib_nostr.KindReader, wr
 		}
 
 		// Check relay settings for allowed events whilst also verifying signatures and kind number
-		success := lib_nostr.ValidateEvent(write, env, 9373)
+		success := lib_nostr.ValidateEvent(write, env, 9373, authenticated)
 		if !success {
 			return
 		}
@@ -39,7 +39,7 @@ func BuildKind9373Handler(store stores.Store) func(read lib_nostr.KindReader, wr
 		repostedEventID, repostedEventFound := getTagValue(env.Event.Tags, "e", "p", "q")
 
 		if !repostedEventFound {
-			write("OK", env.Event.ID, false, "Reposted event ID not found in 'e' or 'p' or 'q' tag.")
+			lib_nostr.WriteRejected(write, env.Event.ID, lib_nostr.PrefixInvalid, "reposted event ID not found in 'e' or 'p' or 'q' tag")
 			return
 		}
 
@@ -51,18 +51,18 @@ func BuildKind9373Handler(store stores.Store) func(read lib_nostr.KindReader, wr
 		if err != nil || len(repostedEvents) == 0 {
 			errMsg := fmt.Sprintf("Reposted event %s not found", repostedEventID)
 			log.Println(errMsg)
-			write("OK", env.Event.ID, false, errMsg)
+			lib_nostr.WriteRejected(write, env.Event.ID, lib_nostr.PrefixInvalid, errMsg)
 			return
 		}
 
 		// Store the new event
 		if err := store.StoreEvent(&env.Event); err != nil {
-			write("NOTICE", "Failed to store the event")
+			lib_nostr.WriteStoreError(write, env.Event.ID, err)
 			return
 		}
 
 		// Successfully processed event
-		write("OK", env.Event.ID, true, "Event stored successfully")
+		lib_nostr.WriteAccepted(write, env.Event.ID)
 	}
 
 	return handler
@@ -9,8 +9,8 @@ import (
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 )
 
-func BuildKind9802Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
-	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter) {
+func BuildKind9802Handler(store stores.Store) func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
+	handler := func(read lib_nostr.KindReader, write lib_nostr.KindWriter, authenticated string) {
 		var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 		// Read data from stream
@@ -28,25 +28,25 @@ func BuildKind9802Handler(store stores.Store) func(read lib_nostr.KindReader, wr
 		}
 
 		// Check relay settings for allowed events whilst also verifying signatures and kind number
-		success := lib_nostr.ValidateEvent(write, env, 9802)
+		success := lib_nostr.ValidateEvent(write, env, 9802, authenticated)
 		if !success {
 			return
 		}
 
 		// Check if at least one of the expected tags ('a', 'e', 'r', 'p', 'context') is present
 		if !hasExpectedTag(env.Event.Tags, "a", "e", "r", "p", "context") {
-			write("OK", env.Event.ID, false, "No expected tags found in the event.")
+			lib_nostr.WriteRejected(write, env.Event.ID, lib_nostr.PrefixInvalid, "no expected tags found in the event")
 			return
 		}
 
 		/// Store the new event
 		if err := store.StoreEvent(&env.Event); err != nil {
-			write("NOTICE", "Failed to store the event")
+			lib_nostr.WriteStoreError(write, env.Event.ID, err)
 			return
 		}
 
 		// Successfully processed event
-		write("OK", env.Event.ID, true, "Event stored successfully")
+		lib_nostr.WriteAccepted(write, env.Event.ID)
 	}
 
 	return handler
@@ -0,0 +1,65 @@
+package nostr
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+	"github.com/spf13/viper"
+)
+
+// MinPowDifficulty returns the NIP-13 difficulty events of a kind need, a per kind minimum replaces the global one
+func MinPowDifficulty(kind int) int {
+	key := "min_pow_difficulty_kinds." + strconv.Itoa(kind)
+	if viper.IsSet(key) {
+		return viper.GetInt(key)
+	}
+
+	return viper.GetInt("min_pow_difficulty")
+}
+
+// CheckPow refuses events that fall short of the minimum difficulty for their kind, the nonce tag has to commit to at
+// least the minimum so events that only got lucky while mining for less are refused too (NIP-13), authenticated is the
+// pubkey the submitting connection authenticated as and is empty when it hasn't, only its own events are exempt
+func CheckPow(event *nostr.Event, authenticated string) error {
+	minimum := MinPowDifficulty(event.Kind)
+	if minimum <= 0 || powExempt(event.PubKey, authenticated) {
+		return nil
+	}
+
+	target, ok := committedTarget(event)
+	if !ok {
+		return &InvalidEventError{Reason: Reason(PrefixPow, fmt.Sprintf("difficulty %d is required and the event has no nonce tag committing to it", minimum))}
+	}
+
+	if target < minimum {
+		return &InvalidEventError{Reason: Reason(PrefixPow, fmt.Sprintf("committed target %d is less than %d", target, minimum))}
+	}
+
+	// The signature check doesn't cover the id the client sent so the difficulty is measured on the id the event hashes to
+	if difficulty := nip13.Difficulty(event.GetID()); difficulty < minimum {
+		return &InvalidEventError{Reason: Reason(PrefixPow, fmt.Sprintf("difficulty %d is less than %d", difficulty, minimum))}
+	}
+
+	return nil
+}
+
+func powExempt(pubkey string, authenticated string) bool {
+	return (authenticated != "" && authenticated == pubkey) || slices.Contains(viper.GetStringSlice("pow_whitelist"), pubkey)
+}
+
+func committedTarget(event *nostr.Event) (int, bool) {
+	tag := event.Tags.GetFirst([]string{"nonce", ""})
+	if tag == nil || len(*tag) < 3 {
+		return 0, false
+	}
+
+	target, err := strconv.Atoi((*tag)[2])
+	if err != nil {
+		return 0, false
+	}
+
+	return target, true
+}
@@ -0,0 +1,55 @@
+package nostr
+
+import "strings"
+
+// Machine readable prefixes clients use to tell why an event was refused or a subscription was closed (NIP-01)
+const (
+	PrefixDuplicate    = "duplicate"
+	PrefixPow          = "pow"
+	PrefixBlocked      = "blocked"
+	PrefixRateLimited  = "rate-limited"
+	PrefixInvalid      = "invalid"
+	PrefixRestricted   = "restricted"
+	PrefixError        = "error"
+	PrefixAuthRequired = "auth-required"
+)
+
+// Reason joins a prefix and a human readable message the way NIP-01 expects them in OK and CLOSED messages
+func Reason(prefix string, message string) string {
+	return prefix + ": " + message
+}
+
+// WriteAccepted answers an event that was stored or otherwise acted on
+func WriteAccepted(write KindWriter, eventID string) {
+	write("OK", eventID, true, "")
+}
+
+// WriteDuplicate answers an event that was already stored, the client knows it is stored without it being broadcast again
+func WriteDuplicate(write KindWriter, eventID string) {
+	write("OK", eventID, true, Reason(PrefixDuplicate, "already have this event"))
+}
+
+// WriteRejected answers an event that was refused with the prefix that tells the client why
+func WriteRejected(write KindWriter, eventID string, prefix string, message string) {
+	write("OK", eventID, false, Reason(prefix, message))
+}
+
+// Accepted reports whether a response written by a handler accepts a new event, transports use it so events are
+// only broadcast once a handler has stored them, duplicates are accepted but were broadcast when first stored
+func Accepted(messageType string, params []interface{}) bool {
+	if messageType != "OK" || len(params) < 2 {
+		return false
+	}
+
+	if ok, _ := params[1].(bool); !ok {
+		return false
+	}
+
+	if len(params) > 2 {
+		if reason, _ := params[2].(string); strings.HasPrefix(reason, PrefixDuplicate+":") {
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,6 +1,7 @@
 package nostr
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
@@ -11,58 +12,121 @@ import (
 	jsoniter "github.com/json-iterator/go"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/spf13/viper"
 
 	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/settings"
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
 )
 
-// Gerneric event validation that almost all kinds will use
-func ValidateEvent(write KindWriter, env nostr.EventEnvelope, expectedKind int) bool {
+// Gerneric event validation that almost all kinds will use, authenticated is the pubkey the connection the event was
+// published over authenticated as
+func ValidateEvent(write KindWriter, env nostr.EventEnvelope, expectedKind int, authenticated string) bool {
+	err := CheckEvent(&env.Event, expectedKind, authenticated, true)
+	if err != nil {
+		var invalid *InvalidEventError
+		if errors.As(err, &invalid) {
+			write("OK", env.Event.ID, false, invalid.Reason)
+		} else {
+			WriteRejected(write, env.Event.ID, PrefixError, err.Error())
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// InvalidEventError is returned by CheckEvent when the relay refuses an event, the reason is what clients are told in the OK message
+// and starts with one of the NIP-01 prefixes
+type InvalidEventError struct {
+	Reason string
+}
+
+func (err *InvalidEventError) Error() string {
+	return err.Reason
+}
+
+// CheckEvent runs the checks behind ValidateEvent without writing a response so events that don't arrive over a connection,
+// such as imports, are held to the same rules, any error that isn't an InvalidEventError means the event could not be checked.
+// Proof of work is only checked when checkPow is set, authenticated is passed on to CheckPow so the pubkey a connection
+// authenticated as doesn't have to mine its own events
+func CheckEvent(event *nostr.Event, expectedKind int, authenticated string, checkPow bool) error {
 	// If the expected kind is greater than -1 then we ensure the event kind matches the expected kind
 	if expectedKind > -1 {
-		if env.Event.Kind != expectedKind {
-			write("OK", env.Event.ID, false, "Invalid event kind")
-			return false
+		if event.Kind != expectedKind {
+			return &InvalidEventError{Reason: Reason(PrefixInvalid, "event kind does not match the handler")}
 		}
 	}
 
-	// Load and check relay settings
-	settings, err := LoadRelaySettings()
-	if err != nil {
-		write("NOTICE", "Failed to load relay settings")
-		return false
+	// Check if the event kind is allowed, ephemeral events are never stored so the kinds the relay stores don't apply to them
+	allowed := stores.IsEphemeralKind(event.Kind) || IsTheKindAllowed(event.Kind, settings.Get())
+	if !allowed {
+		return &InvalidEventError{Reason: Reason(PrefixBlocked, fmt.Sprintf("kind %d is not accepted by this relay", event.Kind))}
 	}
 
-	// Check if the event kind is allowed
-	blocked := IsTheKindAllowed(env.Event.Kind, settings)
-	if !blocked {
-		write("OK", env.Event.ID, false, "This kind is not handled by the relay")
-		return false
+	// Events that have already expired would only be deleted again by the sweeper (NIP-40)
+	if stores.IsExpired(event, time.Now().Unix()) {
+		return &InvalidEventError{Reason: Reason(PrefixInvalid, "event has expired")}
 	}
 
-	timeCheck := TimeCheck(env.Event.CreatedAt.Time().Unix())
+	timeCheck := TimeCheck(event.CreatedAt.Time().Unix())
 	if !timeCheck {
-		write("OK", env.Event.ID, false, "The event creation date must be after January 1, 2019")
+		return &InvalidEventError{Reason: Reason(PrefixInvalid, "event creation date is in the future")}
+	}
+
+	// The signature covers the serialized event rather than the id the client sent, an id that doesn't match the content
+	// could take the place of another event's id and have the real one refused as a duplicate
+	if event.ID != event.GetID() {
+		return &InvalidEventError{Reason: Reason(PrefixInvalid, "event id does not match its content")}
 	}
 
 	// Validate the event signature
-	success, err := env.Event.CheckSignature()
+	success, err := event.CheckSignature()
 	if err != nil {
-		write("NOTICE", "Failed to check signature")
-		return false
+		return fmt.Errorf("failed to check signature")
 	}
 
 	if !success {
-		write("OK", env.Event.ID, false, "Signature failed to verify")
-		return false
+		return &InvalidEventError{Reason: Reason(PrefixInvalid, "signature failed to verify")}
 	}
 
-	return true
+	// Checked once the signature has verified so the pubkey the exemption is given for really is the author
+	if checkPow {
+		return CheckPow(event, authenticated)
+	}
+
+	return nil
 }
 
+// WriteStoreError reports an event that could not be stored, events rejected by the store for going over
+// the author's quota or for being older than the stored version are refused so the client knows not to retry,
+// events that are already stored are accepted as duplicates
+func WriteStoreError(write KindWriter, eventID string, err error) {
+	if errors.Is(err, stores.ErrDuplicate) {
+		WriteDuplicate(write, eventID)
+		return
+	}
+
+	if stores.IsQuotaError(err) {
+		WriteRejected(write, eventID, PrefixBlocked, err.Error())
+		return
+	}
+
+	if errors.Is(err, stores.ErrSuperseded) || errors.Is(err, stores.ErrEphemeral) {
+		WriteRejected(write, eventID, PrefixInvalid, err.Error())
+		return
+	}
+
+	WriteRejected(write, eventID, PrefixError, "failed to store the event")
+}
+
+// MaxFutureSkew is how far ahead of the relay's clock an event's created_at may be, clients with a clock that runs
+// a little fast shouldn't have every event refused
+const MaxFutureSkew = 5 * time.Minute
+
 // Check if the event is pretending it can time travel
 func TimeCheck(eventCreatedAt int64) bool {
-	currentTime := time.Now()
+	currentTime := time.Now().Add(MaxFutureSkew)
 
 	return eventCreatedAt <= currentTime.Unix()
 }
@@ -160,25 +224,6 @@ func CloseStream(stream network.Stream) {
 	}
 }
 
-func LoadRelaySettings() (*types.RelaySettings, error) {
-	viper.SetConfigName("config") // Name of config file (without extension)
-	viper.SetConfigType("json")   // Type of the config file
-	viper.AddConfigPath(".")      // Path to look for the config file in
-
-	if err := viper.ReadInConfig(); err != nil {
-		log.Fatalf("Error reading config file: %s", err)
-		return nil, err
-	}
-
-	var settings types.RelaySettings
-	if err := viper.UnmarshalKey("relay_settings", &settings); err != nil {
-		log.Fatalf("Error unmarshaling config into struct: %s (nostr/utils)", err)
-		return nil, err
-	}
-
-	return &settings, nil
-}
-
 func IsTheKindAllowed(kind int, settings *types.RelaySettings) bool {
 	if settings.Mode != "smart" {
 		return true
@@ -41,13 +41,20 @@ func BuildUploadStreamHandler(store stores.Store, canUploadDag func(rootLeaf *me
 			return
 		}
 
+		// Leaves are staged until the whole dag has been received and verified so a failed upload never leaves a partial dag behind
+		batch := store.NewBatch()
+		defer batch.Discard()
+
+		// The builder only keeps hashes and links to verify the structure, the content of each leaf is held once by the batch
+		builder := merkle_dag.CreateDagBuilder()
+
 		rootData := &types.DagLeafData{
 			PublicKey: message.PublicKey,
 			Signature: message.Signature,
 			Leaf:      message.Leaf,
 		}
 
-		err = store.StoreLeaf(message.Root, rootData)
+		err = batch.StoreLeaf(message.Root, rootData)
 		if err != nil {
 			utils.WriteErrorToStream(stream, "Failed to verify root leaf", err)
 
@@ -55,6 +62,8 @@ func BuildUploadStreamHandler(store stores.Store, canUploadDag func(rootLeaf *me
 			return
 		}
 
+		builder.AddLeaf(withoutContent(&rootData.Leaf), nil)
+
 		err = utils.WriteResponseToStream(stream, true)
 		if err != nil || !result {
 			log.Printf("Failed to write response to stream: %e\n", err)
@@ -82,15 +91,20 @@ func BuildUploadStreamHandler(store stores.Store, canUploadDag func(rootLeaf *me
 				break
 			}
 
-			parentData, err := store.RetrieveLeaf(message.Root, message.Parent, false)
-			if err != nil || !result {
-				utils.WriteErrorToStream(stream, "Failed to find parent leaf", err)
+			parent, ok := builder.Leafs[message.Parent]
+			if !ok {
+				utils.WriteErrorToStream(stream, "Failed to find parent leaf", nil)
 
 				stream.Close()
 				break
 			}
 
-			parent := parentData.Leaf
+			if !parent.HasLink(message.Leaf.Hash) {
+				utils.WriteErrorToStream(stream, "Leaf is not linked from its parent", nil)
+
+				stream.Close()
+				break
+			}
 
 			if message.Branch != nil {
 				err = parent.VerifyBranch(message.Branch)
@@ -106,7 +120,7 @@ func BuildUploadStreamHandler(store stores.Store, canUploadDag func(rootLeaf *me
 				Leaf: message.Leaf,
 			}
 
-			err = store.StoreLeaf(message.Root, data)
+			err = batch.StoreLeaf(message.Root, data)
 			if err != nil {
 				utils.WriteErrorToStream(stream, "Failed to add leaf to block database", err)
 
@@ -114,6 +128,8 @@ func BuildUploadStreamHandler(store stores.Store, canUploadDag func(rootLeaf *me
 				return
 			}
 
+			builder.AddLeaf(withoutContent(&data.Leaf), nil)
+
 			leafCount++
 
 			err = utils.WriteResponseToStream(stream, true)
@@ -125,26 +141,40 @@ func BuildUploadStreamHandler(store stores.Store, canUploadDag func(rootLeaf *me
 			}
 		}
 
-		dagData, err := store.BuildDagFromStore(message.Root, true)
+		dag := builder.BuildDag(message.Root)
+
+		err = dag.Verify()
 		if err != nil {
-			utils.WriteErrorToStream(stream, "Failed to build dag from provided leaves: %e", err)
+			utils.WriteErrorToStream(stream, "Failed to verify dag: %e", err)
 
 			stream.Close()
 			return
 		}
 
-		err = dagData.Dag.Verify()
+		err = batch.Commit()
 		if err != nil {
-			utils.WriteErrorToStream(stream, "Failed to verify dag: %e", err)
+			if stores.IsQuotaError(err) {
+				utils.WriteErrorToStream(stream, "Upload rejected: %v", err)
+			} else {
+				utils.WriteErrorToStream(stream, "Failed to add dag to block database", err)
+			}
 
 			stream.Close()
 			return
 		}
 
-		handleRecievedDag(&dagData.Dag, &message.PublicKey)
+		handleRecievedDag(dag, &message.PublicKey)
 
 		stream.Close()
 	}
 
 	return uploadStreamHandler
 }
+
+// withoutContent copies a leaf without its content, verifying the dag only needs the content hash
+func withoutContent(leaf *merkle_dag.DagLeaf) *merkle_dag.DagLeaf {
+	stripped := leaf.Clone()
+	stripped.Content = nil
+
+	return stripped
+}
@@ -0,0 +1,209 @@
+// Package settings holds the relay settings every component reads from, the settings are loaded from the config once,
+// validated and swapped in as a whole so readers always see a consistent snapshot without touching the config file
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+)
+
+const configKey = "relay_settings"
+
+var (
+	current atomic.Pointer[types.RelaySettings]
+
+	// Updates are serialized so a reload from the config file can't interleave with an update from the panel
+	updateMutex sync.Mutex
+
+	subscribersMutex sync.Mutex
+	subscribers      = map[int]func(settings *types.RelaySettings){}
+	nextSubscriber   int
+)
+
+// Defaults are used when the config has no relay settings, smart mode with no kinds accepts nothing
+// so a relay that was never configured doesn't store every kind it is sent
+func Defaults() types.RelaySettings {
+	return types.RelaySettings{
+		Mode:         "smart",
+		Protocol:     []string{},
+		Chunked:      []string{},
+		Kinds:        []string{},
+		DynamicKinds: []string{},
+		Photos:       []string{},
+		Videos:       []string{},
+		GitNestr:     []string{},
+		Audio:        []string{},
+		Quota: types.Quota{
+			Overrides: map[string]types.QuotaLimit{},
+		},
+	}
+}
+
+// Get returns the current settings, the snapshot is shared and must not be modified,
+// settings are loaded from the config the first time they are needed and the defaults are used if they are invalid
+func Get() *types.RelaySettings {
+	if settings := current.Load(); settings != nil {
+		return settings
+	}
+
+	if err := Load(); err != nil {
+		logInvalid("Invalid relay settings in the config file, using the defaults", err)
+
+		defaults := Defaults()
+		current.CompareAndSwap(nil, &defaults)
+	}
+
+	return current.Load()
+}
+
+// Load reads the relay settings from the config and swaps them in, invalid settings are rejected and the
+// previous settings stay in place so a bad edit to the config file never takes the relay down
+func Load() error {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	settings := Defaults()
+
+	if viper.IsSet(configKey) {
+		if err := viper.UnmarshalKey(configKey, &settings); err != nil {
+			return fmt.Errorf("failed to read relay settings: %w", err)
+		}
+	}
+
+	return apply(settings)
+}
+
+// Apply validates the settings and swaps them in without writing them to the config file
+func Apply(settings types.RelaySettings) error {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	return apply(settings)
+}
+
+// Update validates the settings, writes them to the config file and swaps them in,
+// nothing is written when they are invalid or when the config file can't be written
+func Update(settings types.RelaySettings) error {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	normalize(&settings)
+
+	if err := Validate(&settings); err != nil {
+		return err
+	}
+
+	previous := viper.Get(configKey)
+
+	viper.Set(configKey, settings)
+
+	if err := viper.WriteConfig(); err != nil {
+		viper.Set(configKey, previous)
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	return apply(settings)
+}
+
+func apply(settings types.RelaySettings) error {
+	normalize(&settings)
+
+	if err := Validate(&settings); err != nil {
+		return err
+	}
+
+	previous := current.Swap(&settings)
+
+	// Writing the config file reloads it through the watcher so unchanged settings aren't announced twice
+	if previous != nil && reflect.DeepEqual(*previous, settings) {
+		return nil
+	}
+
+	notify(&settings)
+
+	return nil
+}
+
+// normalize fills in empty lists so readers and the panel never have to deal with nil, lists are clipped so
+// appending to a list from the shared snapshot always copies it instead of writing into spare capacity
+func normalize(settings *types.RelaySettings) {
+	for _, list := range []*[]string{&settings.Protocol, &settings.Chunked, &settings.Kinds, &settings.DynamicKinds, &settings.Photos, &settings.Videos, &settings.GitNestr, &settings.Audio} {
+		if *list == nil {
+			*list = []string{}
+		}
+
+		*list = slices.Clip(*list)
+	}
+
+	if settings.Quota.Overrides == nil {
+		settings.Quota.Overrides = map[string]types.QuotaLimit{}
+	}
+
+	settings.Mode = strings.TrimSpace(settings.Mode)
+}
+
+// Subscribe calls fn with the new settings every time they change until the returned func is called,
+// fn runs on the goroutine that changed the settings so it should return quickly
+func Subscribe(fn func(settings *types.RelaySettings)) func() {
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+
+	id := nextSubscriber
+	nextSubscriber++
+
+	subscribers[id] = fn
+
+	return func() {
+		subscribersMutex.Lock()
+		defer subscribersMutex.Unlock()
+
+		delete(subscribers, id)
+	}
+}
+
+func notify(settings *types.RelaySettings) {
+	subscribersMutex.Lock()
+	listeners := make([]func(settings *types.RelaySettings), 0, len(subscribers))
+	for _, fn := range subscribers {
+		listeners = append(listeners, fn)
+	}
+	subscribersMutex.Unlock()
+
+	for _, fn := range listeners {
+		fn(settings)
+	}
+}
+
+// Reload is meant for viper.OnConfigChange, it loads the changed config and logs rather than fails when it is invalid
+func Reload() {
+	if err := Load(); err != nil {
+		logInvalid("Ignoring invalid relay settings from the config file", err)
+		return
+	}
+
+	log.Println("Relay settings reloaded")
+}
+
+// logInvalid logs why settings were rejected with a line for every field so each problem can be found in the log
+func logInvalid(message string, err error) {
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		log.Printf("%s: %v", message, err)
+		return
+	}
+
+	log.Printf("%s:", message)
+	for _, field := range invalid.Errors {
+		log.Printf("  %s: %s", field.Field, field.Message)
+	}
+}
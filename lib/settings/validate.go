@@ -0,0 +1,112 @@
+package settings
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+)
+
+var (
+	modes     = []string{"smart", "unlimited"}
+	sizeUnits = []string{"", "KB", "MB", "GB", "TB"}
+)
+
+// FieldError describes why a single setting was rejected, the field is its path in the settings json
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when settings are rejected and lists every problem found
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (err *ValidationError) Error() string {
+	messages := make([]string, 0, len(err.Errors))
+	for _, field := range err.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", field.Field, field.Message))
+	}
+
+	return fmt.Sprintf("invalid relay settings: %s", strings.Join(messages, ", "))
+}
+
+func (err *ValidationError) add(field string, format string, args ...interface{}) {
+	err.Errors = append(err.Errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate returns a ValidationError listing every invalid field, or nil when the settings can be used
+func Validate(settings *types.RelaySettings) error {
+	err := &ValidationError{}
+
+	if !contains(modes, settings.Mode) {
+		err.add("mode", "must be one of %s", strings.Join(modes, ", "))
+	}
+
+	for i, kind := range settings.Kinds {
+		number, ok := strings.CutPrefix(kind, "kind")
+		if _, parseErr := strconv.Atoi(number); !ok || parseErr != nil {
+			err.add(fmt.Sprintf("kinds[%d]", i), "%q is not a kind, kinds are written as kind<number>", kind)
+		}
+	}
+
+	for i, kind := range settings.DynamicKinds {
+		if _, parseErr := strconv.Atoi(kind); parseErr != nil {
+			err.add(fmt.Sprintf("dynamicKinds[%d]", i), "%q is not a kind number", kind)
+		}
+	}
+
+	for name, list := range map[string][]string{"photos": settings.Photos, "videos": settings.Videos, "gitNestr": settings.GitNestr, "audio": settings.Audio} {
+		for i, value := range list {
+			if strings.TrimSpace(value) == "" {
+				err.add(fmt.Sprintf("%s[%d]", name, i), "must not be empty")
+			}
+		}
+	}
+
+	if settings.MaxFileSize < 0 {
+		err.add("maxFileSize", "must not be negative")
+	}
+
+	if !contains(sizeUnits, strings.ToUpper(settings.MaxFileSizeUnit)) {
+		err.add("maxFileSizeUnit", "must be one of KB, MB, GB, TB")
+	}
+
+	validateQuota(err, "quota.default", settings.Quota.Default)
+
+	for key, limit := range settings.Quota.Overrides {
+		if strings.TrimSpace(key) == "" {
+			err.add("quota.overrides", "override keys must be public keys")
+		}
+
+		validateQuota(err, fmt.Sprintf("quota.overrides.%s", key), limit)
+	}
+
+	if len(err.Errors) > 0 {
+		return err
+	}
+
+	return nil
+}
+
+func validateQuota(err *ValidationError, field string, limit types.QuotaLimit) {
+	if limit.MaxBytes < 0 {
+		err.add(field+".maxBytes", "must not be negative")
+	}
+
+	if limit.MaxItems < 0 {
+		err.add(field+".maxItems", "must not be negative")
+	}
+}
@@ -0,0 +1,116 @@
+package stores
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Batch stages writes so they can be committed together, nothing staged is visible to readers until
+// Commit succeeds and if any staged write fails none of them are kept, leaves that are already stored don't fail a commit
+type Batch interface {
+	StoreLeaf(root string, leafData *types.DagLeafData) error
+	StoreEvent(event *nostr.Event) error
+	StoreBlob(data []byte, contentType string, publicKey string) (*types.BlobDescriptor, error)
+
+	Commit() error
+	Discard()
+}
+
+// StagedWrite is a single write held by a StagedBatch, exactly one of Leaf, Event or Blob is set
+type StagedWrite struct {
+	Root  string
+	Leaf  *types.DagLeafData
+	Event *nostr.Event
+	Blob  *StagedBlob
+}
+
+type StagedBlob struct {
+	Data        []byte
+	ContentType string
+	PublicKey   string
+}
+
+// StagedBatch records writes in memory until they are committed, stores implement Batch by applying
+// every staged write against a single transaction in the order they were staged
+type StagedBatch struct {
+	writes []StagedWrite
+	apply  func(writes []StagedWrite) error
+	done   bool
+}
+
+func NewStagedBatch(apply func(writes []StagedWrite) error) *StagedBatch {
+	return &StagedBatch{
+		writes: []StagedWrite{},
+		apply:  apply,
+	}
+}
+
+func (batch *StagedBatch) stage(write StagedWrite) error {
+	if batch.done {
+		return fmt.Errorf("batch has already been committed or discarded")
+	}
+
+	batch.writes = append(batch.writes, write)
+
+	return nil
+}
+
+func (batch *StagedBatch) StoreLeaf(root string, leafData *types.DagLeafData) error {
+	// Stores clear the content of the leaf they are given once it has been written, the copy keeps the caller's leaf intact
+	staged := *leafData
+
+	return batch.stage(StagedWrite{Root: root, Leaf: &staged})
+}
+
+func (batch *StagedBatch) StoreEvent(event *nostr.Event) error {
+	return batch.stage(StagedWrite{Event: event})
+}
+
+func (batch *StagedBatch) StoreBlob(data []byte, contentType string, publicKey string) (*types.BlobDescriptor, error) {
+	err := batch.stage(StagedWrite{Blob: &StagedBlob{Data: data, ContentType: contentType, PublicKey: publicKey}})
+	if err != nil {
+		return nil, err
+	}
+
+	descriptor := NewBlobDescriptor(data, contentType)
+
+	return &descriptor, nil
+}
+
+func (batch *StagedBatch) Commit() error {
+	if batch.done {
+		return fmt.Errorf("batch has already been committed or discarded")
+	}
+
+	batch.done = true
+
+	if len(batch.writes) == 0 {
+		return nil
+	}
+
+	return batch.apply(batch.writes)
+}
+
+func (batch *StagedBatch) Discard() {
+	batch.done = true
+	batch.writes = nil
+}
+
+// NewBlobDescriptor describes a blob the way every store records it, blobs are addressed by their sha256 hash
+func NewBlobDescriptor(data []byte, contentType string) types.BlobDescriptor {
+	hash := sha256.Sum256(data)
+	encodedHash := hex.EncodeToString(hash[:])
+
+	return types.BlobDescriptor{
+		URL:      fmt.Sprintf("/%s", encodedHash),
+		SHA256:   encodedHash,
+		Size:     int64(len(data)),
+		Type:     contentType,
+		Uploaded: time.Now().Unix(),
+	}
+}
@@ -1,131 +1,1357 @@
 package bbolt
 
-/*
 import (
-	"crypto/sha256"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/hex"
-	"log"
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
 	"strings"
 
-	"github.com/HORNET-Storage/hornet-storage/lib/database/bbolt"
 	"github.com/fxamacker/cbor/v2"
+	"github.com/nbd-wtf/go-nostr"
+	bolt "go.etcd.io/bbolt"
+
+	jsoniter "github.com/json-iterator/go"
 
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/database/bbolt"
 	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+	stores_graviton "github.com/HORNET-Storage/hornet-storage/lib/stores/graviton"
 	merkle_dag "github.com/HORNET-Storage/scionic-merkletree/dag"
 )
 
+const (
+	contentBucket = "content"
+	leavesBucket  = "leaves"
+	rootsBucket   = "roots"
+	npubsBucket   = "npubs"
+	cachesBucket  = "caches"
+	eventsBucket  = "events"
+	indexBucket   = "idx"
+	countsBucket  = "counts"
+	blossomBucket = "blossom"
+	refsBucket    = "refs"
+	usageBucket   = "usage"
+
+	// Expiring events keyed by their expiration time followed by the event id so sweeps stop at the first unexpired key
+	expirationsBucket = "expirations"
+
+	// The id of the current version of every replaceable and addressable event keyed by stores.ReplaceableKey
+	replaceableBucket = "replaceable"
+)
+
+var topLevelBuckets = []string{
+	contentBucket,
+	leavesBucket,
+	rootsBucket,
+	npubsBucket,
+	cachesBucket,
+	eventsBucket,
+	indexBucket,
+	countsBucket,
+	blossomBucket,
+	refsBucket,
+	usageBucket,
+	expirationsBucket,
+	replaceableBucket,
+}
+
 type BBoltStore struct {
-	ContentDatabase *bbolt.Database
-	UserDatabase    *bbolt.Database
+	Database    *bbolt.Database
+	CacheConfig map[string]string
 }
 
 func (store *BBoltStore) InitStore(args ...interface{}) error {
-	prefix := "default"
+	name := "bboltdb"
+
+	store.CacheConfig = map[string]string{}
+	for _, arg := range args {
+		if cacheConfig, ok := arg.(map[string]string); ok {
+			store.CacheConfig = cacheConfig
+		} else if prefix, ok := arg.(string); ok && prefix != "" {
+			name = prefix
+		}
+	}
 
-	if len(args) > 0 {
-		var ok bool
+	database, err := bbolt.CreateDatabase(name)
+	if err != nil {
+		return err
+	}
 
-		prefix, ok = args[0].(string)
+	store.Database = database
 
-		if !ok {
-			prefix = "default"
+	for _, bucket := range topLevelBuckets {
+		err = database.CreateBucket(bucket)
+		if err != nil {
+			return err
 		}
 	}
 
-	content := strings.Join([]string{prefix, "content"}, "-")
-	users := strings.Join([]string{prefix, "users"}, "-")
+	return nil
+}
 
-	contentDatabase, err := bbolt.CreateDatabase(content)
-	if err != nil {
-		return err
+// appendCacheKey adds a key to the cache data stored under name in the given bucket
+func appendCacheKey(bucket *bolt.Bucket, name string, key string) error {
+	cacheData := &types.CacheData{Keys: []string{}}
+
+	value := bucket.Get([]byte(name))
+	if value != nil {
+		if err := cbor.Unmarshal(value, cacheData); err != nil {
+			return err
+		}
+	}
+
+	for _, existing := range cacheData.Keys {
+		if existing == key {
+			return nil
+		}
 	}
 
-	userDatabase, err := bbolt.CreateDatabase(users)
+	cacheData.Keys = append(cacheData.Keys, key)
+
+	serializedData, err := cbor.Marshal(cacheData)
 	if err != nil {
 		return err
 	}
 
-	store.ContentDatabase = contentDatabase
-	store.UserDatabase = userDatabase
+	return bucket.Put([]byte(name), serializedData)
+}
+
+func readCacheKeys(bucket *bolt.Bucket, name string) []string {
+	if bucket == nil {
+		return nil
+	}
+
+	value := bucket.Get([]byte(name))
+	if value == nil {
+		return nil
+	}
+
+	cacheData := &types.CacheData{}
+	if err := cbor.Unmarshal(value, cacheData); err != nil {
+		return nil
+	}
+
+	return cacheData.Keys
+}
+
+// cacheKey mirrors the graviton caches, npub buckets map a bucket name to the keys a user owns and
+// configured buckets map a cache key to the roots that have it
+func (store *BBoltStore) cacheKey(tx *bolt.Tx, bucket string, key string, root string) error {
+	var parent *bolt.Bucket
+
+	if strings.HasPrefix(bucket, "npub") {
+		parent = tx.Bucket([]byte(npubsBucket))
+	} else if _, ok := store.CacheConfig[bucket]; ok {
+		parent = tx.Bucket([]byte(cachesBucket))
+	} else {
+		return nil
+	}
 
-	err = contentDatabase.CreateBucket("default")
+	nested, err := parent.CreateBucketIfNotExists([]byte(bucket))
 	if err != nil {
 		return err
 	}
 
-	err = userDatabase.CreateBucket("default")
+	return appendCacheKey(nested, key, root)
+}
+
+// Backup copies the database from a read transaction so the copy is consistent while writes carry on
+func (store *BBoltStore) Backup(dir string) error {
+	return store.Database.Db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(filepath.Join(dir, filepath.Base(store.Database.Db.Path())), 0600)
+	})
+}
+
+func (store *BBoltStore) QueryDag(filter map[string]string) ([]string, error) {
+	keys := []string{}
+
+	err := store.Database.Db.View(func(tx *bolt.Tx) error {
+		for bucket, key := range filter {
+			if strings.HasPrefix(bucket, "npub1") {
+				keys = append(keys, readCacheKeys(tx.Bucket([]byte(npubsBucket)).Bucket([]byte(bucket)), key)...)
+			} else if _, ok := store.CacheConfig[bucket]; ok {
+				keys = append(keys, readCacheKeys(tx.Bucket([]byte(cachesBucket)).Bucket([]byte(bucket)), key)...)
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return keys, nil
+}
+
+func (store *BBoltStore) StoreLeaf(root string, leafData *types.DagLeafData) error {
+	return store.Database.Db.Update(func(tx *bolt.Tx) error {
+		return store.storeLeaf(tx, root, leafData)
+	})
 }
 
-func (store *BBoltStore) StoreLeaf(root string, leaf *merkle_dag.DagLeaf) error {
-	if leaf.Data != nil {
-		h := sha256.New()
-		h.Write(leaf.Data)
-		hashed := h.Sum(nil)
+func (store *BBoltStore) storeLeaf(tx *bolt.Tx, root string, leafData *types.DagLeafData) error {
+	if leafData.Leaf.ContentHash != nil && leafData.Leaf.Content == nil {
+		return fmt.Errorf("leaf has content hash but no content")
+	}
+
+	leafContentSize := len(hex.EncodeToString(leafData.Leaf.Content))
+	contentLength := int64(len(leafData.Leaf.Content))
+
+	var rootLeaf *merkle_dag.DagLeaf
+
+	owner := leafData.PublicKey
+
+	if leafData.Leaf.Hash == root {
+		rootLeaf = &leafData.Leaf
+	} else {
+		_rootLeaf, err := loadLeaf(tx, root, root)
+		if err != nil {
+			return err
+		}
+
+		rootLeaf = &_rootLeaf.Leaf
+		owner = _rootLeaf.PublicKey
+	}
+
+	isRoot := rootLeaf.Hash == leafData.Leaf.Hash
+
+	// Root leaves are checked against the relay settings before anything is written
+	if isRoot {
+		err := stores_graviton.CheckLeafStats(rootLeaf)
+		if err != nil {
+			return err
+		}
+
+		statsLeaf := *rootLeaf
+
+		tx.OnCommit(func() {
+			stores_graviton.StoreLeafStats(&statsLeaf, leafContentSize)
+		})
+	}
+
+	if leafData.Leaf.Content != nil {
+		err := tx.Bucket([]byte(contentBucket)).Put(leafData.Leaf.ContentHash, leafData.Leaf.Content)
+		if err != nil {
+			return err
+		}
+
+		leafData.Leaf.Content = nil
+	}
+
+	leaves, err := tx.Bucket([]byte(leavesBucket)).CreateBucketIfNotExists([]byte(root))
+	if err != nil {
+		return err
+	}
+
+	// Every dag has its own leaves so only the content shared between dags and blobs is reference counted
+	if leaves.Get([]byte(leafData.Leaf.Hash)) == nil {
+		err = chargeLeaf(tx, root, owner, isRoot, contentLength)
+		if err != nil {
+			return err
+		}
 
-		store.ContentDatabase.UpdateValue("default", hex.EncodeToString(hashed), leaf.Data)
+		if leafData.Leaf.ContentHash != nil {
+			_, err = addRef(tx.Bucket([]byte(refsBucket)), leafData.Leaf.ContentHash, 1)
+			if err != nil {
+				return err
+			}
+		}
+	}
 
-		leaf.Data = hashed
+	cborData, err := cbor.Marshal(leafData)
+	if err != nil {
+		return err
 	}
 
-	cborData, err := cbor.Marshal(leaf)
+	err = leaves.Put([]byte(leafData.Leaf.Hash), cborData)
 	if err != nil {
 		return err
 	}
 
-	key := leaf.Hash // merkle_dag.GetHash(leaf.Hash)
+	if !isRoot {
+		return nil
+	}
 
-	log.Printf("Adding key to block database: %s\n", key)
+	bucket := stores_graviton.GetBucket(rootLeaf)
 
-	err = store.UserDatabase.UpdateValue("default", key, cborData)
+	err = tx.Bucket([]byte(rootsBucket)).Put([]byte(root), []byte(bucket))
 	if err != nil {
 		return err
 	}
 
+	if leafData.PublicKey != "" {
+		pubKey := leafData.PublicKey
+
+		if !strings.HasPrefix(leafData.PublicKey, "npub1") {
+			pubKey = "npub1" + pubKey
+		}
+
+		err = store.cacheKey(tx, pubKey, bucket, root)
+		if err != nil {
+			return err
+		}
+	}
+
+	if configKey, ok := store.CacheConfig[bucket]; ok {
+		cacheKey, ok := rootLeaf.AdditionalData[configKey]
+
+		if !ok {
+			value := reflect.ValueOf(*rootLeaf).FieldByName(configKey)
+
+			if value.IsValid() && value.Kind() == reflect.String {
+				cacheKey, ok = value.String(), true
+			}
+		}
+
+		if ok {
+			err = store.cacheKey(tx, bucket, cacheKey, root)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
-func (store *BBoltStore) RetrieveLeaf(root string, hash string) (*merkle_dag.DagLeaf, error) {
-	key := hash // merkle_dag.GetHash(hash)
+// NewBatch replays every staged write inside one bolt transaction, an error rolls the whole batch back
+func (store *BBoltStore) NewBatch() stores.Batch {
+	return stores.NewStagedBatch(func(writes []stores.StagedWrite) error {
+		return store.Database.Db.Update(func(tx *bolt.Tx) error {
+			for _, write := range writes {
+				var err error
+
+				switch {
+				case write.Leaf != nil:
+					err = store.storeLeaf(tx, write.Root, write.Leaf)
+				case write.Event != nil:
+					err = store.storeEvent(tx, write.Event)
+				case write.Blob != nil:
+					_, err = storeBlob(tx, write.Blob.Data, write.Blob.ContentType, write.Blob.PublicKey)
+				}
+
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+}
+
+func (store *BBoltStore) RetrieveLeafContent(contentHash []byte) ([]byte, error) {
+	var content []byte
 
-	log.Printf("Searching for leaf with key: %s\n", key)
-	bytes, err := store.UserDatabase.GetValue("default", key)
+	err := store.Database.Db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte(contentBucket)).Get(contentHash)
+		if len(value) == 0 {
+			return fmt.Errorf("content not found")
+		}
+
+		content = bytes.Clone(value)
+
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	var leaf *merkle_dag.DagLeaf = &merkle_dag.DagLeaf{}
+	return content, nil
+}
+
+func (store *BBoltStore) RetrieveLeaf(root string, hash string, includeContent bool) (*types.DagLeafData, error) {
+	var data *types.DagLeafData
+
+	err := store.Database.Db.View(func(tx *bolt.Tx) error {
+		var err error
 
-	err = cbor.Unmarshal(bytes, leaf)
+		data, err = loadLeaf(tx, root, hash)
+
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if leaf.Data != nil {
-		bytes, err := store.ContentDatabase.GetValue("default", hex.EncodeToString(leaf.Data))
+	if includeContent && data.Leaf.ContentHash != nil {
+		content, err := store.RetrieveLeafContent(data.Leaf.ContentHash)
 		if err != nil {
 			return nil, err
 		}
 
-		if len(bytes) > 0 {
-			leaf.Data = bytes
-		} else {
-			leaf.Data = nil
-		}
+		data.Leaf.Content = content
+	}
+
+	return data, nil
+}
+
+// loadLeaf reads a leaf record without its content
+func loadLeaf(tx *bolt.Tx, root string, hash string) (*types.DagLeafData, error) {
+	leaves := tx.Bucket([]byte(leavesBucket)).Bucket([]byte(root))
+	if leaves == nil {
+		return nil, fmt.Errorf("dag not found: %s", root)
+	}
+
+	value := leaves.Get([]byte(hash))
+	if value == nil {
+		return nil, fmt.Errorf("leaf not found: %s", hash)
+	}
+
+	var data *types.DagLeafData = &types.DagLeafData{}
+
+	err := cbor.Unmarshal(value, data)
+	if err != nil {
+		return nil, err
 	}
 
-	return leaf, nil
+	return data, nil
 }
 
-func (store *BBoltStore) BuildDagFromStore(root string) (*merkle_dag.Dag, error) {
-	return stores.BuildDagFromStore(store, root)
+func (store *BBoltStore) BuildDagFromStore(root string, includeContent bool) (*types.DagData, error) {
+	return stores.BuildDagFromStore(store, root, includeContent)
 }
 
-func (store *BBoltStore) StoreDag(dag *merkle_dag.Dag) error {
+func (store *BBoltStore) StoreDag(dag *types.DagData) error {
 	return stores.StoreDag(store, dag)
 }
-*/
+
+func addRef(refs *bolt.Bucket, key []byte, delta int64) (int64, error) {
+	var count int64
+
+	value := refs.Get(key)
+	if len(value) == 8 {
+		count = int64(binary.BigEndian.Uint64(value))
+	}
+
+	count += delta
+	if count < 0 {
+		count = 0
+	}
+
+	buffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(buffer, uint64(count))
+
+	return count, refs.Put(key, buffer)
+}
+
+// removeCacheKey removes a key from the cache data stored under name, deleting the entry once it is empty
+func removeCacheKey(bucket *bolt.Bucket, name string, key string) error {
+	if bucket == nil {
+		return nil
+	}
+
+	keys := []string{}
+	for _, existing := range readCacheKeys(bucket, name) {
+		if existing != key {
+			keys = append(keys, existing)
+		}
+	}
+
+	if len(keys) == 0 {
+		return bucket.Delete([]byte(name))
+	}
+
+	serializedData, err := cbor.Marshal(&types.CacheData{Keys: keys})
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put([]byte(name), serializedData)
+}
+
+// DeleteDag removes a dag and everything that indexes it, content shared with other dags or blobs is kept
+// until nothing references it and unreferenced content is reclaimed by CollectGarbage
+func (store *BBoltStore) DeleteDag(root string) error {
+	err := store.Database.Db.Update(func(tx *bolt.Tx) error {
+		leavesParent := tx.Bucket([]byte(leavesBucket))
+
+		leaves := leavesParent.Bucket([]byte(root))
+		if leaves == nil {
+			return fmt.Errorf("dag not found: %s", root)
+		}
+
+		refs := tx.Bucket([]byte(refsBucket))
+
+		var rootData *types.DagLeafData
+
+		err := leaves.ForEach(func(hash []byte, value []byte) error {
+			data := &types.DagLeafData{}
+
+			err := cbor.Unmarshal(value, data)
+			if err != nil {
+				return err
+			}
+
+			if data.Leaf.Hash == root {
+				rootData = data
+			}
+
+			if data.Leaf.ContentHash != nil {
+				_, err = addRef(refs, data.Leaf.ContentHash, -1)
+			}
+
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = leavesParent.DeleteBucket([]byte(root))
+		if err != nil {
+			return err
+		}
+
+		err = releaseUsageRecord(tx.Bucket([]byte(usageBucket)), dagUsageKey(root))
+		if err != nil {
+			return err
+		}
+
+		roots := tx.Bucket([]byte(rootsBucket))
+
+		bucket := string(roots.Get([]byte(root)))
+
+		err = roots.Delete([]byte(root))
+		if err != nil {
+			return err
+		}
+
+		if rootData == nil {
+			return nil
+		}
+
+		if rootData.PublicKey != "" {
+			pubKey := rootData.PublicKey
+
+			if !strings.HasPrefix(rootData.PublicKey, "npub1") {
+				pubKey = "npub1" + pubKey
+			}
+
+			err = removeCacheKey(tx.Bucket([]byte(npubsBucket)).Bucket([]byte(pubKey)), bucket, root)
+			if err != nil {
+				return err
+			}
+		}
+
+		if configKey, ok := store.CacheConfig[bucket]; ok {
+			cacheKey, ok := rootData.Leaf.AdditionalData[configKey]
+
+			if !ok {
+				value := reflect.ValueOf(rootData.Leaf).FieldByName(configKey)
+
+				if value.IsValid() && value.Kind() == reflect.String {
+					cacheKey, ok = value.String(), true
+				}
+			}
+
+			if ok {
+				err = removeCacheKey(tx.Bucket([]byte(cachesBucket)).Bucket([]byte(bucket)), cacheKey, root)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return stores_graviton.DeleteDagStats(root)
+}
+
+// CollectGarbage removes content whose reference count has dropped to zero
+func (store *BBoltStore) CollectGarbage() (int, error) {
+	collected := 0
+
+	err := store.Database.Db.Update(func(tx *bolt.Tx) error {
+		refs := tx.Bucket([]byte(refsBucket))
+		content := tx.Bucket([]byte(contentBucket))
+
+		unreferenced := [][]byte{}
+
+		err := refs.ForEach(func(key []byte, value []byte) error {
+			if len(value) == 8 && binary.BigEndian.Uint64(value) == 0 {
+				unreferenced = append(unreferenced, bytes.Clone(key))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range unreferenced {
+			err = content.Delete(key)
+			if err != nil {
+				return err
+			}
+
+			err = refs.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+
+		collected = len(unreferenced)
+
+		return nil
+	})
+
+	return collected, err
+}
+
+// The usage bucket holds the running totals for every public key along with records of who was charged
+// for each dag and blob, event usage is worked out from the event itself when it is deleted
+func usageKey(publicKey string) []byte {
+	return []byte(fmt.Sprintf("pubkey:%s", stores.UsageKey(publicKey)))
+}
+
+func dagUsageKey(root string) []byte {
+	return []byte(fmt.Sprintf("dag:%s", root))
+}
+
+func blobUsageKey(hash string) []byte {
+	return []byte(fmt.Sprintf("blob:%s", hash))
+}
+
+func getUsage(usage *bolt.Bucket, publicKey string) types.Usage {
+	var result types.Usage
+
+	value := usage.Get(usageKey(publicKey))
+	if value != nil {
+		cbor.Unmarshal(value, &result)
+	}
+
+	return result
+}
+
+// addUsage changes the usage of a public key, positive changes are checked against the quota first
+func addUsage(usage *bolt.Bucket, publicKey string, bytes int64, items int64) error {
+	if publicKey == "" {
+		return nil
+	}
+
+	current := getUsage(usage, publicKey)
+
+	if bytes > 0 || items > 0 {
+		err := stores.CheckQuota(publicKey, current, bytes, items)
+		if err != nil {
+			return err
+		}
+	}
+
+	serializedUsage, err := cbor.Marshal(stores.AddUsage(current, bytes, items))
+	if err != nil {
+		return err
+	}
+
+	return usage.Put(usageKey(publicKey), serializedUsage)
+}
+
+func getUsageRecord(usage *bolt.Bucket, key []byte) *types.UsageRecord {
+	value := usage.Get(key)
+	if value == nil {
+		return nil
+	}
+
+	var record types.UsageRecord
+	if err := cbor.Unmarshal(value, &record); err != nil {
+		return nil
+	}
+
+	return &record
+}
+
+func putUsageRecord(usage *bolt.Bucket, key []byte, record *types.UsageRecord) error {
+	serializedRecord, err := cbor.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return usage.Put(key, serializedRecord)
+}
+
+// releaseUsageRecord gives back everything charged under a dag or blob record and removes the record
+func releaseUsageRecord(usage *bolt.Bucket, key []byte) error {
+	record := getUsageRecord(usage, key)
+	if record == nil {
+		return nil
+	}
+
+	err := addUsage(usage, record.PublicKey, -record.Bytes, -1)
+	if err != nil {
+		return err
+	}
+
+	return usage.Delete(key)
+}
+
+// chargeLeaf charges a newly stored leaf to the owner of its dag, the dag itself counts as a single item
+func chargeLeaf(tx *bolt.Tx, root string, owner string, isRoot bool, bytes int64) error {
+	if owner == "" {
+		return nil
+	}
+
+	usage := tx.Bucket([]byte(usageBucket))
+
+	var items int64
+	if isRoot {
+		items = 1
+	}
+
+	err := addUsage(usage, owner, bytes, items)
+	if err != nil {
+		return err
+	}
+
+	record := getUsageRecord(usage, dagUsageKey(root))
+	if record == nil {
+		record = &types.UsageRecord{PublicKey: owner}
+	}
+
+	record.Bytes += bytes
+
+	return putUsageRecord(usage, dagUsageKey(root), record)
+}
+
+func (store *BBoltStore) GetUsage(publicKey string) (*types.Usage, error) {
+	var usage types.Usage
+
+	err := store.Database.Db.View(func(tx *bolt.Tx) error {
+		usage = getUsage(tx.Bucket([]byte(usageBucket)), publicKey)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &usage, nil
+}
+
+// Index keys are the index name followed by the inverted created_at and the event id, so a forward
+// cursor walks every index newest first in the same order as stores.IndexEntry.Before
+func indexPrefix(key string) []byte {
+	return append([]byte(key), 0)
+}
+
+func indexTime(createdAt int64) []byte {
+	buffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(buffer, uint64(math.MaxInt64-createdAt))
+	return buffer
+}
+
+func indexKey(key string, entry stores.IndexEntry) []byte {
+	buffer := indexPrefix(key)
+	buffer = append(buffer, indexTime(entry.CreatedAt)...)
+	return append(buffer, []byte(entry.ID)...)
+}
+
+func parseIndexKey(prefix []byte, key []byte, value []byte) stores.IndexEntry {
+	inverted := binary.BigEndian.Uint64(key[len(prefix) : len(prefix)+8])
+	kind, _ := binary.Varint(value)
+
+	return stores.IndexEntry{
+		CreatedAt: math.MaxInt64 - int64(inverted),
+		ID:        string(key[len(prefix)+8:]),
+		Kind:      int(kind),
+	}
+}
+
+func kindValue(kind int) []byte {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	return buffer[:binary.PutVarint(buffer, int64(kind))]
+}
+
+type eventIndex struct {
+	tx *bolt.Tx
+}
+
+func (index *eventIndex) adjustCount(key string, delta int64) error {
+	counts := index.tx.Bucket([]byte(countsBucket))
+
+	count := index.Estimate(key) + delta
+	if count <= 0 {
+		return counts.Delete([]byte(key))
+	}
+
+	buffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(buffer, uint64(count))
+
+	return counts.Put([]byte(key), buffer)
+}
+
+func (index *eventIndex) add(event *nostr.Event) error {
+	entries := index.tx.Bucket([]byte(indexBucket))
+	entry := stores.NewIndexEntry(event)
+
+	for _, key := range stores.EventIndexKeys(event) {
+		err := entries.Put(indexKey(key, entry), kindValue(event.Kind))
+		if err != nil {
+			return err
+		}
+
+		err = index.adjustCount(key, 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (index *eventIndex) delete(event *nostr.Event) error {
+	entries := index.tx.Bucket([]byte(indexBucket))
+	entry := stores.NewIndexEntry(event)
+
+	for _, key := range stores.EventIndexKeys(event) {
+		err := entries.Delete(indexKey(key, entry))
+		if err != nil {
+			return err
+		}
+
+		err = index.adjustCount(key, -1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (index *eventIndex) Estimate(key string) int64 {
+	value := index.tx.Bucket([]byte(countsBucket)).Get([]byte(key))
+	if len(value) != 8 {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(value))
+}
+
+func (index *eventIndex) Iterate(key string, until int64) stores.IndexIterator {
+	prefix := indexPrefix(key)
+	cursor := index.tx.Bucket([]byte(indexBucket)).Cursor()
+
+	start := prefix
+	if until >= 0 {
+		start = append(bytes.Clone(prefix), indexTime(until)...)
+	}
+
+	k, v := cursor.Seek(start)
+
+	return func() (*stores.IndexEntry, error) {
+		if k == nil || !bytes.HasPrefix(k, prefix) {
+			return nil, nil
+		}
+
+		entry := parseIndexKey(prefix, k, v)
+		k, v = cursor.Next()
+
+		return &entry, nil
+	}
+}
+
+func (index *eventIndex) Fetch(entry stores.IndexEntry) (*nostr.Event, error) {
+	return index.Lookup(entry.ID)
+}
+
+func (index *eventIndex) Lookup(id string) (*nostr.Event, error) {
+	value := index.tx.Bucket([]byte(eventsBucket)).Get([]byte(id))
+	if value == nil {
+		return nil, nil
+	}
+
+	var event nostr.Event
+	if err := jsoniter.Unmarshal(value, &event); err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+func (store *BBoltStore) QueryEvents(filter nostr.Filter) ([]*nostr.Event, error) {
+	events := []*nostr.Event{}
+
+	err := store.IterateEvents(context.Background(), filter, func(event *nostr.Event) bool {
+		events = append(events, event)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// IterateEvents holds a read transaction while yielding, bbolt readers do not block writers but the pages
+// they can see are not reused until the transaction ends so slow consumers should cancel the context
+func (store *BBoltStore) IterateEvents(ctx context.Context, filter nostr.Filter, yield func(event *nostr.Event) bool) error {
+	return store.Database.Db.View(func(tx *bolt.Tx) error {
+		return stores.QueryIndexes(ctx, &eventIndex{tx: tx}, filter, yield)
+	})
+}
+
+func (store *BBoltStore) CountEvents(filters ...nostr.Filter) (int64, error) {
+	var count int64
+
+	err := store.Database.Db.View(func(tx *bolt.Tx) error {
+		var err error
+		count, err = stores.CountIndexes(&eventIndex{tx: tx}, filters...)
+		return err
+	})
+
+	return count, err
+}
+
+func (store *BBoltStore) StoreEvent(event *nostr.Event) error {
+	return store.Database.Db.Update(func(tx *bolt.Tx) error {
+		return store.storeEvent(tx, event)
+	})
+}
+
+func (store *BBoltStore) storeEvent(tx *bolt.Tx, event *nostr.Event) error {
+	if stores.IsEphemeralKind(event.Kind) {
+		return stores.ErrEphemeral
+	}
+
+	eventData, err := jsoniter.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	events := tx.Bucket([]byte(eventsBucket))
+
+	// Events are immutable so an event that is already stored is left as it is
+	if events.Get([]byte(event.ID)) != nil {
+		return stores.ErrDuplicate
+	}
+
+	index := &eventIndex{tx: tx}
+
+	// Replaceable and addressable events only keep their newest version, older versions are rejected
+	if key, ok := stores.ReplaceableKey(event); ok {
+		slots := tx.Bucket([]byte(replaceableBucket))
+
+		if currentID := slots.Get([]byte(key)); currentID != nil {
+			current, err := index.Lookup(string(currentID))
+			if err != nil {
+				return err
+			}
+
+			if current != nil {
+				if !stores.IsNewerVersion(event, current) {
+					return stores.ErrSuperseded
+				}
+
+				err = deleteEvent(tx, current)
+				if err != nil {
+					return err
+				}
+
+				tx.OnCommit(func() {
+					stores_graviton.DeleteEventStats(current.ID)
+				})
+			}
+		}
+
+		err = slots.Put([]byte(key), []byte(event.ID))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = addUsage(tx.Bucket([]byte(usageBucket)), event.PubKey, stores.EventSize(event), 1)
+	if err != nil {
+		return err
+	}
+
+	err = index.add(event)
+	if err != nil {
+		return err
+	}
+
+	if expiration, ok := stores.Expiration(event); ok {
+		err = tx.Bucket([]byte(expirationsBucket)).Put(expirationKey(expiration, event.ID), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = events.Put([]byte(event.ID), eventData)
+	if err != nil {
+		return err
+	}
+
+	tx.OnCommit(func() {
+		stores_graviton.StoreEventStats(event)
+	})
+
+	if strings.HasPrefix(event.PubKey, "npub") {
+		return store.cacheKey(tx, event.PubKey, fmt.Sprintf("kind:%d", event.Kind), event.ID)
+	}
+
+	return nil
+}
+
+func (store *BBoltStore) DeleteEvent(eventID string) error {
+	err := store.Database.Db.Update(func(tx *bolt.Tx) error {
+		index := &eventIndex{tx: tx}
+
+		event, err := index.Lookup(eventID)
+		if err != nil {
+			return err
+		}
+
+		if event == nil {
+			return fmt.Errorf("event not found: %s", eventID)
+		}
+
+		return deleteEvent(tx, event)
+	})
+	if err != nil {
+		return err
+	}
+
+	return stores_graviton.DeleteEventStats(eventID)
+}
+
+// deleteEvent removes an event along with its indexes, expiration, replaceable slot and its author's usage
+func deleteEvent(tx *bolt.Tx, event *nostr.Event) error {
+	index := &eventIndex{tx: tx}
+
+	err := index.delete(event)
+	if err != nil {
+		return err
+	}
+
+	err = addUsage(tx.Bucket([]byte(usageBucket)), event.PubKey, -stores.EventSize(event), -1)
+	if err != nil {
+		return err
+	}
+
+	if expiration, ok := stores.Expiration(event); ok {
+		err = tx.Bucket([]byte(expirationsBucket)).Delete(expirationKey(expiration, event.ID))
+		if err != nil {
+			return err
+		}
+	}
+
+	if key, ok := stores.ReplaceableKey(event); ok {
+		slots := tx.Bucket([]byte(replaceableBucket))
+
+		if bytes.Equal(slots.Get([]byte(key)), []byte(event.ID)) {
+			err = slots.Delete([]byte(key))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Bucket([]byte(eventsBucket)).Delete([]byte(event.ID))
+}
+
+func expirationKey(expiration int64, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(expiration))
+
+	return append(key, id...)
+}
+
+// Expired walks the expirations bucket in time order and returns the ids of the events that expired at or before now
+func (index *eventIndex) Expired(now int64) ([]string, error) {
+	expired := []string{}
+
+	cursor := index.tx.Bucket([]byte(expirationsBucket)).Cursor()
+
+	for key, _ := cursor.First(); key != nil && len(key) > 8; key, _ = cursor.Next() {
+		if int64(binary.BigEndian.Uint64(key[:8])) > now {
+			break
+		}
+
+		expired = append(expired, string(key[8:]))
+	}
+
+	return expired, nil
+}
+
+// DeleteExpiredEvents deletes every event that expired at or before now
+func (store *BBoltStore) DeleteExpiredEvents(now int64) (int, error) {
+	var expired []string
+
+	err := store.Database.Db.View(func(tx *bolt.Tx) error {
+		var err error
+		expired, err = (&eventIndex{tx: tx}).Expired(now)
+
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range expired {
+		err = store.DeleteEvent(id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), nil
+}
+
+func (store *BBoltStore) StoreBlob(data []byte, contentType string, publicKey string) (*types.BlobDescriptor, error) {
+	var descriptor *types.BlobDescriptor
+
+	err := store.Database.Db.Update(func(tx *bolt.Tx) error {
+		var err error
+
+		descriptor, err = storeBlob(tx, data, contentType, publicKey)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return descriptor, nil
+}
+
+func storeBlob(tx *bolt.Tx, data []byte, contentType string, publicKey string) (*types.BlobDescriptor, error) {
+	descriptor := stores.NewBlobDescriptor(data, contentType)
+
+	hash, err := hex.DecodeString(descriptor.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	err = indexBlob(tx, descriptor, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Bucket([]byte(contentBucket)).Put(hash, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &descriptor, nil
+}
+
+// IndexBlob records a blob whose content is kept outside of the store
+func (store *BBoltStore) IndexBlob(descriptor types.BlobDescriptor, publicKey string) error {
+	descriptor.External = true
+
+	return store.Database.Db.Update(func(tx *bolt.Tx) error {
+		return indexBlob(tx, descriptor, publicKey)
+	})
+}
+
+// indexBlob records the descriptor and owner of a blob and charges new blobs to the owner, a blob already held in the
+// content bucket keeps its stored descriptor so indexing it again never orphans its content
+func indexBlob(tx *bolt.Tx, descriptor types.BlobDescriptor, publicKey string) error {
+	encodedHash := descriptor.SHA256
+
+	hash, err := hex.DecodeString(encodedHash)
+	if err != nil {
+		return err
+	}
+
+	blossom := tx.Bucket([]byte(blossomBucket))
+
+	if existing := blossom.Get(hash); existing != nil {
+		var stored types.BlobDescriptor
+		if err := cbor.Unmarshal(existing, &stored); err == nil && !stored.External && descriptor.External {
+			return addBlobOwner(tx, publicKey, encodedHash)
+		}
+	} else {
+		if !descriptor.External {
+			_, err := addRef(tx.Bucket([]byte(refsBucket)), hash, 1)
+			if err != nil {
+				return err
+			}
+		}
+
+		usage := tx.Bucket([]byte(usageBucket))
+
+		err = addUsage(usage, publicKey, descriptor.Size, 1)
+		if err != nil {
+			return err
+		}
+
+		if publicKey != "" {
+			err = putUsageRecord(usage, blobUsageKey(encodedHash), &types.UsageRecord{PublicKey: publicKey, Bytes: descriptor.Size})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	serializedDescriptor, err := cbor.Marshal(descriptor)
+	if err != nil {
+		return err
+	}
+
+	err = blossom.Put(hash, serializedDescriptor)
+	if err != nil {
+		return err
+	}
+
+	return addBlobOwner(tx, publicKey, encodedHash)
+}
+
+func addBlobOwner(tx *bolt.Tx, publicKey string, hash string) error {
+	if publicKey == "" {
+		return nil
+	}
+
+	owner, err := tx.Bucket([]byte(npubsBucket)).CreateBucketIfNotExists([]byte(publicKey))
+	if err != nil {
+		return err
+	}
+
+	return appendCacheKey(owner, "blossom", hash)
+}
+
+// GetBlobDescriptor returns the descriptor of a stored or indexed blob
+func (store *BBoltStore) GetBlobDescriptor(hash string) (*types.BlobDescriptor, error) {
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var descriptor types.BlobDescriptor
+
+	err = store.Database.Db.View(func(tx *bolt.Tx) error {
+		serializedDescriptor := tx.Bucket([]byte(blossomBucket)).Get(hashBytes)
+		if serializedDescriptor == nil {
+			return fmt.Errorf("blob not found: %s", hash)
+		}
+
+		return cbor.Unmarshal(serializedDescriptor, &descriptor)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &descriptor, nil
+}
+
+func (store *BBoltStore) GetBlob(hash string) ([]byte, *string, error) {
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var content []byte
+	var descriptor types.BlobDescriptor
+
+	err = store.Database.Db.View(func(tx *bolt.Tx) error {
+		serializedDescriptor := tx.Bucket([]byte(blossomBucket)).Get(hashBytes)
+		if serializedDescriptor == nil {
+			return fmt.Errorf("blob not found: %s", hash)
+		}
+
+		err := cbor.Unmarshal(serializedDescriptor, &descriptor)
+		if err != nil {
+			return err
+		}
+
+		value := tx.Bucket([]byte(contentBucket)).Get(hashBytes)
+		if value == nil {
+			return fmt.Errorf("blob content not found: %s", hash)
+		}
+
+		content = bytes.Clone(value)
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return content, &descriptor.Type, nil
+}
+
+func (store *BBoltStore) DeleteBlob(hash string) error {
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+
+	return store.Database.Db.Update(func(tx *bolt.Tx) error {
+		blossom := tx.Bucket([]byte(blossomBucket))
+
+		serializedDescriptor := blossom.Get(hashBytes)
+		if serializedDescriptor == nil {
+			return fmt.Errorf("blob not found: %s", hash)
+		}
+
+		var descriptor types.BlobDescriptor
+		err := cbor.Unmarshal(serializedDescriptor, &descriptor)
+		if err != nil {
+			return err
+		}
+
+		err = blossom.Delete(hashBytes)
+		if err != nil {
+			return err
+		}
+
+		err = releaseUsageRecord(tx.Bucket([]byte(usageBucket)), blobUsageKey(hash))
+		if err != nil {
+			return err
+		}
+
+		// External blobs never had content in the store to release
+		if descriptor.External {
+			return nil
+		}
+
+		// The content may still be used by a dag so it is left for CollectGarbage
+		_, err = addRef(tx.Bucket([]byte(refsBucket)), hashBytes, -1)
+
+		return err
+	})
+}
+
+func (store *BBoltStore) ListBlobs(pubkey string, since, until int64) ([]types.BlobDescriptor, error) {
+	results := []types.BlobDescriptor{}
+
+	err := store.Database.Db.View(func(tx *bolt.Tx) error {
+		blossom := tx.Bucket([]byte(blossomBucket))
+
+		for _, key := range readCacheKeys(tx.Bucket([]byte(npubsBucket)).Bucket([]byte(pubkey)), "blossom") {
+			hashBytes, err := hex.DecodeString(key)
+			if err != nil {
+				return err
+			}
+
+			serializedDescriptor := blossom.Get(hashBytes)
+			if serializedDescriptor == nil {
+				continue
+			}
+
+			var descriptor types.BlobDescriptor
+			err = cbor.Unmarshal(serializedDescriptor, &descriptor)
+			if err != nil {
+				return err
+			}
+
+			if descriptor.Uploaded >= since && descriptor.Uploaded <= until {
+				results = append(results, descriptor)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
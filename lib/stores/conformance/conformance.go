@@ -0,0 +1,1396 @@
+// Package conformance provides a shared test suite that every stores.Store implementation should pass
+// so the stores behave the same way regardless of which one the relay is configured to use
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/encryption"
+	"github.com/HORNET-Storage/hornet-storage/lib/settings"
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+	merkle_dag "github.com/HORNET-Storage/scionic-merkletree/dag"
+)
+
+// Factory returns a new, initialized and empty store
+type Factory func(t *testing.T) stores.Store
+
+// Run runs the full conformance suite against the stores created by the factory, every test gets its own store
+func Run(t *testing.T, factory Factory) {
+	t.Run("DagRoundTrip", func(t *testing.T) { testDagRoundTrip(t, factory(t)) })
+	t.Run("DeleteDag", func(t *testing.T) { testDeleteDag(t, factory(t)) })
+	t.Run("Filters", func(t *testing.T) { testFilters(t, factory(t)) })
+	t.Run("Counts", func(t *testing.T) { testCounts(t, factory(t)) })
+	t.Run("DeleteEvent", func(t *testing.T) { testDeleteEvent(t, factory(t)) })
+	t.Run("Blobs", func(t *testing.T) { testBlobs(t, factory(t)) })
+	t.Run("IndexBlobs", func(t *testing.T) { testIndexBlobs(t, factory(t)) })
+	t.Run("Usage", func(t *testing.T) { testUsage(t, factory(t)) })
+	t.Run("Quota", func(t *testing.T) { testQuota(t, factory(t)) })
+	t.Run("Expiration", func(t *testing.T) { testExpiration(t, factory(t)) })
+	t.Run("Replaceable", func(t *testing.T) { testReplaceable(t, factory(t)) })
+	t.Run("Ephemeral", func(t *testing.T) { testEphemeral(t, factory(t)) })
+	t.Run("Iterate", func(t *testing.T) { testIterate(t, factory(t)) })
+	t.Run("Batch", func(t *testing.T) { testBatch(t, factory(t)) })
+	t.Run("Versions", func(t *testing.T) { testVersions(t, factory(t)) })
+	t.Run("KeyRotation", func(t *testing.T) { testKeyRotation(t, factory(t)) })
+}
+
+// createDag builds a small dag from a temporary directory containing a nested directory and a file
+// large enough to be split into multiple chunks, dags created with different labels share every leaf except the root
+func createDag(t *testing.T, label string) *types.DagData {
+	t.Helper()
+
+	root := filepath.Join(t.TempDir(), "conformance")
+
+	err := os.MkdirAll(filepath.Join(root, "nested"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"hello.txt":            []byte("hello world"),
+		"nested/chunked.bin":   bytes.Repeat([]byte("hornet storage "), merkle_dag.ChunkSize/15+1),
+		"nested/small-leaf.md": []byte("# conformance"),
+	}
+
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(root, name), content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dag, err := merkle_dag.CreateDagAdvanced(root, map[string]string{"label": label})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &types.DagData{
+		PublicKey: nostr.GeneratePrivateKey(),
+		Signature: "conformance-signature",
+		Dag:       *dag,
+	}
+}
+
+func testDagRoundTrip(t *testing.T, store stores.Store) {
+	data := createDag(t, "round-trip")
+
+	err := store.StoreDag(data)
+	if err != nil {
+		t.Fatalf("failed to store dag: %v", err)
+	}
+
+	built, err := store.BuildDagFromStore(data.Dag.Root, true)
+	if err != nil {
+		t.Fatalf("failed to build dag from store: %v", err)
+	}
+
+	if built.Dag.Root != data.Dag.Root {
+		t.Fatalf("expected root %s, got %s", data.Dag.Root, built.Dag.Root)
+	}
+
+	if built.PublicKey != data.PublicKey || built.Signature != data.Signature {
+		t.Fatalf("public key and signature were not preserved")
+	}
+
+	if len(built.Dag.Leafs) != len(data.Dag.Leafs) {
+		t.Fatalf("expected %d leaves, got %d", len(data.Dag.Leafs), len(built.Dag.Leafs))
+	}
+
+	err = built.Dag.Verify()
+	if err != nil {
+		t.Fatalf("rebuilt dag failed verification: %v", err)
+	}
+
+	for hash, leaf := range data.Dag.Leafs {
+		rebuilt, ok := built.Dag.Leafs[hash]
+		if !ok {
+			t.Fatalf("leaf %s is missing from the rebuilt dag", hash)
+		}
+
+		if !bytes.Equal(rebuilt.Content, leaf.Content) {
+			t.Fatalf("leaf %s content does not match", hash)
+		}
+	}
+
+	for _, leaf := range data.Dag.Leafs {
+		if leaf.ContentHash == nil {
+			continue
+		}
+
+		content, err := store.RetrieveLeafContent(leaf.ContentHash)
+		if err != nil {
+			t.Fatalf("failed to retrieve leaf content: %v", err)
+		}
+
+		if !bytes.Equal(content, leaf.Content) {
+			t.Fatalf("retrieved content for leaf %s does not match", leaf.Hash)
+		}
+	}
+
+	partial, err := store.BuildDagFromStore(data.Dag.Root, false)
+	if err != nil {
+		t.Fatalf("failed to build dag without content: %v", err)
+	}
+
+	for hash, leaf := range partial.Dag.Leafs {
+		if leaf.Content != nil {
+			t.Fatalf("leaf %s has content when built without content", hash)
+		}
+	}
+
+	_, err = store.BuildDagFromStore("missing-root", true)
+	if err == nil {
+		t.Fatalf("expected an error when building a dag that does not exist")
+	}
+}
+
+func testDeleteDag(t *testing.T, store stores.Store) {
+	first := createDag(t, "first")
+	second := createDag(t, "second")
+
+	for _, data := range []*types.DagData{first, second} {
+		err := store.StoreDag(data)
+		if err != nil {
+			t.Fatalf("failed to store dag: %v", err)
+		}
+	}
+
+	collector, collects := store.(stores.GarbageCollector)
+
+	err := store.DeleteDag(first.Dag.Root)
+	if err != nil {
+		t.Fatalf("failed to delete dag: %v", err)
+	}
+
+	if collects {
+		_, err = collector.CollectGarbage()
+		if err != nil {
+			t.Fatalf("failed to collect garbage: %v", err)
+		}
+	}
+
+	_, err = store.BuildDagFromStore(first.Dag.Root, true)
+	if err == nil {
+		t.Fatalf("expected an error when building a deleted dag")
+	}
+
+	built, err := store.BuildDagFromStore(second.Dag.Root, true)
+	if err != nil {
+		t.Fatalf("failed to build a dag sharing leaves with a deleted dag: %v", err)
+	}
+
+	err = built.Dag.Verify()
+	if err != nil {
+		t.Fatalf("dag sharing leaves with a deleted dag failed verification: %v", err)
+	}
+
+	for hash, leaf := range second.Dag.Leafs {
+		if !bytes.Equal(built.Dag.Leafs[hash].Content, leaf.Content) {
+			t.Fatalf("leaf %s content was lost when deleting another dag", hash)
+		}
+	}
+
+	err = store.DeleteDag(second.Dag.Root)
+	if err != nil {
+		t.Fatalf("failed to delete dag: %v", err)
+	}
+
+	err = store.DeleteDag(second.Dag.Root)
+	if err == nil {
+		t.Fatalf("expected an error when deleting a dag that does not exist")
+	}
+
+	if !collects {
+		return
+	}
+
+	collected, err := collector.CollectGarbage()
+	if err != nil {
+		t.Fatalf("failed to collect garbage: %v", err)
+	}
+
+	if collected == 0 {
+		t.Fatalf("expected content to be collected once no dag references it")
+	}
+
+	for _, leaf := range second.Dag.Leafs {
+		if leaf.ContentHash == nil {
+			continue
+		}
+
+		_, err := store.RetrieveLeafContent(leaf.ContentHash)
+		if err == nil {
+			t.Fatalf("content for leaf %s was not collected", leaf.Hash)
+		}
+	}
+}
+
+type fixture struct {
+	events  []*nostr.Event
+	authors []string
+}
+
+// storeEvents stores a deterministic set of signed events from two authors spread over kinds, tags and timestamps
+func storeEvents(t *testing.T, store stores.Store) *fixture {
+	t.Helper()
+
+	keys := []string{nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()}
+
+	f := &fixture{}
+	for _, key := range keys {
+		pubkey, err := nostr.GetPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.authors = append(f.authors, pubkey)
+	}
+
+	for i := 0; i < 30; i++ {
+		event := &nostr.Event{
+			CreatedAt: nostr.Timestamp(1700000000 + i*10),
+			Kind:      []int{1, 7, 1984}[i%3],
+			Tags:      nostr.Tags{{"t", fmt.Sprintf("topic%d", i%2)}},
+			Content:   fmt.Sprintf("conformance event %d", i),
+		}
+
+		if i%5 == 0 {
+			event.Tags = append(event.Tags, nostr.Tag{"e", "referenced"})
+		}
+
+		err := event.Sign(keys[i%2])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.StoreEvent(event)
+		if err != nil {
+			t.Fatalf("failed to store event: %v", err)
+		}
+
+		f.events = append(f.events, event)
+	}
+
+	return f
+}
+
+// expected returns the ids of the fixture events matching the filter in created_at descending order, applying the limit
+func (f *fixture) expected(filter nostr.Filter) []string {
+	ids := []string{}
+
+	for i := len(f.events) - 1; i >= 0; i-- {
+		if filter.Matches(f.events[i]) {
+			ids = append(ids, f.events[i].ID)
+		}
+	}
+
+	if filter.Limit > 0 && len(ids) > filter.Limit {
+		ids = ids[:filter.Limit]
+	}
+
+	return ids
+}
+
+func timestamp(value int) *nostr.Timestamp {
+	ts := nostr.Timestamp(value)
+	return &ts
+}
+
+func testFilters(t *testing.T, store stores.Store) {
+	f := storeEvents(t, store)
+
+	filters := map[string]nostr.Filter{
+		"all":             {},
+		"ids":             {IDs: []string{f.events[3].ID, f.events[17].ID, "missing"}},
+		"authors":         {Authors: []string{f.authors[0]}},
+		"kinds":           {Kinds: []int{7, 1984}},
+		"authors+kinds":   {Authors: []string{f.authors[1]}, Kinds: []int{1}},
+		"tag":             {Tags: nostr.TagMap{"t": []string{"topic1"}}},
+		"tags":            {Tags: nostr.TagMap{"t": []string{"topic0"}, "e": []string{"referenced"}}},
+		"since":           {Since: timestamp(1700000150)},
+		"until":           {Until: timestamp(1700000100)},
+		"since+until":     {Since: timestamp(1700000050), Until: timestamp(1700000200)},
+		"limit":           {Limit: 5},
+		"kinds+limit":     {Kinds: []int{1}, Limit: 3},
+		"tag+until+limit": {Tags: nostr.TagMap{"t": []string{"topic0"}}, Until: timestamp(1700000200), Limit: 4},
+		"ids+authors":     {IDs: []string{f.events[0].ID, f.events[1].ID}, Authors: []string{f.authors[1]}},
+		"no matches":      {Authors: []string{f.authors[0]}, Kinds: []int{30023}},
+	}
+
+	for name, filter := range filters {
+		events, err := store.QueryEvents(filter)
+		if err != nil {
+			t.Fatalf("%s: failed to query events: %v", name, err)
+		}
+
+		expected := f.expected(filter)
+
+		if len(events) != len(expected) {
+			t.Fatalf("%s: expected %d events, got %d", name, len(expected), len(events))
+		}
+
+		for i, event := range events {
+			if event.ID != expected[i] {
+				t.Fatalf("%s: expected event %d to be %s, got %s", name, i, expected[i], event.ID)
+			}
+		}
+	}
+
+	events, err := store.QueryEvents(nostr.Filter{LimitZero: true})
+	if err != nil {
+		t.Fatalf("failed to query events: %v", err)
+	}
+
+	if len(events) != 0 {
+		t.Fatalf("expected no events for a zero limit, got %d", len(events))
+	}
+}
+
+func testCounts(t *testing.T, store stores.Store) {
+	f := storeEvents(t, store)
+
+	filters := []nostr.Filter{
+		{},
+		{Kinds: []int{1}},
+		{Authors: []string{f.authors[0]}, Kinds: []int{7, 1984}},
+		{Tags: nostr.TagMap{"e": []string{"referenced"}}},
+		{Since: timestamp(1700000100), Limit: 2},
+	}
+
+	for i, filter := range filters {
+		count, err := store.CountEvents(filter)
+		if err != nil {
+			t.Fatalf("filter %d: failed to count events: %v", i, err)
+		}
+
+		filter.Limit = 0
+		expected := len(f.expected(filter))
+
+		if count != int64(expected) {
+			t.Fatalf("filter %d: expected a count of %d, got %d", i, expected, count)
+		}
+	}
+
+	// Events matching more than one of the filters are counted once
+	union := map[string]struct{}{}
+	for _, filter := range filters[1:4] {
+		for _, id := range f.expected(filter) {
+			union[id] = struct{}{}
+		}
+	}
+
+	count, err := store.CountEvents(filters[1:4]...)
+	if err != nil {
+		t.Fatalf("failed to count events: %v", err)
+	}
+
+	if count != int64(len(union)) {
+		t.Fatalf("expected the filters to count %d distinct events, got %d", len(union), count)
+	}
+}
+
+func testDeleteEvent(t *testing.T, store stores.Store) {
+	f := storeEvents(t, store)
+
+	deleted := map[string]struct{}{}
+	for i := 0; i < len(f.events); i += 4 {
+		err := store.DeleteEvent(f.events[i].ID)
+		if err != nil {
+			t.Fatalf("failed to delete event: %v", err)
+		}
+
+		deleted[f.events[i].ID] = struct{}{}
+	}
+
+	remaining := []*nostr.Event{}
+	for _, event := range f.events {
+		if _, ok := deleted[event.ID]; !ok {
+			remaining = append(remaining, event)
+		}
+	}
+	f.events = remaining
+
+	for _, filter := range []nostr.Filter{{}, {Kinds: []int{1}}, {Authors: []string{f.authors[1]}}, {Tags: nostr.TagMap{"t": []string{"topic0"}}}} {
+		events, err := store.QueryEvents(filter)
+		if err != nil {
+			t.Fatalf("failed to query events: %v", err)
+		}
+
+		if len(events) != len(f.expected(filter)) {
+			t.Fatalf("expected %d events after deleting, got %d", len(f.expected(filter)), len(events))
+		}
+
+		for _, event := range events {
+			if _, ok := deleted[event.ID]; ok {
+				t.Fatalf("deleted event %s was returned", event.ID)
+			}
+		}
+	}
+
+	for id := range deleted {
+		events, err := store.QueryEvents(nostr.Filter{IDs: []string{id}})
+		if err != nil {
+			t.Fatalf("failed to query events: %v", err)
+		}
+
+		if len(events) != 0 {
+			t.Fatalf("deleted event %s was returned by id", id)
+		}
+	}
+
+	err := store.DeleteEvent("missing")
+	if err == nil {
+		t.Fatalf("expected an error when deleting an event that does not exist")
+	}
+}
+
+func testBlobs(t *testing.T, store stores.Store) {
+	owner := nostr.GeneratePrivateKey()
+	other := nostr.GeneratePrivateKey()
+
+	start := time.Now().Unix()
+
+	first, err := store.StoreBlob([]byte("first blob"), "text/plain", owner)
+	if err != nil {
+		t.Fatalf("failed to store blob: %v", err)
+	}
+
+	second, err := store.StoreBlob([]byte("second blob"), "application/octet-stream", owner)
+	if err != nil {
+		t.Fatalf("failed to store blob: %v", err)
+	}
+
+	_, err = store.StoreBlob([]byte("someone else's blob"), "text/plain", other)
+	if err != nil {
+		t.Fatalf("failed to store blob: %v", err)
+	}
+
+	end := time.Now().Unix()
+
+	content, contentType, err := store.GetBlob(first.SHA256)
+	if err != nil {
+		t.Fatalf("failed to get blob: %v", err)
+	}
+
+	if string(content) != "first blob" || contentType == nil || *contentType != "text/plain" {
+		t.Fatalf("blob content or type does not match")
+	}
+
+	blobs, err := store.ListBlobs(owner, start, end)
+	if err != nil {
+		t.Fatalf("failed to list blobs: %v", err)
+	}
+
+	if len(blobs) != 2 {
+		t.Fatalf("expected the owner to have 2 blobs, got %d", len(blobs))
+	}
+
+	for _, blob := range blobs {
+		if blob.SHA256 != first.SHA256 && blob.SHA256 != second.SHA256 {
+			t.Fatalf("blob %s does not belong to the owner", blob.SHA256)
+		}
+	}
+
+	blobs, err = store.ListBlobs(owner, end+1, end+3600)
+	if err != nil {
+		t.Fatalf("failed to list blobs: %v", err)
+	}
+
+	if len(blobs) != 0 {
+		t.Fatalf("expected no blobs after the upload time range, got %d", len(blobs))
+	}
+
+	blobs, err = store.ListBlobs(owner, 0, start-1)
+	if err != nil {
+		t.Fatalf("failed to list blobs: %v", err)
+	}
+
+	if len(blobs) != 0 {
+		t.Fatalf("expected no blobs before the upload time range, got %d", len(blobs))
+	}
+
+	blobs, err = store.ListBlobs(nostr.GeneratePrivateKey(), 0, end)
+	if err != nil {
+		t.Fatalf("failed to list blobs: %v", err)
+	}
+
+	if len(blobs) != 0 {
+		t.Fatalf("expected no blobs for a public key without uploads, got %d", len(blobs))
+	}
+
+	err = store.DeleteBlob(first.SHA256)
+	if err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+
+	_, _, err = store.GetBlob(first.SHA256)
+	if err == nil {
+		t.Fatalf("expected an error when getting a deleted blob")
+	}
+
+	blobs, err = store.ListBlobs(owner, start, end)
+	if err != nil {
+		t.Fatalf("failed to list blobs: %v", err)
+	}
+
+	if len(blobs) != 1 || blobs[0].SHA256 != second.SHA256 {
+		t.Fatalf("expected only the remaining blob to be listed, got %v", blobs)
+	}
+}
+
+func testIndexBlobs(t *testing.T, store stores.Store) {
+	indexer, ok := store.(stores.BlobIndexer)
+	if !ok {
+		t.Skip("store does not index external blobs")
+	}
+
+	owner := nostr.GeneratePrivateKey()
+
+	external := stores.NewBlobDescriptor([]byte("kept on disk"), "video/mp4")
+
+	err := indexer.IndexBlob(external, owner)
+	if err != nil {
+		t.Fatalf("failed to index blob: %v", err)
+	}
+
+	descriptor, err := indexer.GetBlobDescriptor(external.SHA256)
+	if err != nil {
+		t.Fatalf("failed to get indexed descriptor: %v", err)
+	}
+
+	if !descriptor.External || descriptor.Size != external.Size || descriptor.Type != external.Type {
+		t.Fatalf("indexed descriptor was not kept, got %+v", descriptor)
+	}
+
+	blobs, err := store.ListBlobs(owner, 0, time.Now().Unix()+60)
+	if err != nil {
+		t.Fatalf("failed to list blobs: %v", err)
+	}
+
+	if len(blobs) != 1 || blobs[0].SHA256 != external.SHA256 {
+		t.Fatalf("expected the indexed blob to be listed, got %v", blobs)
+	}
+
+	expectUsage(t, store, owner, external.Size, 1)
+
+	// Indexing a blob the store already holds keeps its stored content
+	stored, err := store.StoreBlob([]byte("kept in the store"), "text/plain", owner)
+	if err != nil {
+		t.Fatalf("failed to store blob: %v", err)
+	}
+
+	err = indexer.IndexBlob(*stored, owner)
+	if err != nil {
+		t.Fatalf("failed to index stored blob: %v", err)
+	}
+
+	content, _, err := store.GetBlob(stored.SHA256)
+	if err != nil || string(content) != "kept in the store" {
+		t.Fatalf("indexing a stored blob lost its content: %v", err)
+	}
+
+	err = store.DeleteBlob(external.SHA256)
+	if err != nil {
+		t.Fatalf("failed to delete indexed blob: %v", err)
+	}
+
+	if _, err := indexer.GetBlobDescriptor(external.SHA256); err == nil {
+		t.Fatalf("expected an error when getting a deleted descriptor")
+	}
+
+	expectUsage(t, store, owner, stored.Size, 1)
+}
+
+func expectUsage(t *testing.T, store stores.Store, publicKey string, bytes int64, items int64) {
+	t.Helper()
+
+	usage, err := store.GetUsage(publicKey)
+	if err != nil {
+		t.Fatalf("failed to get usage: %v", err)
+	}
+
+	if usage.Bytes != bytes || usage.Items != items {
+		t.Fatalf("expected usage of %d bytes and %d items, got %d bytes and %d items", bytes, items, usage.Bytes, usage.Items)
+	}
+}
+
+func testUsage(t *testing.T, store stores.Store) {
+	key := nostr.GeneratePrivateKey()
+	publicKey, _ := nostr.GetPublicKey(key)
+
+	event := &nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Tags: nostr.Tags{}, Content: "usage"}
+	event.Sign(key)
+
+	err := store.StoreEvent(event)
+	if err != nil {
+		t.Fatalf("failed to store event: %v", err)
+	}
+
+	// Storing the same event again is reported as a duplicate and not charged twice
+	if err := store.StoreEvent(event); !errors.Is(err, stores.ErrDuplicate) {
+		t.Fatalf("expected a duplicate error, got %v", err)
+	}
+
+	eventSize := stores.EventSize(event)
+	expectUsage(t, store, publicKey, eventSize, 1)
+
+	blob, err := store.StoreBlob([]byte("usage blob"), "text/plain", publicKey)
+	if err != nil {
+		t.Fatalf("failed to store blob: %v", err)
+	}
+
+	expectUsage(t, store, publicKey, eventSize+blob.Size, 2)
+
+	data := createDag(t, "usage")
+	data.PublicKey = publicKey
+
+	err = store.StoreDag(data)
+	if err != nil {
+		t.Fatalf("failed to store dag: %v", err)
+	}
+
+	var dagSize int64
+	for _, leaf := range data.Dag.Leafs {
+		dagSize += int64(len(leaf.Content))
+	}
+
+	expectUsage(t, store, publicKey, eventSize+blob.Size+dagSize, 3)
+
+	err = store.DeleteEvent(event.ID)
+	if err != nil {
+		t.Fatalf("failed to delete event: %v", err)
+	}
+
+	err = store.DeleteBlob(blob.SHA256)
+	if err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+
+	err = store.DeleteDag(data.Dag.Root)
+	if err != nil {
+		t.Fatalf("failed to delete dag: %v", err)
+	}
+
+	expectUsage(t, store, publicKey, 0, 0)
+}
+
+func testQuota(t *testing.T, store stores.Store) {
+	key := nostr.GeneratePrivateKey()
+	publicKey, _ := nostr.GetPublicKey(key)
+
+	previous := *settings.Get()
+	t.Cleanup(func() {
+		settings.Apply(previous)
+	})
+
+	err := settings.Apply(types.RelaySettings{
+		Mode: "unlimited",
+		Quota: types.Quota{
+			Default: types.QuotaLimit{MaxBytes: 1},
+			Overrides: map[string]types.QuotaLimit{
+				publicKey: {MaxItems: 2},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		event := &nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Tags: nostr.Tags{}, Content: fmt.Sprintf("quota %d", i)}
+		event.Sign(key)
+
+		err := store.StoreEvent(event)
+
+		if i < 2 && err != nil {
+			t.Fatalf("failed to store event within the quota: %v", err)
+		}
+
+		if i == 2 && !stores.IsQuotaError(err) {
+			t.Fatalf("expected a quota error once the override is used up, got %v", err)
+		}
+	}
+
+	_, err = store.StoreBlob([]byte("over the default quota"), "text/plain", nostr.GeneratePrivateKey())
+	if !stores.IsQuotaError(err) {
+		t.Fatalf("expected a quota error for a blob over the default quota, got %v", err)
+	}
+
+	_, err = store.StoreBlob([]byte("anonymous"), "text/plain", "")
+	if err != nil {
+		t.Fatalf("anonymous blobs should not be limited: %v", err)
+	}
+}
+
+func testExpiration(t *testing.T, store stores.Store) {
+	key := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+
+	expirations := []string{"", fmt.Sprint(now - 60), fmt.Sprint(now + 3600)}
+	events := make([]*nostr.Event, len(expirations))
+
+	for i, expiration := range expirations {
+		tags := nostr.Tags{}
+		if expiration != "" {
+			tags = append(tags, nostr.Tag{"expiration", expiration})
+		}
+
+		events[i] = &nostr.Event{CreatedAt: now - nostr.Timestamp(i), Kind: 1, Tags: tags, Content: fmt.Sprintf("expiration %d", i)}
+		events[i].Sign(key)
+
+		err := store.StoreEvent(events[i])
+		if err != nil {
+			t.Fatalf("failed to store event: %v", err)
+		}
+	}
+
+	expired := events[1]
+
+	for _, filter := range []nostr.Filter{{Kinds: []int{1}}, {IDs: []string{expired.ID}}} {
+		results, err := store.QueryEvents(filter)
+		if err != nil {
+			t.Fatalf("failed to query events: %v", err)
+		}
+
+		for _, event := range results {
+			if event.ID == expired.ID {
+				t.Fatalf("expired event %s was returned", event.ID)
+			}
+		}
+	}
+
+	results, err := store.QueryEvents(nostr.Filter{Kinds: []int{1}})
+	if err != nil {
+		t.Fatalf("failed to query events: %v", err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("expected 2 unexpired events, got %d", len(results))
+	}
+
+	// Counts answered from the index counts must leave out expired events that haven't been swept yet
+	for _, filter := range []nostr.Filter{{Kinds: []int{1}}, {Authors: []string{expired.PubKey}}, {Kinds: []int{1}, Authors: []string{expired.PubKey}}} {
+		count, err := store.CountEvents(filter)
+		if err != nil {
+			t.Fatalf("failed to count events: %v", err)
+		}
+
+		if count != 2 {
+			t.Fatalf("expected 2 unexpired events to be counted for %v, got %d", filter, count)
+		}
+	}
+
+	if count, err := store.CountEvents(nostr.Filter{Kinds: []int{1}}, nostr.Filter{IDs: []string{expired.ID}}); err != nil || count != 2 {
+		t.Fatalf("expected 2 unexpired events to be counted across filters, got %d", count)
+	}
+
+	sweeper, ok := store.(stores.ExpirationSweeper)
+	if !ok {
+		return
+	}
+
+	deleted, err := sweeper.DeleteExpiredEvents(int64(now))
+	if err != nil {
+		t.Fatalf("failed to delete expired events: %v", err)
+	}
+
+	if deleted != 1 {
+		t.Fatalf("expected 1 expired event to be deleted, got %d", deleted)
+	}
+
+	if err := store.DeleteEvent(expired.ID); err == nil {
+		t.Fatalf("expired event %s was not deleted by the sweep", expired.ID)
+	}
+
+	deleted, err = sweeper.DeleteExpiredEvents(int64(now))
+	if err != nil {
+		t.Fatalf("failed to delete expired events: %v", err)
+	}
+
+	if deleted != 0 {
+		t.Fatalf("expected nothing left to sweep, got %d", deleted)
+	}
+}
+
+func testEphemeral(t *testing.T, store stores.Store) {
+	event := &nostr.Event{CreatedAt: nostr.Now(), Kind: 20001, Tags: nostr.Tags{}, Content: "typing"}
+	event.Sign(nostr.GeneratePrivateKey())
+
+	if err := store.StoreEvent(event); !errors.Is(err, stores.ErrEphemeral) {
+		t.Fatalf("expected ephemeral events to be refused, got %v", err)
+	}
+
+	batch := store.NewBatch()
+	if err := batch.StoreEvent(event); err == nil {
+		if err := batch.Commit(); !errors.Is(err, stores.ErrEphemeral) {
+			t.Fatalf("expected a batch with an ephemeral event to be refused, got %v", err)
+		}
+	} else {
+		batch.Discard()
+	}
+
+	results, err := store.QueryEvents(nostr.Filter{IDs: []string{event.ID}})
+	if err != nil {
+		t.Fatalf("failed to query events: %v", err)
+	}
+
+	if len(results) != 0 {
+		t.Fatalf("ephemeral event was stored")
+	}
+}
+
+func testReplaceable(t *testing.T, store stores.Store) {
+	key := nostr.GeneratePrivateKey()
+	publicKey, _ := nostr.GetPublicKey(key)
+
+	sign := func(kind int, createdAt nostr.Timestamp, d string, content string) *nostr.Event {
+		tags := nostr.Tags{}
+		if d != "" {
+			tags = append(tags, nostr.Tag{"d", d})
+		}
+
+		event := &nostr.Event{CreatedAt: createdAt, Kind: kind, Tags: tags, Content: content}
+		event.Sign(key)
+
+		return event
+	}
+
+	current := func(filter nostr.Filter) []*nostr.Event {
+		filter.Authors = []string{publicKey}
+
+		events, err := store.QueryEvents(filter)
+		if err != nil {
+			t.Fatalf("failed to query events: %v", err)
+		}
+
+		return events
+	}
+
+	expectCurrent := func(filter nostr.Filter, expected *nostr.Event) {
+		t.Helper()
+
+		events := current(filter)
+		if len(events) != 1 || events[0].ID != expected.ID {
+			t.Fatalf("expected only %s to be stored, got %d events", expected.ID, len(events))
+		}
+	}
+
+	older := sign(0, 1000, "", "older")
+	newer := sign(0, 2000, "", "newer")
+
+	for _, event := range []*nostr.Event{older, newer} {
+		if err := store.StoreEvent(event); err != nil {
+			t.Fatalf("failed to store event: %v", err)
+		}
+	}
+
+	expectCurrent(nostr.Filter{Kinds: []int{0}}, newer)
+
+	if err := store.StoreEvent(older); !errors.Is(err, stores.ErrSuperseded) {
+		t.Fatalf("expected an older version to be rejected, got %v", err)
+	}
+
+	// Ties on created_at go to the lowest id
+	tied := sign(0, 2000, "", "tied")
+	winner, loser := tied, newer
+	if newer.ID < tied.ID {
+		winner, loser = newer, tied
+	}
+
+	if err := store.StoreEvent(tied); err != nil && !errors.Is(err, stores.ErrSuperseded) {
+		t.Fatalf("failed to store event: %v", err)
+	}
+
+	if err := store.StoreEvent(loser); loser != winner && !errors.Is(err, stores.ErrSuperseded) {
+		t.Fatalf("expected the tie with the higher id to be rejected, got %v", err)
+	}
+
+	expectCurrent(nostr.Filter{Kinds: []int{0}}, winner)
+
+	// Addressable events are replaced per d tag
+	first := sign(30079, 1000, "a", "first")
+	other := sign(30079, 1000, "b", "other")
+	second := sign(30079, 2000, "a", "second")
+
+	for _, event := range []*nostr.Event{first, other, second} {
+		if err := store.StoreEvent(event); err != nil {
+			t.Fatalf("failed to store event: %v", err)
+		}
+	}
+
+	expectCurrent(nostr.Filter{Kinds: []int{30079}, Tags: nostr.TagMap{"d": []string{"a"}}}, second)
+	expectCurrent(nostr.Filter{Kinds: []int{30079}, Tags: nostr.TagMap{"d": []string{"b"}}}, other)
+
+	expectUsage(t, store, publicKey, stores.EventSize(winner)+stores.EventSize(other)+stores.EventSize(second), 3)
+
+	// Deleting the current version frees the slot for any version
+	if err := store.DeleteEvent(second.ID); err != nil {
+		t.Fatalf("failed to delete event: %v", err)
+	}
+
+	if err := store.StoreEvent(first); err != nil {
+		t.Fatalf("failed to store event after deleting the current version: %v", err)
+	}
+
+	expectCurrent(nostr.Filter{Kinds: []int{30079}, Tags: nostr.TagMap{"d": []string{"a"}}}, first)
+}
+
+func testIterate(t *testing.T, store stores.Store) {
+	f := storeEvents(t, store)
+
+	for _, filter := range []nostr.Filter{{}, {Kinds: []int{1}, Limit: 5}, {IDs: []string{f.events[0].ID, f.events[1].ID}}} {
+		events := []*nostr.Event{}
+
+		err := store.IterateEvents(context.Background(), filter, func(event *nostr.Event) bool {
+			events = append(events, event)
+			return true
+		})
+		if err != nil {
+			t.Fatalf("failed to iterate events: %v", err)
+		}
+
+		expected := f.expected(filter)
+		if len(events) != len(expected) {
+			t.Fatalf("expected %d events, got %d", len(expected), len(events))
+		}
+
+		for i := range events {
+			if events[i].ID != expected[i] {
+				t.Fatalf("expected event %d to be %s, got %s", i, expected[i], events[i].ID)
+			}
+		}
+	}
+
+	// Cancelling part way through stops the iteration and reports the cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	yielded := 0
+
+	err := store.IterateEvents(ctx, nostr.Filter{}, func(event *nostr.Event) bool {
+		yielded++
+		cancel()
+		return true
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the iteration to be cancelled, got %v", err)
+	}
+
+	if yielded != 1 {
+		t.Fatalf("expected iteration to stop after the first event, got %d events", yielded)
+	}
+}
+
+func testBatch(t *testing.T, store stores.Store) {
+	key := nostr.GeneratePrivateKey()
+
+	sign := func(kind int, createdAt nostr.Timestamp, content string) *nostr.Event {
+		event := &nostr.Event{CreatedAt: createdAt, Kind: kind, Tags: nostr.Tags{}, Content: content}
+		event.Sign(key)
+
+		return event
+	}
+
+	stageDag := func(batch stores.Batch, data *types.DagData) {
+		t.Helper()
+
+		err := data.Dag.IterateDag(func(leaf *merkle_dag.DagLeaf, parent *merkle_dag.DagLeaf) error {
+			leafData := &types.DagLeafData{Leaf: *leaf}
+
+			if leaf.Hash == data.Dag.Root {
+				leafData.PublicKey = data.PublicKey
+				leafData.Signature = data.Signature
+			}
+
+			return batch.StoreLeaf(data.Dag.Root, leafData)
+		})
+		if err != nil {
+			t.Fatalf("failed to stage dag: %v", err)
+		}
+	}
+
+	stage := func(batch stores.Batch, data *types.DagData, event *nostr.Event, blob string) {
+		t.Helper()
+
+		stageDag(batch, data)
+
+		err := batch.StoreEvent(event)
+		if err != nil {
+			t.Fatalf("failed to stage event: %v", err)
+		}
+
+		_, err = batch.StoreBlob([]byte(blob), "text/plain", data.PublicKey)
+		if err != nil {
+			t.Fatalf("failed to stage blob: %v", err)
+		}
+	}
+
+	stored := func(data *types.DagData, event *nostr.Event, blob string) (bool, bool, bool) {
+		_, dagErr := store.BuildDagFromStore(data.Dag.Root, true)
+
+		events, err := store.QueryEvents(nostr.Filter{IDs: []string{event.ID}})
+		if err != nil {
+			t.Fatalf("failed to query events: %v", err)
+		}
+
+		_, _, blobErr := store.GetBlob(stores.NewBlobDescriptor([]byte(blob), "text/plain").SHA256)
+
+		return dagErr == nil, len(events) == 1, blobErr == nil
+	}
+
+	data := createDag(t, "batch")
+	event := sign(1, 1000, "batched")
+
+	batch := store.NewBatch()
+	stage(batch, data, event, "batched blob")
+
+	if dag, event, blob := stored(data, event, "batched blob"); dag || event || blob {
+		t.Fatalf("staged writes are visible before the batch was committed")
+	}
+
+	err := batch.Commit()
+	if err != nil {
+		t.Fatalf("failed to commit batch: %v", err)
+	}
+
+	if dag, event, blob := stored(data, event, "batched blob"); !dag || !event || !blob {
+		t.Fatalf("expected the dag, event and blob to be stored after commit, got %v %v %v", dag, event, blob)
+	}
+
+	built, err := store.BuildDagFromStore(data.Dag.Root, true)
+	if err != nil {
+		t.Fatalf("failed to build dag from store: %v", err)
+	}
+
+	err = built.Dag.Verify()
+	if err != nil {
+		t.Fatalf("committed dag failed verification: %v", err)
+	}
+
+	if err := batch.Commit(); err == nil {
+		t.Fatalf("expected an error when committing a batch twice")
+	}
+
+	// Uploading a dag that is already stored commits as if the leaves were new
+	batch = store.NewBatch()
+	stageDag(batch, data)
+
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("expected a batch of stored leaves to commit, got %v", err)
+	}
+
+	if dag, _, _ := stored(data, event, "batched blob"); !dag {
+		t.Fatalf("expected the dag to still be stored")
+	}
+
+	// A write that fails part way through the batch leaves none of the batch behind
+	newer := sign(0, 2000, "newer profile")
+	if err := store.StoreEvent(newer); err != nil {
+		t.Fatalf("failed to store event: %v", err)
+	}
+
+	failed := createDag(t, "failed-batch")
+	failedEvent := sign(1, 1001, "never stored")
+
+	batch = store.NewBatch()
+	stage(batch, failed, failedEvent, "never stored blob")
+
+	if err := batch.StoreEvent(sign(0, 1000, "older profile")); err != nil {
+		t.Fatalf("failed to stage event: %v", err)
+	}
+
+	err = batch.Commit()
+	if !errors.Is(err, stores.ErrSuperseded) {
+		t.Fatalf("expected the batch to fail with a superseded event, got %v", err)
+	}
+
+	if dag, event, blob := stored(failed, failedEvent, "never stored blob"); dag || event || blob {
+		t.Fatalf("a failed batch left writes behind, dag %v event %v blob %v", dag, event, blob)
+	}
+
+	expectUsage(t, store, failed.PublicKey, 0, 0)
+
+	events, err := store.QueryEvents(nostr.Filter{IDs: []string{newer.ID}})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("expected the newer profile to still be stored")
+	}
+
+	// Discarded batches write nothing and can't be committed
+	discarded := sign(1, 1002, "discarded")
+
+	batch = store.NewBatch()
+	if err := batch.StoreEvent(discarded); err != nil {
+		t.Fatalf("failed to stage event: %v", err)
+	}
+
+	batch.Discard()
+
+	if err := batch.Commit(); err == nil {
+		t.Fatalf("expected an error when committing a discarded batch")
+	}
+
+	events, err = store.QueryEvents(nostr.Filter{IDs: []string{discarded.ID}})
+	if err != nil || len(events) != 0 {
+		t.Fatalf("a discarded batch was written")
+	}
+}
+
+func testVersions(t *testing.T, store stores.Store) {
+	versioned, ok := store.(stores.VersionedStore)
+	if !ok {
+		return
+	}
+
+	latest := func() uint64 {
+		t.Helper()
+
+		versions, err := versioned.ListVersions(0, 0)
+		if err != nil {
+			t.Fatalf("failed to list versions: %v", err)
+		}
+
+		if len(versions) == 0 {
+			t.Fatalf("expected at least one version to be recorded")
+		}
+
+		for i := 1; i < len(versions); i++ {
+			if versions[i].Version <= versions[i-1].Version || versions[i].Timestamp < versions[i-1].Timestamp {
+				t.Fatalf("versions are not listed in commit order")
+			}
+		}
+
+		return versions[len(versions)-1].Version
+	}
+
+	key := nostr.GeneratePrivateKey()
+
+	event := &nostr.Event{CreatedAt: 1000, Kind: 1, Tags: nostr.Tags{}, Content: "versioned"}
+	event.Sign(key)
+
+	if err := store.StoreEvent(event); err != nil {
+		t.Fatalf("failed to store event: %v", err)
+	}
+
+	beforeDag := latest()
+
+	data := createDag(t, "versions")
+	if err := store.StoreDag(data); err != nil {
+		t.Fatalf("failed to store dag: %v", err)
+	}
+
+	stored := latest()
+
+	later := &nostr.Event{CreatedAt: 1001, Kind: 1, Tags: nostr.Tags{}, Content: "stored later"}
+	later.Sign(key)
+
+	if err := store.StoreEvent(later); err != nil {
+		t.Fatalf("failed to store event: %v", err)
+	}
+
+	filter := nostr.Filter{Kinds: []int{1}, Authors: []string{event.PubKey}}
+
+	events, err := versioned.QueryEventsAt(filter, stored)
+	if err != nil {
+		t.Fatalf("failed to query events at version %d: %v", stored, err)
+	}
+
+	if len(events) != 1 || events[0].ID != event.ID {
+		t.Fatalf("expected only the event stored before version %d, got %d events", stored, len(events))
+	}
+
+	built, err := versioned.BuildDagFromStoreAt(data.Dag.Root, stored, true)
+	if err != nil {
+		t.Fatalf("failed to build dag at version %d: %v", stored, err)
+	}
+
+	if len(built.Dag.Leafs) != len(data.Dag.Leafs) || built.PublicKey != data.PublicKey {
+		t.Fatalf("dag at version %d does not match the dag that was stored", stored)
+	}
+
+	if err := built.Dag.Verify(); err != nil {
+		t.Fatalf("dag at version %d failed verification: %v", stored, err)
+	}
+
+	if _, err := versioned.BuildDagFromStoreAt(data.Dag.Root, beforeDag, false); err == nil {
+		t.Fatalf("expected the dag to be missing before it was stored")
+	}
+
+	if err := store.DeleteEvent(event.ID); err != nil {
+		t.Fatalf("failed to delete event: %v", err)
+	}
+
+	if err := store.DeleteDag(data.Dag.Root); err != nil {
+		t.Fatalf("failed to delete dag: %v", err)
+	}
+
+	if latest() <= stored {
+		t.Fatalf("expected the deletes to record new versions")
+	}
+
+	// Deletes are takedowns so nothing deleted can be read back from an older version
+	events, err = versioned.QueryEventsAt(filter, stored)
+	if err != nil {
+		t.Fatalf("failed to query events at version %d: %v", stored, err)
+	}
+
+	if len(events) != 0 {
+		t.Fatalf("expected the deleted event to be hidden at version %d, got %d events", stored, len(events))
+	}
+
+	if _, err := versioned.BuildDagFromStoreAt(data.Dag.Root, stored, false); err == nil {
+		t.Fatalf("expected the deleted dag to be hidden at version %d", stored)
+	}
+
+	if _, err := store.BuildDagFromStore(data.Dag.Root, false); err == nil {
+		t.Fatalf("expected the dag to be deleted from the latest version")
+	}
+
+	// Restoring from a version before the deletes stores the event and dag again and makes their history readable again
+	restored, err := versioned.RestoreEventsAt(filter, stored)
+	if err != nil {
+		t.Fatalf("failed to restore events from version %d: %v", stored, err)
+	}
+
+	if restored != 1 {
+		t.Fatalf("expected only the deleted event to be restored, got %d", restored)
+	}
+
+	events, err = store.QueryEvents(nostr.Filter{IDs: []string{event.ID}})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("expected the restored event to be stored again")
+	}
+
+	if err := versioned.RestoreDagAt(data.Dag.Root, beforeDag); err == nil {
+		t.Fatalf("expected a dag to be missing from a version before it was stored")
+	}
+
+	if err := versioned.RestoreDagAt(data.Dag.Root, stored); err != nil {
+		t.Fatalf("failed to restore dag from version %d: %v", stored, err)
+	}
+
+	rebuilt, err := store.BuildDagFromStore(data.Dag.Root, true)
+	if err != nil {
+		t.Fatalf("failed to build the restored dag: %v", err)
+	}
+
+	if err := rebuilt.Dag.Verify(); err != nil {
+		t.Fatalf("restored dag failed verification: %v", err)
+	}
+
+	if _, err := versioned.BuildDagFromStoreAt(data.Dag.Root, stored, false); err != nil {
+		t.Fatalf("failed to build a restored dag at version %d: %v", stored, err)
+	}
+
+	if err := versioned.RestoreDagAt(data.Dag.Root, stored); err == nil {
+		t.Fatalf("expected a dag that hasn't been deleted not to be restored")
+	}
+
+	// Versions are listed a page at a time starting after the last version of the previous page
+	all, err := versioned.ListVersions(0, 0)
+	if err != nil {
+		t.Fatalf("failed to list versions: %v", err)
+	}
+
+	page, err := versioned.ListVersions(stored, 2)
+	if err != nil {
+		t.Fatalf("failed to list versions: %v", err)
+	}
+
+	if len(page) != 2 || page[0].Version <= stored {
+		t.Fatalf("expected the two versions after %d, got %v", stored, page)
+	}
+
+	for i, version := range all {
+		if version.Version == page[0].Version {
+			if all[i+1] != page[1] {
+				t.Fatalf("expected the page to continue in commit order")
+			}
+		}
+	}
+
+	if page, err := versioned.ListVersions(all[len(all)-1].Version, 0); err != nil || len(page) != 0 {
+		t.Fatalf("expected no versions after the latest")
+	}
+}
+
+func testKeyRotation(t *testing.T, store stores.Store) {
+	encrypted, ok := store.(stores.EncryptedStore)
+	if !ok || !encrypted.Encrypted() {
+		t.Skip("store is not encrypted")
+	}
+
+	data := createDag(t, "rotation")
+
+	err := store.StoreDag(data)
+	if err != nil {
+		t.Fatalf("failed to store dag: %v", err)
+	}
+
+	fixture := storeEvents(t, store)
+
+	blob, err := store.StoreBlob([]byte("sealed blob"), "text/plain", "")
+	if err != nil {
+		t.Fatalf("failed to store blob: %v", err)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+
+	err = encryption.GenerateKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	master, err := encryption.KeyFileKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = encrypted.RotateMasterKey(master)
+	if err != nil {
+		t.Fatalf("failed to rotate master key: %v", err)
+	}
+
+	resealed, err := encrypted.RotateDataKey(master)
+	if err != nil {
+		t.Fatalf("failed to rotate data key: %v", err)
+	}
+
+	if resealed < len(fixture.events)+1 {
+		t.Fatalf("expected every event and the blob to be resealed, got %d values", resealed)
+	}
+
+	built, err := store.BuildDagFromStore(data.Dag.Root, true)
+	if err != nil {
+		t.Fatalf("failed to build dag after rotation: %v", err)
+	}
+
+	err = built.Dag.Verify()
+	if err != nil {
+		t.Fatalf("dag failed verification after rotation: %v", err)
+	}
+
+	events, err := store.QueryEvents(nostr.Filter{})
+	if err != nil {
+		t.Fatalf("failed to query events after rotation: %v", err)
+	}
+
+	if len(events) != len(fixture.events) {
+		t.Fatalf("expected %d events after rotation, got %d", len(fixture.events), len(events))
+	}
+
+	content, _, err := store.GetBlob(blob.SHA256)
+	if err != nil || string(content) != "sealed blob" {
+		t.Fatalf("blob could not be read after rotation: %v", err)
+	}
+}
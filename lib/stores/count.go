@@ -0,0 +1,142 @@
+package stores
+
+import (
+	"context"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ApproximateCounter is implemented by stores that can estimate counts for filters that are too expensive to count exactly (NIP-45)
+type ApproximateCounter interface {
+	// EstimateEvents returns an estimate of the events matching any of the filters and true when every filter is expensive
+	// enough to warrant one, otherwise it returns false and the caller should fall back to CountEvents
+	EstimateEvents(filters ...nostr.Filter) (int64, bool, error)
+}
+
+// ExpiringIndexReader is implemented by index readers that track which events expire (NIP-40)
+type ExpiringIndexReader interface {
+	// Expired returns the ids of the indexed events that expired at or before now and have not been deleted yet
+	Expired(now int64) ([]string, error)
+}
+
+// expiredIDs returns the ids of the events that have expired but are still indexed until the sweeper deletes them,
+// it returns false when the reader doesn't track expiring events
+func expiredIDs(reader IndexReader) (map[string]struct{}, bool, error) {
+	expiring, ok := reader.(ExpiringIndexReader)
+	if !ok {
+		return nil, false, nil
+	}
+
+	ids, err := expiring.Expired(time.Now().Unix())
+	if err != nil {
+		return nil, false, err
+	}
+
+	expired := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		expired[id] = struct{}{}
+	}
+
+	return expired, true, nil
+}
+
+// CountIndexes counts the events matching any of the filters using a store's indexes, an event matching more than one
+// filter is only counted once, events are only loaded when a filter has conditions the index entries can't answer
+func CountIndexes(reader IndexReader, filters ...nostr.Filter) (int64, error) {
+	// Index entries can't tell whether their event has expired so they are checked against the expired events that
+	// haven't been swept yet, readers that don't track them are counted from the events
+	expired, tracked, err := expiredIDs(reader)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(filters) == 1 {
+		// The index counts include expired events so they are only the answer once the sweeper has deleted them
+		if tracked && len(expired) == 0 {
+			if count, ok := countFromIndexes(reader, filters[0]); ok {
+				return count, nil
+			}
+		}
+
+		var count int64
+		err := matchIndexes(reader, filters[0], expired, tracked, func(id string) {
+			count++
+		})
+
+		return count, err
+	}
+
+	matched := map[string]struct{}{}
+
+	for _, filter := range filters {
+		err := matchIndexes(reader, filter, expired, tracked, func(id string) {
+			matched[id] = struct{}{}
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(matched)), nil
+}
+
+// countFromIndexes answers a filter from the counts kept for each index key, it returns false when an event could
+// appear under more than one of the keys or the filter has conditions the counts can't answer
+func countFromIndexes(reader IndexReader, filter nostr.Filter) (int64, bool) {
+	plan := PlanQuery(filter, reader.Estimate)
+
+	if plan.IDs != nil || filter.Search != "" || !coveredByPlan(filter, plan) {
+		return 0, false
+	}
+
+	if filter.Since != nil || filter.Until != nil || (filter.Kinds != nil && plan.Index != IndexKind && plan.Index != IndexAuthorKind) || (plan.Index == IndexTag && len(plan.Keys) != 1) {
+		return 0, false
+	}
+
+	var count int64
+	for _, key := range plan.Keys {
+		count += reader.Estimate(key)
+	}
+
+	return count, true
+}
+
+// matchIndexes passes the id of every unexpired event matching the filter to match, walking the index entries when
+// they carry enough information to evaluate the filter
+func matchIndexes(reader IndexReader, filter nostr.Filter, expired map[string]struct{}, tracked bool, match func(id string)) error {
+	// Counts are never limited
+	filter.Limit = 0
+	filter.LimitZero = false
+
+	plan := PlanQuery(filter, reader.Estimate)
+
+	if tracked && plan.IDs == nil && filter.Search == "" && coveredByPlan(filter, plan) {
+		return walkIndexes(reader, filter, plan.Keys, func(entry IndexEntry) (bool, error) {
+			if _, ok := expired[entry.ID]; !ok {
+				match(entry.ID)
+			}
+
+			return true, nil
+		})
+	}
+
+	return QueryIndexes(context.Background(), reader, filter, func(event *nostr.Event) bool {
+		match(event.ID)
+		return true
+	})
+}
+
+// coveredByPlan reports whether the index entries walked by the plan carry enough information to evaluate the whole filter
+func coveredByPlan(filter nostr.Filter, plan QueryPlan) bool {
+	switch plan.Index {
+	case IndexAll, IndexKind:
+		return filter.Authors == nil && len(filter.Tags) == 0
+	case IndexAuthor, IndexAuthorKind:
+		return len(filter.Tags) == 0
+	case IndexTag:
+		return filter.Authors == nil && len(filter.Tags) == 1
+	}
+
+	return false
+}
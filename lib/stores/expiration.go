@@ -0,0 +1,69 @@
+package stores
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ExpirationSweeper is implemented by stores that track expiring events (NIP-40) and can delete them in bulk
+type ExpirationSweeper interface {
+	DeleteExpiredEvents(now int64) (int, error)
+}
+
+// Expiration returns the unix time from an event's expiration tag and whether the event has one
+func Expiration(event *nostr.Event) (int64, bool) {
+	tag := event.Tags.GetFirst([]string{"expiration", ""})
+	if tag == nil || len(*tag) < 2 {
+		return 0, false
+	}
+
+	expiration, err := strconv.ParseInt((*tag)[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return expiration, true
+}
+
+// IsExpired reports whether an event has an expiration tag that is at or before the given unix time
+func IsExpired(event *nostr.Event, now int64) bool {
+	expiration, ok := Expiration(event)
+
+	return ok && expiration <= now
+}
+
+// StartExpirationSweeper deletes expired events from the store every interval until the returned stop function is called,
+// stores that do not implement ExpirationSweeper still hide expired events from queries but keep them on disk
+func StartExpirationSweeper(store Store, interval time.Duration) func() {
+	sweeper, ok := store.(ExpirationSweeper)
+	if !ok || interval <= 0 {
+		return func() {}
+	}
+
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				deleted, err := sweeper.DeleteExpiredEvents(time.Now().Unix())
+				if err != nil {
+					log.Printf("Failed to delete expired events: %v", err)
+				} else if deleted > 0 {
+					log.Printf("Deleted %d expired events", deleted)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
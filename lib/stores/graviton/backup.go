@@ -0,0 +1,91 @@
+package graviton
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Graviton only ever appends to its data files and to version_root.bin, which holds a fixed size record per version,
+// and the versions file is appended to after every commit, so the first bytes of these files are a whole version
+func appendOnly(path string) bool {
+	name := filepath.Base(path)
+
+	return filepath.Ext(name) == ".dfs" || name == "version_root.bin" || name == versionsFile
+}
+
+// Backup copies the graviton files as of the last commit without holding up writes for the whole copy, the size of
+// every append-only file is recorded under the write lock and only that much is copied once it is released.
+// Files that are rewritten in place, like the keyring, are small and copied while the lock is held.
+func (store *GravitonStore) Backup(dir string) error {
+	target := filepath.Join(dir, filepath.Base(store.path))
+
+	sizes := map[string]int64{}
+
+	err := func() error {
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+
+		return filepath.Walk(store.path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			relative, err := filepath.Rel(store.path, path)
+			if err != nil {
+				return err
+			}
+
+			destination := filepath.Join(target, relative)
+
+			if info.IsDir() {
+				return os.MkdirAll(destination, 0755)
+			}
+
+			if appendOnly(path) {
+				sizes[relative] = info.Size()
+				return nil
+			}
+
+			return copyFile(path, destination, info.Size())
+		})
+	}()
+	if err != nil {
+		return err
+	}
+
+	for relative, size := range sizes {
+		err := copyFile(filepath.Join(store.path, relative), filepath.Join(target, relative), size)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyFile copies the first size bytes of the source and syncs the copy to disk
+func copyFile(source string, destination string, size int64) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(out, in, size); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,179 @@
+package graviton
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/HORNET-Storage/hornet-storage/lib/encryption"
+)
+
+// The keyring lives inside the store directory so backups of the store always carry the keys it was sealed with
+const keyringName = "keyring.json"
+
+// Values are resealed in batches of this many per commit when the data key is rotated
+const rotationBatchSize = 1000
+
+func (store *GravitonStore) openKeyring(master *encryption.MasterKey) error {
+	keyring, err := encryption.OpenKeyring(filepath.Join(store.path, keyringName), master)
+	if err != nil {
+		return err
+	}
+
+	cipher, err := keyring.Cipher()
+	if err != nil {
+		return err
+	}
+
+	store.keyring = keyring
+	store.cipher = cipher
+
+	return nil
+}
+
+// Encrypted reports whether the store seals what it writes
+func (store *GravitonStore) Encrypted() bool {
+	return store.cipher != nil
+}
+
+// RotateMasterKey wraps the data keys with a new master key, nothing stored is rewritten and the old master key
+// stops working as soon as this returns
+func (store *GravitonStore) RotateMasterKey(master *encryption.MasterKey) error {
+	if store.keyring == nil {
+		return fmt.Errorf("store is not encrypted")
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.keyring.Save(master)
+}
+
+// RotateDataKey reseals all content, blobs and events under a new data key and then drops the old data keys,
+// values written before encryption was turned on are sealed too, the master key is needed to save the new key
+//
+// Older versions of the store still hold values sealed with the dropped keys so they can't be read after a rotation
+func (store *GravitonStore) RotateDataKey(master *encryption.MasterKey) (int, error) {
+	if store.keyring == nil {
+		return 0, fmt.Errorf("store is not encrypted")
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// The new key is saved before anything is sealed with it so an interrupted rotation can always be read and resumed
+	_, err := store.keyring.AddDataKey()
+	if err != nil {
+		return 0, err
+	}
+
+	err = store.keyring.Save(master)
+	if err != nil {
+		return 0, err
+	}
+
+	cipher, err := store.keyring.Cipher()
+	if err != nil {
+		return 0, err
+	}
+
+	store.cipher = cipher
+
+	masterBucketList, err := store.GetMasterBucketList("kinds")
+	if err != nil {
+		return 0, err
+	}
+
+	trees := []string{"content"}
+	for _, bucket := range masterBucketList {
+		if strings.HasPrefix(bucket, "kind") {
+			trees = append(trees, bucket)
+		}
+	}
+
+	resealed := 0
+
+	for _, name := range trees {
+		count, err := store.resealTree(name)
+		if err != nil {
+			return resealed, err
+		}
+
+		resealed += count
+	}
+
+	store.keyring.DropInactiveKeys()
+
+	err = store.keyring.Save(master)
+	if err != nil {
+		return resealed, err
+	}
+
+	log.Printf("Rotated the data key and resealed %d values\n", resealed)
+
+	return resealed, nil
+}
+
+// resealTree rewrites every value in the tree that isn't sealed with the active data key, the tree is read from one
+// snapshot and written to a separate copy that is committed in batches so large trees don't have to fit in one commit
+func (store *GravitonStore) resealTree(name string) (int, error) {
+	snapshot, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		return 0, err
+	}
+
+	source, err := snapshot.GetTree(name)
+	if err != nil {
+		return 0, err
+	}
+
+	target, err := snapshot.GetTree(name)
+	if err != nil {
+		return 0, err
+	}
+
+	resealed := 0
+	pending := 0
+
+	cursor := source.Cursor()
+	for key, value, err := cursor.First(); err == nil; key, value, err = cursor.Next() {
+		if store.cipher.Active(value) {
+			continue
+		}
+
+		opened, err := store.cipher.Open(key, value)
+		if err != nil {
+			return resealed, fmt.Errorf("failed to open %x in %s: %w", key, name, err)
+		}
+
+		sealed, err := store.cipher.Seal(key, opened)
+		if err != nil {
+			return resealed, err
+		}
+
+		err = target.Put(key, sealed)
+		if err != nil {
+			return resealed, err
+		}
+
+		resealed++
+		pending++
+
+		if pending >= rotationBatchSize {
+			if err := store.commit(target); err != nil {
+				return resealed, err
+			}
+
+			pending = 0
+		}
+	}
+
+	if pending > 0 {
+		if err := store.commit(target); err != nil {
+			return resealed, err
+		}
+	}
+
+	return resealed, nil
+}
@@ -0,0 +1,59 @@
+package graviton
+
+import (
+	"encoding/binary"
+
+	"github.com/deroproject/graviton"
+)
+
+// Expiring events (NIP-40) are recorded by id in the "expirations" tree, graviton keys are hashed so a sweep
+// has to walk the whole tree but it only ever holds the events that carry an expiration tag
+const expirationsTree = "expirations"
+
+func putExpiration(tree *graviton.Tree, id string, expiration int64) error {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(expiration))
+
+	return tree.Put([]byte(id), value)
+}
+
+// Expired returns the ids of the indexed events that expired at or before now
+func (index *eventIndex) Expired(now int64) ([]string, error) {
+	expired := []string{}
+
+	cursor := index.expirations.Cursor()
+	for key, value, err := cursor.First(); err == nil; key, value, err = cursor.Next() {
+		if len(value) == 8 && int64(binary.BigEndian.Uint64(value)) <= now {
+			expired = append(expired, string(key))
+		}
+	}
+
+	return expired, nil
+}
+
+// DeleteExpiredEvents deletes every event that expired at or before now from the store and the relay stats
+func (store *GravitonStore) DeleteExpiredEvents(now int64) (int, error) {
+	snapshot, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		return 0, err
+	}
+
+	index, err := loadEventIndex(snapshot, store.cipher)
+	if err != nil {
+		return 0, err
+	}
+
+	expired, err := index.Expired(now)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range expired {
+		err = store.DeleteEvent(id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), nil
+}
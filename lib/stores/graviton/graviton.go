@@ -1,21 +1,22 @@
 package graviton
 
 import (
-	"crypto/sha256"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"reflect"
-	"sort"
-	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/deroproject/graviton"
 	"github.com/fxamacker/cbor/v2"
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/spf13/viper"
 
+	"github.com/HORNET-Storage/hornet-storage/lib/encryption"
 	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
 	merkle_dag "github.com/HORNET-Storage/scionic-merkletree/dag"
 
@@ -27,15 +28,52 @@ import (
 type GravitonStore struct {
 	Database    *graviton.Store
 	CacheConfig map[string]string
+
+	// Counts over tag indexes larger than this are estimated from the sketches, zero uses approximateCountThreshold
+	ApproximateCountThreshold int64
+
+	// Event writes share the index trees and dag writes share the reference counts so they have to be serialized to avoid losing updates
+	mutex sync.Mutex
+
+	path string
+
+	// Content, blobs and events are sealed with the cipher when the store is opened with a master key, a nil cipher stores them as they are
+	keyring *encryption.Keyring
+	cipher  *encryption.Cipher
 }
 
 func (store *GravitonStore) InitStore(args ...interface{}) error {
-	db, err := graviton.NewDiskStore("gravitondb")
+	path := "gravitondb"
+
+	var master *encryption.MasterKey
+
+	store.CacheConfig = map[string]string{}
+	for _, arg := range args {
+		if cacheConfig, ok := arg.(map[string]string); ok {
+			store.CacheConfig = cacheConfig
+		} else if _path, ok := arg.(string); ok && _path != "" {
+			path = _path
+		} else if key, ok := arg.(*encryption.MasterKey); ok && key != nil {
+			master = key
+		}
+	}
+
+	db, err := graviton.NewDiskStore(path)
 	if err != nil {
 		return err
 	}
 
 	store.Database = db
+	store.path = path
+
+	if master != nil {
+		err = store.openKeyring(master)
+		if err != nil {
+			return err
+		}
+	} else if _, err := os.Stat(filepath.Join(path, keyringName)); err == nil {
+		return fmt.Errorf("store %s is encrypted and needs its master key", path)
+	}
 
 	snapshot, err := db.LoadSnapshot(0)
 	if err != nil {
@@ -47,16 +85,14 @@ func (store *GravitonStore) InitStore(args ...interface{}) error {
 		return err
 	}
 
-	_, err = graviton.Commit(tree)
+	err = store.commit(tree)
 	if err != nil {
 		return err
 	}
 
-	store.CacheConfig = map[string]string{}
-	for _, arg := range args {
-		if cacheConfig, ok := arg.(map[string]string); ok {
-			store.CacheConfig = cacheConfig
-		}
+	err = store.rebuildIndexes()
+	if err != nil {
+		return err
 	}
 
 	return nil
@@ -105,26 +141,31 @@ func (store *GravitonStore) QueryDag(filter map[string]string) ([]string, error)
 }
 
 func (store *GravitonStore) StoreLeaf(root string, leafData *types.DagLeafData) error {
+	return store.update(func(tx *transaction) error {
+		return store.storeLeaf(tx, root, leafData)
+	})
+}
+
+func (store *GravitonStore) storeLeaf(tx *transaction, root string, leafData *types.DagLeafData) error {
 	if leafData.Leaf.ContentHash != nil && leafData.Leaf.Content == nil {
 		return fmt.Errorf("leaf has content hash but no content")
 	}
 
-	snapshot, err := store.Database.LoadSnapshot(0)
-	if err != nil {
-		return err
-	}
-
-	var contentTree *graviton.Tree = nil
-
 	leafContentSize := len(hex.EncodeToString(leafData.Leaf.Content))
+	contentLength := int64(len(leafData.Leaf.Content))
 
 	if leafData.Leaf.Content != nil {
-		contentTree, err = snapshot.GetTree("content")
+		contentTree, err := tx.GetTree("content")
+		if err != nil {
+			return err
+		}
+
+		sealed, err := store.cipher.Seal(leafData.Leaf.ContentHash, leafData.Leaf.Content)
 		if err != nil {
 			return err
 		}
 
-		err = contentTree.Put(leafData.Leaf.ContentHash, leafData.Leaf.Content)
+		err = contentTree.Put(leafData.Leaf.ContentHash, sealed)
 		if err != nil {
 			return err
 		}
@@ -134,15 +175,19 @@ func (store *GravitonStore) StoreLeaf(root string, leafData *types.DagLeafData)
 
 	var rootLeaf *merkle_dag.DagLeaf
 
+	owner := leafData.PublicKey
+
 	if leafData.Leaf.Hash == root {
 		rootLeaf = &leafData.Leaf
 	} else {
-		_rootLeaf, err := store.RetrieveLeaf(root, root, false)
+		// Read through the transaction so leaves can be stored in the same batch as their root
+		_rootLeaf, err := loadLeaf(tx, root, root)
 		if err != nil {
 			return err
 		}
 
 		rootLeaf = &_rootLeaf.Leaf
+		owner = _rootLeaf.PublicKey
 	}
 
 	bucket := GetBucket(rootLeaf)
@@ -158,28 +203,49 @@ func (store *GravitonStore) StoreLeaf(root string, leafData *types.DagLeafData)
 
 	//log.Printf("Adding key to block database: %s\n", key)
 
-	tree, err := snapshot.GetTree(bucket)
+	tree, err := tx.GetTree(bucket)
 	if err != nil {
 		return err
 	}
 
+	refs, err := tx.GetTree(refsTree)
+	if err != nil {
+		return err
+	}
+
+	// Checked before the put since a leaf stored before reference counting must stay uncounted
+	uncounted := uncountedLeaf(tree, refs, bucket, key)
+
 	err = tree.Put([]byte(key), cborData)
 	if err != nil {
 		return err
 	}
 
-	trees := []*graviton.Tree{}
+	referenced, err := referenceLeaf(tx, root, bucket, leafData, uncounted)
+	if err != nil {
+		return err
+	}
 
-	trees = append(trees, tree)
+	// Leaves are only charged to the owner of the dag the first time they are stored for it
+	if referenced {
+		err = store.chargeLeaf(tx, root, owner, leafData.Leaf.Hash == root, contentLength)
+		if err != nil {
+			return err
+		}
+	}
 
 	if rootLeaf.Hash == leafData.Leaf.Hash {
-		indexTree, err := snapshot.GetTree("mbl")
+		indexTree, err := tx.GetTree("mbl")
 		if err != nil {
 			return err
 		}
 
 		indexTree.Put([]byte(root), []byte(bucket))
-		trees = append(trees, indexTree)
+
+		err = removeTombstone(tx, dagTombstoneKey(root))
+		if err != nil {
+			return err
+		}
 
 		if leafData.PublicKey != "" {
 			pubKey := leafData.PublicKey
@@ -188,20 +254,14 @@ func (store *GravitonStore) StoreLeaf(root string, leafData *types.DagLeafData)
 				pubKey = "npub1" + pubKey
 			}
 
-			_trees, err := store.cacheKey(pubKey, bucket, root)
-			if err == nil {
-				trees = append(trees, _trees...)
-			}
+			store.cacheKey(tx, pubKey, bucket, root)
 		}
 
 		if configKey, ok := store.CacheConfig[bucket]; ok {
 			cacheKey, ok := rootLeaf.AdditionalData[configKey]
 
 			if ok {
-				_trees, err := store.cacheKey(bucket, cacheKey, root)
-				if err == nil {
-					trees = append(trees, _trees...)
-				}
+				store.cacheKey(tx, bucket, cacheKey, root)
 			} else {
 				valueOfLeaf := reflect.ValueOf(rootLeaf)
 				value := valueOfLeaf.FieldByName(configKey)
@@ -209,136 +269,24 @@ func (store *GravitonStore) StoreLeaf(root string, leafData *types.DagLeafData)
 				if value.IsValid() && value.Kind() == reflect.String {
 					cacheKey := value.String()
 
-					_trees, err := store.cacheKey(bucket, cacheKey, root)
-					if err == nil {
-						trees = append(trees, _trees...)
-					}
+					store.cacheKey(tx, bucket, cacheKey, root)
 				}
 			}
 		}
 
-		// Store photo or video based on file extension if it's a root leaf
-		itemName := rootLeaf.ItemName
-		leafCount := rootLeaf.LeafCount
-		hash := rootLeaf.Hash
-
-		kindName := GetKindFromItemName(itemName)
-
-		ChunkSize := 2048 * 1024
-
-		var relaySettings types.RelaySettings
-		if err := viper.UnmarshalKey("relay_settings", &relaySettings); err != nil {
-			log.Fatalf("Error unmarshaling relay settings: %v", err)
-		}
-
-		var sizeMB float64
-		if leafCount > 0 {
-			sizeMB = float64(leafCount*ChunkSize) / (1024 * 1024) // Convert to MB
-		} else {
-			sizeBytes := leafContentSize
-			sizeMB = float64(sizeBytes) / (1024 * 1024) // Convert to MB
-		}
-
-		gormDB, err := InitGorm()
+		err = CheckLeafStats(rootLeaf)
 		if err != nil {
 			return err
 		}
 
-		mode := relaySettings.Mode
-
-		// Process file according to the mode (smart or unlimited)
-		if mode == "smart" {
-			// In smart mode, check if the file type is blocked
-			if contains(append(append(relaySettings.Photos, relaySettings.Videos...), relaySettings.Audio...), strings.ToLower(kindName)) {
-				return fmt.Errorf("file type not permitted: %s", kindName)
-			}
-
-			// Save the file under the correct category if not blocked
-			if contains(relaySettings.Photos, strings.ToLower(kindName)) {
-				photo := types.Photo{
-					Hash:      hash,
-					LeafCount: leafCount,
-					KindName:  kindName,
-					Size:      sizeMB,
-				}
-				gormDB.Create(&photo)
-			} else if contains(relaySettings.Videos, strings.ToLower(kindName)) {
-				video := types.Video{
-					Hash:      hash,
-					LeafCount: leafCount,
-					KindName:  kindName,
-					Size:      sizeMB,
-				}
-				gormDB.Create(&video)
-			} else if contains(relaySettings.Audio, strings.ToLower(kindName)) {
-				audio := types.Audio{
-					Hash:      hash,
-					LeafCount: leafCount,
-					KindName:  kindName,
-					Size:      sizeMB,
-				}
-				gormDB.Create(&audio)
-			} else {
-				// Save the file under Misc if it doesn't fall under any specific category
-				misc := types.Misc{
-					Hash:      hash,
-					LeafCount: leafCount,
-					KindName:  itemName,
-					Size:      sizeMB,
-				}
-				gormDB.Create(&misc)
-			}
-		} else if mode == "unlimited" {
-			// In unlimited mode, check if the file type is blocked
-			if contains(append(append(relaySettings.Photos, relaySettings.Videos...), relaySettings.Audio...), strings.ToLower(kindName)) {
-				return fmt.Errorf("blocked file type: %s", kindName)
-			}
+		statsLeaf := *rootLeaf
 
-			// Save the file under the correct category if not blocked
-			if contains(relaySettings.Photos, strings.ToLower(kindName)) {
-				photo := types.Photo{
-					Hash:      hash,
-					LeafCount: leafCount,
-					KindName:  kindName,
-					Size:      sizeMB,
-				}
-				gormDB.Create(&photo)
-			} else if contains(relaySettings.Videos, strings.ToLower(kindName)) {
-				video := types.Video{
-					Hash:      hash,
-					LeafCount: leafCount,
-					KindName:  kindName,
-					Size:      sizeMB,
-				}
-				gormDB.Create(&video)
-			} else if contains(relaySettings.Audio, strings.ToLower(kindName)) {
-				audio := types.Audio{
-					Hash:      hash,
-					LeafCount: leafCount,
-					KindName:  kindName,
-					Size:      sizeMB,
-				}
-				gormDB.Create(&audio)
-			} else {
-				// Save the file under Misc if it doesn't fall under any specific category
-				misc := types.Misc{
-					Hash:      hash,
-					LeafCount: leafCount,
-					KindName:  itemName,
-					Size:      sizeMB,
-				}
-				gormDB.Create(&misc)
+		tx.onCommit(func() {
+			err := StoreLeafStats(&statsLeaf, leafContentSize)
+			if err != nil {
+				log.Printf("Failed to store leaf stats: %v", err)
 			}
-		}
-	}
-
-	if contentTree != nil {
-		trees = append(trees, contentTree)
-	}
-
-	_, err = graviton.Commit(trees...)
-	if err != nil {
-		return err
+		})
 	}
 
 	return nil
@@ -355,7 +303,11 @@ func (store *GravitonStore) RetrieveLeafContent(contentHash []byte) ([]byte, err
 		return nil, err
 	}
 
-	contentTree, err := snapshot.GetTree("content")
+	return loadContent(snapshot, store.cipher, contentHash)
+}
+
+func loadContent(trees treeSource, cipher *encryption.Cipher, contentHash []byte) ([]byte, error) {
+	contentTree, err := trees.GetTree("content")
 	if err != nil {
 		return nil, err
 	}
@@ -366,7 +318,7 @@ func (store *GravitonStore) RetrieveLeafContent(contentHash []byte) ([]byte, err
 	}
 
 	if len(bytes) > 0 {
-		return bytes, nil
+		return cipher.Open(contentHash, bytes)
 	} else {
 		return nil, fmt.Errorf("content not found")
 	}
@@ -378,7 +330,11 @@ func (store *GravitonStore) retrieveBucket(root string) (string, error) {
 		return "", err
 	}
 
-	tree, err := snapshot.GetTree("mbl")
+	return retrieveBucket(snapshot, root)
+}
+
+func retrieveBucket(trees treeSource, root string) (string, error) {
+	tree, err := trees.GetTree("mbl")
 	if err != nil {
 		return "", err
 	}
@@ -392,19 +348,46 @@ func (store *GravitonStore) retrieveBucket(root string) (string, error) {
 }
 
 func (store *GravitonStore) RetrieveLeaf(root string, hash string, includeContent bool) (*types.DagLeafData, error) {
-	key := []byte(hash) // merkle_dag.GetHash(hash)
-
 	snapshot, err := store.Database.LoadSnapshot(0)
 	if err != nil {
 		return nil, err
 	}
 
-	bucket, err := store.retrieveBucket(root)
+	return retrieveLeaf(snapshot, store.cipher, root, hash, includeContent)
+}
+
+func retrieveLeaf(trees treeSource, cipher *encryption.Cipher, root string, hash string, includeContent bool) (*types.DagLeafData, error) {
+	data, err := loadLeaf(trees, root, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if includeContent && data.Leaf.ContentHash != nil {
+		//fmt.Println("Fetching  leaf content")
+
+		content, err := loadContent(trees, cipher, data.Leaf.ContentHash)
+		if err != nil {
+			return nil, err
+		}
+
+		data.Leaf.Content = content
+	}
+
+	//fmt.Println("Leaf found")
+
+	return data, nil
+}
+
+// loadLeaf reads a leaf record without its content
+func loadLeaf(trees treeSource, root string, hash string) (*types.DagLeafData, error) {
+	key := []byte(hash) // merkle_dag.GetHash(hash)
+
+	bucket, err := retrieveBucket(trees, root)
 	if err != nil {
 		return nil, err
 	}
 
-	tree, err := snapshot.GetTree(bucket)
+	tree, err := trees.GetTree(bucket)
 	if err != nil {
 		return nil, err
 	}
@@ -422,19 +405,6 @@ func (store *GravitonStore) RetrieveLeaf(root string, hash string, includeConten
 		return nil, err
 	}
 
-	if includeContent && data.Leaf.ContentHash != nil {
-		//fmt.Println("Fetching  leaf content")
-
-		content, err := store.RetrieveLeafContent(data.Leaf.ContentHash)
-		if err != nil {
-			return nil, err
-		}
-
-		data.Leaf.Content = content
-	}
-
-	//fmt.Println("Leaf found")
-
 	return data, nil
 }
 
@@ -448,114 +418,136 @@ func (store *GravitonStore) StoreDag(dag *types.DagData) error {
 
 func (store *GravitonStore) QueryEvents(filter nostr.Filter) ([]*nostr.Event, error) {
 	log.Println("Processing filter:", filter)
-	var events []*nostr.Event
+	events := []*nostr.Event{}
 
-	snapshot, err := store.Database.LoadSnapshot(0)
+	err := store.IterateEvents(context.Background(), filter, func(event *nostr.Event) bool {
+		events = append(events, event)
+		return true
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	masterBucketList, err := store.GetMasterBucketList("kinds")
+	log.Println("Found", len(events), "matching events")
+	return events, nil
+}
+
+func (store *GravitonStore) IterateEvents(ctx context.Context, filter nostr.Filter, yield func(event *nostr.Event) bool) error {
+	snapshot, err := store.Database.LoadSnapshot(0)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Convert search term to lowercase for case-insensitive comparison
-	searchTerm := strings.ToLower(filter.Search)
-
-	for _, bucket := range masterBucketList {
-		if strings.HasPrefix(bucket, "kind") {
-			tree, err := snapshot.GetTree(bucket)
-			if err != nil {
-				continue // Skip this bucket if there's an error
-			}
+	return iterateEvents(ctx, snapshot, store.cipher, filter, yield)
+}
 
-			c := tree.Cursor()
-			for _, v, err := c.First(); err == nil; _, v, err = c.Next() {
-				var event nostr.Event
-				if err := jsoniter.Unmarshal(v, &event); err != nil {
-					continue // Skip on unmarshal error
-				}
+func iterateEvents(ctx context.Context, snapshot treeSource, cipher *encryption.Cipher, filter nostr.Filter, yield func(event *nostr.Event) bool) error {
+	index, err := loadEventIndex(snapshot, cipher)
+	if err != nil {
+		return err
+	}
 
-				// Step 1: Check if the event matches the filter criteria, including kind
-				if !filter.Matches(&event) {
-					continue
-				}
+	// The planner walks the narrowest index in created_at order so since, until and limit stop early
+	return stores.QueryIndexes(ctx, index, filter, yield)
+}
 
-				// Step 2: Implement search logic here, after ensuring the event matches the filter
-				if searchTerm != "" && !strings.Contains(strings.ToLower(event.Content), searchTerm) {
-					continue // If the lowercase content doesn't contain the lowercase search term, skip
-				}
+func (store *GravitonStore) CountEvents(filters ...nostr.Filter) (int64, error) {
+	snapshot, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		return 0, err
+	}
 
-				// If the event passes both the filter and search, add it to the results
-				events = append(events, &event)
-			}
-		}
+	index, err := loadEventIndex(snapshot, store.cipher)
+	if err != nil {
+		return 0, err
 	}
 
-	// Sort the events based on creation time, most recent first
-	sort.Slice(events, func(i, j int) bool {
-		return events[i].CreatedAt > events[j].CreatedAt
-	})
+	return stores.CountIndexes(index, filters...)
+}
 
-	// Step 3: Apply the limit, if specified
-	if filter.Limit > 0 && len(events) > filter.Limit {
-		events = events[:filter.Limit]
+// EstimateEvents merges the sketches of every filter so an event matching more than one is only counted once, sketches
+// keep counting expired events until the sweeper deletes them so the estimate relies on it rather than loading them
+func (store *GravitonStore) EstimateEvents(filters ...nostr.Filter) (int64, bool, error) {
+	threshold := store.ApproximateCountThreshold
+	if threshold <= 0 {
+		threshold = approximateCountThreshold
 	}
 
-	log.Println("Found", len(events), "matching events")
-	return events, nil
-}
+	// Sketches are rebuilt the first time they are needed after losing an event so later estimates can use them,
+	// an event removed again in the meantime leaves the count to be made exactly
+	for attempt := 0; ; attempt++ {
+		snapshot, err := store.Database.LoadSnapshot(0)
+		if err != nil {
+			return 0, false, err
+		}
 
-// func (store *GravitonStore) QueryEvents(filter nostr.Filter) ([]*nostr.Event, error) {
-// 	//log.Println("Processing filter:", filter)
+		index, err := loadEventIndex(snapshot, store.cipher)
+		if err != nil {
+			return 0, false, err
+		}
 
-// 	var events []*nostr.Event
+		merged, ok, err := index.estimateFilters(filters, threshold)
+		if errors.Is(err, errStaleSketch) {
+			if attempt > 0 {
+				return 0, false, nil
+			}
 
-// 	snapshot, err := store.Database.LoadSnapshot(0)
-// 	if err != nil {
-// 		return nil, err
-// 	}
+			if err := store.resketch(filters); err != nil {
+				return 0, false, err
+			}
 
-// 	masterBucketList, err := store.GetMasterBucketList("kinds")
-// 	if err != nil {
-// 		return nil, err
-// 	}
+			continue
+		}
 
-// 	for _, bucket := range masterBucketList {
-// 		if strings.HasPrefix(bucket, "kind") {
-// 			tree, err := snapshot.GetTree(bucket)
-// 			if err == nil {
-// 				c := tree.Cursor()
+		if err != nil || !ok {
+			return 0, false, err
+		}
 
-// 				for _, v, err := c.First(); err == nil; _, v, err = c.Next() {
-// 					var event nostr.Event
-// 					if err := jsoniter.Unmarshal(v, &event); err != nil {
-// 						continue
-// 					}
+		return merged.Estimate(), true, nil
+	}
+}
 
-// 					if filter.Matches(&event) {
-// 						events = append(events, &event)
-// 					}
-// 				}
-// 			}
-// 		}
-// 	}
+// resketch rebuilds the stale sketches the filters' estimate needs
+func (store *GravitonStore) resketch(filters []nostr.Filter) error {
+	return store.update(func(tx *transaction) error {
+		index, err := loadEventIndex(tx, store.cipher)
+		if err != nil {
+			return err
+		}
 
-// 	sort.Slice(events, func(i, j int) bool {
-// 		return events[i].CreatedAt > events[j].CreatedAt
-// 	})
+		for _, filter := range filters {
+			for name, values := range filter.Tags {
+				for _, value := range values {
+					key := stores.TagIndexKey(name, value)
 
-// 	if filter.Limit > 0 && len(events) > filter.Limit {
-// 		events = events[:filter.Limit]
-// 	}
+					for _, kind := range filter.Kinds {
+						if !index.stale(key, kind) {
+							continue
+						}
 
-// 	//log.Println("Found", len(events), "matching events")
+						if err := index.resketch(key, kind); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
 
-// 	return events, nil
-// }
+		return nil
+	})
+}
 
 func (store *GravitonStore) StoreEvent(event *nostr.Event) error {
+	return store.update(func(tx *transaction) error {
+		return store.storeEvent(tx, event)
+	})
+}
+
+func (store *GravitonStore) storeEvent(tx *transaction, event *nostr.Event) error {
+	if stores.IsEphemeralKind(event.Kind) {
+		return stores.ErrEphemeral
+	}
+
 	eventData, err := jsoniter.Marshal(event)
 	if err != nil {
 		return err
@@ -563,18 +555,65 @@ func (store *GravitonStore) StoreEvent(event *nostr.Event) error {
 
 	bucket := fmt.Sprintf("kind:%d", event.Kind)
 
-	trees := []*graviton.Tree{}
+	index, err := loadEventIndex(tx, store.cipher)
+	if err != nil {
+		return err
+	}
+
+	tree, err := index.bucket(bucket)
+	if err != nil {
+		return err
+	}
 
-	ss, _ := store.Database.LoadSnapshot(0)
-	tree, _ := ss.GetTree(bucket)
+	// Events are immutable so an event that is already stored is left as it is
+	if index.has(event.ID) {
+		return stores.ErrDuplicate
+	}
 
-	trees = append(trees, tree)
+	usage, err := tx.GetTree(usageTree)
+	if err != nil {
+		return err
+	}
 
-	if strings.HasPrefix(event.PubKey, "npub") {
-		_trees, err := store.cacheKey(event.PubKey, bucket, event.ID)
-		if err == nil {
-			trees = append(trees, _trees...)
+	// Replaceable and addressable events only keep their newest version, older versions are rejected
+	replaced, err := index.current(event)
+	if err != nil {
+		return err
+	}
+
+	if replaced != nil {
+		if !stores.IsNewerVersion(event, replaced) {
+			return stores.ErrSuperseded
+		}
+
+		// Every version shares the kind so the replaced event lives in the same bucket tree
+		err = removeEvent(index, usage, replaced, event)
+		if err != nil {
+			return err
 		}
+
+		tx.onCommit(func() {
+			DeleteEventStats(replaced.ID)
+		})
+	}
+
+	err = addUsage(usage, event.PubKey, stores.EventSize(event), 1)
+	if err != nil {
+		return err
+	}
+
+	err = index.add(event, bucket)
+	if err != nil {
+		return err
+	}
+
+	err = removeTombstone(tx, eventTombstoneKey(event.ID))
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(event.PubKey, "npub") {
+		store.cacheKey(tx, event.PubKey, bucket, event.ID)
 	}
 
 	if configKey, ok := store.CacheConfig[bucket]; ok {
@@ -584,45 +623,37 @@ func (store *GravitonStore) StoreEvent(event *nostr.Event) error {
 		if value.IsValid() && value.Kind() == reflect.String {
 			cacheKey := value.String()
 
-			_trees, err := store.cacheKey(bucket, cacheKey, event.ID)
-			if err == nil {
-				trees = append(trees, _trees...)
-			}
-
+			store.cacheKey(tx, bucket, cacheKey, event.ID)
 		}
 	}
 
-	err = tree.Put([]byte(event.ID), eventData)
+	sealed, err := store.cipher.Seal([]byte(event.ID), eventData)
 	if err != nil {
 		return err
 	}
 
-	masterBucketListTree, err := store.UpdateMasterBucketList("kinds", bucket)
+	err = tree.Put([]byte(event.ID), sealed)
 	if err != nil {
 		return err
 	}
 
-	if masterBucketListTree != nil {
-		trees = append(trees, masterBucketListTree)
-	}
-
-	_, err = graviton.Commit(trees...)
+	err = updateMasterBucketList(tx, "kinds", bucket)
 	if err != nil {
 		return err
 	}
 
 	// Store event in Gorm SQLite database
-	storeInGorm(event)
+	tx.onCommit(func() {
+		storeInGorm(event)
+	})
 
 	return nil
 }
 
-func (store *GravitonStore) UpdateMasterBucketList(key string, bucket string) (*graviton.Tree, error) {
-	snapshot, _ := store.Database.LoadSnapshot(0)
-
-	tree, err := snapshot.GetTree("mbl")
+func updateMasterBucketList(trees treeSource, key string, bucket string) error {
+	tree, err := trees.GetTree("mbl")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	var masterBucketList []string
@@ -633,27 +664,22 @@ func (store *GravitonStore) UpdateMasterBucketList(key string, bucket string) (*
 	} else {
 		err = cbor.Unmarshal(bytes, &masterBucketList)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
 	if contains(masterBucketList, bucket) {
-		return nil, nil
-	} else {
-		masterBucketList = append(masterBucketList, bucket)
+		return nil
+	}
 
-		bytes, err = cbor.Marshal(masterBucketList)
-		if err != nil {
-			return nil, err
-		}
+	masterBucketList = append(masterBucketList, bucket)
 
-		err = tree.Put([]byte(fmt.Sprintf("mbl_%s", key)), bytes)
-		if err != nil {
-			return nil, err
-		}
+	bytes, err = cbor.Marshal(masterBucketList)
+	if err != nil {
+		return err
 	}
 
-	return tree, nil
+	return tree.Put([]byte(fmt.Sprintf("mbl_%s", key)), bytes)
 }
 
 func (store *GravitonStore) GetMasterBucketList(key string) ([]string, error) {
@@ -680,54 +706,71 @@ func (store *GravitonStore) GetMasterBucketList(key string) ([]string, error) {
 }
 
 func (store *GravitonStore) DeleteEvent(eventID string) error {
-	snapshot, err := store.Database.LoadSnapshot(0)
-	if err != nil {
-		return err
-	}
+	return store.update(func(tx *transaction) error {
+		index, err := loadEventIndex(tx, store.cipher)
+		if err != nil {
+			return err
+		}
 
-	event, err := store.QueryEvents(nostr.Filter{IDs: []string{eventID}})
-	if err != nil {
-		return err
-	}
+		event, err := index.Lookup(eventID)
+		if err != nil {
+			return err
+		}
 
-	// event kind number is an integer
-	kindInt, _ := strconv.ParseInt(fmt.Sprintf("%d", event[0].Kind), 10, 64)
+		if event == nil {
+			return fmt.Errorf("event not found: %s", eventID)
+		}
 
-	bucket := fmt.Sprintf("kind:%d", kindInt)
+		usage, err := tx.GetTree(usageTree)
+		if err != nil {
+			return err
+		}
 
-	tree, err := snapshot.GetTree(bucket)
-	if err == nil {
-		err := tree.Delete([]byte(eventID))
+		err = removeEvent(index, usage, event, nil)
 		if err != nil {
 			return err
-		} else {
-			log.Println("Deleted event", eventID)
 		}
 
-	}
-	graviton.Commit(tree)
+		err = addTombstone(tx, eventTombstoneKey(eventID))
+		if err != nil {
+			return err
+		}
 
-	gormDB, err := InitGorm()
+		tx.onCommit(func() {
+			log.Println("Deleted event", eventID)
+
+			// Delete event from Gorm SQLite database
+			DeleteEventStats(eventID)
+		})
+
+		return nil
+	})
+}
+
+// removeEvent deletes an event from its kind bucket, the indexes and its author's usage, the caller commits the trees,
+// replacement is the newer version taking its place when a replaceable or addressable event is replaced
+func removeEvent(index *eventIndex, usage *graviton.Tree, event *nostr.Event, replacement *nostr.Event) error {
+	tree, err := index.bucket(fmt.Sprintf("kind:%d", event.Kind))
 	if err != nil {
 		return err
 	}
 
-	// Delete event from Gorm SQLite database
-	gormDB.Delete(&types.Kind{}, "event_id = ?", eventID)
-
-	return nil
-}
+	err = tree.Delete([]byte(event.ID))
+	if err != nil {
+		return err
+	}
 
-func (store *GravitonStore) cacheKey(bucket string, key string, root string) ([]*graviton.Tree, error) {
-	snapshot, err := store.Database.LoadSnapshot(0)
+	err = index.delete(event, replacement)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	trees := []*graviton.Tree{}
+	return addUsage(usage, event.PubKey, -stores.EventSize(event), -1)
+}
 
+func (store *GravitonStore) cacheKey(trees treeSource, bucket string, key string, root string) {
 	if strings.HasPrefix(bucket, "npub") {
-		userTree, err := snapshot.GetTree(bucket)
+		userTree, err := trees.GetTree(bucket)
 		if err == nil {
 			value, err := userTree.Get([]byte(key))
 
@@ -741,8 +784,6 @@ func (store *GravitonStore) cacheKey(bucket string, key string, root string) ([]
 					serializedData, err := cbor.Marshal(cacheData)
 					if err == nil {
 						userTree.Put([]byte(key), serializedData)
-
-						trees = append(trees, userTree)
 					}
 				}
 			} else {
@@ -753,27 +794,16 @@ func (store *GravitonStore) cacheKey(bucket string, key string, root string) ([]
 				serializedData, err := cbor.Marshal(cacheData)
 				if err == nil {
 					userTree.Put([]byte(key), serializedData)
-
-					trees = append(trees, userTree)
 				}
 			}
 
 		}
 
-		/*
-			masterBucketListTree, err := store.UpdateMasterBucketList("npubs", bucket)
-			if err != nil {
-				return trees, nil
-			}
-
-			if masterBucketListTree != nil {
-				trees = append(trees, masterBucketListTree)
-			}
-		*/
+		//updateMasterBucketList(trees, "npubs", bucket)
 	} else if _, ok := store.CacheConfig[bucket]; ok {
 		cacheBucket := fmt.Sprintf("cache:%s", bucket)
 
-		cacheTree, err := snapshot.GetTree(cacheBucket)
+		cacheTree, err := trees.GetTree(cacheBucket)
 		if err == nil {
 			value, err := cacheTree.Get([]byte(key))
 
@@ -787,8 +817,6 @@ func (store *GravitonStore) cacheKey(bucket string, key string, root string) ([]
 					serializedData, err := cbor.Marshal(cacheData)
 					if err == nil {
 						cacheTree.Put([]byte(key), serializedData)
-
-						trees = append(trees, cacheTree)
 					}
 				}
 			} else {
@@ -799,25 +827,12 @@ func (store *GravitonStore) cacheKey(bucket string, key string, root string) ([]
 				serializedData, err := cbor.Marshal(cacheData)
 				if err == nil {
 					cacheTree.Put([]byte(key), serializedData)
-
-					trees = append(trees, cacheTree)
 				}
 			}
 		}
 
-		/*
-			masterBucketListTree, err := store.UpdateMasterBucketList("scionic", bucket)
-			if err != nil {
-				return trees, nil
-			}
-
-			if masterBucketListTree != nil {
-				trees = append(trees, masterBucketListTree)
-			}
-		*/
+		//updateMasterBucketList(trees, "scionic", bucket)
 	}
-
-	return trees, nil
 }
 
 func (store *GravitonStore) CountFileLeavesByType() (map[string]int, error) {
@@ -860,38 +875,154 @@ func (store *GravitonStore) CountFileLeavesByType() (map[string]int, error) {
 }
 
 func (store *GravitonStore) StoreBlob(data []byte, contentType string, publicKey string) (*types.BlobDescriptor, error) {
-	snapshot, _ := store.Database.LoadSnapshot(0)
-	blossomTree, _ := snapshot.GetTree("blossom")
-	contentTree, _ := snapshot.GetTree("content")
+	var descriptor *types.BlobDescriptor
+
+	err := store.update(func(tx *transaction) error {
+		var err error
+
+		descriptor, err = store.storeBlob(tx, data, contentType, publicKey)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	hash := sha256.Sum256(data)
-	encodedHash := hex.EncodeToString(hash[:])
+	return descriptor, nil
+}
+
+func (store *GravitonStore) storeBlob(tx *transaction, data []byte, contentType string, publicKey string) (*types.BlobDescriptor, error) {
+	descriptor := stores.NewBlobDescriptor(data, contentType)
 
-	descriptor := types.BlobDescriptor{
-		URL:      fmt.Sprintf("/%s", encodedHash),
-		SHA256:   encodedHash,
-		Size:     int64(len(data)),
-		Type:     contentType,
-		Uploaded: time.Now().Unix(),
+	err := store.indexBlob(tx, descriptor, publicKey)
+	if err != nil {
+		return nil, err
 	}
 
-	cacheTrees, err := store.cacheKey(publicKey, "blossom", encodedHash)
+	contentTree, err := tx.GetTree("content")
 	if err != nil {
 		return nil, err
 	}
 
+	hash, err := hex.DecodeString(descriptor.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := store.cipher.Seal(hash, data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = contentTree.Put(hash, sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	return &descriptor, nil
+}
+
+// IndexBlob records a blob whose content is kept outside of the store
+func (store *GravitonStore) IndexBlob(descriptor types.BlobDescriptor, publicKey string) error {
+	descriptor.External = true
+
+	return store.update(func(tx *transaction) error {
+		return store.indexBlob(tx, descriptor, publicKey)
+	})
+}
+
+// indexBlob records the descriptor and owner of a blob and charges new blobs to the owner, a blob already held in the
+// content tree keeps its stored descriptor so indexing it again never orphans its content
+func (store *GravitonStore) indexBlob(tx *transaction, descriptor types.BlobDescriptor, publicKey string) error {
+	blossomTree, err := tx.GetTree("blossom")
+	if err != nil {
+		return err
+	}
+
+	hash, err := hex.DecodeString(descriptor.SHA256)
+	if err != nil {
+		return err
+	}
+
+	if publicKey != "" {
+		err := store.blobOwner(tx, publicKey, descriptor.SHA256)
+		if err != nil {
+			return err
+		}
+	}
+
+	if existing, err := blossomTree.Get(hash); err == nil {
+		var stored types.BlobDescriptor
+		if err := cbor.Unmarshal(existing, &stored); err == nil && !stored.External && descriptor.External {
+			return nil
+		}
+	} else {
+		// Blobs share the content tree with dag leaves so each new stored blob holds a reference to its content
+		if !descriptor.External {
+			refs, err := tx.GetTree(refsTree)
+			if err != nil {
+				return err
+			}
+
+			_, err = addRef(refs, hash, 1)
+			if err != nil {
+				return err
+			}
+		}
+
+		usage, err := tx.GetTree(usageTree)
+		if err != nil {
+			return err
+		}
+
+		err = addUsage(usage, publicKey, descriptor.Size, 1)
+		if err != nil {
+			return err
+		}
+
+		if publicKey != "" {
+			err = putUsageRecord(usage, blobUsageKey(descriptor.SHA256), &types.UsageRecord{PublicKey: publicKey, Bytes: descriptor.Size})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	serializedDescriptor, err := cbor.Marshal(descriptor)
+	if err != nil {
+		return err
+	}
+
+	return blossomTree.Put(hash, serializedDescriptor)
+}
+
+// GetBlobDescriptor returns the descriptor of a stored or indexed blob
+func (store *GravitonStore) GetBlobDescriptor(hash string) (*types.BlobDescriptor, error) {
+	snapshot, err := store.Database.LoadSnapshot(0)
 	if err != nil {
 		return nil, err
 	}
 
-	blossomTree.Put(hash[:], serializedDescriptor)
-	contentTree.Put(hash[:], data)
+	blossomTree, err := snapshot.GetTree("blossom")
+	if err != nil {
+		return nil, err
+	}
 
-	cacheTrees = append(cacheTrees, blossomTree)
-	cacheTrees = append(cacheTrees, contentTree)
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, err
+	}
 
-	graviton.Commit(cacheTrees...)
+	serializedDescriptor, err := blossomTree.Get(hashBytes)
+	if err != nil {
+		return nil, fmt.Errorf("blob not found: %s", hash)
+	}
+
+	var descriptor types.BlobDescriptor
+	err = cbor.Unmarshal(serializedDescriptor, &descriptor)
+	if err != nil {
+		return nil, err
+	}
 
 	return &descriptor, nil
 }
@@ -922,76 +1053,138 @@ func (store *GravitonStore) GetBlob(hash string) ([]byte, *string, error) {
 		return nil, nil, err
 	}
 
+	content, err = store.cipher.Open(hashBytes, content)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	return content, &descriptor.Type, nil
 }
 
 func (store *GravitonStore) DeleteBlob(hash string) error {
-	snapshot, _ := store.Database.LoadSnapshot(0)
-	blossomTree, _ := snapshot.GetTree("blossom")
-	contentTree, _ := snapshot.GetTree("content")
-
 	hashBytes, err := hex.DecodeString(hash)
 	if err != nil {
 		return err
 	}
 
-	blossomTree.Delete(hashBytes)
-	contentTree.Delete(hashBytes)
+	return store.update(func(tx *transaction) error {
+		blossomTree, _ := tx.GetTree("blossom")
+		contentTree, _ := tx.GetTree("content")
+		refs, _ := tx.GetTree(refsTree)
 
-	graviton.Commit(blossomTree, contentTree)
+		serializedDescriptor, err := blossomTree.Get(hashBytes)
+		if err != nil {
+			return fmt.Errorf("blob not found: %s", hash)
+		}
 
-	return nil
+		var descriptor types.BlobDescriptor
+		err = cbor.Unmarshal(serializedDescriptor, &descriptor)
+		if err != nil {
+			return err
+		}
+
+		blossomTree.Delete(hashBytes)
+
+		usage, _ := tx.GetTree(usageTree)
+
+		err = releaseUsageRecord(usage, blobUsageKey(hash))
+		if err != nil {
+			return err
+		}
+
+		// External blobs never had content in the store to release
+		if descriptor.External {
+			return nil
+		}
+
+		// Content that is reference counted may still be used by a dag so it is left for CollectGarbage
+		if _, counted := getRef(refs, hashBytes); counted {
+			_, err = addRef(refs, hashBytes, -1)
+			if err != nil {
+				return err
+			}
+		} else {
+			contentTree.Delete(hashBytes)
+		}
+
+		return nil
+	})
+}
+
+// blobOwner adds a blob to the list of blobs uploaded by the public key, the list lives in the
+// owner's own tree so that npub keyed owners share it with their dag cache entries
+func (store *GravitonStore) blobOwner(trees treeSource, publicKey string, hash string) error {
+	userTree, err := trees.GetTree(publicKey)
+	if err != nil {
+		return err
+	}
+
+	var cacheData *types.CacheData = &types.CacheData{Keys: []string{}}
+
+	value, err := userTree.Get([]byte("blossom"))
+	if err == nil && value != nil {
+		err = cbor.Unmarshal(value, cacheData)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !contains(cacheData.Keys, hash) {
+		cacheData.Keys = append(cacheData.Keys, hash)
+	}
+
+	serializedData, err := cbor.Marshal(cacheData)
+	if err != nil {
+		return err
+	}
+
+	return userTree.Put([]byte("blossom"), serializedData)
 }
 
 func (store *GravitonStore) ListBlobs(pubkey string, since, until int64) ([]types.BlobDescriptor, error) {
-	snapshot, _ := store.Database.LoadSnapshot(0)
-	blossomTree, _ := snapshot.GetTree("blossom")
-	cursor := blossomTree.Cursor()
+	snapshot, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		return nil, err
+	}
+
+	blossomTree, err := snapshot.GetTree("blossom")
+	if err != nil {
+		return nil, err
+	}
 
 	results := []types.BlobDescriptor{}
 
 	userTree, err := snapshot.GetTree(pubkey)
-	if err == nil {
-		value, err := userTree.Get([]byte("blossom"))
-
-		if err == nil && value != nil {
-			var cacheData *types.CacheData = &types.CacheData{}
+	if err != nil {
+		return results, nil
+	}
 
-			err = cbor.Unmarshal(value, cacheData)
-			if err == nil {
-				for _, key := range cacheData.Keys {
-					hashBytes, err := hex.DecodeString(key)
-					if err != nil {
-						return nil, err
-					}
+	value, err := userTree.Get([]byte("blossom"))
+	if err != nil || value == nil {
+		return results, nil
+	}
 
-					serializedDescriptor, err := blossomTree.Get(hashBytes)
-					if err != nil {
-						return nil, err
-					}
+	var cacheData *types.CacheData = &types.CacheData{}
 
-					var descriptor types.BlobDescriptor
-					err = cbor.Unmarshal(serializedDescriptor, &descriptor)
-					if err != nil {
-						return nil, err
-					}
+	err = cbor.Unmarshal(value, cacheData)
+	if err != nil {
+		return nil, err
+	}
 
-					if descriptor.Uploaded >= since && descriptor.Uploaded <= until {
-						results = append(results, descriptor)
-					}
-				}
-			}
+	for _, key := range cacheData.Keys {
+		hashBytes, err := hex.DecodeString(key)
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	_, value, cursorErr := cursor.First()
-	for {
-		if cursorErr == nil {
-			break
+		// Deleted blobs are left in the owner's list so missing descriptors are skipped
+		serializedDescriptor, err := blossomTree.Get(hashBytes)
+		if err != nil {
+			continue
 		}
 
 		var descriptor types.BlobDescriptor
-		err := cbor.Unmarshal(value, &descriptor)
+		err = cbor.Unmarshal(serializedDescriptor, &descriptor)
 		if err != nil {
 			return nil, err
 		}
@@ -999,8 +1192,6 @@ func (store *GravitonStore) ListBlobs(pubkey string, since, until int64) ([]type
 		if descriptor.Uploaded >= since && descriptor.Uploaded <= until {
 			results = append(results, descriptor)
 		}
-
-		_, value, cursorErr = cursor.Next()
 	}
 
 	return results, nil
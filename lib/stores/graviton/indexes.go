@@ -0,0 +1,810 @@
+package graviton
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/deroproject/graviton"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/nbd-wtf/go-nostr"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/HORNET-Storage/hornet-storage/lib/encryption"
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+	"github.com/HORNET-Storage/hornet-storage/lib/stores/hyperloglog"
+)
+
+const (
+	indexTreeName = "idx"
+	idsTreeName   = "ids"
+
+	// Bump this to force the indexes to be rebuilt from the kind buckets on startup
+	indexVersion = "6"
+
+	// Entries of an index key are split into trees covering this many seconds each, a query walks the trees of a key
+	// newest first so limit, since and until stop early while a single tree stays small enough to sort in memory
+	indexBucketSeconds = 1 << 16
+
+	// Number of events indexed per commit while rebuilding
+	indexRebuildBatchSize = 1000
+
+	// Counts over tag indexes larger than this are estimated from the sketches when approximate counts are acceptable,
+	// stores can set their own threshold
+	approximateCountThreshold = 10000
+)
+
+// Tags that get a cardinality sketch per tag value and kind, these back follower, reaction and reply counts
+var sketchedTags = []string{"p", "e"}
+
+// Graviton hashes its keys so a cursor walks a tree in no particular order, every index key therefore gets a tree per
+// time bucket holding one key per entry, the inverted created_at followed by the id as in the bbolt index, and a tree
+// listing its buckets. The trees are named after the index generation so a rebuild starts from empty trees
+type eventIndex struct {
+	snapshot    treeSource
+	cipher      *encryption.Cipher
+	tree        *graviton.Tree
+	ids         *graviton.Tree
+	expirations *graviton.Tree
+	buckets     map[string]*graviton.Tree
+	generation  uint64
+	keyTrees    map[string]*graviton.Tree
+}
+
+func loadEventIndex(snapshot treeSource, cipher *encryption.Cipher) (*eventIndex, error) {
+	tree, err := snapshot.GetTree(indexTreeName)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := snapshot.GetTree(idsTreeName)
+	if err != nil {
+		return nil, err
+	}
+
+	expirations, err := snapshot.GetTree(expirationsTree)
+	if err != nil {
+		return nil, err
+	}
+
+	return &eventIndex{
+		snapshot:    snapshot,
+		cipher:      cipher,
+		tree:        tree,
+		ids:         ids,
+		expirations: expirations,
+		buckets:     map[string]*graviton.Tree{},
+		generation:  indexGeneration(tree),
+		keyTrees:    map[string]*graviton.Tree{},
+	}, nil
+}
+
+func indexGeneration(tree *graviton.Tree) uint64 {
+	bytes, err := tree.Get([]byte("generation"))
+	if err != nil || len(bytes) != 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(bytes)
+}
+
+func countKey(key string) []byte {
+	return []byte(fmt.Sprintf("n:%s", key))
+}
+
+func sketchKey(key string, kind int) []byte {
+	return []byte(fmt.Sprintf("h:%s:%d", key, kind))
+}
+
+// Sketches that have lost an event are marked stale, a sketch can't forget an identity so it would keep counting it
+func staleKey(key string, kind int) []byte {
+	return []byte(fmt.Sprintf("x:%s:%d", key, kind))
+}
+
+func replaceableKey(key string) []byte {
+	return []byte(fmt.Sprintf("r:%s", key))
+}
+
+// Tag values can be longer than a tree name may be so index keys are hashed into the names of their trees
+func (index *eventIndex) treeName(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("i%d:%x", index.generation, hash[:16])
+}
+
+func (index *eventIndex) bucketTreeName(key string, bucket int64) string {
+	return fmt.Sprintf("%s:%d", index.treeName(key), bucket)
+}
+
+func entryBucket(createdAt int64) int64 {
+	if createdAt < 0 {
+		return (createdAt+1)/indexBucketSeconds - 1
+	}
+
+	return createdAt / indexBucketSeconds
+}
+
+func uint64Value(value uint64) []byte {
+	buffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(buffer, value)
+	return buffer
+}
+
+func entryKey(entry stores.IndexEntry) []byte {
+	buffer := make([]byte, 8, 8+len(entry.ID))
+	binary.BigEndian.PutUint64(buffer, uint64(math.MaxInt64-entry.CreatedAt))
+	return append(buffer, entry.ID...)
+}
+
+func parseEntryKey(key []byte, value []byte) stores.IndexEntry {
+	kind, _ := binary.Varint(value)
+
+	return stores.IndexEntry{
+		CreatedAt: math.MaxInt64 - int64(binary.BigEndian.Uint64(key[:8])),
+		ID:        string(key[8:]),
+		Kind:      int(kind),
+	}
+}
+
+func kindValue(kind int) []byte {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	return buffer[:binary.PutVarint(buffer, int64(kind))]
+}
+
+// keyTree hands out one copy of each index key tree so writes made through the index are all committed with it
+func (index *eventIndex) keyTree(name string) (*graviton.Tree, error) {
+	if tree, ok := index.keyTrees[name]; ok {
+		return tree, nil
+	}
+
+	tree, err := index.snapshot.GetTree(name)
+	if err != nil {
+		return nil, err
+	}
+
+	index.keyTrees[name] = tree
+
+	return tree, nil
+}
+
+func (index *eventIndex) trees() []*graviton.Tree {
+	trees := []*graviton.Tree{index.tree, index.ids, index.expirations}
+	for _, tree := range index.keyTrees {
+		trees = append(trees, tree)
+	}
+
+	return trees
+}
+
+func (index *eventIndex) adjustCount(key string, delta int64) error {
+	count := index.Estimate(key) + delta
+	if count <= 0 {
+		return index.tree.Delete(countKey(key))
+	}
+
+	return index.tree.Put(countKey(key), uint64Value(uint64(count)))
+}
+
+func empty(tree *graviton.Tree) bool {
+	cursor := tree.Cursor()
+	_, _, err := cursor.First()
+	return err != nil
+}
+
+func (index *eventIndex) insert(key string, entry stores.IndexEntry) error {
+	bucket := entryBucket(entry.CreatedAt)
+
+	tree, err := index.keyTree(index.bucketTreeName(key, bucket))
+	if err != nil {
+		return err
+	}
+
+	if bytes, err := tree.Get(entryKey(entry)); err == nil && bytes != nil {
+		return nil
+	}
+
+	// The bucket is only listed under the key when its first entry arrives
+	if empty(tree) {
+		buckets, err := index.keyTree(index.treeName(key))
+		if err != nil {
+			return err
+		}
+
+		if err := buckets.Put(uint64Value(uint64(bucket)), []byte{1}); err != nil {
+			return err
+		}
+	}
+
+	if err := tree.Put(entryKey(entry), kindValue(entry.Kind)); err != nil {
+		return err
+	}
+
+	return index.adjustCount(key, 1)
+}
+
+func (index *eventIndex) remove(key string, entry stores.IndexEntry) error {
+	bucket := entryBucket(entry.CreatedAt)
+
+	tree, err := index.keyTree(index.bucketTreeName(key, bucket))
+	if err != nil {
+		return err
+	}
+
+	if bytes, err := tree.Get(entryKey(entry)); err != nil || bytes == nil {
+		return nil
+	}
+
+	if err := tree.Delete(entryKey(entry)); err != nil {
+		return err
+	}
+
+	if empty(tree) {
+		buckets, err := index.keyTree(index.treeName(key))
+		if err != nil {
+			return err
+		}
+
+		if err := buckets.Delete(uint64Value(uint64(bucket))); err != nil {
+			return err
+		}
+	}
+
+	return index.adjustCount(key, -1)
+}
+
+// add references the event from every index key it belongs to, the event itself lives in the given bucket
+func (index *eventIndex) add(event *nostr.Event, bucket string) error {
+	entry := stores.NewIndexEntry(event)
+
+	for _, key := range stores.EventIndexKeys(event) {
+		if err := index.insert(key, entry); err != nil {
+			return err
+		}
+	}
+
+	if err := index.sketch(event); err != nil {
+		return err
+	}
+
+	if expiration, ok := stores.Expiration(event); ok {
+		if err := putExpiration(index.expirations, event.ID, expiration); err != nil {
+			return err
+		}
+	}
+
+	if key, ok := stores.ReplaceableKey(event); ok {
+		current, err := index.current(event)
+		if err != nil {
+			return err
+		}
+
+		// Rebuilding can meet older versions stored before replacement was enforced, the slot keeps the newest
+		if current == nil || stores.IsNewerVersion(event, current) {
+			if err := index.tree.Put(replaceableKey(key), []byte(event.ID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return index.ids.Put([]byte(event.ID), []byte(bucket))
+}
+
+// current returns the version of a replaceable or addressable event that is currently stored, if any
+func (index *eventIndex) current(event *nostr.Event) (*nostr.Event, error) {
+	key, ok := stores.ReplaceableKey(event)
+	if !ok {
+		return nil, nil
+	}
+
+	bytes, err := index.tree.Get(replaceableKey(key))
+	if err != nil || bytes == nil {
+		return nil, nil
+	}
+
+	return index.Lookup(string(bytes))
+}
+
+func (index *eventIndex) loadSketch(key string, kind int) (*hyperloglog.Sketch, error) {
+	bytes, err := index.tree.Get(sketchKey(key, kind))
+	if err != nil || bytes == nil {
+		return nil, nil
+	}
+
+	sketch := hyperloglog.New()
+	if err := cbor.Unmarshal(bytes, sketch); err != nil {
+		return nil, err
+	}
+
+	return sketch, nil
+}
+
+func (index *eventIndex) stale(key string, kind int) bool {
+	bytes, err := index.tree.Get(staleKey(key, kind))
+	return err == nil && bytes != nil
+}
+
+// sketchKeys returns the tag index keys of the event's sketched tags
+func sketchKeys(event *nostr.Event) []string {
+	keys := []string{}
+
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || !contains(sketchedTags, tag[0]) {
+			continue
+		}
+
+		keys = append(keys, stores.TagIndexKey(tag[0], tag[1]))
+	}
+
+	return keys
+}
+
+// sketch records the event's identity in the sketches of its sketched tags, stale sketches are left alone
+// since their counts are made from the index until they are rebuilt by resketch
+func (index *eventIndex) sketch(event *nostr.Event) error {
+	identity := []byte(stores.EventIdentity(event))
+
+	for _, key := range sketchKeys(event) {
+		if index.stale(key, event.Kind) {
+			continue
+		}
+
+		sketch, err := index.loadSketch(key, event.Kind)
+		if err != nil {
+			return err
+		}
+
+		if sketch == nil {
+			sketch = hyperloglog.New()
+		}
+
+		sketch.Add(identity)
+
+		bytes, err := cbor.Marshal(sketch)
+		if err != nil {
+			return err
+		}
+
+		if err := index.tree.Put(sketchKey(key, event.Kind), bytes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unsketch marks the sketches that counted a removed event as stale so estimates never include removed events,
+// a replacement that keeps a tag keeps that sketch as it is since both versions share the identity it counted
+func (index *eventIndex) unsketch(event *nostr.Event, replacement *nostr.Event) error {
+	kept := map[string]bool{}
+	if replacement != nil {
+		for _, key := range sketchKeys(replacement) {
+			kept[key] = true
+		}
+	}
+
+	for _, key := range sketchKeys(event) {
+		if kept[key] {
+			continue
+		}
+
+		if err := index.tree.Put(staleKey(key, event.Kind), []byte{1}); err != nil {
+			return err
+		}
+
+		if err := index.tree.Delete(sketchKey(key, event.Kind)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resketch rebuilds a stale sketch from the events still under its index key and clears the stale mark,
+// replaceable and addressable events are loaded since their identity isn't in the index entries
+func (index *eventIndex) resketch(key string, kind int) error {
+	sketch := hyperloglog.New()
+
+	next := index.Iterate(key, -1)
+	for {
+		entry, err := next()
+		if err != nil {
+			return err
+		}
+
+		if entry == nil {
+			break
+		}
+
+		if entry.Kind != kind {
+			continue
+		}
+
+		identity := entry.ID
+
+		if stores.IsReplaceableKind(kind) || stores.IsAddressableKind(kind) {
+			event, err := index.Fetch(*entry)
+			if err != nil {
+				return err
+			}
+
+			if event == nil {
+				continue
+			}
+
+			identity = stores.EventIdentity(event)
+		}
+
+		sketch.Add([]byte(identity))
+	}
+
+	bytes, err := cbor.Marshal(sketch)
+	if err != nil {
+		return err
+	}
+
+	if err := index.tree.Put(sketchKey(key, kind), bytes); err != nil {
+		return err
+	}
+
+	return index.tree.Delete(staleKey(key, kind))
+}
+
+func (index *eventIndex) delete(event *nostr.Event, replacement *nostr.Event) error {
+	entry := stores.NewIndexEntry(event)
+
+	if err := index.unsketch(event, replacement); err != nil {
+		return err
+	}
+
+	for _, key := range stores.EventIndexKeys(event) {
+		if err := index.remove(key, entry); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := stores.Expiration(event); ok {
+		index.expirations.Delete([]byte(event.ID))
+	}
+
+	if key, ok := stores.ReplaceableKey(event); ok {
+		bytes, err := index.tree.Get(replaceableKey(key))
+		if err == nil && string(bytes) == event.ID {
+			if err := index.tree.Delete(replaceableKey(key)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return index.ids.Delete([]byte(event.ID))
+}
+
+// has reports whether an event id is already indexed
+func (index *eventIndex) has(id string) bool {
+	bytes, err := index.ids.Get([]byte(id))
+	return err == nil && bytes != nil
+}
+
+func (index *eventIndex) bucket(name string) (*graviton.Tree, error) {
+	if tree, ok := index.buckets[name]; ok {
+		return tree, nil
+	}
+
+	tree, err := index.snapshot.GetTree(name)
+	if err != nil {
+		return nil, err
+	}
+
+	index.buckets[name] = tree
+
+	return tree, nil
+}
+
+func (index *eventIndex) loadEvent(bucket string, id string) (*nostr.Event, error) {
+	tree, err := index.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := tree.Get([]byte(id))
+	if err != nil || bytes == nil {
+		return nil, nil
+	}
+
+	bytes, err = index.cipher.Open([]byte(id), bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var event nostr.Event
+	if err := jsoniter.Unmarshal(bytes, &event); err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+func (index *eventIndex) Estimate(key string) int64 {
+	bytes, err := index.tree.Get(countKey(key))
+	if err != nil || len(bytes) != 8 {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(bytes))
+}
+
+// walk returns every key of a tree, graviton keeps no order so callers sort what they need
+func walk(tree *graviton.Tree, fn func(key []byte, value []byte)) {
+	cursor := tree.Cursor()
+	for k, v, err := cursor.First(); err == nil; k, v, err = cursor.Next() {
+		fn(k, v)
+	}
+}
+
+func (index *eventIndex) Iterate(key string, until int64) stores.IndexIterator {
+	buckets := []int64{}
+	entries := []stores.IndexEntry{}
+
+	tree, err := index.keyTree(index.treeName(key))
+	if err == nil {
+		walk(tree, func(k []byte, v []byte) {
+			bucket := int64(binary.BigEndian.Uint64(k))
+			if until < 0 || bucket <= entryBucket(until) {
+				buckets = append(buckets, bucket)
+			}
+		})
+
+		sort.Slice(buckets, func(i, j int) bool {
+			return buckets[i] > buckets[j]
+		})
+	}
+
+	return func() (*stores.IndexEntry, error) {
+		if err != nil {
+			return nil, err
+		}
+
+		for len(entries) == 0 {
+			if len(buckets) == 0 {
+				return nil, nil
+			}
+
+			var tree *graviton.Tree
+			tree, err = index.keyTree(index.bucketTreeName(key, buckets[0]))
+			if err != nil {
+				return nil, err
+			}
+
+			buckets = buckets[1:]
+
+			walk(tree, func(k []byte, v []byte) {
+				entries = append(entries, parseEntryKey(k, v))
+			})
+
+			sort.Slice(entries, func(i, j int) bool {
+				return entries[i].Before(entries[j])
+			})
+		}
+
+		entry := entries[0]
+		entries = entries[1:]
+
+		return &entry, nil
+	}
+}
+
+func (index *eventIndex) Fetch(entry stores.IndexEntry) (*nostr.Event, error) {
+	return index.loadEvent(fmt.Sprintf("kind:%d", entry.Kind), entry.ID)
+}
+
+// errStaleSketch is returned by estimate when a sketch it needs has lost an event and has to be rebuilt first
+var errStaleSketch = errors.New("stale sketch")
+
+// estimate merges the sketches that answer filters shaped like {"kinds": [...], "#p": [...]} once they are expensive to count
+func (index *eventIndex) estimate(filter nostr.Filter, threshold int64) (*hyperloglog.Sketch, bool, error) {
+	if filter.IDs != nil || filter.Authors != nil || filter.Since != nil || filter.Until != nil || filter.Search != "" {
+		return nil, false, nil
+	}
+
+	if len(filter.Kinds) == 0 || len(filter.Tags) != 1 {
+		return nil, false, nil
+	}
+
+	for name, values := range filter.Tags {
+		if !contains(sketchedTags, name) || len(values) == 0 {
+			return nil, false, nil
+		}
+
+		keys := []string{}
+		var cost int64
+		for _, value := range values {
+			key := stores.TagIndexKey(name, value)
+			keys = append(keys, key)
+			cost += index.Estimate(key)
+		}
+
+		if cost <= threshold {
+			return nil, false, nil
+		}
+
+		merged := hyperloglog.New()
+		for _, key := range keys {
+			for _, kind := range filter.Kinds {
+				// Stale sketches would count removed events
+				if index.stale(key, kind) {
+					return nil, false, errStaleSketch
+				}
+
+				sketch, err := index.loadSketch(key, kind)
+				if err != nil {
+					return nil, false, err
+				}
+
+				if sketch != nil {
+					merged.Merge(sketch)
+				}
+			}
+		}
+
+		return merged, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// estimateFilters merges the sketches of every filter, it returns false if any of them has to be counted exactly
+func (index *eventIndex) estimateFilters(filters []nostr.Filter, threshold int64) (*hyperloglog.Sketch, bool, error) {
+	if len(filters) == 0 {
+		return nil, false, nil
+	}
+
+	merged := hyperloglog.New()
+
+	for _, filter := range filters {
+		sketch, ok, err := index.estimate(filter, threshold)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+
+		merged.Merge(sketch)
+	}
+
+	return merged, true, nil
+}
+
+func (index *eventIndex) Lookup(id string) (*nostr.Event, error) {
+	bytes, err := index.ids.Get([]byte(id))
+	if err != nil || bytes == nil {
+		return nil, nil
+	}
+
+	return index.loadEvent(string(bytes), id)
+}
+
+// rebuildIndexes indexes every stored event when the indexes are missing or were built by an older version
+func (store *GravitonStore) rebuildIndexes() error {
+	snapshot, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		return err
+	}
+
+	tree, err := snapshot.GetTree(indexTreeName)
+	if err != nil {
+		return err
+	}
+
+	version, err := tree.Get([]byte("version"))
+	if err == nil && string(version) == indexVersion {
+		return nil
+	}
+
+	masterBucketList, err := store.GetMasterBucketList("kinds")
+	if err != nil {
+		return err
+	}
+
+	if len(masterBucketList) > 0 {
+		log.Println("Rebuilding event indexes, this may take a while")
+	}
+
+	// The previous index is discarded by starting from empty trees and a new generation of index key trees
+	emptyIndex, err := snapshot.GetTreeWithVersion(indexTreeName, 0)
+	if err != nil {
+		return err
+	}
+
+	emptyIds, err := snapshot.GetTreeWithVersion(idsTreeName, 0)
+	if err != nil {
+		return err
+	}
+
+	emptyExpirations, err := snapshot.GetTreeWithVersion(expirationsTree, 0)
+	if err != nil {
+		return err
+	}
+
+	generation := indexGeneration(tree) + 1
+
+	if err := emptyIndex.Put([]byte("generation"), uint64Value(generation)); err != nil {
+		return err
+	}
+
+	index := &eventIndex{
+		snapshot:    snapshot,
+		cipher:      store.cipher,
+		tree:        emptyIndex,
+		ids:         emptyIds,
+		expirations: emptyExpirations,
+		buckets:     map[string]*graviton.Tree{},
+		generation:  generation,
+		keyTrees:    map[string]*graviton.Tree{},
+	}
+
+	count := 0
+
+	for _, bucket := range masterBucketList {
+		if !strings.HasPrefix(bucket, "kind") {
+			continue
+		}
+
+		bucketTree, err := snapshot.GetTree(bucket)
+		if err != nil {
+			continue
+		}
+
+		c := bucketTree.Cursor()
+		for k, v, err := c.First(); err == nil; k, v, err = c.Next() {
+			v, err := store.cipher.Open(k, v)
+			if err != nil {
+				return err
+			}
+
+			var event nostr.Event
+			if err := jsoniter.Unmarshal(v, &event); err != nil {
+				continue
+			}
+
+			if err := index.add(&event, bucket); err != nil {
+				return err
+			}
+
+			count++
+
+			if count%indexRebuildBatchSize == 0 {
+				if err := store.commit(index.trees()...); err != nil {
+					return err
+				}
+
+				// Trees opened after a commit have to come from the committed snapshot, the ones held so far are let go
+				committed, err := store.Database.LoadSnapshot(0)
+				if err != nil {
+					return err
+				}
+
+				index, err = loadEventIndex(committed, store.cipher)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err := index.tree.Put([]byte("version"), []byte(indexVersion)); err != nil {
+		return err
+	}
+
+	err = store.commit(index.trees()...)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		log.Println("Indexed", count, "events")
+	}
+
+	return nil
+}
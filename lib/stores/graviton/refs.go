@@ -0,0 +1,369 @@
+package graviton
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+
+	"github.com/deroproject/graviton"
+	"github.com/fxamacker/cbor/v2"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+)
+
+// Leaf records and content are shared between dags so both are reference counted in the "refs" tree,
+// leaf records are keyed by their bucket and hash while content is keyed by its content hash.
+// The "dagrefs" tree records which leaves have been counted for each root so uploads can be retried safely.
+// Leaves stored before reference counting have no count, other dags may still link to them so they are never
+// counted or removed and their dagrefs entries are marked as uncounted.
+const (
+	refsTree    = "refs"
+	dagRefsTree = "dagrefs"
+)
+
+func leafRefKey(bucket string, hash string) []byte {
+	return []byte(fmt.Sprintf("leaf:%s:%s", bucket, hash))
+}
+
+func dagRefKey(root string, hash string) []byte {
+	return []byte(fmt.Sprintf("%s:%s", root, hash))
+}
+
+// getRef returns the reference count for a key and whether the key is being reference counted at all
+func getRef(tree *graviton.Tree, key []byte) (int64, bool) {
+	value, err := tree.Get(key)
+	if err != nil || len(value) != 8 {
+		return 0, false
+	}
+
+	return int64(binary.BigEndian.Uint64(value)), true
+}
+
+func addRef(tree *graviton.Tree, key []byte, delta int64) (int64, error) {
+	count, _ := getRef(tree, key)
+
+	count += delta
+	if count < 0 {
+		count = 0
+	}
+
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(count))
+
+	return count, tree.Put(key, value)
+}
+
+const (
+	uncountedRef byte = 0
+	countedRef   byte = 1
+)
+
+// uncountedLeaf reports whether a leaf was stored before reference counting and so has no count
+func uncountedLeaf(leafTree *graviton.Tree, refs *graviton.Tree, bucket string, hash string) bool {
+	if _, err := leafTree.Get([]byte(hash)); err != nil {
+		return false
+	}
+
+	_, ok := getRef(refs, leafRefKey(bucket, hash))
+
+	return !ok
+}
+
+// referenceLeaf counts a leaf and its content as used by the root the first time the leaf is stored for it
+// and reports whether it did, leaves that were already stored without a count are recorded but left uncounted
+func referenceLeaf(trees treeSource, root string, bucket string, leafData *types.DagLeafData, uncounted bool) (bool, error) {
+	dagRefs, err := trees.GetTree(dagRefsTree)
+	if err != nil {
+		return false, err
+	}
+
+	key := dagRefKey(root, leafData.Leaf.Hash)
+
+	if _, err := dagRefs.Get(key); err == nil {
+		return false, nil
+	}
+
+	if uncounted {
+		return true, dagRefs.Put(key, []byte{uncountedRef})
+	}
+
+	refs, err := trees.GetTree(refsTree)
+	if err != nil {
+		return false, err
+	}
+
+	err = dagRefs.Put(key, []byte{countedRef})
+	if err != nil {
+		return false, err
+	}
+
+	_, err = addRef(refs, leafRefKey(bucket, leafData.Leaf.Hash), 1)
+	if err != nil {
+		return false, err
+	}
+
+	if leafData.Leaf.ContentHash != nil {
+		_, err = addRef(refs, leafData.Leaf.ContentHash, 1)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// uncacheKey removes a root from a cache entry written by cacheKey
+func (store *GravitonStore) uncacheKey(trees treeSource, bucket string, key string, root string) error {
+	treeName := bucket
+	if !strings.HasPrefix(bucket, "npub") {
+		treeName = fmt.Sprintf("cache:%s", bucket)
+	}
+
+	tree, err := trees.GetTree(treeName)
+	if err != nil {
+		return err
+	}
+
+	value, err := tree.Get([]byte(key))
+	if err != nil || value == nil {
+		return nil
+	}
+
+	var cacheData *types.CacheData = &types.CacheData{}
+
+	err = cbor.Unmarshal(value, cacheData)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{}
+	for _, cached := range cacheData.Keys {
+		if cached != root {
+			keys = append(keys, cached)
+		}
+	}
+
+	if len(keys) == 0 {
+		err = tree.Delete([]byte(key))
+	} else {
+		cacheData.Keys = keys
+
+		var serializedData []byte
+		serializedData, err = cbor.Marshal(cacheData)
+		if err == nil {
+			err = tree.Put([]byte(key), serializedData)
+		}
+	}
+
+	return err
+}
+
+// DeleteDag removes a dag and everything that indexes it, leaves and content shared with other dags are kept
+// until nothing references them and unreferenced content is removed by CollectGarbage.
+// Graviton is append-only so removed keys are no longer readable but still take up space on disk.
+func (store *GravitonStore) DeleteDag(root string) error {
+	return store.update(func(tx *transaction) error {
+		return store.deleteDag(tx, root)
+	})
+}
+
+func (store *GravitonStore) deleteDag(tx *transaction, root string) error {
+	rootData, err := loadLeaf(tx, root, root)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := retrieveBucket(tx, root)
+	if err != nil {
+		return err
+	}
+
+	leafTree, err := tx.GetTree(bucket)
+	if err != nil {
+		return err
+	}
+
+	indexTree, err := tx.GetTree("mbl")
+	if err != nil {
+		return err
+	}
+
+	refs, err := tx.GetTree(refsTree)
+	if err != nil {
+		return err
+	}
+
+	dagRefs, err := tx.GetTree(dagRefsTree)
+	if err != nil {
+		return err
+	}
+
+	visited := map[string]struct{}{}
+
+	var removeLeaf func(hash string) error
+	removeLeaf = func(hash string) error {
+		if _, ok := visited[hash]; ok {
+			return nil
+		}
+		visited[hash] = struct{}{}
+
+		value, err := leafTree.Get([]byte(hash))
+		if err != nil {
+			// Leaves of partially uploaded dags may be missing
+			return nil
+		}
+
+		var data types.DagLeafData
+		err = cbor.Unmarshal(value, &data)
+		if err != nil {
+			return err
+		}
+
+		key := dagRefKey(root, hash)
+
+		if value, err := dagRefs.Get(key); err == nil {
+			err = dagRefs.Delete(key)
+			if err != nil {
+				return err
+			}
+
+			if len(value) == 1 && value[0] == countedRef {
+				_, err = addRef(refs, leafRefKey(bucket, hash), -1)
+				if err != nil {
+					return err
+				}
+
+				if data.Leaf.ContentHash != nil {
+					_, err = addRef(refs, data.Leaf.ContentHash, -1)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		// Uncounted leaves may still be linked from other dags so only counted leaves are removed
+		if count, ok := getRef(refs, leafRefKey(bucket, hash)); ok && count <= 0 {
+			leafTree.Delete([]byte(hash))
+			refs.Delete(leafRefKey(bucket, hash))
+		}
+
+		for _, child := range data.Leaf.Links {
+			err = removeLeaf(child)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	err = removeLeaf(root)
+	if err != nil {
+		return err
+	}
+
+	err = indexTree.Delete([]byte(root))
+	if err != nil {
+		return err
+	}
+
+	usage, err := tx.GetTree(usageTree)
+	if err != nil {
+		return err
+	}
+
+	err = releaseUsageRecord(usage, dagUsageKey(root))
+	if err != nil {
+		return err
+	}
+
+	if rootData.PublicKey != "" {
+		pubKey := rootData.PublicKey
+
+		if !strings.HasPrefix(rootData.PublicKey, "npub1") {
+			pubKey = "npub1" + pubKey
+		}
+
+		err = store.uncacheKey(tx, pubKey, bucket, root)
+		if err != nil {
+			return err
+		}
+	}
+
+	if configKey, ok := store.CacheConfig[bucket]; ok {
+		cacheKey, ok := rootData.Leaf.AdditionalData[configKey]
+
+		if !ok {
+			value := reflect.ValueOf(rootData.Leaf).FieldByName(configKey)
+
+			if value.IsValid() && value.Kind() == reflect.String {
+				cacheKey, ok = value.String(), true
+			}
+		}
+
+		if ok {
+			err = store.uncacheKey(tx, bucket, cacheKey, root)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = addTombstone(tx, dagTombstoneKey(root))
+	if err != nil {
+		return err
+	}
+
+	tx.onCommit(func() {
+		DeleteDagStats(root)
+	})
+
+	return nil
+}
+
+// CollectGarbage removes content whose reference count has dropped to zero
+func (store *GravitonStore) CollectGarbage() (int, error) {
+	collected := 0
+
+	err := store.update(func(tx *transaction) error {
+		refs, err := tx.GetTree(refsTree)
+		if err != nil {
+			return err
+		}
+
+		contentTree, err := tx.GetTree("content")
+		if err != nil {
+			return err
+		}
+
+		unreferenced := [][]byte{}
+
+		cursor := refs.Cursor()
+		for key, value, err := cursor.First(); err == nil; key, value, err = cursor.Next() {
+			if len(value) == 8 && binary.BigEndian.Uint64(value) == 0 {
+				unreferenced = append(unreferenced, append([]byte{}, key...))
+			}
+		}
+
+		for _, key := range unreferenced {
+			contentTree.Delete(key)
+			refs.Delete(key)
+		}
+
+		collected = len(unreferenced)
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if collected > 0 {
+		log.Printf("Collected %d unreferenced content entries\n", collected)
+	}
+
+	return collected, nil
+}
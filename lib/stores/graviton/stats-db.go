@@ -3,15 +3,20 @@ package graviton
 import (
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/spf13/viper"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
 	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/config"
+	"github.com/HORNET-Storage/hornet-storage/lib/settings"
+	merkle_dag "github.com/HORNET-Storage/scionic-merkletree/dag"
 	jsoniter "github.com/json-iterator/go"
 )
 
@@ -24,7 +29,14 @@ var (
 // InitGorm initializes the GORM DB (This will handle the SQLite DB for Relay Stats)
 func InitGorm() (*gorm.DB, error) {
 	once.Do(func() {
-		instance, err = gorm.Open(sqlite.Open("relay_stats.db"), &gorm.Config{})
+		path := config.StatsDatabasePath()
+
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			log.Fatalf("Failed to create the relay stats directory: %v", err)
+		}
+
+		instance, err = gorm.Open(sqlite.Open(path), &gorm.Config{})
 		if err != nil {
 			log.Fatalf("Failed to connect to database: %v", err)
 		}
@@ -52,6 +64,173 @@ func InitGorm() (*gorm.DB, error) {
 	return instance, err
 }
 
+// CheckLeafStats returns the error StoreLeafStats would return for a root leaf without recording anything,
+// stores use it to reject a dag before writing it and only record the stats once the write has been committed
+func CheckLeafStats(rootLeaf *merkle_dag.DagLeaf) error {
+	kindName := strings.ToLower(GetKindFromItemName(rootLeaf.ItemName))
+
+	relaySettings := settings.Get()
+
+	if !contains(append(append(relaySettings.Photos, relaySettings.Videos...), relaySettings.Audio...), kindName) {
+		return nil
+	}
+
+	if relaySettings.Mode == "smart" {
+		return fmt.Errorf("file type not permitted: %s", GetKindFromItemName(rootLeaf.ItemName))
+	} else if relaySettings.Mode == "unlimited" {
+		return fmt.Errorf("blocked file type: %s", GetKindFromItemName(rootLeaf.ItemName))
+	}
+
+	return nil
+}
+
+// StoreLeafStats records a root leaf in the relay stats under the category matching its file type
+func StoreLeafStats(rootLeaf *merkle_dag.DagLeaf, leafContentSize int) error {
+	itemName := rootLeaf.ItemName
+	leafCount := rootLeaf.LeafCount
+	hash := rootLeaf.Hash
+
+	kindName := GetKindFromItemName(itemName)
+
+	ChunkSize := 2048 * 1024
+
+	relaySettings := settings.Get()
+
+	var sizeMB float64
+	if leafCount > 0 {
+		sizeMB = float64(leafCount*ChunkSize) / (1024 * 1024) // Convert to MB
+	} else {
+		sizeBytes := leafContentSize
+		sizeMB = float64(sizeBytes) / (1024 * 1024) // Convert to MB
+	}
+
+	gormDB, err := InitGorm()
+	if err != nil {
+		return err
+	}
+
+	mode := relaySettings.Mode
+
+	// Process file according to the mode (smart or unlimited)
+	if mode == "smart" {
+		// In smart mode, check if the file type is blocked
+		if contains(append(append(relaySettings.Photos, relaySettings.Videos...), relaySettings.Audio...), strings.ToLower(kindName)) {
+			return fmt.Errorf("file type not permitted: %s", kindName)
+		}
+
+		// Save the file under the correct category if not blocked
+		if contains(relaySettings.Photos, strings.ToLower(kindName)) {
+			photo := types.Photo{
+				Hash:      hash,
+				LeafCount: leafCount,
+				KindName:  kindName,
+				Size:      sizeMB,
+			}
+			gormDB.Create(&photo)
+		} else if contains(relaySettings.Videos, strings.ToLower(kindName)) {
+			video := types.Video{
+				Hash:      hash,
+				LeafCount: leafCount,
+				KindName:  kindName,
+				Size:      sizeMB,
+			}
+			gormDB.Create(&video)
+		} else if contains(relaySettings.Audio, strings.ToLower(kindName)) {
+			audio := types.Audio{
+				Hash:      hash,
+				LeafCount: leafCount,
+				KindName:  kindName,
+				Size:      sizeMB,
+			}
+			gormDB.Create(&audio)
+		} else {
+			// Save the file under Misc if it doesn't fall under any specific category
+			misc := types.Misc{
+				Hash:      hash,
+				LeafCount: leafCount,
+				KindName:  itemName,
+				Size:      sizeMB,
+			}
+			gormDB.Create(&misc)
+		}
+	} else if mode == "unlimited" {
+		// In unlimited mode, check if the file type is blocked
+		if contains(append(append(relaySettings.Photos, relaySettings.Videos...), relaySettings.Audio...), strings.ToLower(kindName)) {
+			return fmt.Errorf("blocked file type: %s", kindName)
+		}
+
+		// Save the file under the correct category if not blocked
+		if contains(relaySettings.Photos, strings.ToLower(kindName)) {
+			photo := types.Photo{
+				Hash:      hash,
+				LeafCount: leafCount,
+				KindName:  kindName,
+				Size:      sizeMB,
+			}
+			gormDB.Create(&photo)
+		} else if contains(relaySettings.Videos, strings.ToLower(kindName)) {
+			video := types.Video{
+				Hash:      hash,
+				LeafCount: leafCount,
+				KindName:  kindName,
+				Size:      sizeMB,
+			}
+			gormDB.Create(&video)
+		} else if contains(relaySettings.Audio, strings.ToLower(kindName)) {
+			audio := types.Audio{
+				Hash:      hash,
+				LeafCount: leafCount,
+				KindName:  kindName,
+				Size:      sizeMB,
+			}
+			gormDB.Create(&audio)
+		} else {
+			// Save the file under Misc if it doesn't fall under any specific category
+			misc := types.Misc{
+				Hash:      hash,
+				LeafCount: leafCount,
+				KindName:  itemName,
+				Size:      sizeMB,
+			}
+			gormDB.Create(&misc)
+		}
+	}
+
+	return nil
+}
+
+// StoreEventStats records a stored event in the relay stats
+func StoreEventStats(event *nostr.Event) {
+	storeInGorm(event)
+}
+
+// DeleteEventStats removes a deleted event from the relay stats
+func DeleteEventStats(eventID string) error {
+	gormDB, err := InitGorm()
+	if err != nil {
+		return err
+	}
+
+	return gormDB.Delete(&types.Kind{}, "event_id = ?", eventID).Error
+}
+
+// DeleteDagStats removes the stats rows recorded for a root leaf by StoreLeafStats
+func DeleteDagStats(root string) error {
+	gormDB, err := InitGorm()
+	if err != nil {
+		return err
+	}
+
+	for _, model := range []interface{}{&types.Photo{}, &types.Video{}, &types.Audio{}, &types.Misc{}} {
+		err = gormDB.Delete(model, "hash = ?", root).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func storeInGorm(event *nostr.Event) {
 	gormDB, err := InitGorm()
 	if err != nil {
@@ -61,11 +240,7 @@ func storeInGorm(event *nostr.Event) {
 
 	kindStr := fmt.Sprintf("kind%d", event.Kind)
 
-	var relaySettings types.RelaySettings
-	if err := viper.UnmarshalKey("relay_settings", &relaySettings); err != nil {
-		log.Printf("Error unmarshaling relay settings: %v", err)
-		return
-	}
+	relaySettings := settings.Get()
 
 	if event.Kind == 0 {
 		// Handle user profile creation or update
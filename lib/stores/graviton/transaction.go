@@ -0,0 +1,115 @@
+package graviton
+
+import (
+	"github.com/deroproject/graviton"
+
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+)
+
+// treeSource is satisfied by both snapshots and transactions so helpers can read from either
+type treeSource interface {
+	GetTree(name string) (*graviton.Tree, error)
+}
+
+// transaction hands out a single copy of every tree it is asked for so that all of the writes staged against it,
+// whether from one call or a whole batch, land in the same trees and are committed with one graviton commit
+type transaction struct {
+	store    *GravitonStore
+	snapshot *graviton.Snapshot
+	trees    map[string]*graviton.Tree
+	order    []*graviton.Tree
+
+	// The relay stats live in a separate database so they are only written once the commit has succeeded
+	afterCommit []func()
+}
+
+func (store *GravitonStore) beginTransaction() (*transaction, error) {
+	snapshot, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &transaction{
+		store:    store,
+		snapshot: snapshot,
+		trees:    map[string]*graviton.Tree{},
+		order:    []*graviton.Tree{},
+	}, nil
+}
+
+func (tx *transaction) GetTree(name string) (*graviton.Tree, error) {
+	if tree, ok := tx.trees[name]; ok {
+		return tree, nil
+	}
+
+	tree, err := tx.snapshot.GetTree(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tx.trees[name] = tree
+	tx.order = append(tx.order, tree)
+
+	return tree, nil
+}
+
+func (tx *transaction) onCommit(fn func()) {
+	tx.afterCommit = append(tx.afterCommit, fn)
+}
+
+func (tx *transaction) commit() error {
+	err := tx.store.commit(tx.order...)
+	if err != nil {
+		return err
+	}
+
+	for _, fn := range tx.afterCommit {
+		fn()
+	}
+
+	return nil
+}
+
+// update runs fn against a new transaction and commits it if fn succeeds, nothing is written if it fails
+func (store *GravitonStore) update(fn func(tx *transaction) error) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tx, err := store.beginTransaction()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.commit()
+}
+
+// NewBatch replays every staged write against one set of trees so the whole batch lands in a single graviton commit
+func (store *GravitonStore) NewBatch() stores.Batch {
+	return stores.NewStagedBatch(func(writes []stores.StagedWrite) error {
+		return store.update(func(tx *transaction) error {
+			for _, write := range writes {
+				var err error
+
+				switch {
+				case write.Leaf != nil:
+					err = store.storeLeaf(tx, write.Root, write.Leaf)
+				case write.Event != nil:
+					err = store.storeEvent(tx, write.Event)
+				case write.Blob != nil:
+					_, err = store.storeBlob(tx, write.Blob.Data, write.Blob.ContentType, write.Blob.PublicKey)
+				}
+
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+}
@@ -0,0 +1,146 @@
+package graviton
+
+import (
+	"fmt"
+
+	"github.com/deroproject/graviton"
+	"github.com/fxamacker/cbor/v2"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+)
+
+// The "usage" tree holds the running totals for every public key along with records of who was charged
+// for each dag and blob, event usage is worked out from the event itself when it is deleted
+const usageTree = "usage"
+
+func usageKey(publicKey string) []byte {
+	return []byte(fmt.Sprintf("pubkey:%s", stores.UsageKey(publicKey)))
+}
+
+func dagUsageKey(root string) []byte {
+	return []byte(fmt.Sprintf("dag:%s", root))
+}
+
+func blobUsageKey(hash string) []byte {
+	return []byte(fmt.Sprintf("blob:%s", hash))
+}
+
+func getUsage(tree *graviton.Tree, publicKey string) types.Usage {
+	var usage types.Usage
+
+	value, err := tree.Get(usageKey(publicKey))
+	if err == nil && value != nil {
+		cbor.Unmarshal(value, &usage)
+	}
+
+	return usage
+}
+
+// addUsage changes the usage of a public key, positive changes are checked against the quota first
+func addUsage(tree *graviton.Tree, publicKey string, bytes int64, items int64) error {
+	if publicKey == "" {
+		return nil
+	}
+
+	usage := getUsage(tree, publicKey)
+
+	if bytes > 0 || items > 0 {
+		err := stores.CheckQuota(publicKey, usage, bytes, items)
+		if err != nil {
+			return err
+		}
+	}
+
+	serializedUsage, err := cbor.Marshal(stores.AddUsage(usage, bytes, items))
+	if err != nil {
+		return err
+	}
+
+	return tree.Put(usageKey(publicKey), serializedUsage)
+}
+
+func getUsageRecord(tree *graviton.Tree, key []byte) *types.UsageRecord {
+	value, err := tree.Get(key)
+	if err != nil || value == nil {
+		return nil
+	}
+
+	var record types.UsageRecord
+	if err := cbor.Unmarshal(value, &record); err != nil {
+		return nil
+	}
+
+	return &record
+}
+
+func putUsageRecord(tree *graviton.Tree, key []byte, record *types.UsageRecord) error {
+	serializedRecord, err := cbor.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return tree.Put(key, serializedRecord)
+}
+
+// releaseUsageRecord gives back everything charged under a dag or blob record and removes the record
+func releaseUsageRecord(tree *graviton.Tree, key []byte) error {
+	record := getUsageRecord(tree, key)
+	if record == nil {
+		return nil
+	}
+
+	err := addUsage(tree, record.PublicKey, -record.Bytes, -1)
+	if err != nil {
+		return err
+	}
+
+	return tree.Delete(key)
+}
+
+func (store *GravitonStore) GetUsage(publicKey string) (*types.Usage, error) {
+	snapshot, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := snapshot.GetTree(usageTree)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := getUsage(tree, publicKey)
+
+	return &usage, nil
+}
+
+// chargeLeaf charges a newly stored leaf to the owner of its dag, the dag itself counts as a single item
+func (store *GravitonStore) chargeLeaf(trees treeSource, root string, owner string, isRoot bool, bytes int64) error {
+	if owner == "" {
+		return nil
+	}
+
+	tree, err := trees.GetTree(usageTree)
+	if err != nil {
+		return err
+	}
+
+	var items int64
+	if isRoot {
+		items = 1
+	}
+
+	err = addUsage(tree, owner, bytes, items)
+	if err != nil {
+		return err
+	}
+
+	record := getUsageRecord(tree, dagUsageKey(root))
+	if record == nil {
+		record = &types.UsageRecord{PublicKey: owner}
+	}
+
+	record.Bytes += bytes
+
+	return putUsageRecord(tree, dagUsageKey(root), record)
+}
@@ -0,0 +1,333 @@
+package graviton
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/deroproject/graviton"
+	"github.com/nbd-wtf/go-nostr"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+)
+
+// Graviton numbers every commit, the version it gave each commit and when it was made are appended to the versions
+// file in the store directory so older snapshots can be found again, a commit can't hold its own version so the
+// versions are kept next to the graviton files rather than in a tree.
+// Deleted dags and events are tombstoned so they can't be read back from a version from before they were deleted
+// unless they are restored from one.
+const (
+	versionsFile   = "versions.log"
+	tombstonesTree = "tombstones"
+)
+
+// Every record in the versions file is the version followed by the unix time it was committed
+const versionRecordSize = 16
+
+// commit commits the trees in a single graviton commit and records the version graviton gave it,
+// every commit to the store goes through here so the recorded versions match graviton's.
+// Every tree in a commit costs a few records in graviton's root whether it changed or not so unchanged trees are left out
+func (store *GravitonStore) commit(trees ...*graviton.Tree) error {
+	dirty := []*graviton.Tree{}
+	for _, tree := range trees {
+		if tree.IsDirty() {
+			dirty = append(dirty, tree)
+		}
+	}
+
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	version, err := graviton.Commit(dirty...)
+	if err != nil {
+		return err
+	}
+
+	return store.recordVersion(version)
+}
+
+func (store *GravitonStore) recordVersion(version uint64) error {
+	file, err := os.OpenFile(filepath.Join(store.path, versionsFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	record := make([]byte, versionRecordSize)
+	binary.BigEndian.PutUint64(record[:8], version)
+	binary.BigEndian.PutUint64(record[8:], uint64(time.Now().Unix()))
+
+	_, err = file.Write(record)
+
+	return err
+}
+
+func dagTombstoneKey(root string) []byte {
+	return []byte(fmt.Sprintf("dag:%s", root))
+}
+
+func eventTombstoneKey(id string) []byte {
+	return []byte(fmt.Sprintf("event:%s", id))
+}
+
+func addTombstone(trees treeSource, key []byte) error {
+	tree, err := trees.GetTree(tombstonesTree)
+	if err != nil {
+		return err
+	}
+
+	return tree.Put(key, []byte{1})
+}
+
+// removeTombstone makes a dag or event readable from older versions again once it has been stored again
+func removeTombstone(trees treeSource, key []byte) error {
+	tree, err := trees.GetTree(tombstonesTree)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tree.Get(key); err != nil {
+		return nil
+	}
+
+	return tree.Delete(key)
+}
+
+// loadTombstones reads the tombstones from the latest version since a delete has to hide every version before it
+func (store *GravitonStore) loadTombstones() (*graviton.Tree, error) {
+	snapshot, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot.GetTree(tombstonesTree)
+}
+
+func tombstoned(tree *graviton.Tree, key []byte) bool {
+	_, err := tree.Get(key)
+
+	return err == nil
+}
+
+// ListVersions reads the versions after since from the versions file, graviton numbers its commits in order so the
+// first record after since is found with a binary search rather than by reading the whole file
+func (store *GravitonStore) ListVersions(since uint64, limit int) ([]types.StoreVersion, error) {
+	versions := []types.StoreVersion{}
+
+	file, err := os.Open(filepath.Join(store.path, versionsFile))
+	if os.IsNotExist(err) {
+		return versions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// A record cut short by a crash while it was written is left out
+	count := int(info.Size() / versionRecordSize)
+
+	record := make([]byte, versionRecordSize)
+	read := func(position int) (types.StoreVersion, error) {
+		if _, err := file.ReadAt(record, int64(position)*versionRecordSize); err != nil {
+			return types.StoreVersion{}, err
+		}
+
+		return types.StoreVersion{
+			Version:   binary.BigEndian.Uint64(record[:8]),
+			Timestamp: int64(binary.BigEndian.Uint64(record[8:])),
+		}, nil
+	}
+
+	var searchErr error
+	start := sort.Search(count, func(position int) bool {
+		version, err := read(position)
+		if err != nil {
+			searchErr = err
+			return true
+		}
+
+		return version.Version > since
+	})
+	if searchErr != nil {
+		return nil, searchErr
+	}
+
+	for position := start; position < count && (limit <= 0 || len(versions) < limit); position++ {
+		version, err := read(position)
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
+
+// loadSnapshotAt loads an earlier version of the store, version 0 would load the latest so it is rejected
+func (store *GravitonStore) loadSnapshotAt(version uint64) (*graviton.Snapshot, error) {
+	if version == 0 {
+		return nil, fmt.Errorf("version must be greater than 0")
+	}
+
+	snapshot, err := store.Database.LoadSnapshot(version)
+	if err != nil {
+		return nil, fmt.Errorf("version %d not found: %w", version, err)
+	}
+
+	return snapshot, nil
+}
+
+// QueryEventsAt reads from the event indexes as they were at the given version, versions committed before the
+// indexes were built have no indexes to read from and return no events, events deleted since are left out
+func (store *GravitonStore) QueryEventsAt(filter nostr.Filter, version uint64) ([]*nostr.Event, error) {
+	snapshot, err := store.loadSnapshotAt(version)
+	if err != nil {
+		return nil, err
+	}
+
+	tombstones, err := store.loadTombstones()
+	if err != nil {
+		return nil, err
+	}
+
+	// The limit is applied here so deleted events don't take up any of it
+	limit := filter.Limit
+	filter.Limit = 0
+
+	events := []*nostr.Event{}
+
+	err = iterateEvents(context.Background(), snapshot, store.cipher, filter, func(event *nostr.Event) bool {
+		if tombstoned(tombstones, eventTombstoneKey(event.ID)) {
+			return true
+		}
+
+		events = append(events, event)
+
+		return limit <= 0 || len(events) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// BuildDagFromStoreAt builds a dag from an earlier version, dags deleted since can't be built from any version
+func (store *GravitonStore) BuildDagFromStoreAt(root string, version uint64, includeContent bool) (*types.DagData, error) {
+	tombstones, err := store.loadTombstones()
+	if err != nil {
+		return nil, err
+	}
+
+	if tombstoned(tombstones, dagTombstoneKey(root)) {
+		return nil, fmt.Errorf("dag %s has been deleted", root)
+	}
+
+	snapshot, err := store.loadSnapshotAt(version)
+	if err != nil {
+		return nil, err
+	}
+
+	return stores.BuildDag(root, includeContent, func(hash string) (*types.DagLeafData, error) {
+		return retrieveLeaf(snapshot, store.cipher, root, hash, includeContent)
+	})
+}
+
+// deletedEventsAt returns the events matching the filter as of the given version that have been deleted since
+func (store *GravitonStore) deletedEventsAt(filter nostr.Filter, version uint64) ([]*nostr.Event, error) {
+	snapshot, err := store.loadSnapshotAt(version)
+	if err != nil {
+		return nil, err
+	}
+
+	tombstones, err := store.loadTombstones()
+	if err != nil {
+		return nil, err
+	}
+
+	limit := filter.Limit
+	filter.Limit = 0
+
+	events := []*nostr.Event{}
+
+	err = iterateEvents(context.Background(), snapshot, store.cipher, filter, func(event *nostr.Event) bool {
+		if !tombstoned(tombstones, eventTombstoneKey(event.ID)) {
+			return true
+		}
+
+		events = append(events, event)
+
+		return limit <= 0 || len(events) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// RestoreEventsAt stores the events matching the filter that were deleted since the given version again, so a delete made
+// by mistake can be undone from a version before it. Each event is stored on its own and is held to the same rules as a
+// newly published one, events that have been replaced by a newer version or would go over their author's quota are skipped
+func (store *GravitonStore) RestoreEventsAt(filter nostr.Filter, version uint64) (int, error) {
+	events, err := store.deletedEventsAt(filter, version)
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+
+	for _, event := range events {
+		err := store.StoreEvent(event)
+		if errors.Is(err, stores.ErrDuplicate) || errors.Is(err, stores.ErrSuperseded) || stores.IsQuotaError(err) {
+			continue
+		}
+		if err != nil {
+			return restored, err
+		}
+
+		restored++
+	}
+
+	return restored, nil
+}
+
+// RestoreDagAt stores a deleted dag again as it was at the given version, its leaves and content are read back from the
+// older version since the delete removed them from the latest one
+func (store *GravitonStore) RestoreDagAt(root string, version uint64) error {
+	tombstones, err := store.loadTombstones()
+	if err != nil {
+		return err
+	}
+
+	if !tombstoned(tombstones, dagTombstoneKey(root)) {
+		return fmt.Errorf("dag %s has not been deleted", root)
+	}
+
+	snapshot, err := store.loadSnapshotAt(version)
+	if err != nil {
+		return err
+	}
+
+	dag, err := stores.BuildDag(root, true, func(hash string) (*types.DagLeafData, error) {
+		return retrieveLeaf(snapshot, store.cipher, root, hash, true)
+	})
+	if err != nil {
+		return err
+	}
+
+	return store.StoreDag(dag)
+}
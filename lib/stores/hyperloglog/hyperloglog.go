@@ -0,0 +1,124 @@
+package hyperloglog
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+const (
+	// 4096 registers gives a standard error of roughly 1.6%
+	precision = 12
+	registers = 1 << precision
+
+	// Sketches stay sparse until they have this many registers set, which keeps small sketches small on disk
+	sparseLimit = 512
+)
+
+// Sketch is a HyperLogLog cardinality estimator that can be serialized with cbor
+type Sketch struct {
+	Sparse []uint32 // sorted register index << 8 | rank
+	Dense  []byte
+}
+
+func New() *Sketch {
+	return &Sketch{}
+}
+
+func position(value []byte) (uint32, uint8) {
+	hash := sha256.Sum256(value)
+	x := binary.BigEndian.Uint64(hash[:8])
+
+	index := uint32(x >> (64 - precision))
+	rank := uint8(bits.LeadingZeros64(x<<precision|1<<(precision-1)) + 1)
+
+	return index, rank
+}
+
+func (sketch *Sketch) set(index uint32, rank uint8) {
+	if sketch.Dense != nil {
+		if sketch.Dense[index] < rank {
+			sketch.Dense[index] = rank
+		}
+		return
+	}
+
+	at := sort.Search(len(sketch.Sparse), func(i int) bool {
+		return sketch.Sparse[i]>>8 >= index
+	})
+
+	if at < len(sketch.Sparse) && sketch.Sparse[at]>>8 == index {
+		if uint8(sketch.Sparse[at]) < rank {
+			sketch.Sparse[at] = index<<8 | uint32(rank)
+		}
+		return
+	}
+
+	sketch.Sparse = append(sketch.Sparse, 0)
+	copy(sketch.Sparse[at+1:], sketch.Sparse[at:])
+	sketch.Sparse[at] = index<<8 | uint32(rank)
+
+	if len(sketch.Sparse) > sparseLimit {
+		sketch.Dense = make([]byte, registers)
+		for _, entry := range sketch.Sparse {
+			sketch.Dense[entry>>8] = uint8(entry)
+		}
+		sketch.Sparse = nil
+	}
+}
+
+// Add records a value in the sketch
+func (sketch *Sketch) Add(value []byte) {
+	sketch.set(position(value))
+}
+
+// Merge folds another sketch into this one so the result estimates the union of both
+func (sketch *Sketch) Merge(other *Sketch) {
+	if other.Dense != nil {
+		for index, rank := range other.Dense {
+			if rank > 0 {
+				sketch.set(uint32(index), rank)
+			}
+		}
+		return
+	}
+
+	for _, entry := range other.Sparse {
+		sketch.set(entry>>8, uint8(entry))
+	}
+}
+
+// Estimate returns the approximate number of distinct values added to the sketch
+func (sketch *Sketch) Estimate() int64 {
+	m := float64(registers)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	sum := 0.0
+	zeros := 0
+
+	if sketch.Dense != nil {
+		for _, rank := range sketch.Dense {
+			sum += math.Ldexp(1, -int(rank))
+			if rank == 0 {
+				zeros++
+			}
+		}
+	} else {
+		zeros = registers - len(sketch.Sparse)
+		sum = float64(zeros)
+		for _, entry := range sketch.Sparse {
+			sum += math.Ldexp(1, -int(uint8(entry)))
+		}
+	}
+
+	estimate := alpha * m * m / sum
+
+	// Linear counting is far more accurate while most registers are still empty
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return int64(math.Round(estimate))
+}
@@ -0,0 +1,368 @@
+package stores
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Secondary index names maintained by stores that index nostr events
+const (
+	IndexAll        = "all"
+	IndexAuthor     = "author"
+	IndexKind       = "kind"
+	IndexAuthorKind = "authorkind"
+	IndexTag        = "tag"
+)
+
+// Tag values longer than this are hashed so index keys stay within the key size limits of the databases
+const maxIndexValueLength = 128
+
+// Queries over more than this many author and kind combinations fall back to the single dimension indexes
+const maxAuthorKindKeys = 64
+
+// IndexEntry is a single reference from a secondary index to a stored event
+type IndexEntry struct {
+	CreatedAt int64
+	ID        string
+	Kind      int
+}
+
+func NewIndexEntry(event *nostr.Event) IndexEntry {
+	return IndexEntry{
+		CreatedAt: int64(event.CreatedAt),
+		ID:        event.ID,
+		Kind:      event.Kind,
+	}
+}
+
+// Before reports whether the entry comes before the other entry in index order (newest first, then by id)
+func (entry IndexEntry) Before(other IndexEntry) bool {
+	if entry.CreatedAt != other.CreatedAt {
+		return entry.CreatedAt > other.CreatedAt
+	}
+
+	return entry.ID < other.ID
+}
+
+func AuthorIndexKey(pubkey string) string {
+	return fmt.Sprintf("%s:%s", IndexAuthor, pubkey)
+}
+
+func KindIndexKey(kind int) string {
+	return fmt.Sprintf("%s:%d", IndexKind, kind)
+}
+
+func AuthorKindIndexKey(pubkey string, kind int) string {
+	return fmt.Sprintf("%s:%s:%d", IndexAuthorKind, pubkey, kind)
+}
+
+func TagIndexKey(name string, value string) string {
+	if len(value) > maxIndexValueLength {
+		hash := sha256.Sum256([]byte(value))
+		value = "sha256:" + hex.EncodeToString(hash[:])
+	}
+
+	return fmt.Sprintf("%s:%s:%s", IndexTag, name, value)
+}
+
+// EventIndexKeys returns every index key that should reference the event
+func EventIndexKeys(event *nostr.Event) []string {
+	keys := []string{
+		IndexAll,
+		AuthorIndexKey(event.PubKey),
+		KindIndexKey(event.Kind),
+		AuthorKindIndexKey(event.PubKey, event.Kind),
+	}
+
+	seen := map[string]struct{}{}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || len(tag[0]) != 1 {
+			continue
+		}
+
+		key := TagIndexKey(tag[0], tag[1])
+		if _, ok := seen[key]; ok {
+			continue
+		}
+
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// QueryPlan describes how a filter will be resolved, either by direct id lookups or by walking index keys
+type QueryPlan struct {
+	IDs   []string
+	Index string
+	Tag   string
+	Keys  []string
+}
+
+// PlanQuery picks the narrowest index for a filter using the entry count estimates provided by the store
+func PlanQuery(filter nostr.Filter, estimate func(key string) int64) QueryPlan {
+	if filter.IDs != nil {
+		return QueryPlan{IDs: filter.IDs}
+	}
+
+	candidates := []QueryPlan{}
+
+	if len(filter.Authors) > 0 && len(filter.Kinds) > 0 && len(filter.Authors)*len(filter.Kinds) <= maxAuthorKindKeys {
+		keys := []string{}
+		for _, author := range filter.Authors {
+			for _, kind := range filter.Kinds {
+				keys = append(keys, AuthorKindIndexKey(author, kind))
+			}
+		}
+
+		candidates = append(candidates, QueryPlan{Index: IndexAuthorKind, Keys: keys})
+	}
+
+	tagNames := make([]string, 0, len(filter.Tags))
+	for name := range filter.Tags {
+		tagNames = append(tagNames, name)
+	}
+	sort.Strings(tagNames)
+
+	for _, name := range tagNames {
+		values := filter.Tags[name]
+		if len(name) != 1 || values == nil {
+			continue
+		}
+
+		keys := []string{}
+		for _, value := range values {
+			keys = append(keys, TagIndexKey(name, value))
+		}
+
+		candidates = append(candidates, QueryPlan{Index: IndexTag, Tag: name, Keys: keys})
+	}
+
+	if filter.Authors != nil {
+		keys := []string{}
+		for _, author := range filter.Authors {
+			keys = append(keys, AuthorIndexKey(author))
+		}
+
+		candidates = append(candidates, QueryPlan{Index: IndexAuthor, Keys: keys})
+	}
+
+	if filter.Kinds != nil {
+		keys := []string{}
+		for _, kind := range filter.Kinds {
+			keys = append(keys, KindIndexKey(kind))
+		}
+
+		candidates = append(candidates, QueryPlan{Index: IndexKind, Keys: keys})
+	}
+
+	plan := QueryPlan{Index: IndexAll, Keys: []string{IndexAll}}
+	best := int64(-1)
+
+	for _, candidate := range candidates {
+		var cost int64
+		for _, key := range candidate.Keys {
+			cost += estimate(key)
+		}
+
+		if best < 0 || cost < best {
+			best = cost
+			plan = candidate
+		}
+	}
+
+	return plan
+}
+
+// IndexIterator yields index entries in index order and returns nil once the index is exhausted
+type IndexIterator func() (*IndexEntry, error)
+
+// IndexReader is implemented by stores that keep secondary indexes so they can share the query planner
+type IndexReader interface {
+	// Estimate returns the number of entries referenced by an index key
+	Estimate(key string) int64
+
+	// Iterate walks an index key in index order, skipping ahead to entries created at or before until where possible
+	Iterate(key string, until int64) IndexIterator
+
+	// Fetch loads the event an index entry refers to, returning nil if it no longer exists
+	Fetch(entry IndexEntry) (*nostr.Event, error)
+
+	// Lookup loads an event by id, returning nil if it does not exist
+	Lookup(id string) (*nostr.Event, error)
+}
+
+// QueryIndexes resolves a filter against a store's indexes and passes every matching event to yield
+// in created_at descending order until the filter limit is reached, yield returns false or the context is cancelled
+func QueryIndexes(ctx context.Context, reader IndexReader, filter nostr.Filter, yield func(event *nostr.Event) bool) error {
+	if filter.LimitZero {
+		return nil
+	}
+
+	searchTerm := strings.ToLower(filter.Search)
+	now := time.Now().Unix()
+
+	matches := func(event *nostr.Event) bool {
+		if !filter.Matches(event) || IsExpired(event, now) {
+			return false
+		}
+
+		return searchTerm == "" || strings.Contains(strings.ToLower(event.Content), searchTerm)
+	}
+
+	plan := PlanQuery(filter, reader.Estimate)
+
+	if plan.IDs != nil {
+		events := []*nostr.Event{}
+
+		for _, id := range plan.IDs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			event, err := reader.Lookup(id)
+			if err != nil {
+				return err
+			}
+
+			if event != nil && matches(event) {
+				events = append(events, event)
+			}
+		}
+
+		sort.Slice(events, func(i, j int) bool {
+			return NewIndexEntry(events[i]).Before(NewIndexEntry(events[j]))
+		})
+
+		for i, event := range events {
+			if filter.Limit > 0 && i >= filter.Limit {
+				break
+			}
+
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if !yield(event) {
+				break
+			}
+		}
+
+		return nil
+	}
+
+	found := 0
+
+	return walkIndexes(reader, filter, plan.Keys, func(entry IndexEntry) (bool, error) {
+		// Checked for every entry rather than every match so wide scans stop promptly as well
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		event, err := reader.Fetch(entry)
+		if err != nil {
+			return false, err
+		}
+
+		if event == nil || !matches(event) {
+			return true, nil
+		}
+
+		found++
+		if !yield(event) {
+			return false, nil
+		}
+
+		return filter.Limit <= 0 || found < filter.Limit, nil
+	})
+}
+
+// walkIndexes merges the index keys into a single stream of unique entries in index order, skipping entries
+// outside of the filter's kinds, since and until, and passes each one to visit until it returns false
+func walkIndexes(reader IndexReader, filter nostr.Filter, keys []string, visit func(entry IndexEntry) (bool, error)) error {
+	until := int64(-1)
+	if filter.Until != nil {
+		until = int64(*filter.Until)
+	}
+
+	iterators := make([]IndexIterator, len(keys))
+	heads := make([]*IndexEntry, len(keys))
+
+	for i, key := range keys {
+		iterators[i] = reader.Iterate(key, until)
+
+		head, err := iterators[i]()
+		if err != nil {
+			return err
+		}
+
+		heads[i] = head
+	}
+
+	seen := map[string]struct{}{}
+
+	for {
+		next := -1
+		for i, head := range heads {
+			if head != nil && (next < 0 || head.Before(*heads[next])) {
+				next = i
+			}
+		}
+
+		if next < 0 {
+			return nil
+		}
+
+		entry := *heads[next]
+
+		head, err := iterators[next]()
+		if err != nil {
+			return err
+		}
+		heads[next] = head
+
+		if filter.Since != nil && entry.CreatedAt < int64(*filter.Since) {
+			return nil
+		}
+
+		if until >= 0 && entry.CreatedAt > until {
+			continue
+		}
+
+		if filter.Kinds != nil && !containsKind(filter.Kinds, entry.Kind) {
+			continue
+		}
+
+		if _, ok := seen[entry.ID]; ok {
+			continue
+		}
+		seen[entry.ID] = struct{}{}
+
+		more, err := visit(entry)
+		if err != nil {
+			return err
+		}
+
+		if !more {
+			return nil
+		}
+	}
+}
+
+func containsKind(kinds []int, kind int) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,79 @@
+package stores
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// IsReplaceableKind reports whether only the latest event per pubkey and kind should be kept (NIP-01)
+func IsReplaceableKind(kind int) bool {
+	return kind == 0 || kind == 3 || (kind >= 10000 && kind < 20000)
+}
+
+// IsAddressableKind reports whether only the latest event per pubkey, kind and d tag should be kept (NIP-01)
+func IsAddressableKind(kind int) bool {
+	return kind >= 30000 && kind < 40000
+}
+
+// IsEphemeralKind reports whether an event is only meant to be relayed to live subscriptions and never stored (NIP-01)
+func IsEphemeralKind(kind int) bool {
+	return kind >= 20000 && kind < 30000
+}
+
+// EventIdentity returns the value that identifies an event across replacements, the pubkey for replaceable
+// events, the pubkey and d tag for addressable events and the event id for everything else
+func EventIdentity(event *nostr.Event) string {
+	if IsReplaceableKind(event.Kind) {
+		return event.PubKey
+	}
+
+	if IsAddressableKind(event.Kind) {
+		return event.PubKey + ":" + event.Tags.GetD()
+	}
+
+	return event.ID
+}
+
+// ErrSuperseded is returned by stores when a replaceable or addressable event is older than the version already stored
+var ErrSuperseded = errors.New("a newer version of this event is already stored")
+
+// ErrDuplicate is returned by stores when an event with the same id is already stored
+var ErrDuplicate = errors.New("event is already stored")
+
+// ErrEphemeral is returned by stores when asked to store an ephemeral event, they are relayed but never stored
+var ErrEphemeral = errors.New("ephemeral events are not stored")
+
+// ReplaceableKey returns the key shared by every version of a replaceable or addressable event, pubkey and kind
+// for replaceable events and pubkey, kind and d tag for addressable events, the d tag is hashed when it is too
+// long to be used in an index key
+func ReplaceableKey(event *nostr.Event) (string, bool) {
+	if IsReplaceableKind(event.Kind) {
+		return fmt.Sprintf("%s:%d", event.PubKey, event.Kind), true
+	}
+
+	if IsAddressableKind(event.Kind) {
+		d := event.Tags.GetD()
+		if len(d) > maxIndexValueLength {
+			hash := sha256.Sum256([]byte(d))
+			d = "sha256:" + hex.EncodeToString(hash[:])
+		}
+
+		return fmt.Sprintf("%s:%d:%s", event.PubKey, event.Kind, d), true
+	}
+
+	return "", false
+}
+
+// IsNewerVersion reports whether an event should replace the current version of a replaceable or addressable event,
+// the later created_at wins and ties go to the lowest id (NIP-01)
+func IsNewerVersion(event *nostr.Event, current *nostr.Event) bool {
+	if event.CreatedAt != current.CreatedAt {
+		return event.CreatedAt > current.CreatedAt
+	}
+
+	return event.ID < current.ID
+}
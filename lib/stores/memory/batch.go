@@ -0,0 +1,79 @@
+package memory
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+)
+
+// NewBatch applies the staged writes one at a time, the memory store has no transactions so a failed batch is
+// rolled back by deleting the dags, events and blobs it created, events it replaced are not restored
+func (store *GravitonMemoryStore) NewBatch() stores.Batch {
+	return stores.NewStagedBatch(func(writes []stores.StagedWrite) error {
+		roots := []string{}
+		events := []string{}
+		blobs := []string{}
+
+		rollback := func() {
+			for _, root := range roots {
+				store.DeleteDag(root)
+			}
+
+			for _, id := range events {
+				store.DeleteEvent(id)
+			}
+
+			for _, hash := range blobs {
+				store.DeleteBlob(hash)
+			}
+		}
+
+		for _, write := range writes {
+			switch {
+			case write.Leaf != nil:
+				isNew := false
+				if write.Leaf.Leaf.Hash == write.Root {
+					_, err := store.retrieveBucket(write.Root)
+					isNew = err != nil
+				}
+
+				err := store.StoreLeaf(write.Root, write.Leaf)
+				if err != nil {
+					rollback()
+					return err
+				}
+
+				if isNew {
+					roots = append(roots, write.Root)
+				}
+			case write.Event != nil:
+				existing, _ := store.QueryEvents(nostr.Filter{IDs: []string{write.Event.ID}})
+
+				err := store.StoreEvent(write.Event)
+				if err != nil {
+					rollback()
+					return err
+				}
+
+				if len(existing) == 0 {
+					events = append(events, write.Event.ID)
+				}
+			case write.Blob != nil:
+				descriptor := stores.NewBlobDescriptor(write.Blob.Data, write.Blob.ContentType)
+				_, _, existing := store.GetBlob(descriptor.SHA256)
+
+				_, err := store.StoreBlob(write.Blob.Data, write.Blob.ContentType, write.Blob.PublicKey)
+				if err != nil {
+					rollback()
+					return err
+				}
+
+				if existing != nil {
+					blobs = append(blobs, descriptor.SHA256)
+				}
+			}
+		}
+
+		return nil
+	})
+}
@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -26,6 +27,8 @@ type GravitonMemoryStore struct {
 	Database *graviton.Store
 
 	CacheConfig map[string]string
+
+	usage *usageTracker
 }
 
 func (store *GravitonMemoryStore) InitStore(args ...interface{}) error {
@@ -35,6 +38,7 @@ func (store *GravitonMemoryStore) InitStore(args ...interface{}) error {
 	}
 
 	store.Database = db
+	store.usage = newUsageTracker()
 
 	snapshot, err := db.LoadSnapshot(0)
 	if err != nil {
@@ -108,6 +112,8 @@ func (store *GravitonMemoryStore) StoreLeaf(root string, leafData *types.DagLeaf
 
 	var contentTree *graviton.Tree = nil
 
+	contentLength := int64(len(leafData.Leaf.Content))
+
 	if leafData.Leaf.Content != nil {
 		contentTree, err = snapshot.GetTree("content")
 		if err != nil {
@@ -124,6 +130,8 @@ func (store *GravitonMemoryStore) StoreLeaf(root string, leafData *types.DagLeaf
 
 	var rootLeaf *merkle_dag.DagLeaf
 
+	owner := leafData.PublicKey
+
 	if leafData.Leaf.Hash == root {
 		rootLeaf = &leafData.Leaf
 	} else {
@@ -133,6 +141,17 @@ func (store *GravitonMemoryStore) StoreLeaf(root string, leafData *types.DagLeaf
 		}
 
 		rootLeaf = &_rootLeaf.Leaf
+		owner = _rootLeaf.PublicKey
+	}
+
+	var items int64
+	if rootLeaf.Hash == leafData.Leaf.Hash {
+		items = 1
+	}
+
+	err = store.usage.charge(fmt.Sprintf("dag:%s:%s", root, leafData.Leaf.Hash), fmt.Sprintf("dag:%s", root), owner, contentLength, items)
+	if err != nil {
+		return err
 	}
 
 	bucket := GetBucket(rootLeaf)
@@ -332,72 +351,322 @@ func (store *GravitonMemoryStore) StoreDag(dag *types.DagData) error {
 	return stores.StoreDag(store, dag)
 }
 
-func (store *GravitonMemoryStore) QueryEvents(filter nostr.Filter) ([]*nostr.Event, error) {
-	log.Println("Processing filter:", filter)
+// DeleteDag removes the root index entry so the dag can no longer be retrieved, leaves and content may be
+// shared with other dags and are not reclaimed as the memory store only lives as long as the process
+func (store *GravitonMemoryStore) DeleteDag(root string) error {
+	snapshot, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		return err
+	}
+
+	indexTree, err := snapshot.GetTree("root_index")
+	if err != nil {
+		return err
+	}
+
+	if _, err := indexTree.Get([]byte(root)); err != nil {
+		return fmt.Errorf("dag not found: %s", root)
+	}
+
+	err = indexTree.Delete([]byte(root))
+	if err != nil {
+		return err
+	}
 
-	var events []*nostr.Event
+	_, err = graviton.Commit(indexTree)
+	if err != nil {
+		return err
+	}
 
-	ss, _ := store.Database.LoadSnapshot(0)
+	store.usage.release(fmt.Sprintf("dag:%s", root), fmt.Sprintf("dag:%s:", root))
 
-	for _, kind := range filter.Kinds {
-		tree, _ := ss.GetTree(fmt.Sprintf("kind:%d", kind))
+	return nil
+}
 
-		c := tree.Cursor()
+// matchingEvents loads every stored event that matches the filter, ignoring the limit
+func (store *GravitonMemoryStore) matchingEvents(filter nostr.Filter) ([]*nostr.Event, error) {
+	events := []*nostr.Event{}
+
+	ss, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := ss.GetTree("events")
+	if err != nil {
+		return nil, err
+	}
+
+	searchTerm := strings.ToLower(filter.Search)
+	now := time.Now().Unix()
+
+	matches := func(event *nostr.Event) bool {
+		if !filter.Matches(event) || stores.IsExpired(event, now) {
+			return false
+		}
+
+		return searchTerm == "" || strings.Contains(strings.ToLower(event.Content), searchTerm)
+	}
+
+	if filter.IDs != nil {
+		for _, id := range filter.IDs {
+			v, err := tree.Get([]byte(id))
+			if err != nil {
+				continue
+			}
 
-		for _, v, err := c.First(); err == nil; _, v, err = c.Next() {
 			var event nostr.Event
 			if err := jsoniter.Unmarshal(v, &event); err != nil {
 				continue
 			}
 
-			if filter.Matches(&event) {
+			if matches(&event) {
 				events = append(events, &event)
 			}
 		}
+
+		return events, nil
+	}
+
+	c := tree.Cursor()
+
+	for _, v, err := c.First(); err == nil; _, v, err = c.Next() {
+		var event nostr.Event
+		if err := jsoniter.Unmarshal(v, &event); err != nil {
+			continue
+		}
+
+		if matches(&event) {
+			events = append(events, &event)
+		}
+	}
+
+	return events, nil
+}
+
+func (store *GravitonMemoryStore) QueryEvents(filter nostr.Filter) ([]*nostr.Event, error) {
+	events := []*nostr.Event{}
+
+	err := store.IterateEvents(context.Background(), filter, func(event *nostr.Event) bool {
+		events = append(events, event)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// IterateEvents has to load and sort every match before yielding since the memory store keeps no indexes
+func (store *GravitonMemoryStore) IterateEvents(ctx context.Context, filter nostr.Filter, yield func(event *nostr.Event) bool) error {
+	if filter.LimitZero {
+		return nil
+	}
+
+	events, err := store.matchingEvents(filter)
+	if err != nil {
+		return err
 	}
 
 	sort.Slice(events, func(i, j int) bool {
-		return events[i].CreatedAt > events[j].CreatedAt
+		return stores.NewIndexEntry(events[i]).Before(stores.NewIndexEntry(events[j]))
 	})
 
-	if filter.Limit > 0 && len(events) > filter.Limit {
-		events = events[:filter.Limit]
+	for i, event := range events {
+		if filter.Limit > 0 && i >= filter.Limit {
+			break
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !yield(event) {
+			break
+		}
 	}
-	log.Println("Found", len(events), "matching events")
 
-	return events, nil
+	return nil
+}
+
+func (store *GravitonMemoryStore) CountEvents(filters ...nostr.Filter) (int64, error) {
+	matched := map[string]struct{}{}
+
+	for _, filter := range filters {
+		filter.LimitZero = false
+
+		events, err := store.matchingEvents(filter)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, event := range events {
+			matched[event.ID] = struct{}{}
+		}
+	}
+
+	return int64(len(matched)), nil
 }
 
 func (store *GravitonMemoryStore) StoreEvent(event *nostr.Event) error {
+	if stores.IsEphemeralKind(event.Kind) {
+		return stores.ErrEphemeral
+	}
+
 	eventData, err := jsoniter.Marshal(event)
 	if err != nil {
 		return err
 	}
 
-	ss, _ := store.Database.LoadSnapshot(0)
-	tree, _ := ss.GetTree(fmt.Sprintf("kind:%d", event.Kind))
+	ss, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		return err
+	}
+
+	tree, err := ss.GetTree("events")
+	if err != nil {
+		return err
+	}
+
+	slots, err := ss.GetTree("replaceable")
+	if err != nil {
+		return err
+	}
+
+	// Events are immutable so an event that is already stored is left as it is
+	if _, err := tree.Get([]byte(event.ID)); err == nil {
+		return stores.ErrDuplicate
+	}
 
-	tree.Put([]byte(event.ID), eventData)
+	bytes, items := stores.EventSize(event), int64(1)
 
-	graviton.Commit(tree)
+	// Replaceable and addressable events only keep their newest version, older versions are rejected
+	if key, ok := stores.ReplaceableKey(event); ok {
+		if currentID, err := slots.Get([]byte(key)); err == nil {
+			if value, err := tree.Get(currentID); err == nil {
+				var current nostr.Event
+				if err := jsoniter.Unmarshal(value, &current); err != nil {
+					return err
+				}
 
-	return nil
+				if !stores.IsNewerVersion(event, &current) {
+					return stores.ErrSuperseded
+				}
+
+				err = tree.Delete(currentID)
+				if err != nil {
+					return err
+				}
+
+				// Every version shares the author so the replacement is charged as the difference in size
+				bytes, items = bytes-stores.EventSize(&current), 0
+			}
+		}
+
+		err = slots.Put([]byte(key), []byte(event.ID))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = store.usage.event(event.PubKey, bytes, items)
+	if err != nil {
+		return err
+	}
+
+	err = tree.Put([]byte(event.ID), eventData)
+	if err != nil {
+		return err
+	}
+
+	_, err = graviton.Commit(tree, slots)
+
+	return err
 }
 
 func (store *GravitonMemoryStore) DeleteEvent(eventID string) error {
-	ss, _ := store.Database.LoadSnapshot(0)
-	tree, _ := ss.GetTree("events")
+	ss, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		return err
+	}
 
-	err := tree.Delete([]byte(eventID))
+	tree, err := ss.GetTree("events")
 	if err != nil {
 		return err
-	} else {
-		log.Println("Deleted event", eventID)
 	}
 
-	graviton.Commit(tree)
+	value, err := tree.Get([]byte(eventID))
+	if err != nil {
+		return fmt.Errorf("event not found: %s", eventID)
+	}
 
-	return nil
+	var event nostr.Event
+	if err := jsoniter.Unmarshal(value, &event); err != nil {
+		return err
+	}
+
+	err = tree.Delete([]byte(eventID))
+	if err != nil {
+		return err
+	}
+
+	slots, err := ss.GetTree("replaceable")
+	if err != nil {
+		return err
+	}
+
+	if key, ok := stores.ReplaceableKey(&event); ok {
+		if currentID, err := slots.Get([]byte(key)); err == nil && string(currentID) == eventID {
+			err = slots.Delete([]byte(key))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = graviton.Commit(tree, slots)
+	if err != nil {
+		return err
+	}
+
+	return store.usage.event(event.PubKey, -stores.EventSize(&event), -1)
+}
+
+// DeleteExpiredEvents scans every event since the memory store keeps no expiration index
+func (store *GravitonMemoryStore) DeleteExpiredEvents(now int64) (int, error) {
+	ss, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		return 0, err
+	}
+
+	tree, err := ss.GetTree("events")
+	if err != nil {
+		return 0, err
+	}
+
+	expired := []string{}
+
+	c := tree.Cursor()
+	for _, v, err := c.First(); err == nil; _, v, err = c.Next() {
+		var event nostr.Event
+		if err := jsoniter.Unmarshal(v, &event); err != nil {
+			continue
+		}
+
+		if stores.IsExpired(&event, now) {
+			expired = append(expired, event.ID)
+		}
+	}
+
+	for _, id := range expired {
+		err = store.DeleteEvent(id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), nil
 }
 
 func (store *GravitonMemoryStore) StoreBlob(data []byte, contentType string, publicKey string) (*types.BlobDescriptor, error) {
@@ -421,10 +690,29 @@ func (store *GravitonMemoryStore) StoreBlob(data []byte, contentType string, pub
 		return nil, err
 	}
 
+	if _, err := blossomTree.Get(hash[:]); err != nil {
+		err = store.usage.charge(fmt.Sprintf("blob:%s", sha256Str), fmt.Sprintf("blob:%s", sha256Str), publicKey, descriptor.Size, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	blossomTree.Put(hash[:], serializedDescriptor)
 	contentTree.Put(hash[:], data)
 
-	graviton.Commit(blossomTree, contentTree)
+	trees := []*graviton.Tree{blossomTree, contentTree}
+
+	if publicKey != "" {
+		ownerTree, err := snapshot.GetTree(fmt.Sprintf("blossom:%s", publicKey))
+		if err != nil {
+			return nil, err
+		}
+
+		ownerTree.Put(hash[:], []byte(sha256Str))
+		trees = append(trees, ownerTree)
+	}
+
+	graviton.Commit(trees...)
 
 	return &descriptor, nil
 }
@@ -458,6 +746,79 @@ func (store *GravitonMemoryStore) GetBlob(hash string) ([]byte, *string, error)
 	return content, &descriptor.Type, nil
 }
 
+// IndexBlob records a blob whose content is kept outside of the store
+func (store *GravitonMemoryStore) IndexBlob(descriptor types.BlobDescriptor, publicKey string) error {
+	snapshot, _ := store.Database.LoadSnapshot(0)
+	blossomTree, _ := snapshot.GetTree("blossom")
+
+	hash, err := hex.DecodeString(descriptor.SHA256)
+	if err != nil {
+		return err
+	}
+
+	descriptor.External = true
+
+	if existing, err := blossomTree.Get(hash); err != nil {
+		err = store.usage.charge(fmt.Sprintf("blob:%s", descriptor.SHA256), fmt.Sprintf("blob:%s", descriptor.SHA256), publicKey, descriptor.Size, 1)
+		if err != nil {
+			return err
+		}
+	} else {
+		// A blob with content in the store keeps its stored descriptor
+		var stored types.BlobDescriptor
+		if err := cbor.Unmarshal(existing, &stored); err == nil && !stored.External {
+			descriptor = stored
+		}
+	}
+
+	serializedDescriptor, err := cbor.Marshal(descriptor)
+	if err != nil {
+		return err
+	}
+
+	blossomTree.Put(hash, serializedDescriptor)
+
+	trees := []*graviton.Tree{blossomTree}
+
+	if publicKey != "" {
+		ownerTree, err := snapshot.GetTree(fmt.Sprintf("blossom:%s", publicKey))
+		if err != nil {
+			return err
+		}
+
+		ownerTree.Put(hash, []byte(descriptor.SHA256))
+		trees = append(trees, ownerTree)
+	}
+
+	_, err = graviton.Commit(trees...)
+
+	return err
+}
+
+// GetBlobDescriptor returns the descriptor of a stored or indexed blob
+func (store *GravitonMemoryStore) GetBlobDescriptor(hash string) (*types.BlobDescriptor, error) {
+	snapshot, _ := store.Database.LoadSnapshot(0)
+	blossomTree, _ := snapshot.GetTree("blossom")
+
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	serializedDescriptor, err := blossomTree.Get(hashBytes)
+	if err != nil {
+		return nil, fmt.Errorf("blob not found: %s", hash)
+	}
+
+	var descriptor types.BlobDescriptor
+	err = cbor.Unmarshal(serializedDescriptor, &descriptor)
+	if err != nil {
+		return nil, err
+	}
+
+	return &descriptor, nil
+}
+
 func (store *GravitonMemoryStore) DeleteBlob(hash string) error {
 	snapshot, _ := store.Database.LoadSnapshot(0)
 	blossomTree, _ := snapshot.GetTree("blossom")
@@ -471,24 +832,35 @@ func (store *GravitonMemoryStore) DeleteBlob(hash string) error {
 	blossomTree.Delete(hashBytes)
 	contentTree.Delete(hashBytes)
 
+	graviton.Commit(blossomTree, contentTree)
+
+	store.usage.release(fmt.Sprintf("blob:%s", hash), fmt.Sprintf("blob:%s", hash))
+
 	return nil
 }
 
 func (store *GravitonMemoryStore) ListBlobs(pubkey string, since, until int64) ([]types.BlobDescriptor, error) {
 	snapshot, _ := store.Database.LoadSnapshot(0)
 	blossomTree, _ := snapshot.GetTree("blossom")
-	cursor := blossomTree.Cursor()
 
 	results := []types.BlobDescriptor{}
 
-	_, value, cursorErr := cursor.First()
-	for {
-		if cursorErr == nil {
-			break
+	ownerTree, err := snapshot.GetTree(fmt.Sprintf("blossom:%s", pubkey))
+	if err != nil {
+		return results, nil
+	}
+
+	cursor := ownerTree.Cursor()
+
+	for hash, _, err := cursor.First(); err == nil; hash, _, err = cursor.Next() {
+		// Deleted blobs are left in the owner's tree so missing descriptors are skipped
+		serializedDescriptor, err := blossomTree.Get(hash)
+		if err != nil {
+			continue
 		}
 
 		var descriptor types.BlobDescriptor
-		err := cbor.Unmarshal(value, &descriptor)
+		err = cbor.Unmarshal(serializedDescriptor, &descriptor)
 		if err != nil {
 			return nil, err
 		}
@@ -496,8 +868,6 @@ func (store *GravitonMemoryStore) ListBlobs(pubkey string, since, until int64) (
 		if descriptor.Uploaded >= since && descriptor.Uploaded <= until {
 			results = append(results, descriptor)
 		}
-
-		_, value, cursorErr = cursor.Next()
 	}
 
 	return results, nil
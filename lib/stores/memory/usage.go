@@ -0,0 +1,116 @@
+package memory
+
+import (
+	"strings"
+	"sync"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+)
+
+// usageTracker keeps the quota usage for the memory store, dags and blobs are charged under a record
+// so the usage can be released when they are deleted
+type usageTracker struct {
+	mutex   sync.Mutex
+	usage   map[string]types.Usage
+	records map[string]*types.UsageRecord
+	charged map[string]struct{}
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{
+		usage:   map[string]types.Usage{},
+		records: map[string]*types.UsageRecord{},
+		charged: map[string]struct{}{},
+	}
+}
+
+func (tracker *usageTracker) get(publicKey string) types.Usage {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	return tracker.usage[stores.UsageKey(publicKey)]
+}
+
+func (tracker *usageTracker) add(publicKey string, bytes int64, items int64) error {
+	if publicKey == "" {
+		return nil
+	}
+
+	key := stores.UsageKey(publicKey)
+	usage := tracker.usage[key]
+
+	if bytes > 0 || items > 0 {
+		err := stores.CheckQuota(publicKey, usage, bytes, items)
+		if err != nil {
+			return err
+		}
+	}
+
+	tracker.usage[key] = stores.AddUsage(usage, bytes, items)
+
+	return nil
+}
+
+// charge adds usage for a public key once per charge key and keeps a record of it under the record key
+func (tracker *usageTracker) charge(chargeKey string, recordKey string, publicKey string, bytes int64, items int64) error {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if publicKey == "" {
+		return nil
+	}
+
+	if _, ok := tracker.charged[chargeKey]; ok {
+		return nil
+	}
+
+	err := tracker.add(publicKey, bytes, items)
+	if err != nil {
+		return err
+	}
+
+	tracker.charged[chargeKey] = struct{}{}
+
+	record, ok := tracker.records[recordKey]
+	if !ok {
+		record = &types.UsageRecord{PublicKey: publicKey}
+		tracker.records[recordKey] = record
+	}
+
+	record.Bytes += bytes
+
+	return nil
+}
+
+// release gives back everything charged under a record
+func (tracker *usageTracker) release(recordKey string, chargePrefix string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	record, ok := tracker.records[recordKey]
+	if !ok {
+		return
+	}
+
+	tracker.add(record.PublicKey, -record.Bytes, -1)
+	delete(tracker.records, recordKey)
+
+	for key := range tracker.charged {
+		if strings.HasPrefix(key, chargePrefix) {
+			delete(tracker.charged, key)
+		}
+	}
+}
+
+func (tracker *usageTracker) event(publicKey string, bytes int64, items int64) error {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	return tracker.add(publicKey, bytes, items)
+}
+
+func (store *GravitonMemoryStore) GetUsage(publicKey string) (*types.Usage, error) {
+	usage := store.usage.get(publicKey)
+	return &usage, nil
+}
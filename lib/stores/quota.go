@@ -0,0 +1,103 @@
+package stores
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/settings"
+)
+
+// QuotaError is returned by stores when a write would take a public key over its quota
+type QuotaError struct {
+	PublicKey string
+	Usage     types.Usage
+	Limit     types.QuotaLimit
+}
+
+func (err *QuotaError) Error() string {
+	if err.Limit.MaxItems > 0 && err.Usage.Items >= err.Limit.MaxItems {
+		return fmt.Sprintf("storage quota exceeded: %d of %d items used", err.Usage.Items, err.Limit.MaxItems)
+	}
+
+	return fmt.Sprintf("storage quota exceeded: %d of %d bytes used", err.Usage.Bytes, err.Limit.MaxBytes)
+}
+
+func IsQuotaError(err error) bool {
+	var quotaError *QuotaError
+	return errors.As(err, &quotaError)
+}
+
+// UsageKey normalizes a public key so usage is tracked under the same key regardless of the encoding the
+// transport received it in, npub keys are decoded to hex and hex keys are used as is
+func UsageKey(publicKey string) string {
+	if strings.HasPrefix(publicKey, "npub1") {
+		if _, value, err := nip19.Decode(publicKey); err == nil {
+			if hexKey, ok := value.(string); ok {
+				return hexKey
+			}
+		}
+	}
+
+	return publicKey
+}
+
+// LoadQuota returns the quota that applies to a public key from the relay settings
+func LoadQuota(publicKey string) types.QuotaLimit {
+	relaySettings := settings.Get()
+
+	key := UsageKey(publicKey)
+
+	for overrideKey, limit := range relaySettings.Quota.Overrides {
+		if UsageKey(overrideKey) == key {
+			return limit
+		}
+	}
+
+	return relaySettings.Quota.Default
+}
+
+// CheckQuota returns a QuotaError if adding the bytes and items to the current usage would exceed the public key's quota,
+// writes without a public key can not be attributed to anyone and are never limited
+func CheckQuota(publicKey string, usage types.Usage, bytes int64, items int64) error {
+	if publicKey == "" {
+		return nil
+	}
+
+	limit := LoadQuota(publicKey)
+
+	if (limit.MaxBytes > 0 && usage.Bytes+bytes > limit.MaxBytes) || (limit.MaxItems > 0 && usage.Items+items > limit.MaxItems) {
+		return &QuotaError{
+			PublicKey: UsageKey(publicKey),
+			Usage:     usage,
+			Limit:     limit,
+		}
+	}
+
+	return nil
+}
+
+// AddUsage applies a change in bytes and items to a usage, never letting either drop below zero
+func AddUsage(usage types.Usage, bytes int64, items int64) types.Usage {
+	usage.Bytes += bytes
+	usage.Items += items
+
+	if usage.Bytes < 0 {
+		usage.Bytes = 0
+	}
+
+	if usage.Items < 0 {
+		usage.Items = 0
+	}
+
+	return usage
+}
+
+// EventSize is the number of bytes an event is charged against its author's quota
+func EventSize(event *nostr.Event) int64 {
+	return int64(len(event.String()))
+}
@@ -1,9 +1,11 @@
 package stores
 
 import (
+	"context"
 	"log"
 
 	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/encryption"
 	merkle_dag "github.com/HORNET-Storage/scionic-merkletree/dag"
 	"github.com/nbd-wtf/go-nostr"
 )
@@ -18,9 +20,15 @@ type Store interface {
 	StoreDag(dag *types.DagData) error
 	BuildDagFromStore(root string, includeContent bool) (*types.DagData, error)
 	RetrieveLeafContent(contentHash []byte) ([]byte, error)
+	DeleteDag(root string) error
 
 	// Nostr
 	QueryEvents(filter nostr.Filter) ([]*nostr.Event, error)
+	// IterateEvents passes matching events to yield in created_at descending order as they are found, it stops
+	// when yield returns false or the context is cancelled, in which case the context's error is returned
+	IterateEvents(ctx context.Context, filter nostr.Filter, yield func(event *nostr.Event) bool) error
+	// CountEvents counts the events matching any of the filters, an event matching more than one is counted once
+	CountEvents(filters ...nostr.Filter) (int64, error)
 	StoreEvent(event *nostr.Event) error
 	DeleteEvent(eventID string) error
 
@@ -29,9 +37,57 @@ type Store interface {
 	GetBlob(sha256 string) ([]byte, *string, error)
 	DeleteBlob(sha256 string) error
 	ListBlobs(pubkey string, since, until int64) ([]types.BlobDescriptor, error)
+
+	// Batches
+	NewBatch() Batch
+
+	// Quotas
+	GetUsage(publicKey string) (*types.Usage, error)
+}
+
+// GarbageCollector is implemented by stores that reference count leaf content shared between dags and blobs
+type GarbageCollector interface {
+	// CollectGarbage removes content that is no longer referenced by any dag or blob and returns how many items were removed
+	CollectGarbage() (int, error)
+}
+
+// Backuper is implemented by stores that can copy a consistent snapshot of their data while they keep serving
+type Backuper interface {
+	// Backup copies the store's files into dir under the same name they have on disk so they can be restored in place
+	Backup(dir string) error
+}
+
+// BlobIndexer is implemented by stores that can keep the descriptors of blobs whose content lives outside of the store
+type BlobIndexer interface {
+	// IndexBlob records an external blob for its owner and charges it to their quota without storing any content,
+	// DeleteBlob removes indexed blobs the same way it removes stored ones
+	IndexBlob(descriptor types.BlobDescriptor, publicKey string) error
+
+	// GetBlobDescriptor returns the descriptor of a stored or indexed blob
+	GetBlobDescriptor(sha256 string) (*types.BlobDescriptor, error)
+}
+
+// EncryptedStore is implemented by stores that can seal what they write to disk with keys wrapped by a master key,
+// content hashes, CIDs and event ids stay in the clear so lookups, dedup and verification work as before
+type EncryptedStore interface {
+	// Encrypted reports whether the store was opened with a master key
+	Encrypted() bool
+
+	// RotateMasterKey wraps the data keys with a new master key without rewriting any stored data
+	RotateMasterKey(master *encryption.MasterKey) error
+
+	// RotateDataKey reseals everything stored under a new data key and returns how many values were rewritten
+	RotateDataKey(master *encryption.MasterKey) (int, error)
 }
 
 func BuildDagFromStore(store Store, root string, includeContent bool) (*types.DagData, error) {
+	return BuildDag(root, includeContent, func(hash string) (*types.DagLeafData, error) {
+		return store.RetrieveLeaf(root, hash, includeContent)
+	})
+}
+
+// BuildDag assembles a dag from the leaves returned by retrieve, stores use it to build dags from older versions of their data
+func BuildDag(root string, includeContent bool, retrieve func(hash string) (*types.DagLeafData, error)) (*types.DagData, error) {
 	builder := merkle_dag.CreateDagBuilder()
 
 	var publicKey *string
@@ -39,7 +95,11 @@ func BuildDagFromStore(store Store, root string, includeContent bool) (*types.Da
 	var addLeavesRecursively func(builder *merkle_dag.DagBuilder, hash string) error
 
 	addLeavesRecursively = func(builder *merkle_dag.DagBuilder, hash string) error {
-		data, err := store.RetrieveLeaf(root, hash, includeContent)
+		data, err := retrieve(hash)
+		if err != nil {
+			log.Println("Unable to find leaf in the database:", err)
+			return err
+		}
 
 		leaf := data.Leaf
 
@@ -48,11 +108,6 @@ func BuildDagFromStore(store Store, root string, includeContent bool) (*types.Da
 			signature = &data.Signature
 		}
 
-		if err != nil {
-			log.Println("Unable to find leaf in the database:", err)
-			return err
-		}
-
 		if !includeContent {
 			if leaf.Type == merkle_dag.FileLeafType {
 				leaf.Links = make(map[string]string)
@@ -90,7 +145,26 @@ func BuildDagFromStore(store Store, root string, includeContent bool) (*types.Da
 	return data, nil
 }
 
+// StoreDag stages every leaf of a dag starting from the root and commits them together so a dag is never partially stored
 func StoreDag(store Store, dag *types.DagData) error {
+	batch := store.NewBatch()
+
+	err := dag.Dag.IterateDag(func(leaf *merkle_dag.DagLeaf, parent *merkle_dag.DagLeaf) error {
+		data := &types.DagLeafData{
+			Leaf: *leaf,
+		}
+
+		if leaf.Hash == dag.Dag.Root {
+			data.PublicKey = dag.PublicKey
+			data.Signature = dag.Signature
+		}
+
+		return batch.StoreLeaf(dag.Dag.Root, data)
+	})
+	if err != nil {
+		batch.Discard()
+		return err
+	}
 
-	return nil
+	return batch.Commit()
 }
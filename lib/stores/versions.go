@@ -0,0 +1,27 @@
+package stores
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+)
+
+// VersionedStore is implemented by stores that keep every committed version of their data and can read from any of them
+type VersionedStore interface {
+	// ListVersions returns up to limit of the versions committed after since in the order they were committed,
+	// a limit of 0 returns all of them
+	ListVersions(since uint64, limit int) ([]types.StoreVersion, error)
+
+	// QueryEventsAt answers a filter with the events that were stored as of the given version and have not been deleted since
+	QueryEventsAt(filter nostr.Filter, version uint64) ([]*nostr.Event, error)
+
+	// BuildDagFromStoreAt builds a dag as it was stored as of the given version, deleted dags can't be built from any version
+	BuildDagFromStoreAt(root string, version uint64, includeContent bool) (*types.DagData, error)
+
+	// RestoreEventsAt stores the events matching the filter that were stored as of the given version and have been deleted since
+	// again and returns how many were restored
+	RestoreEventsAt(filter nostr.Filter, version uint64) (int, error)
+
+	// RestoreDagAt stores a dag that was stored as of the given version and has been deleted since again
+	RestoreDagAt(root string, version uint64) error
+}
@@ -0,0 +1,231 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ipfs/go-cid"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+	merkle_dag "github.com/HORNET-Storage/scionic-merkletree/dag"
+)
+
+// Sections larger than this are refused when reading a CAR file rather than allocated
+const maxCarSectionSize = 64 * 1024 * 1024
+
+// CAR files store CIDs under the dag-cbor link tag with a leading zero byte for the identity multibase
+const cborLinkTag = 42
+
+// carHeader is the CARv1 header, the fields are in dag-cbor key order
+type carHeader struct {
+	Roots   []cbor.Tag `cbor:"roots"`
+	Version uint64     `cbor:"version"`
+}
+
+// ExportCar writes a stored dag as a CARv1 archive rooted at the dag root, every leaf is a block keyed by its CID holding
+// the cbor encoded leaf with its content, the root block also carries the uploader's public key and signature
+//
+// Scionic leaf CIDs are computed from the leaf fields rather than the block bytes, tools that only read or move CAR files
+// work with these archives but tools that re-hash every block will not accept them
+func ExportCar(store stores.Store, root string, w io.Writer) (int, error) {
+	dagData, err := store.BuildDagFromStore(root, true)
+	if err != nil {
+		return 0, err
+	}
+
+	rootCid, err := cid.Decode(merkle_dag.GetHash(dagData.Dag.Root))
+	if err != nil {
+		return 0, fmt.Errorf("dag root is not a cid: %w", err)
+	}
+
+	header, err := cbor.Marshal(carHeader{
+		Roots:   []cbor.Tag{{Number: cborLinkTag, Content: append([]byte{0}, rootCid.Bytes()...)}},
+		Version: 1,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	writer := bufio.NewWriter(w)
+
+	err = writeCarSection(writer, header)
+	if err != nil {
+		return 0, err
+	}
+
+	blocks := 0
+
+	err = dagData.Dag.IterateDag(func(leaf *merkle_dag.DagLeaf, parent *merkle_dag.DagLeaf) error {
+		leafCid, err := cid.Decode(merkle_dag.GetHash(leaf.Hash))
+		if err != nil {
+			return fmt.Errorf("leaf %s is not a cid: %w", leaf.Hash, err)
+		}
+
+		data := &types.DagLeafData{
+			Leaf: *leaf,
+		}
+
+		if leaf.Hash == dagData.Dag.Root {
+			data.PublicKey = dagData.PublicKey
+			data.Signature = dagData.Signature
+		}
+
+		block, err := cbor.Marshal(data)
+		if err != nil {
+			return err
+		}
+
+		blocks++
+
+		return writeCarSection(writer, append(leafCid.Bytes(), block...))
+	})
+	if err != nil {
+		return blocks, err
+	}
+
+	return blocks, writer.Flush()
+}
+
+func writeCarSection(w io.Writer, data []byte) error {
+	length := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(length, uint64(len(data)))
+
+	if _, err := w.Write(length[:n]); err != nil {
+		return err
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func readCarSection(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if length > maxCarSectionSize {
+		return nil, fmt.Errorf("car section of %d bytes is too large", length)
+	}
+
+	data := make([]byte, length)
+
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// ImportCar reads a CARv1 archive written by ExportCar and stores the dag it holds, the leaves are checked the same way
+// as uploaded leaves and the whole dag is verified before anything is stored, canImport is given the root leaf along
+// with the uploader's public key and signature and can refuse the dag just like the upload handler
+func ImportCar(store stores.Store, r io.Reader, canImport func(rootLeaf *merkle_dag.DagLeaf, pubKey *string, signature *string) bool) (*types.DagData, error) {
+	reader := bufio.NewReader(r)
+
+	headerData, err := readCarSection(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read car header: %w", err)
+	}
+
+	var header carHeader
+	if err := cbor.Unmarshal(headerData, &header); err != nil {
+		return nil, fmt.Errorf("failed to decode car header: %w", err)
+	}
+
+	if header.Version != 1 {
+		return nil, fmt.Errorf("unsupported car version %d", header.Version)
+	}
+
+	if len(header.Roots) != 1 {
+		return nil, fmt.Errorf("expected a single root, the car file has %d", len(header.Roots))
+	}
+
+	rootBytes, ok := header.Roots[0].Content.([]byte)
+	if header.Roots[0].Number != cborLinkTag || !ok || len(rootBytes) < 1 {
+		return nil, fmt.Errorf("car root is not a cid")
+	}
+
+	_, rootCid, err := cid.CidFromBytes(rootBytes[1:])
+	if err != nil {
+		return nil, fmt.Errorf("car root is not a cid: %w", err)
+	}
+
+	builder := merkle_dag.CreateDagBuilder()
+
+	var rootData *types.DagLeafData
+
+	for {
+		section, err := readCarSection(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read car section: %w", err)
+		}
+
+		n, blockCid, err := cid.CidFromBytes(section)
+		if err != nil {
+			return nil, fmt.Errorf("car section does not start with a cid: %w", err)
+		}
+
+		data := &types.DagLeafData{}
+		if err := cbor.Unmarshal(section[n:], data); err != nil {
+			return nil, fmt.Errorf("block %s is not a dag leaf: %w", blockCid, err)
+		}
+
+		leafCid, err := cid.Decode(merkle_dag.GetHash(data.Leaf.Hash))
+		if err != nil || !leafCid.Equals(blockCid) {
+			return nil, fmt.Errorf("block %s does not hold the leaf it is keyed by", blockCid)
+		}
+
+		if blockCid.Equals(rootCid) {
+			err = data.Leaf.VerifyRootLeaf()
+			if err != nil {
+				return nil, fmt.Errorf("failed to verify root leaf: %w", err)
+			}
+
+			rootData = data
+		} else {
+			err = data.Leaf.VerifyLeaf()
+			if err != nil {
+				return nil, fmt.Errorf("failed to verify leaf %s: %w", data.Leaf.Hash, err)
+			}
+		}
+
+		builder.AddLeaf(&data.Leaf, nil)
+	}
+
+	if rootData == nil {
+		return nil, fmt.Errorf("car file does not contain its root %s", rootCid)
+	}
+
+	if canImport != nil && !canImport(&rootData.Leaf, &rootData.PublicKey, &rootData.Signature) {
+		return nil, fmt.Errorf("not allowed to import dag %s", rootData.Leaf.Hash)
+	}
+
+	dagData := &types.DagData{
+		PublicKey: rootData.PublicKey,
+		Signature: rootData.Signature,
+		Dag:       *builder.BuildDag(rootData.Leaf.Hash),
+	}
+
+	err = dagData.Dag.Verify()
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify dag: %w", err)
+	}
+
+	// StoreDag commits every leaf in a single batch so a dag that fails to store leaves nothing behind
+	err = store.StoreDag(dagData)
+	if err != nil {
+		return nil, err
+	}
+
+	return dagData, nil
+}
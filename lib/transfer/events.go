@@ -0,0 +1,284 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nbd-wtf/go-nostr"
+
+	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+)
+
+// Events are imported in batches of this size unless told otherwise
+const DefaultImportBatchSize = 500
+
+// ExportCheckpoint describes what an interrupted export already wrote so it can carry on from where it stopped
+type ExportCheckpoint struct {
+	// Written is how many events the export file already holds
+	Written int
+
+	// Size is the length of the export file up to the end of its last complete line, anything after it was cut off mid write
+	Size int64
+
+	// Until is the created_at of the oldest event written so far, stores return events newest first so nothing older has been written
+	Until *nostr.Timestamp
+
+	// Seen holds the ids already written that were created at Until
+	Seen map[string]struct{}
+}
+
+// LoadExportCheckpoint reads an existing export to find where it should resume from
+func LoadExportCheckpoint(r io.Reader) (*ExportCheckpoint, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	checkpoint := &ExportCheckpoint{
+		Seen: map[string]struct{}{},
+	}
+
+	reader := bufio.NewReader(r)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without a newline was still being written when the export stopped
+			return checkpoint, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		checkpoint.Size += int64(len(line))
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var event nostr.Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, fmt.Errorf("line %d of the export is not an event: %w", checkpoint.Written+1, err)
+		}
+
+		checkpoint.Written++
+
+		if checkpoint.Until == nil || event.CreatedAt < *checkpoint.Until {
+			until := event.CreatedAt
+			checkpoint.Until = &until
+			checkpoint.Seen = map[string]struct{}{}
+		}
+
+		checkpoint.Seen[event.ID] = struct{}{}
+	}
+}
+
+// ExportEvents writes every event matching the filter to w as newline delimited JSON, newest first, when a checkpoint
+// is given the events it has already written are skipped and the filter limit counts them as exported
+func ExportEvents(ctx context.Context, store stores.Store, filter nostr.Filter, w io.Writer, checkpoint *ExportCheckpoint, progress func(written int)) (int, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	written := 0
+	seen := map[string]struct{}{}
+
+	if checkpoint != nil {
+		written = checkpoint.Written
+		seen = checkpoint.Seen
+
+		if checkpoint.Until != nil && (filter.Until == nil || *checkpoint.Until < *filter.Until) {
+			filter.Until = checkpoint.Until
+		}
+
+		if filter.Limit > 0 {
+			if written >= filter.Limit {
+				return written, nil
+			}
+
+			filter.Limit -= written
+		}
+	}
+
+	writer := bufio.NewWriter(w)
+
+	var writeErr error
+
+	err := store.IterateEvents(ctx, filter, func(event *nostr.Event) bool {
+		if _, exists := seen[event.ID]; exists {
+			return true
+		}
+
+		line, err := json.Marshal(event)
+		if err != nil {
+			writeErr = err
+			return false
+		}
+
+		line = append(line, '\n')
+
+		if _, err := writer.Write(line); err != nil {
+			writeErr = err
+			return false
+		}
+
+		written++
+
+		if progress != nil {
+			progress(written)
+		}
+
+		return true
+	})
+	if err == nil {
+		err = writeErr
+	}
+
+	// Whatever was exported is flushed even on failure so a resumed export doesn't write it twice
+	if flushErr := writer.Flush(); err == nil {
+		err = flushErr
+	}
+
+	return written, err
+}
+
+// ImportProgress counts what has happened to the lines read by ImportEvents
+type ImportProgress struct {
+	// Lines is how many lines have been read and dealt with, including the lines skipped when resuming
+	Lines int
+
+	Stored int
+
+	// Invalid events failed validation or could not be parsed
+	Invalid int
+
+	// Rejected events were refused by the store, for being superseded, already stored, ephemeral or going over a quota
+	Rejected int
+}
+
+// ImportEvents reads newline delimited JSON events from r, checks each one with the same rules as events sent to the relay
+// and stores them a batch at a time, the first skip lines are passed over so an interrupted import can be resumed from the
+// line count given to the last progress call, progress is only called once a batch has been committed
+func ImportEvents(ctx context.Context, store stores.Store, r io.Reader, skip int, batchSize int, progress func(progress ImportProgress)) (ImportProgress, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	if batchSize <= 0 {
+		batchSize = DefaultImportBatchSize
+	}
+
+	result := ImportProgress{}
+	pending := []*nostr.Event{}
+	lines := 0
+
+	flush := func() error {
+		if len(pending) > 0 {
+			stored, rejected, err := storeEvents(store, pending)
+			if err != nil {
+				return err
+			}
+
+			result.Stored += stored
+			result.Rejected += rejected
+			pending = []*nostr.Event{}
+		}
+
+		result.Lines = lines
+
+		if progress != nil {
+			progress(result)
+		}
+
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		lines++
+
+		if lines <= skip {
+			result.Lines = lines
+			continue
+		}
+
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var event nostr.Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			result.Invalid++
+			continue
+		}
+
+		// Imports skip proof of work, it prices publishing to the relay over a connection while an import is run by
+		// the operator and usually holds events that were published elsewhere without mining for this relay's minimum
+		err := lib_nostr.CheckEvent(&event, -1, "", false)
+		if err != nil {
+			var invalid *lib_nostr.InvalidEventError
+			if !errors.As(err, &invalid) {
+				return result, err
+			}
+
+			result.Invalid++
+			continue
+		}
+
+		pending = append(pending, &event)
+
+		if len(pending) >= batchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+
+	return result, flush()
+}
+
+// storeEvents commits the events as a single batch, if the batch is refused the events are stored one at a time so a
+// single superseded, duplicate or over quota event only rejects itself
+func storeEvents(store stores.Store, events []*nostr.Event) (int, int, error) {
+	batch := store.NewBatch()
+
+	for _, event := range events {
+		if err := batch.StoreEvent(event); err != nil {
+			batch.Discard()
+			return 0, 0, err
+		}
+	}
+
+	if err := batch.Commit(); err == nil {
+		return len(events), 0, nil
+	}
+
+	stored, rejected := 0, 0
+
+	for _, event := range events {
+		err := store.StoreEvent(event)
+		if err == nil {
+			stored++
+			continue
+		}
+
+		if errors.Is(err, stores.ErrSuperseded) || errors.Is(err, stores.ErrDuplicate) || errors.Is(err, stores.ErrEphemeral) || stores.IsQuotaError(err) {
+			rejected++
+			continue
+		}
+
+		return stored, rejected, err
+	}
+
+	return stored, rejected, nil
+}
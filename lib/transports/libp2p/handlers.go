@@ -0,0 +1,75 @@
+package libp2p
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
+	"github.com/HORNET-Storage/hornet-storage/lib/stores"
+)
+
+// Nostr handlers are served under this prefix followed by the name they were registered with
+const eventProtocolPrefix = "/nostr/event/"
+
+// RegisterHandlers serves every registered nostr handler over libp2p, ephemeral kinds have no kind handler of their
+// own so streams opened for one are given to the ephemeral handler
+func RegisterHandlers(libp2phost host.Host) {
+	for name := range lib_nostr.GetHandlers() {
+		libp2phost.SetStreamHandler(protocol.ID(eventProtocolPrefix+name), BuildStreamHandler(lib_nostr.GetHandler(name)))
+	}
+
+	if handler := lib_nostr.GetHandler("ephemeral"); handler != nil {
+		libp2phost.SetStreamHandlerMatch(protocol.ID(eventProtocolPrefix+"kind/20000"), isEphemeralProtocol, BuildStreamHandler(handler))
+	}
+}
+
+// isEphemeralProtocol reports whether a protocol is the kind handler protocol of an ephemeral kind
+func isEphemeralProtocol(id protocol.ID) bool {
+	number, ok := strings.CutPrefix(string(id), eventProtocolPrefix+"kind/")
+	if !ok {
+		return false
+	}
+
+	kind, err := strconv.Atoi(number)
+
+	return err == nil && stores.IsEphemeralKind(kind)
+}
+
+// BuildStreamHandler runs a nostr handler over a libp2p stream, the handler reads one message and its responses are
+// written back to the stream
+func BuildStreamHandler(handler lib_nostr.KindHandler) network.StreamHandler {
+	return func(stream network.Stream) {
+		read := func() ([]byte, error) {
+			decoder := json.NewDecoder(stream)
+
+			var rawMessage json.RawMessage
+			err := decoder.Decode(&rawMessage)
+			if err != nil {
+				return nil, err
+			}
+
+			return rawMessage, nil
+		}
+
+		write := func(messageType string, params ...interface{}) {
+			response := lib_nostr.BuildResponse(messageType, params)
+
+			if len(response) > 0 {
+				stream.Write(response)
+			}
+		}
+
+		// Events accepted over libp2p are delivered to the websocket subscriptions as well
+		read, write = lib_nostr.BroadcastAccepted(read, write)
+
+		// Libp2p connections can't authenticate so no event is exempt from proof of work
+		handler(read, write, "")
+
+		stream.Close()
+	}
+}
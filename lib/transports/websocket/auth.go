@@ -1,13 +1,96 @@
 package websocket
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+
 	"github.com/gofiber/contrib/websocket"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/puzpuzpuz/xsync/v3"
+	"github.com/spf13/viper"
 
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 )
 
-func handleAuthMessage(c *websocket.Conn, env *nostr.AuthEnvelope, challenge string, state *connectionState) {
+const challengeLength = 32
+
+// connectionState lives as long as the connection, every connection gets its own challenge so an AUTH event
+// captured on one connection can't be replayed on another and authenticating once lasts until it closes (NIP-42)
+type connectionState struct {
+	challenge string
+	pubkey    atomic.Pointer[string]
+}
+
+// Connection state indexed by WebSocket connection so listeners can check it when notifying
+var connections = xsync.NewMapOf[*websocket.Conn, *connectionState]()
+
+func newConnectionState() (*connectionState, error) {
+	bytes := make([]byte, challengeLength)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate random bytes: %v", err)
+	}
+
+	return &connectionState{challenge: hex.EncodeToString(bytes)}, nil
+}
+
+func (state *connectionState) authenticated() bool {
+	return state.pubkey.Load() != nil
+}
+
+// authenticatedPubkey returns the pubkey the connection authenticated as, or an empty string if it hasn't
+func (state *connectionState) authenticatedPubkey() string {
+	if pubkey := state.pubkey.Load(); pubkey != nil {
+		return *pubkey
+	}
+
+	return ""
+}
+
+func isAuthenticated(ws *websocket.Conn) bool {
+	state, ok := connections.Load(ws)
+	return ok && state.authenticated()
+}
+
+// Operators can require AUTH before a connection may publish, subscribe or count, or before it may touch specific kinds
+func publishRequiresAuth(kind int) bool {
+	return viper.GetBool("auth_required_publish") || kindRequiresAuth(kind)
+}
+
+func reqRequiresAuth(filters nostr.Filters) bool {
+	return viper.GetBool("auth_required_req") || filtersRequireAuth(filters)
+}
+
+func countRequiresAuth(filters nostr.Filters) bool {
+	return viper.GetBool("auth_required_count") || filtersRequireAuth(filters)
+}
+
+func kindRequiresAuth(kind int) bool {
+	for _, restricted := range viper.GetIntSlice("auth_required_kinds") {
+		if restricted == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Filters asking for a restricted kind need AUTH, filters that don't name any kinds are answered without the restricted ones
+func filtersRequireAuth(filters nostr.Filters) bool {
+	for _, filter := range filters {
+		for _, kind := range filter.Kinds {
+			if kindRequiresAuth(kind) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func handleAuthMessage(c *websocket.Conn, env *nostr.AuthEnvelope, state *connectionState) {
 	write := func(messageType string, params ...interface{}) {
 		response := lib_nostr.BuildResponse(messageType, params)
 		if len(response) > 0 {
@@ -16,7 +99,7 @@ func handleAuthMessage(c *websocket.Conn, env *nostr.AuthEnvelope, challenge str
 	}
 
 	if env.Event.Kind != 22242 {
-		write("OK", env.Event.ID, false, "Error auth event kind must be 22242")
+		lib_nostr.WriteRejected(write, env.Event.ID, lib_nostr.PrefixInvalid, "auth event kind must be 22242")
 		return
 	}
 
@@ -28,12 +111,12 @@ func handleAuthMessage(c *websocket.Conn, env *nostr.AuthEnvelope, challenge str
 
 	success, err := env.Event.CheckSignature()
 	if err != nil {
-		write("NOTICE", "Failed to check signature")
+		lib_nostr.WriteRejected(write, env.Event.ID, lib_nostr.PrefixError, "failed to check signature")
 		return
 	}
 
 	if !success {
-		write("OK", env.Event.ID, false, "Signature failed to verify")
+		lib_nostr.WriteRejected(write, env.Event.ID, lib_nostr.PrefixInvalid, "signature failed to verify")
 		return
 	}
 
@@ -44,8 +127,8 @@ func handleAuthMessage(c *websocket.Conn, env *nostr.AuthEnvelope, challenge str
 				hasRelayTag = true
 			} else if tag[0] == "challenge" {
 				hasChallengeTag = true
-				if tag[1] != challenge {
-					write("OK", env.Event.ID, false, "Error checking session challenge")
+				if tag[1] != state.challenge {
+					lib_nostr.WriteRejected(write, env.Event.ID, lib_nostr.PrefixInvalid, "challenge does not match this connection")
 					return
 				}
 			}
@@ -53,17 +136,12 @@ func handleAuthMessage(c *websocket.Conn, env *nostr.AuthEnvelope, challenge str
 	}
 
 	if !hasRelayTag || !hasChallengeTag {
-		write("OK", env.Event.ID, false, "Error event does not have required tags")
-		return
-	}
-
-	err = AuthenticateConnection(c)
-	if err != nil {
-		write("OK", env.Event.ID, false, "Error authorizing connection")
+		lib_nostr.WriteRejected(write, env.Event.ID, lib_nostr.PrefixInvalid, "auth event does not have the relay and challenge tags")
 		return
 	}
 
-	state.authenticated = true
+	pubkey := env.Event.PubKey
+	state.pubkey.Store(&pubkey)
 
-	write("OK", env.Event.ID, true, "")
+	lib_nostr.WriteAccepted(write, env.Event.ID)
 }
@@ -1,33 +1,23 @@
 package websocket
 
 import (
-	"fmt"
 	"log"
 
-	jsoniter "github.com/json-iterator/go"
-
 	"github.com/gofiber/contrib/websocket"
 	"github.com/nbd-wtf/go-nostr"
 )
 
+// Clients closing their own subscriptions aren't answered, CLOSED is only sent when the relay ends a subscription (NIP-01)
 func handleCloseMessage(c *websocket.Conn, env *nostr.CloseEnvelope) {
-	var json = jsoniter.ConfigCompatibleWithStandardLibrary
-	var closeEvent []string
-	err := json.Unmarshal([]byte(env.String()), &closeEvent)
-	if err != nil {
-		fmt.Println("Error:", err)
-		errMsg := "Error unmarshalling CLOSE request: " + err.Error()
-		if writeErr := sendWebSocketMessage(c, nostr.NoticeEnvelope(errMsg)); writeErr != nil {
-			fmt.Println("Error sending NOTICE message:", writeErr)
-		}
-	}
-	subscriptionID := closeEvent[1]
+	removeListenerId(c, string(*env))
+}
 
+// closeSubscription ends a subscription from the relay's side, or refuses one that was never opened, and tells the
+// client why, a refused REQ that reused an id also ends the subscription it would have replaced
+func closeSubscription(c *websocket.Conn, subscriptionID string, reason string) {
 	removeListenerId(c, subscriptionID)
 
-	responseMsg := nostr.ClosedEnvelope{SubscriptionID: subscriptionID, Reason: "Subscription closed successfully."}
-
-	if err := sendWebSocketMessage(c, responseMsg); err != nil {
+	if err := sendWebSocketMessage(c, nostr.ClosedEnvelope{SubscriptionID: subscriptionID, Reason: reason}); err != nil {
 		log.Printf("Error sending 'CLOSED' envelope over WebSocket: %v", err)
 	}
 }
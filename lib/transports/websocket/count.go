@@ -1,8 +1,6 @@
 package websocket
 
 import (
-	"context"
-
 	jsoniter "github.com/json-iterator/go"
 
 	"github.com/gofiber/contrib/websocket"
@@ -11,20 +9,21 @@ import (
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 )
 
-func handleCountMessage(c *websocket.Conn, env *nostr.CountEnvelope, challenge string) {
+func handleCountMessage(c *websocket.Conn, env *nostr.CountEnvelope, state *connectionState) {
 	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 	handler := lib_nostr.GetHandler("count")
 
-	if handler != nil {
-		_, cancelFunc := context.WithCancel(context.Background())
-
-		setListener(env.SubscriptionID, c, env.Filters, cancelFunc)
+	if countRequiresAuth(env.Filters) && !state.authenticated() {
+		sendWebSocketMessage(c, nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: lib_nostr.Reason(lib_nostr.PrefixAuthRequired, "authenticate to count events")})
+		return
+	}
 
-		response := lib_nostr.BuildResponse("AUTH", challenge)
-		if len(response) > 0 {
-			handleIncomingMessage(c, response)
-		}
+	if reason := getSubscriptionLimits().checkFilters(env.Filters); reason != "" {
+		sendWebSocketMessage(c, nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: reason})
+		return
+	}
 
+	if handler != nil {
 		read := func() ([]byte, error) {
 			return json.Marshal(env)
 		}
@@ -36,6 +35,6 @@ func handleCountMessage(c *websocket.Conn, env *nostr.CountEnvelope, challenge s
 			}
 		}
 
-		handler(read, write)
+		handler(read, write, state.authenticatedPubkey())
 	}
 }
@@ -2,72 +2,73 @@ package websocket
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/gofiber/contrib/websocket"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/nbd-wtf/go-nostr"
 
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
+	"github.com/HORNET-Storage/hornet-storage/lib/settings"
+	"github.com/HORNET-Storage/hornet-storage/lib/stores"
 )
 
-func handleEventMessage(c *websocket.Conn, env *nostr.EventEnvelope) {
-	settings, err := lib_nostr.LoadRelaySettings()
-	if err != nil {
-		log.Printf("Failed to load relay settings: %v", err)
+func handleEventMessage(c *websocket.Conn, env *nostr.EventEnvelope, state *connectionState) {
+	if publishRequiresAuth(env.Event.Kind) && !state.authenticated() {
+		sendWebSocketMessage(c, nostr.OKEnvelope{EventID: env.Event.ID, OK: false, Reason: lib_nostr.Reason(lib_nostr.PrefixAuthRequired, "authenticate to publish this event")})
+		return
 	}
 
-	if settings.Mode == "unlimited" {
-		handleUnlimitedModeEvent(c, env)
-	} else if settings.Mode == "smart" {
-		handleSmartModeEvent(c, env)
+	// Ephemeral events are relayed in every mode without being stored
+	if stores.IsEphemeralKind(env.Event.Kind) {
+		handleEphemeralEvent(c, env, state)
+		return
 	}
-}
 
-func handleUnlimitedModeEvent(c *websocket.Conn, env *nostr.EventEnvelope) {
-	var json = jsoniter.ConfigCompatibleWithStandardLibrary
-	handler := lib_nostr.GetHandler("universal")
+	relaySettings := settings.Get()
 
-	read := func() ([]byte, error) {
-		return json.Marshal(env)
+	if relaySettings.Mode == "unlimited" {
+		handleUnlimitedModeEvent(c, env, state)
+	} else if relaySettings.Mode == "smart" {
+		handleSmartModeEvent(c, env, state)
 	}
+}
 
-	write := func(messageType string, params ...interface{}) {
-		response := lib_nostr.BuildResponse(messageType, params)
-		if len(response) > 0 {
-			handleIncomingMessage(c, response)
-		}
-	}
+func handleUnlimitedModeEvent(c *websocket.Conn, env *nostr.EventEnvelope, state *connectionState) {
+	dispatchEvent(c, env, state, "universal", "universal handler not supported")
+}
 
-	if handler != nil {
-		notifyListeners(&env.Event)
+func handleSmartModeEvent(c *websocket.Conn, env *nostr.EventEnvelope, state *connectionState) {
+	dispatchEvent(c, env, state, fmt.Sprintf("kind/%d", env.Kind), fmt.Sprintf("kind %d is not supported", env.Kind))
+}
 
-		handler(read, write)
-	} else {
-		write("OK", env.Event.ID, false, "Universal handler not supported")
-	}
+func handleEphemeralEvent(c *websocket.Conn, env *nostr.EventEnvelope, state *connectionState) {
+	dispatchEvent(c, env, state, "ephemeral", "ephemeral events are not supported")
 }
 
-func handleSmartModeEvent(c *websocket.Conn, env *nostr.EventEnvelope) {
+func dispatchEvent(c *websocket.Conn, env *nostr.EventEnvelope, state *connectionState, name string, unsupported string) {
 	var json = jsoniter.ConfigCompatibleWithStandardLibrary
-	handler := lib_nostr.GetHandler(fmt.Sprintf("kind/%d", env.Kind))
+	handler := lib_nostr.GetHandler(name)
 
 	read := func() ([]byte, error) {
 		return json.Marshal(env)
 	}
 
 	write := func(messageType string, params ...interface{}) {
+		// Subscribers only see the event once the handler has accepted it
+		if lib_nostr.Accepted(messageType, params) {
+			lib_nostr.Broadcast(&env.Event)
+		}
+
 		response := lib_nostr.BuildResponse(messageType, params)
 		if len(response) > 0 {
 			handleIncomingMessage(c, response)
 		}
 	}
 
+	// Only events authored by the pubkey this connection authenticated as are exempt from proof of work
 	if handler != nil {
-		notifyListeners(&env.Event)
-
-		handler(read, write)
+		handler(read, write, state.authenticatedPubkey())
 	} else {
-		write("OK", env.Event.ID, false, "Kind not supported")
+		lib_nostr.WriteRejected(write, env.Event.ID, lib_nostr.PrefixBlocked, unsupported)
 	}
 }
@@ -0,0 +1,104 @@
+package websocket
+
+import (
+	"fmt"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/viper"
+
+	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
+)
+
+// subscriptionLimits caps what a single connection can ask for, zero means no cap, the caps are advertised in the
+// NIP-11 limitation object so well behaved clients never run into them
+type subscriptionLimits struct {
+	MaxSubscriptions int
+	MaxFilters       int
+	MaxLimit         int
+	MaxSubIDLength   int
+}
+
+func getSubscriptionLimits() subscriptionLimits {
+	return subscriptionLimits{
+		MaxSubscriptions: viper.GetInt("max_subscriptions"),
+		MaxFilters:       viper.GetInt("max_filters"),
+		MaxLimit:         viper.GetInt("max_limit"),
+		MaxSubIDLength:   viper.GetInt("max_subid_length"),
+	}
+}
+
+// checkRequest returns why a REQ is refused or an empty string when the subscription can be opened
+func (limits subscriptionLimits) checkRequest(ws *websocket.Conn, id string, filters nostr.Filters) string {
+	if reason := limits.checkSubscriptionID(id); reason != "" {
+		return reason
+	}
+
+	if reason := limits.checkFilters(filters); reason != "" {
+		return reason
+	}
+
+	return limits.checkSubscriptions(ws, id)
+}
+
+// checkSubscriptionID returns why a subscription id is refused or an empty string when it can be used
+func (limits subscriptionLimits) checkSubscriptionID(id string) string {
+	if id == "" {
+		return lib_nostr.Reason(lib_nostr.PrefixInvalid, "subscription id must not be empty")
+	}
+
+	if limits.MaxSubIDLength > 0 && len(id) > limits.MaxSubIDLength {
+		return lib_nostr.Reason(lib_nostr.PrefixInvalid, fmt.Sprintf("subscription id is longer than %d characters", limits.MaxSubIDLength))
+	}
+
+	return ""
+}
+
+// checkFilters returns why a set of filters is refused or an empty string when they can be answered
+func (limits subscriptionLimits) checkFilters(filters nostr.Filters) string {
+	if limits.MaxFilters > 0 && len(filters) > limits.MaxFilters {
+		return lib_nostr.Reason(lib_nostr.PrefixInvalid, fmt.Sprintf("too many filters, at most %d are allowed", limits.MaxFilters))
+	}
+
+	return ""
+}
+
+// checkSubscriptions returns why a connection can't open another subscription, replacing one of its own is always allowed
+func (limits subscriptionLimits) checkSubscriptions(ws *websocket.Conn, id string) string {
+	if limits.MaxSubscriptions <= 0 {
+		return ""
+	}
+
+	conData, ok := listeners.Load(ws)
+	if !ok {
+		return ""
+	}
+
+	if _, exists := conData.subscriptions.Load(id); exists {
+		return ""
+	}
+
+	if conData.subscriptions.Size() >= limits.MaxSubscriptions {
+		return lib_nostr.Reason(lib_nostr.PrefixBlocked, fmt.Sprintf("too many open subscriptions, at most %d are allowed", limits.MaxSubscriptions))
+	}
+
+	return ""
+}
+
+// clampLimits lowers every filter's limit to the cap, filters without a limit are given the cap so no request can
+// stream the whole store
+func (limits subscriptionLimits) clampLimits(filters nostr.Filters) {
+	if limits.MaxLimit <= 0 {
+		return
+	}
+
+	for i := range filters {
+		if filters[i].LimitZero {
+			continue
+		}
+
+		if filters[i].Limit <= 0 || filters[i].Limit > limits.MaxLimit {
+			filters[i].Limit = limits.MaxLimit
+		}
+	}
+}
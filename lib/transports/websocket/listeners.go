@@ -2,38 +2,31 @@ package websocket
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
-	"fmt"
 	"log"
-
-	"sync/atomic"
+	"time"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/puzpuzpuz/xsync/v3"
+
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
 )
 
 // Global map to hold all listeners indexed by WebSocket connections and subscription IDs.
 var listeners = xsync.NewMapOf[*websocket.Conn, ListenerData]()
 
-// Global challenge variable
-var globalChallenge atomic.Value
-
-const challengeLength = 32
-
-// SetListener sets a new listener with given ID, WebSocket connection, filters, and cancel function.
+// SetListener sets a new listener with given ID, WebSocket connection, filters, and cancel function,
+// a listener already using the ID is replaced and cancelled.
 func setListener(id string, ws *websocket.Conn, filters nostr.Filters, cancel context.CancelFunc) {
 	conData, _ := listeners.LoadOrCompute(ws, func() ListenerData {
 		return ListenerData{
-			challenge:     "",
 			subscriptions: xsync.NewMapOf[string, *Subscription](),
 		}
 	})
 
-	conData.subscriptions.Store(id, &Subscription{filters: filters, cancel: cancel})
-	conData.authenticated = false
-	listeners.Store(ws, conData)
+	if previous, replaced := conData.subscriptions.LoadAndStore(id, &Subscription{filters: filters, cancel: cancel}); replaced {
+		previous.cancel()
+	}
 }
 
 // RemoveListenerId removes a listener by its ID and cancels its context.
@@ -52,22 +45,35 @@ func removeListenerId(ws *websocket.Conn, id string) bool {
 	return removed
 }
 
-// RemoveListener removes all listeners associated with a WebSocket connection.
+// RemoveListener removes all listeners associated with a WebSocket connection and cancels their subscriptions.
 func removeListener(ws *websocket.Conn) {
-	listeners.Delete(ws)
+	if conData, ok := listeners.LoadAndDelete(ws); ok {
+		conData.subscriptions.Range(func(id string, listener *Subscription) bool {
+			listener.cancel()
+			return true
+		})
+	}
+
+	connections.Delete(ws)
 }
 
 // NotifyListeners notifies all listeners with an event if it matches their filters.
 func notifyListeners(event *nostr.Event) {
+	if stores.IsExpired(event, time.Now().Unix()) {
+		return
+	}
+
+	restricted := kindRequiresAuth(event.Kind)
+
 	listeners.Range(func(ws *websocket.Conn, conData ListenerData) bool {
-		if !conData.authenticated {
-			return true // Skip notification if not authenticated
+		if restricted && !isAuthenticated(ws) {
+			return true // Restricted kinds are only sent to authenticated connections
 		}
 		conData.subscriptions.Range(func(id string, listener *Subscription) bool {
 			if !listener.filters.Match(event) {
 				return true
 			}
-			if err := ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &id, Event: *event}); err != nil {
+			if err := notifyJSON(ws, nostr.EventEnvelope{SubscriptionID: &id, Event: *event}); err != nil {
 				log.Printf("Error notifying listener: %v\n", err)
 			}
 			return true
@@ -75,41 +81,3 @@ func notifyListeners(event *nostr.Event) {
 		return true
 	})
 }
-
-func GetListenerChallenge(ws *websocket.Conn) (*string, error) {
-	conData, ok := listeners.Load(ws)
-	if !ok {
-		return nil, fmt.Errorf("no listeners found for this WebSocket connection")
-	}
-
-	return &conData.challenge, nil
-}
-
-func AuthenticateConnection(ws *websocket.Conn) error {
-	conData, ok := listeners.Load(ws)
-	if !ok {
-		return fmt.Errorf("no listeners found for this WebSocket connection")
-	}
-
-	conData.authenticated = true
-	listeners.Store(ws, conData)
-
-	return nil
-}
-
-// Generate the global challenge
-func generateGlobalChallenge() (string, error) {
-	bytes := make([]byte, challengeLength)
-	_, err := rand.Read(bytes)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate random bytes: %v", err)
-	}
-	challenge := hex.EncodeToString(bytes)
-	globalChallenge.Store(challenge)
-	return challenge, nil
-}
-
-// Get the global challenge
-func getGlobalChallenge() string {
-	return globalChallenge.Load().(string)
-}
@@ -0,0 +1,275 @@
+package websocket
+
+import (
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+
+	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
+	"github.com/HORNET-Storage/hornet-storage/lib/settings"
+)
+
+// nip11RelayInfo is the relay information document served to clients that ask for application/nostr+json (NIP-11)
+type nip11RelayInfo struct {
+	Name          string `json:"name,omitempty"`
+	Description   string `json:"description,omitempty"`
+	Icon          string `json:"icon,omitempty"`
+	Pubkey        string `json:"pubkey,omitempty"`
+	Contact       string `json:"contact,omitempty"`
+	SupportedNIPs []int  `json:"supported_nips,omitempty"`
+	Software      string `json:"software,omitempty"`
+	Version       string `json:"version,omitempty"`
+	PostingPolicy string `json:"posting_policy,omitempty"`
+	PaymentsURL   string `json:"payments_url,omitempty"`
+
+	Limitation *nip11Limitation `json:"limitation,omitempty"`
+	Retention  []nip11Retention `json:"retention,omitempty"`
+	Fees       *nip11Fees       `json:"fees,omitempty"`
+
+	// Settings is not part of NIP-11, it tells clients which kinds and media types the relay settings let through
+	Settings *nip11Settings `json:"relay_settings,omitempty"`
+}
+
+// nip11Limitation tells clients the caps the relay enforces so they can stay within them
+type nip11Limitation struct {
+	MaxMessageLength int  `json:"max_message_length,omitempty"`
+	MaxSubscriptions int  `json:"max_subscriptions,omitempty"`
+	MaxFilters       int  `json:"max_filters,omitempty"`
+	MaxLimit         int  `json:"max_limit,omitempty"`
+	MaxSubIDLength   int  `json:"max_subid_length,omitempty"`
+	MinPowDifficulty int  `json:"min_pow_difficulty,omitempty"`
+	AuthRequired     bool `json:"auth_required"`
+	PaymentRequired  bool `json:"payment_required"`
+	RestrictedWrites bool `json:"restricted_writes"`
+}
+
+// nip11Retention describes how long events of the listed kinds are kept, kinds holds single kinds and [from, to] ranges
+// and a time of zero means the events are never stored
+type nip11Retention struct {
+	Kinds []interface{} `json:"kinds,omitempty"`
+	Time  *int64        `json:"time,omitempty"`
+	Count *int64        `json:"count,omitempty"`
+}
+
+type nip11Fees struct {
+	Admission    []nip11Fee `json:"admission,omitempty" mapstructure:"admission"`
+	Subscription []nip11Fee `json:"subscription,omitempty" mapstructure:"subscription"`
+	Publication  []nip11Fee `json:"publication,omitempty" mapstructure:"publication"`
+}
+
+type nip11Fee struct {
+	Kinds  []int  `json:"kinds,omitempty" mapstructure:"kinds"`
+	Amount int64  `json:"amount" mapstructure:"amount"`
+	Unit   string `json:"unit" mapstructure:"unit"`
+	Period int64  `json:"period,omitempty" mapstructure:"period"`
+}
+
+type nip11Settings struct {
+	Mode string `json:"mode"`
+
+	// AcceptedKinds is only set in smart mode, unlimited mode accepts every kind
+	AcceptedKinds []int `json:"accepted_kinds,omitempty"`
+
+	BlockedMedia *nip11Media `json:"blocked_media,omitempty"`
+}
+
+// nip11Media lists the file types the relay refuses to store
+type nip11Media struct {
+	Photos []string `json:"photos,omitempty"`
+	Videos []string `json:"videos,omitempty"`
+	Audio  []string `json:"audio,omitempty"`
+}
+
+// handlerNIPs maps the registered handlers to the NIPs they implement, NIPs the transport handles itself are in baseNIPs
+var handlerNIPs = map[string][]int{
+	"filter":     {1, 50},
+	"universal":  {1},
+	"count":      {45},
+	"kind/0":     {1},
+	"kind/1":     {1},
+	"kind/3":     {2},
+	"kind/5":     {9},
+	"kind/6":     {18},
+	"kind/7":     {25},
+	"kind/8":     {58},
+	"kind/1984":  {56},
+	"kind/9735":  {57},
+	"kind/9802":  {84},
+	"kind/10000": {51},
+	"kind/10001": {51},
+	"kind/10002": {65},
+	"kind/30000": {51},
+	"kind/30008": {58},
+	"kind/30009": {58},
+	"kind/30023": {23},
+}
+
+// Relay information (11), expiration (40) and authentication (42) are handled by the transport and the stores
+var baseNIPs = []int{11, 40, 42}
+
+// maxKind is the largest kind NIP-01 allows
+const maxKind = 65535
+
+func handleRelayInfoRequests(c *fiber.Ctx) error {
+	if c.Method() == fiber.MethodGet && c.Get(fiber.HeaderAccept) == "application/nostr+json" {
+		return c.JSON(getRelayInfo(), "application/nostr+json")
+	}
+	return c.Next()
+}
+
+func getRelayInfo() nip11RelayInfo {
+	limits := getSubscriptionLimits()
+	relaySettings := settings.Get()
+
+	paymentRequired := viper.GetBool("RelayPaymentRequired")
+	publishRequired := viper.GetBool("auth_required_publish")
+
+	info := nip11RelayInfo{
+		Name:          viper.GetString("RelayName"),
+		Description:   viper.GetString("RelayDescription"),
+		Icon:          viper.GetString("RelayIcon"),
+		Pubkey:        viper.GetString("RelayPubkey"),
+		Contact:       viper.GetString("RelayContact"),
+		SupportedNIPs: supportedNIPs(),
+		Software:      viper.GetString("RelaySoftware"),
+		Version:       viper.GetString("RelayVersion"),
+		PostingPolicy: viper.GetString("RelayPostingPolicy"),
+		PaymentsURL:   viper.GetString("RelayPaymentsUrl"),
+		Limitation: &nip11Limitation{
+			MaxMessageLength: viper.GetInt("max_message_length"),
+			MaxSubscriptions: limits.MaxSubscriptions,
+			MaxFilters:       limits.MaxFilters,
+			MaxLimit:         limits.MaxLimit,
+			MaxSubIDLength:   limits.MaxSubIDLength,
+			MinPowDifficulty: viper.GetInt("min_pow_difficulty"),
+			AuthRequired:     publishRequired && viper.GetBool("auth_required_req") && viper.GetBool("auth_required_count"),
+			PaymentRequired:  paymentRequired,
+			RestrictedWrites: publishRequired || paymentRequired || relaySettings.Mode == "smart" || len(viper.GetIntSlice("auth_required_kinds")) > 0 || powRequired(),
+		},
+		Retention: retention(),
+		Settings: &nip11Settings{
+			Mode: relaySettings.Mode,
+		},
+	}
+
+	if relaySettings.Mode == "smart" {
+		info.Settings.AcceptedKinds = acceptedKinds()
+	}
+
+	if len(relaySettings.Photos) > 0 || len(relaySettings.Videos) > 0 || len(relaySettings.Audio) > 0 {
+		info.Settings.BlockedMedia = &nip11Media{
+			Photos: relaySettings.Photos,
+			Videos: relaySettings.Videos,
+			Audio:  relaySettings.Audio,
+		}
+	}
+
+	// Fees are declared by the operator in the config, a malformed entry is left out rather than guessed
+	if viper.IsSet("RelayFees") {
+		fees := &nip11Fees{}
+		if err := viper.UnmarshalKey("RelayFees", fees); err != nil {
+			log.Printf("Ignoring invalid RelayFees: %v", err)
+		} else {
+			info.Fees = fees
+		}
+	}
+
+	return info
+}
+
+// supportedNIPs lists the NIPs behind the handlers that are registered so the document never claims more than the relay does
+func supportedNIPs() []int {
+	nips := slices.Clone(baseNIPs)
+
+	for name := range lib_nostr.GetHandlers() {
+		nips = append(nips, handlerNIPs[name]...)
+	}
+
+	// Proof of work (13) is only checked when some kind has a minimum difficulty
+	if powRequired() {
+		nips = append(nips, 13)
+	}
+
+	slices.Sort(nips)
+
+	return slices.Compact(nips)
+}
+
+// retention tells clients which kinds are never stored, the relay keeps every other kind until it is deleted or expires
+func retention() []nip11Retention {
+	kinds := unstoredKinds()
+	if len(kinds) == 0 {
+		return nil
+	}
+
+	return []nip11Retention{{Kinds: kinds, Time: new(int64)}}
+}
+
+// unstoredKinds lists the kinds the relay never stores as single kinds and [from, to] ranges, ephemeral kinds are only
+// relayed and smart mode only stores the kinds that have a registered handler and are allowed by the settings
+func unstoredKinds() []interface{} {
+	if settings.Get().Mode != "smart" {
+		return []interface{}{[]int{20000, 29999}}
+	}
+
+	kinds := []interface{}{}
+	from := 0
+
+	for _, kind := range append(acceptedKinds(), maxKind+1) {
+		if kind == from+1 {
+			kinds = append(kinds, from)
+		} else if kind > from+1 {
+			kinds = append(kinds, []int{from, kind - 1})
+		}
+
+		from = kind + 1
+	}
+
+	return kinds
+}
+
+// acceptedKinds lists the kinds smart mode stores, a kind needs both a registered handler and to be allowed by the settings
+func acceptedKinds() []int {
+	relaySettings := settings.Get()
+	kinds := []int{}
+
+	for name := range lib_nostr.GetHandlers() {
+		number, ok := strings.CutPrefix(name, "kind/")
+		if !ok {
+			continue
+		}
+
+		kind, err := strconv.Atoi(number)
+		if err != nil {
+			continue
+		}
+
+		if lib_nostr.IsTheKindAllowed(kind, relaySettings) {
+			kinds = append(kinds, kind)
+		}
+	}
+
+	slices.Sort(kinds)
+
+	return kinds
+}
+
+// powRequired reports whether any kind needs proof of work, per kind minimums can ask for it when the global one doesn't
+func powRequired() bool {
+	if viper.GetInt("min_pow_difficulty") > 0 {
+		return true
+	}
+
+	for key := range viper.GetStringMap("min_pow_difficulty_kinds") {
+		kind, err := strconv.Atoi(key)
+		if err == nil && lib_nostr.MinPowDifficulty(kind) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -11,26 +11,74 @@ import (
 	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 )
 
-func handleReqMessage(c *websocket.Conn, env *nostr.ReqEnvelope) {
+func handleReqMessage(c *websocket.Conn, env *nostr.ReqEnvelope, state *connectionState) {
 	var json = jsoniter.ConfigCompatibleWithStandardLibrary
-	handler := lib_nostr.GetHandler("filter")
 
-	if handler != nil {
-		_, cancelFunc := context.WithCancel(context.Background())
+	if reqRequiresAuth(env.Filters) && !state.authenticated() {
+		closeSubscription(c, env.SubscriptionID, lib_nostr.Reason(lib_nostr.PrefixAuthRequired, "authenticate to subscribe"))
+		return
+	}
+
+	limits := getSubscriptionLimits()
+
+	if reason := limits.checkRequest(c, env.SubscriptionID, env.Filters); reason != "" {
+		closeSubscription(c, env.SubscriptionID, reason)
+		return
+	}
+
+	limits.clampLimits(env.Filters)
 
-		setListener(env.SubscriptionID, c, env.Filters, cancelFunc)
+	// Reusing a subscription id replaces the subscription, the old one is cancelled before the new one starts
+	ctx, cancelFunc := context.WithCancel(context.Background())
+
+	setListener(env.SubscriptionID, c, env.Filters, cancelFunc)
+
+	read := func() ([]byte, error) {
+		return json.Marshal(env)
+	}
+
+	write := func(messageType string, params ...interface{}) {
+		// A closed or replaced subscription stops sending even if its results were waiting for the client to read them
+		if ctx.Err() != nil {
+			return
+		}
 
-		read := func() ([]byte, error) {
-			return json.Marshal(env)
+		// Filters that don't name any kinds are answered without the kinds that need AUTH
+		if messageType == "EVENT" && !state.authenticated() && restrictedEvent(params) {
+			return
 		}
 
-		write := func(messageType string, params ...interface{}) {
-			response := lib_nostr.BuildResponse(messageType, params)
-			if len(response) > 0 {
-				handleIncomingMessage(c, response)
-			}
+		response := lib_nostr.BuildResponse(messageType, params)
+		if len(response) > 0 {
+			handleIncomingMessage(c, response)
 		}
+	}
+
+	// Stored events are streamed from their own goroutine so a CLOSE can be read and cancel the query part way through
+	if handler := lib_nostr.GetStreamHandler("filter"); handler != nil {
+		go handler(ctx, read, write)
+	} else if handler := lib_nostr.GetHandler("filter"); handler != nil {
+		handler(read, write, state.authenticatedPubkey())
+	}
+}
+
+// restrictedEvent reports whether the event written by the filter handler is of a kind that needs AUTH
+func restrictedEvent(params []interface{}) bool {
+	if len(params) < 2 {
+		return false
+	}
+
+	eventJSON, ok := params[1].(string)
+	if !ok {
+		return false
+	}
 
-		handler(read, write)
+	var event struct {
+		Kind int `json:"kind"`
 	}
+	if err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal([]byte(eventJSON), &event); err != nil {
+		return false
+	}
+
+	return kindRequiresAuth(event.Kind)
 }
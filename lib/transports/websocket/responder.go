@@ -11,7 +11,7 @@ import (
 
 func sendWebSocketMessage(ws *websocket.Conn, msg interface{}) error {
 	// msg is any of nostr.ClosedEnvelope, nostr.EOSEEnvelope, nostr.OKEnvelope, nostr.EventEnvelope, nostr.NoticeEnvelope
-	if err := ws.WriteJSON(msg); err != nil {
+	if err := writeJSON(ws, msg); err != nil {
 		log.Printf("Error sending message over WebSocket: %v", err)
 		return err
 	}
@@ -100,41 +100,39 @@ func handleIncomingMessage(ws *websocket.Conn, jsonMessage []byte) {
 			return
 		}
 
-		// No reason provided in this message format; handling accordingly.
-		// You could define a default or conditional reason based on success, if needed.
+		// Handlers pass the reason as the fourth element, prefixed as NIP-01 describes (auth-required:, blocked:, ...)
 		var reason string
-		if !success {
-			// Define how you want to handle a false success scenario. Maybe a default reason or additional handling.
-			reason = "Operation failed" // Placeholder; adjust based on your requirements or context.
+		if len(messageSlice) > 3 {
+			reason, _ = messageSlice[3].(string)
+		}
+		if !success && reason == "" {
+			reason = "error: operation failed"
 		}
 
 		// Constructing the OKEnvelope with the provided data.
 		okEnvelope := nostr.OKEnvelope{
 			EventID: eventID,
 			OK:      success,
-			Reason:  reason, // Note: This will be empty if success is true, based on current message format.
+			Reason:  reason,
 		}
 		// Sending the constructed OKEnvelope.
 		sendWebSocketMessage(ws, okEnvelope)
 
-	case "COUNT":
-		type CountStruct struct {
-			Count int `json:"count"`
+	case "CLOSED":
+		var reason string
+		if len(messageSlice) > 2 {
+			reason, _ = messageSlice[2].(string)
 		}
-		// Assuming the COUNT message includes the subscription ID as the second element
-		if len(messageSlice) < 2 {
+		sendWebSocketMessage(ws, nostr.ClosedEnvelope{SubscriptionID: subID, Reason: reason})
+
+	case "COUNT":
+		// The count handler sends the result as an object so it can carry the approximate flag
+		if len(messageSlice) < 3 {
 			log.Println("Expected data for 'COUNT' message type is missing.")
 			return
 		}
-		countMsg, ok := messageSlice[2].(string)
-		if !ok {
-			log.Println("Expected data for 'COUNT' message type is not a string.")
-			return
-		}
-		var count CountStruct
-		err := json.Unmarshal([]byte(countMsg), &count)
-		if err != nil {
-			log.Println("Error:", err)
+		if _, ok := messageSlice[2].(map[string]interface{}); !ok {
+			log.Println("Expected data for 'COUNT' message type is not an object.")
 			return
 		}
 		if err := sendWebSocketMessage(ws, messageSlice); err != nil {
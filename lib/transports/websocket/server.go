@@ -6,35 +6,46 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/spf13/viper"
 
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/blossom"
+	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 	"github.com/HORNET-Storage/hornet-storage/lib/stores"
 )
 
-type connectionState struct {
-	authenticated bool
-}
-
 func StartServer(store stores.Store) error {
-	// Generate the global challenge
-	_, err := generateGlobalChallenge()
-	if err != nil {
-		log.Fatalf("Failed to generate global challenge: %v", err)
-	}
+	// Events accepted on any transport are delivered to the subscriptions held by this server
+	lib_nostr.RegisterBroadcaster(notifyListeners)
+
+	// Request bodies are streamed so blossom uploads can be written to disk as they arrive
+	app := fiber.New(fiber.Config{
+		StreamRequestBody: true,
+	})
 
-	app := fiber.New()
+	// Browser clients fetch the relay information document and blossom blobs from other origins, the allowed
+	// headers are left empty so whatever headers a preflight asks for are allowed
+	app.Use(cors.New(cors.Config{
+		AllowOrigins: "*",
+		AllowMethods: "GET,HEAD,PUT,DELETE,OPTIONS",
+	}))
 
 	// Middleware for handling relay information requests
 	app.Use(handleRelayInfoRequests)
 	app.Get("/", websocket.New(handleWebSocketConnections))
 
 	// Enable blossom routes for unchunked file storage
-	server := blossom.NewServer(store)
+	storage, err := blossom.NewStorage(store)
+	if err != nil {
+		log.Fatalf("Failed to initialize blossom storage: %v", err)
+	}
+
+	server := blossom.NewServer(store, storage)
 	server.SetupRoutes(app)
 
 	port := viper.GetString("port")
@@ -60,72 +71,70 @@ func StartServer(store stores.Store) error {
 	return err
 }
 
-func handleRelayInfoRequests(c *fiber.Ctx) error {
-	if c.Method() == "GET" && c.Get("Accept") == "application/nostr+json" {
-		relayInfo := getRelayInfo()
-		c.Set("Access-Control-Allow-Origin", "*")
-		return c.JSON(relayInfo)
-	}
-	return c.Next()
-}
+func handleWebSocketConnections(c *websocket.Conn) {
+	defer removeListener(c)
 
-func getRelayInfo() nip11RelayInfo {
-	return nip11RelayInfo{
-		Name:          viper.GetString("RelayName"),
-		Description:   viper.GetString("RelayDescription"),
-		Pubkey:        viper.GetString("RelayPubkey"),
-		Contact:       viper.GetString("RelayContact"),
-		SupportedNIPs: []int{1, 11, 2, 9, 18, 23, 24, 25, 51, 56, 57, 42, 45, 50, 65, 116},
-		Software:      viper.GetString("RelaySoftware"),
-		Version:       viper.GetString("RelayVersion"),
+	state, err := newConnectionState()
+	if err != nil {
+		log.Printf("Failed to create connection state: %v", err)
+		return
 	}
-}
 
-func handleWebSocketConnections(c *websocket.Conn) {
-	defer removeListener(c)
+	connections.Store(c, state)
 
-	challenge := getGlobalChallenge()
-	log.Printf("Using global challenge for connection: %s", challenge)
+	writer := startWriter(c)
+	defer writer.close()
 
-	state := &connectionState{authenticated: false}
+	// Messages over the advertised max_message_length fail the read and close the connection
+	if limit := viper.GetInt64("max_message_length"); limit > 0 {
+		c.SetReadLimit(limit)
+	}
+
+	// Clients must answer the writer's pings, a connection that goes quiet for longer than pongWait is dropped
+	c.SetReadDeadline(time.Now().Add(pongWait))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(pongWait))
+	})
 
 	// Send the AUTH challenge immediately upon connection
-	authChallenge := []interface{}{"AUTH", challenge}
+	authChallenge := []interface{}{"AUTH", state.challenge}
 	if err := sendWebSocketMessage(c, authChallenge); err != nil {
 		log.Printf("Error sending AUTH challenge: %v", err)
 		return
 	}
 
 	for {
-		if err := processWebSocketMessage(c, challenge, state); err != nil {
+		if err := processWebSocketMessage(c, state); err != nil {
 			break
 		}
 	}
 }
 
-func processWebSocketMessage(c *websocket.Conn, challenge string, state *connectionState) error {
+func processWebSocketMessage(c *websocket.Conn, state *connectionState) error {
 	_, message, err := c.ReadMessage()
 	if err != nil {
 		return fmt.Errorf("read error: %w", err)
 	}
 
+	c.SetReadDeadline(time.Now().Add(pongWait))
+
 	rawMessage := nostr.ParseMessage(message)
 
 	switch env := rawMessage.(type) {
 	case *nostr.EventEnvelope:
-		handleEventMessage(c, env)
+		handleEventMessage(c, env, state)
 
 	case *nostr.ReqEnvelope:
-		handleReqMessage(c, env)
+		handleReqMessage(c, env, state)
 
 	case *nostr.AuthEnvelope:
-		handleAuthMessage(c, env, challenge, state)
+		handleAuthMessage(c, env, state)
 
 	case *nostr.CloseEnvelope:
 		handleCloseMessage(c, env)
 
 	case *nostr.CountEnvelope:
-		handleCountMessage(c, env, challenge)
+		handleCountMessage(c, env, state)
 
 	default:
 		firstComma := bytes.Index(message, []byte{','})
@@ -10,16 +10,6 @@ import (
 	"github.com/puzpuzpuz/xsync/v3"
 )
 
-type nip11RelayInfo struct {
-	Name          string `json:"name,omitempty"`
-	Description   string `json:"description,omitempty"`
-	Pubkey        string `json:"pubkey,omitempty"`
-	Contact       string `json:"contact,omitempty"`
-	SupportedNIPs []int  `json:"supported_nips,omitempty"`
-	Software      string `json:"software,omitempty"`
-	Version       string `json:"version,omitempty"`
-}
-
 type Message struct {
 	MessageType string          `json:"messageType"`
 	Event       json.RawMessage `json:"event"`
@@ -40,8 +30,6 @@ type Subscription struct {
 }
 
 type ListenerData struct {
-	authenticated bool
-	challenge     string
 	subscriptions *xsync.MapOf[string, *Subscription]
 }
 
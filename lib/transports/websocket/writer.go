@@ -0,0 +1,193 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+const (
+	// Events from other connections waiting to be sent before a connection is treated as a slow consumer and dropped
+	writeQueueSize = 256
+
+	// Replies to the connection's own messages wait for room in their queue instead of dropping the connection
+	replyQueueSize = 16
+
+	// Time allowed to write a single message before the connection is considered dead
+	writeWait = 10 * time.Second
+
+	// Time allowed between pongs, pings are sent often enough that a live client always answers in time
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+)
+
+var (
+	errConnectionClosed = errors.New("connection closed")
+	errSlowConsumer     = errors.New("slow consumer, too many messages waiting to be sent")
+)
+
+// Subscriptions stream from their own goroutines and other connections notify listeners from theirs,
+// websocket connections only support one concurrent writer so every write is queued for the connection's writer
+var writers = xsync.NewMapOf[*websocket.Conn, *connectionWriter]()
+
+// connectionWriter owns every write to its connection, other connections only ever queue events so a slow client
+// can't hold up anyone else and is disconnected once that queue fills up, replies to the client's own requests such
+// as the stored results of a REQ wait for the client to read them instead
+type connectionWriter struct {
+	ws       *websocket.Conn
+	queue    chan []byte
+	replies  chan []byte
+	done     chan struct{}
+	finished chan struct{}
+	once     sync.Once
+	reason   string
+}
+
+func startWriter(ws *websocket.Conn) *connectionWriter {
+	writer := &connectionWriter{
+		ws:       ws,
+		queue:    make(chan []byte, writeQueueSize),
+		replies:  make(chan []byte, replyQueueSize),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+
+	writers.Store(ws, writer)
+
+	go writer.run()
+
+	return writer
+}
+
+func (writer *connectionWriter) run() {
+	defer close(writer.finished)
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message := <-writer.queue:
+			if !writer.write(message) {
+				return
+			}
+
+		case message := <-writer.replies:
+			if !writer.write(message) {
+				return
+			}
+
+		case <-ticker.C:
+			if err := writer.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				log.Printf("Error sending ping: %v", err)
+				writer.ws.Close()
+				return
+			}
+
+		case <-writer.done:
+			if writer.reason != "" {
+				// The client is told why it is being dropped before the connection is closed under it, which also
+				// ends the read loop so the connection is cleaned up as usual
+				writer.ws.SetWriteDeadline(time.Now().Add(writeWait))
+				if message, err := json.Marshal(nostr.NoticeEnvelope(writer.reason)); err == nil {
+					writer.ws.WriteMessage(websocket.TextMessage, message)
+				}
+
+				writer.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""), time.Now().Add(writeWait))
+				writer.ws.Close()
+			}
+
+			return
+		}
+	}
+}
+
+func (writer *connectionWriter) write(message []byte) bool {
+	writer.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := writer.ws.WriteMessage(websocket.TextMessage, message); err != nil {
+		log.Printf("Error writing to websocket: %v", err)
+		writer.ws.Close()
+		return false
+	}
+
+	return true
+}
+
+// reply waits until there is room for the message, a client that stops reading entirely is dropped by the write deadline
+func (writer *connectionWriter) reply(message []byte) error {
+	select {
+	case writer.replies <- message:
+		return nil
+	case <-writer.done:
+		return errConnectionClosed
+	}
+}
+
+// enqueue never blocks, a connection that has fallen too far behind is dropped instead
+func (writer *connectionWriter) enqueue(message []byte) error {
+	select {
+	case <-writer.done:
+		return errConnectionClosed
+	default:
+	}
+
+	select {
+	case writer.queue <- message:
+		return nil
+	default:
+		writer.stop(errSlowConsumer.Error())
+		return errSlowConsumer
+	}
+}
+
+// stop ends the writer, a reason is sent to the client as a NOTICE before its connection is closed
+func (writer *connectionWriter) stop(reason string) {
+	writer.once.Do(func() {
+		writer.reason = reason
+		close(writer.done)
+	})
+}
+
+// close stops the writer and waits for it to finish, the connection must not be used by the writer once its handler returns
+func (writer *connectionWriter) close() {
+	writer.stop("")
+	<-writer.finished
+
+	writers.Delete(writer.ws)
+}
+
+// writeJSON sends a reply to the connection's own messages, it blocks until the writer has room for it
+func writeJSON(ws *websocket.Conn, msg interface{}) error {
+	writer, ok := writers.Load(ws)
+	if !ok {
+		return errConnectionClosed
+	}
+
+	message, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return writer.reply(message)
+}
+
+// notifyJSON sends an event published by another connection, it never blocks and drops a connection that can't keep up
+func notifyJSON(ws *websocket.Conn, msg interface{}) error {
+	writer, ok := writers.Load(ws)
+	if !ok {
+		return errConnectionClosed
+	}
+
+	message, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return writer.enqueue(message)
+}
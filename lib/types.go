@@ -174,6 +174,37 @@ type RelaySettings struct {
 	IsVideosActive   bool     `json:"isVideosActive"`
 	IsGitNestrActive bool     `json:"isGitNestrActive"`
 	IsAudioActive    bool     `json:"isAudioActive"`
+	Quota            Quota    `json:"quota"`
+}
+
+// QuotaLimit caps what a single public key can store, zero means unlimited
+type QuotaLimit struct {
+	MaxBytes int64 `json:"maxBytes"`
+	MaxItems int64 `json:"maxItems"`
+}
+
+// Quota is the default limit applied to every public key along with per key overrides
+type Quota struct {
+	Default   QuotaLimit            `json:"default"`
+	Overrides map[string]QuotaLimit `json:"overrides"`
+}
+
+// Usage is what a public key currently has stored across events, dags and blobs
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Items int64 `json:"items"`
+}
+
+// UsageRecord remembers who was charged for a dag or blob so the usage can be released when it is deleted
+type UsageRecord struct {
+	PublicKey string
+	Bytes     int64
+}
+
+// StoreVersion is a committed version of a versioned store and the time it was committed
+type StoreVersion struct {
+	Version   uint64 `json:"version"`
+	Timestamp int64  `json:"timestamp"`
 }
 
 type TimeSeriesData struct {
@@ -250,6 +281,9 @@ type BlobDescriptor struct {
 	Size     int64  `json:"size"`
 	Type     string `json:"type,omitempty"`
 	Uploaded int64  `json:"uploaded"`
+
+	// External blobs only have their descriptor in the store, their content is kept by a blob backend such as the filesystem
+	External bool `cbor:"external,omitempty" json:"-"`
 }
 
 // LoginPayload represents the structure of the login request payload
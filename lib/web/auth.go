@@ -0,0 +1,36 @@
+package web
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+)
+
+// requireAuth only lets requests through that carry a bearer token issued to a panel user by handleVerify
+func requireAuth(c *fiber.Ctx) error {
+	tokenString, ok := strings.CutPrefix(c.Get("Authorization"), "Bearer ")
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Missing authorization token"})
+	}
+
+	claims := &types.JWTClaims{}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return jwtKey, nil
+	})
+	if err != nil || !token.Valid {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired authorization token"})
+	}
+
+	c.Locals("claims", claims)
+
+	return c.Next()
+}
@@ -0,0 +1,44 @@
+package web
+
+import (
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+
+	"github.com/HORNET-Storage/hornet-storage/lib/backup"
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+)
+
+// handleCreateBackup writes an archive of the relay state to the backup directory while the relay keeps serving
+func handleCreateBackup(store stores.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if _, ok := store.(stores.Backuper); !ok {
+			return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{"message": "Store does not support backups"})
+		}
+
+		path, manifest, err := backup.CreateInDir(store, viper.GetString("backup_dir"), viper.GetInt("backup_retention"))
+		if err != nil {
+			log.Printf("Failed to create backup: %v", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		}
+
+		return c.JSON(fiber.Map{
+			"path":     path,
+			"manifest": manifest,
+		})
+	}
+}
+
+// handleListBackups returns the archives in the backup directory oldest first
+func handleListBackups(c *fiber.Ctx) error {
+	backups, err := backup.List(viper.GetString("backup_dir"))
+	if err != nil {
+		log.Printf("Failed to list backups: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+	}
+
+	return c.JSON(fiber.Map{
+		"backups": backups,
+	})
+}
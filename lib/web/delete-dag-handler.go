@@ -0,0 +1,40 @@
+package web
+
+import (
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+)
+
+// handleDeleteDag removes a dag from the store so it is no longer served, used for takedown requests.
+// Graviton is append-only so the deleted leaves and content stay in its files and no disk space is freed.
+func handleDeleteDag(store stores.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		root := c.Params("root")
+
+		log.Printf("Delete dag request received for %s\n", root)
+
+		err := store.DeleteDag(root)
+		if err != nil {
+			log.Printf("Failed to delete dag %s: %v", root, err)
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Failed to delete dag"})
+		}
+
+		collected := 0
+
+		if collector, ok := store.(stores.GarbageCollector); ok {
+			collected, err = collector.CollectGarbage()
+			if err != nil {
+				log.Printf("Failed to collect garbage after deleting dag %s: %v", root, err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Dag deleted but its unreferenced content could not be removed"})
+			}
+		}
+
+		return c.JSON(fiber.Map{
+			"root":      root,
+			"collected": collected,
+		})
+	}
+}
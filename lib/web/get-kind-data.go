@@ -5,6 +5,7 @@ import (
 	"sort"
 
 	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/config"
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -19,7 +20,7 @@ type AggregatedKindData struct {
 func handleKindData(c *fiber.Ctx) error {
 	log.Println("Kind data request received")
 
-	db, err := gorm.Open(sqlite.Open("relay_stats.db"), &gorm.Config{})
+	db, err := gorm.Open(sqlite.Open(config.StatsDatabasePath()), &gorm.Config{})
 	if err != nil {
 		log.Printf("Failed to connect to the database: %v", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
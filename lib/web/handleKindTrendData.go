@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/HORNET-Storage/hornet-storage/lib/config"
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -31,7 +32,7 @@ func handleKindTrendData(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString("Invalid kind number")
 	}
 
-	db, err := gorm.Open(sqlite.Open("relay_stats.db"), &gorm.Config{})
+	db, err := gorm.Open(sqlite.Open(config.StatsDatabasePath()), &gorm.Config{})
 	if err != nil {
 		log.Printf("Failed to connect to the database: %v", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
@@ -5,8 +5,8 @@ import (
 	"time"
 
 	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/config"
 	"github.com/gofiber/fiber/v2"
-	"github.com/spf13/viper"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -14,15 +14,8 @@ import (
 func handleTimeSeries(c *fiber.Ctx) error {
 	log.Println("Time series request received")
 
-	// Retrieve the database path from the config file using Viper
-	dbPath := viper.GetString("relay_stats_db")
-	if dbPath == "" {
-		log.Fatal("Database path not found in config")
-		return c.Status(fiber.StatusInternalServerError).SendString("Database configuration not found")
-	}
-
 	// Initialize the Gorm database
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	db, err := gorm.Open(sqlite.Open(config.StatsDatabasePath()), &gorm.Config{})
 	if err != nil {
 		log.Printf("Failed to connect to the database: %v", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
@@ -4,8 +4,9 @@ import (
 	"log"
 
 	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/config"
+	"github.com/HORNET-Storage/hornet-storage/lib/settings"
 	"github.com/gofiber/fiber/v2"
-	"github.com/spf13/viper"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -13,30 +14,14 @@ import (
 func handleRelayCount(c *fiber.Ctx) error {
 	log.Println("Relay count request received")
 
-	// Retrieve the database path from the config file using Viper
-	dbPath := viper.GetString("relay_stats_db")
-	if dbPath == "" {
-		log.Fatal("Database path not found in config")
-	}
-
 	// Initialize the Gorm database
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	db, err := gorm.Open(sqlite.Open(config.StatsDatabasePath()), &gorm.Config{})
 	if err != nil {
 		log.Printf("Failed to connect to the database: %v", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
 	}
 
-	// Retrieve relay settings from the config file using Viper
-	var relaySettings struct {
-		Kinds    []string `mapstructure:"kinds"`
-		Photos   []string `mapstructure:"photos"`
-		Videos   []string `mapstructure:"videos"`
-		GitNestr []string `mapstructure:"gitNestr"`
-		Audio    []string `mapstructure:"audio"`
-	}
-	if err := viper.UnmarshalKey("relay_settings", &relaySettings); err != nil {
-		log.Fatalf("Error unmarshaling relay settings: %v", err)
-	}
+	relaySettings := settings.Get()
 
 	// Initialize the response data
 	responseData := map[string]int{
@@ -1,12 +1,13 @@
 package web
 
 import (
+	"errors"
 	"log"
 
 	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/settings"
 	"github.com/gofiber/fiber/v2"
 	jsoniter "github.com/json-iterator/go"
-	"github.com/spf13/viper"
 )
 
 func handleRelaySettings(c *fiber.Ctx) error {
@@ -39,6 +40,11 @@ func handleRelaySettings(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
 	}
 
+	// The panel doesn't edit quotas, a save that leaves them out keeps the ones in place instead of lifting every limit
+	if settingsMap, ok := relaySettingsData.(map[string]interface{}); !ok || settingsMap["quota"] == nil {
+		relaySettings.Quota = settings.Get().Quota
+	}
+
 	// Check boolean flags and set corresponding arrays to empty if false
 	if !relaySettings.IsKindsActive {
 		relaySettings.Kinds = []string{}
@@ -60,11 +66,17 @@ func handleRelaySettings(c *fiber.Ctx) error {
 		relaySettings.DynamicKinds = []string{}
 	}
 
-	// Store in Viper
-	viper.Set("relay_settings", relaySettings)
+	// Invalid settings are never written, the panel gets every rejected field back so it can point at them
+	if err := settings.Update(relaySettings); err != nil {
+		var validationErr *settings.ValidationError
+		if errors.As(err, &validationErr) {
+			log.Println("Rejected relay settings:", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"message": "Invalid relay settings",
+				"errors":  validationErr.Errors,
+			})
+		}
 
-	// Save the changes to the configuration file
-	if err := viper.WriteConfig(); err != nil {
 		log.Printf("Error writing config: %s", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Failed to update settings")
 	}
@@ -77,22 +89,8 @@ func handleRelaySettings(c *fiber.Ctx) error {
 func handleGetRelaySettings(c *fiber.Ctx) error {
 	log.Println("Get relay settings request received")
 
-	var relaySettings types.RelaySettings
-
-	// Fetch settings from Viper
-	err := viper.UnmarshalKey("relay_settings", &relaySettings)
-	if err != nil {
-		log.Printf("Error unmarshaling relay settings: %s", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to fetch settings")
-	}
-
-	// Ensure Protocol and Chunked are arrays
-	if relaySettings.Protocol == nil {
-		relaySettings.Protocol = []string{}
-	}
-	if relaySettings.Chunked == nil {
-		relaySettings.Chunked = []string{}
-	}
+	// Lists are never nil once loaded so the panel always gets arrays back
+	relaySettings := settings.Get()
 
 	log.Println("Fetched relay settings:", relaySettings)
 
@@ -4,19 +4,36 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"path/filepath"
 	"strconv"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
 	"github.com/spf13/viper"
-)
 
-func StartServer() error {
-	app := fiber.New()
+	"github.com/HORNET-Storage/hornet-storage/lib/config"
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+)
 
+func StartServer(store stores.Store) error {
 	go pullBitcoinPrice()
 
+	app := NewApp(store)
+
+	port := viper.GetString("port")
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		log.Fatal("Error parsing port port")
+	}
+
+	return app.Listen(fmt.Sprintf(":%d", p+2))
+}
+
+// NewApp builds the panel's routes without listening so they can also be served from tests
+func NewApp(store stores.Store) *fiber.App {
+	app := fiber.New()
+
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: "*",
 		AllowHeaders: "Origin, Content-Type, Accept",
@@ -43,22 +60,25 @@ func StartServer() error {
 	app.Get("/user-exist", userExist)
 	app.Get("/api/kinds", handleKindData)
 	app.Get("/api/kind-trend/:kindNumber", handleKindTrendData)
-
-	port := viper.GetString("port")
-	p, err := strconv.Atoi(port)
-	if err != nil {
-		log.Fatal("Error parsing port port")
-	}
+	app.Delete("/api/dag/:root", requireAuth, handleDeleteDag(store))
+	app.Get("/api/usage/:pubkey", handleUsage(store))
+	app.Get("/api/versions", requireAuth, handleListVersions(store))
+	app.Post("/api/versions/:version/events", requireAuth, handleQueryEventsAt(store))
+	app.Get("/api/versions/:version/dag/:root", requireAuth, handleGetDagAt(store))
+	app.Post("/api/versions/:version/restore/events", requireAuth, handleRestoreEventsAt(store))
+	app.Post("/api/versions/:version/restore/dag/:root", requireAuth, handleRestoreDagAt(store))
+	app.Get("/api/backups", requireAuth, handleListBackups)
+	app.Post("/api/backup", requireAuth, handleCreateBackup(store))
 
 	app.Use(filesystem.New(filesystem.Config{
-		Root:   http.Dir("./web"),
+		Root:   http.Dir(config.WebRoot()),
 		Browse: false,
 		Index:  "index.html",
 	}))
 
 	app.Use(func(c *fiber.Ctx) error {
-		return c.SendFile("./web/index.html")
+		return c.SendFile(filepath.Join(config.WebRoot(), "index.html"))
 	})
 
-	return app.Listen(fmt.Sprintf(":%d", p+2))
+	return app
 }
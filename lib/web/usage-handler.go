@@ -0,0 +1,28 @@
+package web
+
+import (
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+)
+
+// handleUsage returns how much a public key has stored along with the quota that applies to it
+func handleUsage(store stores.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pubkey := c.Params("pubkey")
+
+		usage, err := store.GetUsage(pubkey)
+		if err != nil {
+			log.Printf("Failed to get usage for %s: %v", pubkey, err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		}
+
+		return c.JSON(fiber.Map{
+			"pubkey": stores.UsageKey(pubkey),
+			"usage":  usage,
+			"limit":  stores.LoadQuota(pubkey),
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package web
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nbd-wtf/go-nostr"
+
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+)
+
+// A version is recorded for every commit so the versions are listed a page at a time
+const (
+	defaultVersionsLimit = 100
+	maxVersionsLimit     = 1000
+)
+
+// handleListVersions returns a page of the committed versions of the store along with when they were committed,
+// the next page starts after the last version of the previous one
+func handleListVersions(store stores.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		versioned, ok := store.(stores.VersionedStore)
+		if !ok {
+			return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{"message": "Store does not keep version history"})
+		}
+
+		since, err := strconv.ParseUint(c.Query("since", "0"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid since"})
+		}
+
+		limit := c.QueryInt("limit", defaultVersionsLimit)
+		if limit <= 0 || limit > maxVersionsLimit {
+			limit = maxVersionsLimit
+		}
+
+		versions, err := versioned.ListVersions(since, limit)
+		if err != nil {
+			log.Printf("Failed to list versions: %v", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		}
+
+		return c.JSON(fiber.Map{
+			"versions": versions,
+		})
+	}
+}
+
+// handleQueryEventsAt answers the nostr filter in the request body with the events stored as of a version,
+// events that have since been deleted are left out
+func handleQueryEventsAt(store stores.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		versioned, ok := store.(stores.VersionedStore)
+		if !ok {
+			return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{"message": "Store does not keep version history"})
+		}
+
+		version, err := strconv.ParseUint(c.Params("version"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid version"})
+		}
+
+		var filter nostr.Filter
+		if err := c.BodyParser(&filter); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid filter"})
+		}
+
+		events, err := versioned.QueryEventsAt(filter, version)
+		if err != nil {
+			log.Printf("Failed to query events at version %d: %v", version, err)
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Failed to query events at version"})
+		}
+
+		return c.JSON(fiber.Map{
+			"version": version,
+			"events":  events,
+		})
+	}
+}
+
+// handleGetDagAt returns a dag as it was stored as of a version, dags that have since been deleted are not found
+func handleGetDagAt(store stores.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		versioned, ok := store.(stores.VersionedStore)
+		if !ok {
+			return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{"message": "Store does not keep version history"})
+		}
+
+		version, err := strconv.ParseUint(c.Params("version"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid version"})
+		}
+
+		root := c.Params("root")
+
+		dag, err := versioned.BuildDagFromStoreAt(root, version, c.QueryBool("content", false))
+		if err != nil {
+			log.Printf("Failed to build dag %s at version %d: %v", root, version, err)
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Dag not found at version"})
+		}
+
+		return c.JSON(fiber.Map{
+			"version": version,
+			"dag":     dag,
+		})
+	}
+}
+
+// handleRestoreEventsAt stores the events matching the nostr filter in the request body that were deleted since a version again
+func handleRestoreEventsAt(store stores.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		versioned, ok := store.(stores.VersionedStore)
+		if !ok {
+			return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{"message": "Store does not keep version history"})
+		}
+
+		version, err := strconv.ParseUint(c.Params("version"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid version"})
+		}
+
+		var filter nostr.Filter
+		if err := c.BodyParser(&filter); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid filter"})
+		}
+
+		restored, err := versioned.RestoreEventsAt(filter, version)
+		if err != nil {
+			log.Printf("Failed to restore events from version %d: %v", version, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Failed to restore events", "restored": restored})
+		}
+
+		return c.JSON(fiber.Map{
+			"version":  version,
+			"restored": restored,
+		})
+	}
+}
+
+// handleRestoreDagAt stores a dag that was deleted since a version again
+func handleRestoreDagAt(store stores.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		versioned, ok := store.(stores.VersionedStore)
+		if !ok {
+			return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{"message": "Store does not keep version history"})
+		}
+
+		version, err := strconv.ParseUint(c.Params("version"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid version"})
+		}
+
+		root := c.Params("root")
+
+		if err := versioned.RestoreDagAt(root, version); err != nil {
+			log.Printf("Failed to restore dag %s from version %d: %v", root, version, err)
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Failed to restore dag"})
+		}
+
+		return c.JSON(fiber.Map{
+			"version": version,
+			"root":    root,
+		})
+	}
+}
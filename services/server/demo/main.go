@@ -8,7 +8,7 @@ import (
 	//"github.com/libp2p/go-libp2p/p2p/security/noise"
 	//libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
 	//stores_bbolt "github.com/HORNET-Storage/hornet-storage/lib/stores/bbolt"
-	//stores_memory "github.com/HORNET-Storage/hornet-storage/lib/stores/memory"
+	stores_memory "github.com/HORNET-Storage/hornet-storage/lib/stores/memory"
 	//negentropy "github.com/illuzen/go-negentropy"
 )
 
@@ -17,6 +17,7 @@ func init() {
 	viper.SetDefault("web", true)
 	viper.SetDefault("proxy", true)
 	viper.SetDefault("port", "9000")
+	viper.SetDefault("data_dir", ".")
 	viper.SetDefault("relay_stats_db", "relay_stats.db")
 	viper.SetDefault("service_tag", "hornet-storage-service")
 
@@ -31,7 +32,15 @@ func init() {
 }
 
 func main() {
-	err := web.StartServer()
+	store := &stores_memory.GravitonMemoryStore{}
+
+	err := store.InitStore()
+	if err != nil {
+		fmt.Println("Failed to initialize store")
+		return
+	}
+
+	err = web.StartServer(store)
 
 	if err != nil {
 		fmt.Println("Fatal error occurred in web server")
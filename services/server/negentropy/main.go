@@ -2,10 +2,10 @@ package main
 
 import (
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	merkle_dag "github.com/HORNET-Storage/scionic-merkletree/dag"
 
@@ -14,12 +14,11 @@ import (
 	"github.com/ipfs/go-cid"
 	"github.com/spf13/viper"
 
-	"github.com/libp2p/go-libp2p/core/network"
-	"github.com/libp2p/go-libp2p/core/protocol"
-
 	//"github.com/libp2p/go-libp2p/p2p/security/noise"
 	//libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
 
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/settings"
 	"github.com/HORNET-Storage/hornet-storage/lib/signing"
 	"github.com/HORNET-Storage/hornet-storage/lib/transports/libp2p"
 	"github.com/HORNET-Storage/hornet-storage/lib/transports/websocket"
@@ -27,6 +26,7 @@ import (
 
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/count"
+	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/ephemeral"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/filter"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/kind0"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/kind1"
@@ -51,6 +51,8 @@ import (
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/scionic/query"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/scionic/upload"
 
+	"github.com/HORNET-Storage/hornet-storage/lib/config"
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
 	//stores_memory "github.com/HORNET-Storage/hornet-storage/lib/stores/memory"
 	stores_graviton "github.com/HORNET-Storage/hornet-storage/lib/stores/graviton"
 	//negentropy "github.com/illuzen/go-negentropy"
@@ -61,8 +63,22 @@ func init() {
 	viper.SetDefault("web", false)
 	viper.SetDefault("proxy", true)
 	viper.SetDefault("port", "9000")
+	viper.SetDefault("data_dir", ".")
 	viper.SetDefault("relay_stats_db", "relay_stats.db")
 	viper.SetDefault("query_cache", map[string]string{})
+	viper.SetDefault("expiration_sweep_interval", 60)
+	viper.SetDefault("auth_required_publish", false)
+	viper.SetDefault("auth_required_req", false)
+	viper.SetDefault("auth_required_count", false)
+	viper.SetDefault("auth_required_kinds", []int{})
+	viper.SetDefault("max_subscriptions", 20)
+	viper.SetDefault("max_filters", 10)
+	viper.SetDefault("max_limit", 500)
+	viper.SetDefault("max_subid_length", 64)
+	viper.SetDefault("max_message_length", 524288)
+	viper.SetDefault("min_pow_difficulty", 0)
+	viper.SetDefault("min_pow_difficulty_kinds", map[string]int{})
+	viper.SetDefault("pow_whitelist", []string{})
 	viper.SetDefault("service_tag", "hornet-storage-service")
 
 	viper.AddConfigPath(".")
@@ -76,6 +92,8 @@ func init() {
 
 	viper.OnConfigChange(func(e fsnotify.Event) {
 		fmt.Println("Config file changed:", e.Name)
+
+		settings.Reload()
 	})
 
 	viper.WatchConfig()
@@ -93,7 +111,7 @@ func main() {
 	store := &stores_graviton.GravitonStore{}
 
 	queryCache := viper.GetStringMapString("query_cache")
-	store.InitStore(queryCache)
+	store.InitStore(queryCache, config.GravitonPath())
 
 	// Stream Handlers
 	download.AddDownloadHandler(host, store, func(rootLeaf *merkle_dag.DagLeaf, pubKey *string, signature *string) bool {
@@ -127,17 +145,30 @@ func main() {
 
 	query.AddQueryHandler(host, store)
 
-	settings, err := nostr.LoadRelaySettings()
+	// Expired events are hidden from queries straight away and deleted in the background (NIP-40)
+	stopSweeper := stores.StartExpirationSweeper(store, time.Duration(viper.GetInt("expiration_sweep_interval"))*time.Second)
+	defer stopSweeper()
+
+	err := settings.Load()
 	if err != nil {
 		log.Fatalf("Failed to load relay settings: %v", err)
 		return
 	}
 
+	relaySettings := settings.Get()
+
+	// Handlers are registered for the mode the relay started in so switching modes takes a restart
+	settings.Subscribe(func(updated *types.RelaySettings) {
+		if updated.Mode != relaySettings.Mode {
+			log.Printf("Relay mode changed from %s to %s, restart the relay to apply it", relaySettings.Mode, updated.Mode)
+		}
+	})
+
 	// Register Our Nostr Stream Handlers
-	if settings.Mode == "unlimited" {
+	if relaySettings.Mode == "unlimited" {
 		log.Println("Limited server mode")
 		nostr.RegisterHandler("universal", universal.BuildUniversalHandler(store))
-	} else if settings.Mode == "smart" {
+	} else if relaySettings.Mode == "smart" {
 		log.Println("Smart server mode")
 		nostr.RegisterHandler("kind/0", kind0.BuildKind0Handler(store))
 		nostr.RegisterHandler("kind/1", kind1.BuildKind1Handler(store))
@@ -158,44 +189,18 @@ func main() {
 		nostr.RegisterHandler("kind/30009", kind30009.BuildKind30009Handler(store))
 	}
 
+	// Ephemeral events are relayed in every mode and never stored
+	nostr.RegisterHandler("ephemeral", ephemeral.BuildEphemeralHandler())
+
 	nostr.RegisterHandler("filter", filter.BuildFilterHandler(store))
+	nostr.RegisterStreamHandler("filter", filter.BuildFilterStreamHandler(store))
 	nostr.RegisterHandler("count", count.BuildCountsHandler(store))
 
 	// Auth event not supported for the libp2p connections yet
 	//nostr.RegisterHandler("auth", auth.BuildAuthHandler(store))
 
 	// Register a libp2p handler for every stream handler
-	for kind := range nostr.GetHandlers() {
-		handler := nostr.GetHandler(kind)
-
-		wrapper := func(stream network.Stream) {
-			read := func() ([]byte, error) {
-				decoder := json.NewDecoder(stream)
-
-				var rawMessage json.RawMessage
-				err := decoder.Decode(&rawMessage)
-				if err != nil {
-					return nil, err
-				}
-
-				return rawMessage, nil
-			}
-
-			write := func(messageType string, params ...interface{}) {
-				response := nostr.BuildResponse(messageType, params)
-
-				if len(response) > 0 {
-					stream.Write(response)
-				}
-			}
-
-			handler(read, write)
-
-			stream.Close()
-		}
-
-		host.SetStreamHandler(protocol.ID("/nostr/event/"+kind), wrapper)
-	}
+	libp2p.RegisterHandlers(host)
 
 	// Web Panel
 	if viper.GetBool("web") {
@@ -204,7 +209,7 @@ func main() {
 		fmt.Println("Starting with web server enabled")
 
 		go func() {
-			err := web.StartServer()
+			err := web.StartServer(store)
 
 			if err != nil {
 				fmt.Println("Fatal error occurred in web server")
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/viper"
+
+	"github.com/HORNET-Storage/hornet-storage/lib/backup"
+	"github.com/HORNET-Storage/hornet-storage/lib/config"
+	"github.com/HORNET-Storage/hornet-storage/lib/encryption"
+	"github.com/HORNET-Storage/hornet-storage/lib/stores"
+	"github.com/HORNET-Storage/hornet-storage/lib/transfer"
+)
+
+// commands are run with `hornet <command> [flags]` instead of starting the relay
+var commands = map[string]func(args []string) error{
+	"export":     exportCommand,
+	"import":     importCommand,
+	"car-export": carExportCommand,
+	"car-import": carImportCommand,
+	"backup":     backupCommand,
+	"restore":    restoreCommand,
+	"keygen":     keygenCommand,
+	"rotate-key": rotateKeyCommand,
+}
+
+// Progress is logged every time this many events have been exported
+const exportProgressInterval = 1000
+
+// exportCommand writes the events matching a filter to a file as newline delimited JSON,
+// running it again with -resume carries on an export that was interrupted
+func exportCommand(args []string) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	out := flags.String("out", "", "file to write the events to, stdout when empty")
+	filterJSON := flags.String("filter", "{}", "nostr filter selecting the events to export")
+	resume := flags.Bool("resume", false, "continue an interrupted export into the same file")
+	flags.Parse(args)
+
+	var filter nostr.Filter
+	if err := json.Unmarshal([]byte(*filterJSON), &filter); err != nil {
+		return fmt.Errorf("invalid filter: %w", err)
+	}
+
+	if *resume && *out == "" {
+		return fmt.Errorf("-resume needs an -out file")
+	}
+
+	store, err := initStore()
+	if err != nil {
+		return err
+	}
+
+	var writer io.Writer = os.Stdout
+	var checkpoint *transfer.ExportCheckpoint
+
+	if *out != "" {
+		mode := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if *resume {
+			mode = os.O_CREATE | os.O_RDWR
+		}
+
+		file, err := os.OpenFile(*out, mode, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if *resume {
+			checkpoint, err = transfer.LoadExportCheckpoint(file)
+			if err != nil {
+				return err
+			}
+
+			// Drop a line that was cut off part way through and append after the last complete event
+			if err := file.Truncate(checkpoint.Size); err != nil {
+				return err
+			}
+
+			if _, err := file.Seek(checkpoint.Size, io.SeekStart); err != nil {
+				return err
+			}
+
+			log.Printf("Resuming export after %d events\n", checkpoint.Written)
+		}
+
+		writer = file
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	written, err := transfer.ExportEvents(ctx, store, filter, writer, checkpoint, func(written int) {
+		if written%exportProgressInterval == 0 {
+			log.Printf("Exported %d events\n", written)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Export finished with %d events\n", written)
+
+	return nil
+}
+
+// importCommand stores the events in a newline delimited JSON file after checking them like the relay checks new events,
+// the number of lines dealt with is kept next to the file so running it again with -resume skips them
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	in := flags.String("in", "", "newline delimited JSON file to import")
+	batchSize := flags.Int("batch", transfer.DefaultImportBatchSize, "number of events stored in each commit")
+	resume := flags.Bool("resume", false, "skip the lines a previous import of the same file already dealt with")
+	flags.Parse(args)
+
+	if *in == "" {
+		return fmt.Errorf("-in is required")
+	}
+
+	progressPath := *in + ".progress"
+
+	skip := 0
+	if *resume {
+		data, err := os.ReadFile(progressPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err == nil {
+			skip, err = strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil {
+				return fmt.Errorf("invalid progress file %s: %w", progressPath, err)
+			}
+
+			log.Printf("Resuming import after %d lines\n", skip)
+		}
+	}
+
+	file, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	store, err := initStore()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	result, err := transfer.ImportEvents(ctx, store, file, skip, *batchSize, func(progress transfer.ImportProgress) {
+		if err := os.WriteFile(progressPath, []byte(strconv.Itoa(progress.Lines)), 0644); err != nil {
+			log.Printf("Failed to save import progress: %v\n", err)
+		}
+
+		log.Printf("Imported %d lines, %d stored, %d invalid, %d rejected\n", progress.Lines, progress.Stored, progress.Invalid, progress.Rejected)
+	})
+	if err != nil {
+		return err
+	}
+
+	os.Remove(progressPath)
+
+	log.Printf("Import finished with %d events stored, %d invalid and %d rejected\n", result.Stored, result.Invalid, result.Rejected)
+
+	return nil
+}
+
+// carExportCommand writes a stored dag to a CARv1 archive
+func carExportCommand(args []string) error {
+	flags := flag.NewFlagSet("car-export", flag.ExitOnError)
+	root := flags.String("root", "", "root of the dag to export")
+	out := flags.String("out", "", "file to write the archive to, stdout when empty")
+	flags.Parse(args)
+
+	if *root == "" {
+		return fmt.Errorf("-root is required")
+	}
+
+	store, err := initStore()
+	if err != nil {
+		return err
+	}
+
+	var writer io.Writer = os.Stdout
+
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		writer = file
+	}
+
+	blocks, err := transfer.ExportCar(store, *root, writer)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Exported dag %s with %d blocks\n", *root, blocks)
+
+	return nil
+}
+
+// carImportCommand stores the dags held in CARv1 archives, the root of each dag must be signed by its uploader
+func carImportCommand(args []string) error {
+	flags := flag.NewFlagSet("car-import", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("no car files given")
+	}
+
+	store, err := initStore()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range flags.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		dagData, err := transfer.ImportCar(store, file, verifyDagSignature)
+		file.Close()
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		log.Printf("Imported dag %s with %d leaves from %s\n", dagData.Dag.Root, len(dagData.Dag.Leafs), path)
+	}
+
+	return nil
+}
+
+// backupCommand writes an archive of the store, the relay stats and the config from a relay that isn't running,
+// a running relay is backed up with POST /api/backup or the backup_interval schedule instead
+func backupCommand(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("out", "", "archive to write, a timestamped archive in backup_dir when empty")
+	flags.Parse(args)
+
+	store, err := initStore()
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		path, manifest, err := backup.CreateInDir(store, viper.GetString("backup_dir"), viper.GetInt("backup_retention"))
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Backed up %d files to %s\n", len(manifest.Files), path)
+
+		return nil
+	}
+
+	manifest, err := backup.Create(store, *out)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Backed up %d files to %s\n", len(manifest.Files), *out)
+
+	return nil
+}
+
+// restoreCommand rebuilds the relay's files from a backup archive, the relay must be stopped first
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := flags.String("in", "", "archive to restore")
+	dir := flags.String("dir", config.DataDir(), "data directory of the relay")
+	force := flags.Bool("force", false, "replace files that already exist")
+	flags.Parse(args)
+
+	if *in == "" {
+		return fmt.Errorf("-in is required")
+	}
+
+	// The store paths are resolved against the data directory so the overrides in the config still apply
+	viper.Set("data_dir", *dir)
+
+	manifest, err := backup.Restore(*in, *force)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Restored %d files from the backup taken at %s\n", len(manifest.Files), time.Unix(manifest.CreatedAt, 0).UTC().Format(time.RFC3339))
+
+	return nil
+}
+
+// keygenCommand writes a new random key file that can be used as encryption_keyfile
+func keygenCommand(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := flags.String("out", "", "key file to create")
+	flags.Parse(args)
+
+	if *out == "" {
+		return fmt.Errorf("-out is required")
+	}
+
+	if _, err := os.Stat(*out); err == nil {
+		return fmt.Errorf("%s already exists", *out)
+	}
+
+	err := encryption.GenerateKeyFile(*out)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Wrote a new key file to %s, keep a copy somewhere safe as the store can't be read without it\n", *out)
+
+	return nil
+}
+
+// rotateKeyCommand wraps the store's data keys with a new master key, with -data it also reseals everything stored
+// under a new data key, the current master key is loaded the same way as when the relay starts
+func rotateKeyCommand(args []string) error {
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	newKeyFile := flags.String("new-keyfile", "", "key file holding the new master key")
+	newPassphraseEnv := flags.String("new-passphrase-env", "HORNET_NEW_PASSPHRASE", "environment variable holding the new master passphrase")
+	data := flags.Bool("data", false, "also reseal everything stored under a new data key")
+	flags.Parse(args)
+
+	store, err := initStore()
+	if err != nil {
+		return err
+	}
+
+	encrypted, ok := store.(stores.EncryptedStore)
+	if !ok || !encrypted.Encrypted() {
+		return fmt.Errorf("store is not encrypted, set encryption_keyfile or %s first", passphraseEnv)
+	}
+
+	master, err := masterKey()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *newKeyFile != "":
+		master, err = encryption.KeyFileKey(*newKeyFile)
+	case os.Getenv(*newPassphraseEnv) != "":
+		master, err = encryption.PassphraseKey(os.Getenv(*newPassphraseEnv))
+	case !*data:
+		return fmt.Errorf("no new master key given, use -new-keyfile or set %s", *newPassphraseEnv)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *data {
+		resealed, err := encrypted.RotateDataKey(master)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Resealed %d values under a new data key\n", resealed)
+	} else {
+		err = encrypted.RotateMasterKey(master)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *newKeyFile != "" || os.Getenv(*newPassphraseEnv) != "" {
+		log.Println("Master key rotated, update encryption_keyfile or the passphrase before starting the relay")
+	}
+
+	return nil
+}
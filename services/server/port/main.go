@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	merkle_dag "github.com/HORNET-Storage/scionic-merkletree/dag"
 
@@ -14,12 +16,14 @@ import (
 	"github.com/ipfs/go-cid"
 	"github.com/spf13/viper"
 
-	"github.com/libp2p/go-libp2p/core/network"
-	"github.com/libp2p/go-libp2p/core/protocol"
-
 	//"github.com/libp2p/go-libp2p/p2p/security/noise"
 	//libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
 
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/backup"
+	"github.com/HORNET-Storage/hornet-storage/lib/config"
+	"github.com/HORNET-Storage/hornet-storage/lib/encryption"
+	"github.com/HORNET-Storage/hornet-storage/lib/settings"
 	"github.com/HORNET-Storage/hornet-storage/lib/signing"
 	"github.com/HORNET-Storage/hornet-storage/lib/transports/libp2p"
 	"github.com/HORNET-Storage/hornet-storage/lib/transports/websocket"
@@ -27,6 +31,7 @@ import (
 
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/count"
+	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/ephemeral"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/filter"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/kind0"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/kind1"
@@ -54,7 +59,9 @@ import (
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/scionic/query"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/scionic/upload"
 
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
 	//stores_memory "github.com/HORNET-Storage/hornet-storage/lib/stores/memory"
+	stores_bbolt "github.com/HORNET-Storage/hornet-storage/lib/stores/bbolt"
 	stores_graviton "github.com/HORNET-Storage/hornet-storage/lib/stores/graviton"
 	//negentropy "github.com/illuzen/go-negentropy"
 )
@@ -64,8 +71,29 @@ func init() {
 	viper.SetDefault("web", false)
 	viper.SetDefault("proxy", true)
 	viper.SetDefault("port", "9000")
+	viper.SetDefault("data_dir", ".")
 	viper.SetDefault("relay_stats_db", "relay_stats.db")
 	viper.SetDefault("query_cache", map[string]string{})
+	viper.SetDefault("expiration_sweep_interval", 60)
+	viper.SetDefault("auth_required_publish", false)
+	viper.SetDefault("auth_required_req", false)
+	viper.SetDefault("auth_required_count", false)
+	viper.SetDefault("auth_required_kinds", []int{})
+	viper.SetDefault("max_subscriptions", 20)
+	viper.SetDefault("max_filters", 10)
+	viper.SetDefault("max_limit", 500)
+	viper.SetDefault("max_subid_length", 64)
+	viper.SetDefault("max_message_length", 524288)
+	viper.SetDefault("min_pow_difficulty", 0)
+	viper.SetDefault("min_pow_difficulty_kinds", map[string]int{})
+	viper.SetDefault("pow_whitelist", []string{})
+	viper.SetDefault("backup_dir", "backups")
+	viper.SetDefault("backup_interval", 0)
+	viper.SetDefault("backup_retention", 7)
+	viper.SetDefault("store", "graviton")
+	viper.SetDefault("blossom_storage", "store")
+	viper.SetDefault("blossom_dir", "blobs")
+	viper.SetDefault("encryption_keyfile", "")
 	viper.SetDefault("service_tag", "hornet-storage-service")
 
 	viper.AddConfigPath(".")
@@ -79,12 +107,107 @@ func init() {
 
 	viper.OnConfigChange(func(e fsnotify.Event) {
 		fmt.Println("Config file changed:", e.Name)
+
+		settings.Reload()
 	})
 
 	viper.WatchConfig()
 }
 
+// The passphrase is read from the environment rather than the config so it never sits on disk next to the data
+const passphraseEnv = "HORNET_PASSPHRASE"
+
+// masterKey loads the master key for encryption at rest from encryption_keyfile or the HORNET_PASSPHRASE
+// environment variable, encryption is off when neither is set
+func masterKey() (*encryption.MasterKey, error) {
+	if path := viper.GetString("encryption_keyfile"); path != "" {
+		return encryption.KeyFileKey(path)
+	}
+
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return encryption.PassphraseKey(passphrase)
+	}
+
+	return nil, nil
+}
+
+// initStore creates and initializes the store selected in the config
+func initStore() (stores.Store, error) {
+	var store stores.Store
+	var path string
+
+	switch viper.GetString("store") {
+	case "bbolt":
+		store = &stores_bbolt.BBoltStore{}
+		path = config.BBoltPath()
+	default:
+		store = &stores_graviton.GravitonStore{}
+		path = config.GravitonPath()
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	master, err := masterKey()
+	if err != nil {
+		return nil, err
+	}
+
+	queryCache := viper.GetStringMapString("query_cache")
+	err = store.InitStore(queryCache, path, master)
+	if err != nil {
+		return nil, err
+	}
+
+	if master != nil {
+		if encrypted, ok := store.(stores.EncryptedStore); !ok || !encrypted.Encrypted() {
+			return nil, fmt.Errorf("the %s store does not support encryption at rest", viper.GetString("store"))
+		}
+	}
+
+	return store, nil
+}
+
+// verifyDagSignature checks that the root of a dag was signed by the public key it was uploaded with
+func verifyDagSignature(rootLeaf *merkle_dag.DagLeaf, pubKey *string, signature *string) bool {
+	decodedSignature, err := hex.DecodeString(*signature)
+	if err != nil {
+		return false
+	}
+
+	parsedSignature, err := schnorr.ParseSignature(decodedSignature)
+	if err != nil {
+		return false
+	}
+
+	cid, err := cid.Parse(rootLeaf.Hash)
+	if err != nil {
+		return false
+	}
+
+	publicKey, err := signing.DeserializePublicKey(*pubKey)
+	if err != nil {
+		return false
+	}
+
+	err = signing.VerifyCIDSignature(parsedSignature, cid, publicKey)
+	return err == nil
+}
+
 func main() {
+	// Maintenance commands run against the store and exit without starting the relay
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatalf("%s failed: %v", os.Args[1], err)
+			}
+
+			return
+		}
+	}
+
 	wg := new(sync.WaitGroup)
 
 	// Private key
@@ -93,53 +216,47 @@ func main() {
 	host := libp2p.GetHostOnPort(key, viper.GetString("port"))
 
 	// Create and initialize database
-	store := &stores_graviton.GravitonStore{}
-
-	queryCache := viper.GetStringMapString("query_cache")
-	store.InitStore(queryCache)
+	store, err := initStore()
+	if err != nil {
+		log.Fatalf("Failed to initialize store: %v", err)
+	}
 
 	// Stream Handlers
 	download.AddDownloadHandler(host, store, func(rootLeaf *merkle_dag.DagLeaf, pubKey *string, signature *string) bool {
 		return true
 	})
 
-	upload.AddUploadHandler(host, store, func(rootLeaf *merkle_dag.DagLeaf, pubKey *string, signature *string) bool {
-		decodedSignature, err := hex.DecodeString(*signature)
-		if err != nil {
-			return false
-		}
-
-		parsedSignature, err := schnorr.ParseSignature(decodedSignature)
-		if err != nil {
-			return false
-		}
+	upload.AddUploadHandler(host, store, verifyDagSignature, func(dag *merkle_dag.Dag, pubKey *string) {})
 
-		cid, err := cid.Parse(rootLeaf.Hash)
-		if err != nil {
-			return false
-		}
+	query.AddQueryHandler(host, store)
 
-		publicKey, err := signing.DeserializePublicKey(*pubKey)
-		if err != nil {
-			return false
-		}
+	// Expired events are hidden from queries straight away and deleted in the background (NIP-40)
+	stopSweeper := stores.StartExpirationSweeper(store, time.Duration(viper.GetInt("expiration_sweep_interval"))*time.Second)
+	defer stopSweeper()
 
-		err = signing.VerifyCIDSignature(parsedSignature, cid, publicKey)
-		return err == nil
-	}, func(dag *merkle_dag.Dag, pubKey *string) {})
+	// Scheduled backups are off unless backup_interval is set to a number of hours
+	stopBackups := backup.StartScheduledBackups(store, viper.GetString("backup_dir"), time.Duration(viper.GetInt("backup_interval"))*time.Hour, viper.GetInt("backup_retention"))
+	defer stopBackups()
 
-	query.AddQueryHandler(host, store)
-
-	settings, err := nostr.LoadRelaySettings()
+	err = settings.Load()
 	if err != nil {
 		log.Fatalf("Failed to load relay settings: %v", err)
 		return
 	}
 
+	relaySettings := settings.Get()
+
+	// Handlers are registered for the mode the relay started in so switching modes takes a restart
+	settings.Subscribe(func(updated *types.RelaySettings) {
+		if updated.Mode != relaySettings.Mode {
+			log.Printf("Relay mode changed from %s to %s, restart the relay to apply it", relaySettings.Mode, updated.Mode)
+		}
+	})
+
 	// Register Our Nostr Stream Handlers
-	if settings.Mode == "unlimited" {
+	if relaySettings.Mode == "unlimited" {
 		nostr.RegisterHandler("universal", universal.BuildUniversalHandler(store))
-	} else if settings.Mode == "smart" {
+	} else if relaySettings.Mode == "smart" {
 		nostr.RegisterHandler("kind/0", kind0.BuildKind0Handler(store))
 		nostr.RegisterHandler("kind/1", kind1.BuildKind1Handler(store))
 		nostr.RegisterHandler("kind/3", kind3.BuildKind3Handler(store))
@@ -162,44 +279,18 @@ func main() {
 		nostr.RegisterHandler("kind/30079", kind30079.BuildKind30079Handler(store))
 	}
 
+	// Ephemeral events are relayed in every mode and never stored
+	nostr.RegisterHandler("ephemeral", ephemeral.BuildEphemeralHandler())
+
 	nostr.RegisterHandler("filter", filter.BuildFilterHandler(store))
+	nostr.RegisterStreamHandler("filter", filter.BuildFilterStreamHandler(store))
 	nostr.RegisterHandler("count", count.BuildCountsHandler(store))
 
 	// Auth event not supported for the libp2p connections yet
 	//nostr.RegisterHandler("auth", auth.BuildAuthHandler(store))
 
 	// Register a libp2p handler for every stream handler
-	for kind := range nostr.GetHandlers() {
-		handler := nostr.GetHandler(kind)
-
-		wrapper := func(stream network.Stream) {
-			read := func() ([]byte, error) {
-				decoder := json.NewDecoder(stream)
-
-				var rawMessage json.RawMessage
-				err := decoder.Decode(&rawMessage)
-				if err != nil {
-					return nil, err
-				}
-
-				return rawMessage, nil
-			}
-
-			write := func(messageType string, params ...interface{}) {
-				response := nostr.BuildResponse(messageType, params)
-
-				if len(response) > 0 {
-					stream.Write(response)
-				}
-			}
-
-			handler(read, write)
-
-			stream.Close()
-		}
-
-		host.SetStreamHandler(protocol.ID("/nostr/event/"+kind), wrapper)
-	}
+	libp2p.RegisterHandlers(host)
 
 	// Web Panel
 	if viper.GetBool("web") {
@@ -208,7 +299,7 @@ func main() {
 		fmt.Println("Starting with web server enabled")
 
 		go func() {
-			err := web.StartServer()
+			err := web.StartServer(store)
 
 			if err != nil {
 				fmt.Println("Fatal error occurred in web server")
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/HORNET-Storage/hornet-storage/lib/blobs"
+)
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := blobs.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := bytes.Repeat([]byte("streamed blob "), 10000)
+	sum := sha256.Sum256(content)
+	expected := hex.EncodeToString(sum[:])
+
+	hash, size, err := store.Write(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("failed to write blob: %v", err)
+	}
+
+	if hash != expected || size != int64(len(content)) {
+		t.Fatalf("expected %s with %d bytes, got %s with %d bytes", expected, len(content), hash, size)
+	}
+
+	if store.Path(hash) != filepath.Join(dir, hash[0:2], hash[2:4], hash) {
+		t.Fatalf("blob is not sharded by its hash: %s", store.Path(hash))
+	}
+
+	// Nothing is left behind in the temporary directory once the blob is in place
+	temp, err := os.ReadDir(filepath.Join(dir, ".tmp"))
+	if err != nil || len(temp) != 0 {
+		t.Fatalf("expected no temporary files, got %d: %v", len(temp), err)
+	}
+
+	// Writing the same content again keeps the existing blob
+	if _, _, err := store.Write(bytes.NewReader(content)); err != nil {
+		t.Fatalf("failed to write duplicate blob: %v", err)
+	}
+
+	file, size, err := store.Open(hash)
+	if err != nil {
+		t.Fatalf("failed to open blob: %v", err)
+	}
+
+	read, err := io.ReadAll(file)
+	file.Close()
+
+	if err != nil || !bytes.Equal(read, content) || size != int64(len(content)) {
+		t.Fatalf("blob content was not preserved: %v", err)
+	}
+
+	if _, _, err := store.Open("../../" + hash); err == nil {
+		t.Fatalf("expected an invalid hash to be refused")
+	}
+
+	err = store.Remove(hash)
+	if err != nil {
+		t.Fatalf("failed to remove blob: %v", err)
+	}
+
+	if store.Has(hash) {
+		t.Fatalf("removed blob is still present")
+	}
+
+	if err := store.Remove(hash); err != nil {
+		t.Fatalf("removing a missing blob should not fail: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/HORNET-Storage/hornet-storage/lib/encryption"
+	stores_graviton "github.com/HORNET-Storage/hornet-storage/lib/stores/graviton"
+)
+
+func TestEncryptionAtRest(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gravitondb")
+
+	master := encryptionKey(t, dir)
+
+	store := &stores_graviton.GravitonStore{}
+
+	err := store.InitStore(path, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := bytes.Repeat([]byte("operator must not read this "), 5000)
+
+	blob, err := store.StoreBlob(secret, "text/plain", "")
+	if err != nil {
+		t.Fatalf("failed to store blob: %v", err)
+	}
+
+	// Nothing written to disk holds the plaintext
+	err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		if bytes.Contains(data, []byte("operator must not read this")) {
+			t.Fatalf("%s holds plaintext content", file)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The store can't be opened without its master key or with the wrong one
+	if err := (&stores_graviton.GravitonStore{}).InitStore(path); err == nil {
+		t.Fatalf("expected an encrypted store to need its master key")
+	}
+
+	if err := (&stores_graviton.GravitonStore{}).InitStore(path, encryptionKey(t, t.TempDir())); err == nil {
+		t.Fatalf("expected the wrong master key to be refused")
+	}
+
+	reopened := &stores_graviton.GravitonStore{}
+
+	err = reopened.InitStore(path, master)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+
+	content, _, err := reopened.GetBlob(blob.SHA256)
+	if err != nil || !bytes.Equal(content, secret) {
+		t.Fatalf("blob was not decrypted: %v", err)
+	}
+}
+
+func TestCipherSegments(t *testing.T) {
+	dir := t.TempDir()
+
+	keyring, err := encryption.OpenKeyring(filepath.Join(dir, "keyring.json"), encryptionKey(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cipher, err := keyring.Cipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := []byte("key")
+
+	for _, size := range []int{0, 1, 64 * 1024, 64*1024 + 1, 3 * 64 * 1024} {
+		value := bytes.Repeat([]byte{7}, size)
+
+		sealed, err := cipher.Seal(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opened, err := cipher.Open(key, sealed)
+		if err != nil || !bytes.Equal(opened, value) {
+			t.Fatalf("failed to open a %d byte value: %v", size, err)
+		}
+
+		if _, err := cipher.Open([]byte("another key"), sealed); err == nil {
+			t.Fatalf("a %d byte value opened under another key", size)
+		}
+
+		if size > 64*1024 {
+			if _, err := cipher.Open(key, sealed[:len(sealed)-17]); err == nil {
+				t.Fatalf("a truncated %d byte value opened", size)
+			}
+		}
+	}
+
+	// Values stored before encryption was turned on are read as they are
+	opened, err := cipher.Open(key, []byte("plaintext"))
+	if err != nil || string(opened) != "plaintext" {
+		t.Fatalf("unsealed value was not returned as is: %v", err)
+	}
+}
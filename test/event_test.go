@@ -5,16 +5,23 @@ import (
 	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/viper"
 
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/ephemeral"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/kind0"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/kind1"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/kind10000"
@@ -32,6 +39,7 @@ import (
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/kind9373"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/kind9735"
 	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/universal"
+	"github.com/HORNET-Storage/hornet-storage/lib/settings"
 	"github.com/HORNET-Storage/hornet-storage/lib/signing"
 	"github.com/HORNET-Storage/hornet-storage/lib/transports/libp2p"
 
@@ -291,3 +299,101 @@ func TestHostCommunication(t *testing.T) {
 	time.Sleep(2 * time.Second)
 
 }
+
+func TestLibp2pEphemeralKinds(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	network, err := mocknet.FullMeshLinked(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer network.Close()
+
+	server, client := network.Hosts()[0], network.Hosts()[1]
+
+	handlers.RegisterHandler("ephemeral", ephemeral.BuildEphemeralHandler())
+	libp2p.RegisterHandlers(server)
+
+	// Ephemeral kinds have no kind handler, the stream is served by the ephemeral handler
+	event := createSignedEvent(t, 20001, "typing")
+
+	if ok := publishLibp2p(t, ctx, client, server, event); !ok.OK || ok.EventID != event.ID {
+		t.Fatalf("expected the ephemeral event to be accepted, got %v", ok)
+	}
+
+	// Libp2p connections can't authenticate so every event needs the minimum proof of work
+	viper.Set("min_pow_difficulty", 8)
+	defer viper.Set("min_pow_difficulty", nil)
+
+	if ok := publishLibp2p(t, ctx, client, server, createSignedEvent(t, 20001, "typing")); ok.OK || !strings.HasPrefix(ok.Reason, handlers.PrefixPow) {
+		t.Fatalf("expected the event to need pow, got %v", ok)
+	}
+
+	// Kinds outside the ephemeral range are still only served by their own handlers
+	if _, err := client.NewStream(ctx, server.ID(), protocol.ID("/nostr/event/kind/30001")); err == nil {
+		t.Fatalf("expected a kind without a handler not to be served")
+	}
+}
+
+// publishLibp2p sends an event to the protocol of its kind and returns the OK it is answered with
+func publishLibp2p(t *testing.T, ctx context.Context, client host.Host, server host.Host, event nostr.Event) nostr.OKEnvelope {
+	stream, err := client.NewStream(ctx, server.ID(), protocol.ID(fmt.Sprintf("/nostr/event/kind/%d", event.Kind)))
+	if err != nil {
+		t.Fatalf("expected kind %d to be served, got %v", event.Kind, err)
+	}
+
+	if err := json.NewEncoder(stream).Encode(nostr.EventEnvelope{Event: event}); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ok nostr.OKEnvelope
+	if err := ok.UnmarshalJSON(response); err != nil {
+		t.Fatalf("expected an OK response, got %s", response)
+	}
+
+	return ok
+}
+
+func TestCheckEventFutureCreatedAt(t *testing.T) {
+	previous := *settings.Get()
+	t.Cleanup(func() {
+		settings.Apply(previous)
+	})
+
+	if err := settings.Apply(types.RelaySettings{Mode: "smart", Kinds: []string{"kind1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	signed := func(createdAt time.Time) *nostr.Event {
+		privateKey := nostr.GeneratePrivateKey()
+		event := &nostr.Event{
+			CreatedAt: nostr.Timestamp(createdAt.Unix()),
+			Kind:      1,
+			Tags:      nostr.Tags{},
+			Content:   "clock skew",
+		}
+
+		if err := event.Sign(privateKey); err != nil {
+			t.Fatal(err)
+		}
+
+		return event
+	}
+
+	// A client whose clock runs a little fast is still accepted
+	if err := handlers.CheckEvent(signed(time.Now().Add(30*time.Second)), 1, "", true); err != nil {
+		t.Fatalf("expected an event within the allowed skew to pass, got %v", err)
+	}
+
+	var invalid *handlers.InvalidEventError
+	err := handlers.CheckEvent(signed(time.Now().Add(time.Hour)), 1, "", true)
+	if !errors.As(err, &invalid) || !strings.HasPrefix(invalid.Reason, handlers.PrefixInvalid) {
+		t.Fatalf("expected an event an hour ahead to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package test
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+	"github.com/spf13/viper"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
+	"github.com/HORNET-Storage/hornet-storage/lib/settings"
+)
+
+func createPowEvent(t *testing.T, difficulty int) *nostr.Event {
+	publicKey, err := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := &nostr.Event{
+		PubKey:    publicKey,
+		CreatedAt: nostr.Now(),
+		Kind:      1,
+		Tags:      nostr.Tags{},
+		Content:   "proof of work",
+	}
+
+	if difficulty > 0 {
+		if _, err := nip13.Generate(event, difficulty, 10*time.Second); err != nil {
+			t.Fatalf("failed to mine event: %v", err)
+		}
+	}
+
+	event.ID = event.GetID()
+
+	return event
+}
+
+func expectPowRejected(t *testing.T, event *nostr.Event, authenticated string) {
+	t.Helper()
+
+	var invalid *lib_nostr.InvalidEventError
+	if err := lib_nostr.CheckPow(event, authenticated); !errors.As(err, &invalid) || !strings.HasPrefix(invalid.Reason, lib_nostr.PrefixPow) {
+		t.Fatalf("expected a pow rejection, got %v", err)
+	}
+}
+
+func TestPow(t *testing.T) {
+	t.Cleanup(func() {
+		viper.Set("min_pow_difficulty", nil)
+		viper.Set("min_pow_difficulty_kinds", nil)
+		viper.Set("pow_whitelist", nil)
+	})
+
+	viper.Set("min_pow_difficulty", 8)
+
+	unmined := createPowEvent(t, 0)
+	expectPowRejected(t, unmined, "")
+
+	mined := createPowEvent(t, 8)
+	if err := lib_nostr.CheckPow(mined, ""); err != nil {
+		t.Fatalf("expected a mined event to pass, got %v", err)
+	}
+
+	// A lucky id is refused when the nonce tag committed to less than the minimum
+	lucky := createPowEvent(t, 0)
+	lucky.Tags = nostr.Tags{{"nonce", "0", "4"}}
+	for nonce := 1; nip13.Difficulty(lucky.GetID()) < 8; nonce++ {
+		lucky.Tags[0][1] = strconv.Itoa(nonce)
+	}
+	lucky.ID = lucky.GetID()
+	expectPowRejected(t, lucky, "")
+
+	// The difficulty is measured on the id the event hashes to rather than the one it claims
+	forged := createPowEvent(t, 0)
+	forged.Tags = nostr.Tags{{"nonce", "0", "8"}}
+	for nonce := 1; nip13.Difficulty(forged.GetID()) >= 8; nonce++ {
+		forged.Tags[0][1] = strconv.Itoa(nonce)
+	}
+	forged.ID = "00000000" + forged.GetID()[8:]
+	expectPowRejected(t, forged, "")
+
+	// A per kind minimum replaces the global one
+	viper.Set("min_pow_difficulty_kinds", map[string]interface{}{"1": 0})
+	if err := lib_nostr.CheckPow(unmined, ""); err != nil {
+		t.Fatalf("expected the kind minimum to apply, got %v", err)
+	}
+	viper.Set("min_pow_difficulty_kinds", nil)
+
+	viper.Set("pow_whitelist", []string{unmined.PubKey})
+	if err := lib_nostr.CheckPow(unmined, ""); err != nil {
+		t.Fatalf("expected a whitelisted pubkey to bypass pow, got %v", err)
+	}
+	viper.Set("pow_whitelist", nil)
+
+	// Only the events of the pubkey the connection authenticated as are exempt
+	authenticated := createPowEvent(t, 0)
+	if err := lib_nostr.CheckPow(authenticated, authenticated.PubKey); err != nil {
+		t.Fatalf("expected an authenticated pubkey to bypass pow, got %v", err)
+	}
+
+	expectPowRejected(t, unmined, authenticated.PubKey)
+}
+
+// Events are held to the minimum by the shared validation, only the author's own connection and imports skip it
+func TestCheckEventPow(t *testing.T) {
+	previous := *settings.Get()
+	t.Cleanup(func() {
+		settings.Apply(previous)
+		viper.Set("min_pow_difficulty", nil)
+	})
+
+	if err := settings.Apply(types.RelaySettings{Mode: "smart", Kinds: []string{"kind1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("min_pow_difficulty", 8)
+
+	event := createSignedEvent(t, 1, "unmined")
+
+	var invalid *lib_nostr.InvalidEventError
+	if err := lib_nostr.CheckEvent(&event, 1, "", true); !errors.As(err, &invalid) || !strings.HasPrefix(invalid.Reason, lib_nostr.PrefixPow) {
+		t.Fatalf("expected an unmined event to be refused, got %v", err)
+	}
+
+	if err := lib_nostr.CheckEvent(&event, 1, event.PubKey, true); err != nil {
+		t.Fatalf("expected the authenticated author to skip pow, got %v", err)
+	}
+
+	if err := lib_nostr.CheckEvent(&event, 1, "", false); err != nil {
+		t.Fatalf("expected pow to be skipped when it isn't checked, got %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
+	"github.com/HORNET-Storage/hornet-storage/lib/settings"
+	"github.com/HORNET-Storage/hornet-storage/lib/web"
+)
+
+func TestSettingsValidation(t *testing.T) {
+	err := settings.Validate(&types.RelaySettings{
+		Mode:         "fast",
+		Kinds:        []string{"kind1", "1"},
+		DynamicKinds: []string{"two"},
+		Quota: types.Quota{
+			Overrides: map[string]types.QuotaLimit{
+				"npub": {MaxBytes: -1},
+			},
+		},
+	})
+
+	var validationErr *settings.ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+
+	fields := map[string]bool{}
+	for _, field := range validationErr.Errors {
+		fields[field.Field] = true
+	}
+
+	for _, field := range []string{"mode", "kinds[1]", "dynamicKinds[0]", "quota.overrides.npub.maxBytes"} {
+		if !fields[field] {
+			t.Fatalf("expected %s to be rejected, got %v", field, validationErr.Errors)
+		}
+	}
+
+	if fields["kinds[0]"] {
+		t.Fatalf("a valid kind was rejected")
+	}
+}
+
+func TestSettingsSubscribe(t *testing.T) {
+	previous := *settings.Get()
+	t.Cleanup(func() {
+		settings.Apply(previous)
+	})
+
+	updates := 0
+	unsubscribe := settings.Subscribe(func(updated *types.RelaySettings) {
+		updates++
+	})
+	defer unsubscribe()
+
+	err := settings.Apply(types.RelaySettings{Mode: "smart", Kinds: []string{"kind1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updates != 1 {
+		t.Fatalf("expected 1 update, got %d", updates)
+	}
+
+	// Invalid settings are rejected and the current settings stay in place
+	if err := settings.Apply(types.RelaySettings{Mode: "smart", Kinds: []string{"one"}}); err == nil {
+		t.Fatalf("expected invalid settings to be rejected")
+	}
+
+	if current := settings.Get(); current.Mode != "smart" || len(current.Kinds) != 1 || current.Kinds[0] != "kind1" {
+		t.Fatalf("invalid settings replaced the current settings: %+v", current)
+	}
+
+	// Applying the same settings again is not a change
+	err = settings.Apply(types.RelaySettings{Mode: "smart", Kinds: []string{"kind1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updates != 1 {
+		t.Fatalf("unchanged settings were announced, got %d updates", updates)
+	}
+}
+
+func TestSettingsLoadInvalid(t *testing.T) {
+	previous := *settings.Get()
+	t.Cleanup(func() {
+		viper.Set("relay_settings", nil)
+		settings.Apply(previous)
+	})
+
+	if err := settings.Apply(types.RelaySettings{Mode: "smart", Kinds: []string{"kind1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A bad config file is logged and the relay keeps serving with the settings it has
+	viper.Set("relay_settings", map[string]interface{}{"mode": "fast"})
+
+	if err := settings.Load(); err == nil {
+		t.Fatalf("expected the invalid config to be rejected")
+	}
+
+	settings.Reload()
+
+	if current := settings.Get(); current.Mode != "smart" {
+		t.Fatalf("invalid settings replaced the current settings: %+v", current)
+	}
+}
+
+// A relay without usable settings must not fall back to accepting every kind
+func TestSettingsDefaultsRestrictive(t *testing.T) {
+	defaults := settings.Defaults()
+
+	if err := settings.Validate(&defaults); err != nil {
+		t.Fatalf("expected the defaults to be valid: %v", err)
+	}
+
+	if lib_nostr.IsTheKindAllowed(1, &defaults) {
+		t.Fatalf("expected the defaults to accept no kinds, got %+v", defaults)
+	}
+}
+
+// The panel saves its settings without the quota, which must not lift the limits already in place
+func TestRelaySettingsKeepQuota(t *testing.T) {
+	previous := *settings.Get()
+	t.Cleanup(func() {
+		viper.SetConfigFile("")
+		viper.Set("relay_settings", nil)
+		settings.Apply(previous)
+	})
+
+	viper.SetConfigFile(filepath.Join(t.TempDir(), "config.json"))
+
+	quota := types.Quota{
+		Default:   types.QuotaLimit{MaxBytes: 1000, MaxItems: 10},
+		Overrides: map[string]types.QuotaLimit{strings.Repeat("a", 64): {MaxBytes: 5000}},
+	}
+
+	if err := settings.Apply(types.RelaySettings{Mode: "smart", Kinds: []string{"kind1"}, Quota: quota}); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"relay_settings": {"mode": "smart", "kinds": ["kind1", "kind7"], "isKindsActive": true}}`
+
+	request := httptest.NewRequest(http.MethodPost, "/relay-settings", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := web.NewApp(newMemoryStore(t)).Test(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected the settings to be saved, got status %d", response.StatusCode)
+	}
+
+	current := settings.Get()
+
+	if len(current.Kinds) != 2 {
+		t.Fatalf("expected the posted kinds to be saved, got %v", current.Kinds)
+	}
+
+	if !reflect.DeepEqual(current.Quota, quota) {
+		t.Fatalf("expected the quota to survive a save without one, got %+v", current.Quota)
+	}
+}
@@ -0,0 +1,598 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/deroproject/graviton"
+	"github.com/nbd-wtf/go-nostr"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/encryption"
+	stores "github.com/HORNET-Storage/hornet-storage/lib/stores"
+	stores_bbolt "github.com/HORNET-Storage/hornet-storage/lib/stores/bbolt"
+	"github.com/HORNET-Storage/hornet-storage/lib/stores/conformance"
+	stores_graviton "github.com/HORNET-Storage/hornet-storage/lib/stores/graviton"
+	stores_memory "github.com/HORNET-Storage/hornet-storage/lib/stores/memory"
+	merkle_dag "github.com/HORNET-Storage/scionic-merkletree/dag"
+)
+
+func TestGravitonStoreConformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T) stores.Store {
+		store := &stores_graviton.GravitonStore{}
+
+		err := store.InitStore(filepath.Join(t.TempDir(), "gravitondb"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return store
+	})
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T) stores.Store {
+		store := &stores_memory.GravitonMemoryStore{}
+
+		err := store.InitStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return store
+	})
+}
+
+func TestBBoltStoreConformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T) stores.Store {
+		store := &stores_bbolt.BBoltStore{}
+
+		err := store.InitStore(filepath.Join(t.TempDir(), "bboltdb"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() {
+			store.Database.Db.Close()
+		})
+
+		return store
+	})
+}
+
+func TestEncryptedGravitonStoreConformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T) stores.Store {
+		dir := t.TempDir()
+
+		master := encryptionKey(t, dir)
+
+		store := &stores_graviton.GravitonStore{}
+
+		err := store.InitStore(filepath.Join(dir, "gravitondb"), master)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return store
+	})
+}
+
+func encryptionKey(t *testing.T, dir string) *encryption.MasterKey {
+	keyFile := filepath.Join(dir, "master.key")
+
+	err := encryption.GenerateKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	master, err := encryption.KeyFileKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return master
+}
+
+// Estimates from the p and e tag sketches must never count events that have been removed
+func TestGravitonSketchDeletes(t *testing.T) {
+	store := &stores_graviton.GravitonStore{}
+
+	err := store.InitStore(filepath.Join(t.TempDir(), "gravitondb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough reactions to the same pubkey for counts to be estimated from its sketch
+	store.ApproximateCountThreshold = 90
+
+	target := strings.Repeat("a", 64)
+
+	batch := store.NewBatch()
+	events := []*nostr.Event{}
+	for i := 0; i < 101; i++ {
+		event := &nostr.Event{
+			PubKey:    strings.Repeat("b", 64),
+			CreatedAt: nostr.Timestamp(1700000000 + i),
+			Kind:      7,
+			Tags:      nostr.Tags{{"p", target}},
+			Content:   "+",
+		}
+		event.ID = event.GetID()
+		events = append(events, event)
+
+		if err := batch.StoreEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("failed to store events: %v", err)
+	}
+
+	filter := nostr.Filter{Kinds: []int{7}, Tags: nostr.TagMap{"p": []string{target}}}
+
+	if _, ok, err := store.EstimateEvents(filter); err != nil || !ok {
+		t.Fatalf("expected the count to be estimated: %v", err)
+	}
+
+	if err := store.DeleteEvent(events[0].ID); err != nil {
+		t.Fatalf("failed to delete event: %v", err)
+	}
+
+	// The sketch that lost the event is rebuilt from the index the next time it is needed
+	for i := 0; i < 2; i++ {
+		estimate, ok, err := store.EstimateEvents(filter)
+		if err != nil || !ok {
+			t.Fatalf("expected the count to be estimated from the rebuilt sketch: %v", err)
+		}
+
+		if estimate < 97 || estimate > 103 {
+			t.Fatalf("expected an estimate close to 100 once an event was deleted, got %d", estimate)
+		}
+	}
+
+	count, err := store.CountEvents(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 100 {
+		t.Fatalf("expected an exact count of 100, got %d", count)
+	}
+}
+
+// A COUNT with several filters estimates the union of their sketches so events tagging both pubkeys are counted once
+func TestGravitonSketchUnion(t *testing.T) {
+	store := &stores_graviton.GravitonStore{}
+
+	err := store.InitStore(filepath.Join(t.TempDir(), "gravitondb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.ApproximateCountThreshold = 90
+
+	first := strings.Repeat("a", 64)
+	second := strings.Repeat("c", 64)
+
+	batch := store.NewBatch()
+	for i := 0; i < 100; i++ {
+		event := &nostr.Event{
+			PubKey:    strings.Repeat("b", 64),
+			CreatedAt: nostr.Timestamp(1700000000 + i),
+			Kind:      7,
+			Tags:      nostr.Tags{{"p", first}, {"p", second}},
+			Content:   "+",
+		}
+		event.ID = event.GetID()
+
+		if err := batch.StoreEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("failed to store events: %v", err)
+	}
+
+	filters := []nostr.Filter{
+		{Kinds: []int{7}, Tags: nostr.TagMap{"p": []string{first}}},
+		{Kinds: []int{7}, Tags: nostr.TagMap{"p": []string{second}}},
+	}
+
+	estimate, ok, err := store.EstimateEvents(filters...)
+	if err != nil || !ok {
+		t.Fatalf("expected the count to be estimated: %v", err)
+	}
+
+	if estimate < 97 || estimate > 103 {
+		t.Fatalf("expected an estimate close to 100 for the union of the filters, got %d", estimate)
+	}
+
+	count, err := store.CountEvents(filters...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 100 {
+		t.Fatalf("expected an exact count of 100 for the union of the filters, got %d", count)
+	}
+
+	// A filter too cheap to estimate means the whole union is counted exactly
+	if _, ok, err := store.EstimateEvents(filters[0], nostr.Filter{Kinds: []int{7}}); err != nil || ok {
+		t.Fatalf("expected the union to be counted exactly when a filter can't be estimated")
+	}
+}
+
+func TestGravitonIndexTies(t *testing.T) {
+	store := &stores_graviton.GravitonStore{}
+
+	err := store.InitStore(filepath.Join(t.TempDir(), "gravitondb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Events created in the same second are ordered by id however many of them share the second
+	batch := store.NewBatch()
+	ids := []string{}
+	for i := 0; i < 1200; i++ {
+		event := &nostr.Event{
+			PubKey:    strings.Repeat("c", 64),
+			CreatedAt: 1700000000,
+			Kind:      30,
+			Tags:      nostr.Tags{},
+			Content:   strconv.Itoa(i),
+		}
+		event.ID = event.GetID()
+		ids = append(ids, event.ID)
+
+		if err := batch.StoreEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("failed to store events: %v", err)
+	}
+
+	sort.Strings(ids)
+
+	events, err := store.QueryEvents(nostr.Filter{Kinds: []int{30}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != len(ids) {
+		t.Fatalf("expected %d events, got %d", len(ids), len(events))
+	}
+
+	for i, event := range events {
+		if event.ID != ids[i] {
+			t.Fatalf("expected the events in id order, event %d is %s instead of %s", i, event.ID, ids[i])
+		}
+	}
+
+	for _, id := range ids[:600] {
+		if err := store.DeleteEvent(id); err != nil {
+			t.Fatalf("failed to delete event: %v", err)
+		}
+	}
+
+	if count, err := store.CountEvents(nostr.Filter{Kinds: []int{30}}); err != nil || count != 600 {
+		t.Fatalf("expected 600 events to be left, got %d %v", count, err)
+	}
+}
+
+// Index entries are kept in a tree per time bucket, queries walk the buckets newest first and skip emptied ones
+func TestGravitonIndexBuckets(t *testing.T) {
+	store := &stores_graviton.GravitonStore{}
+
+	err := store.InitStore(filepath.Join(t.TempDir(), "gravitondb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := nostr.GeneratePrivateKey()
+
+	// A day apart puts every event in a bucket of its own
+	events := []*nostr.Event{}
+	for i := 0; i < 10; i++ {
+		event := &nostr.Event{CreatedAt: nostr.Timestamp(1700000000 + i*86400), Kind: 1, Tags: nostr.Tags{}, Content: strconv.Itoa(i)}
+		event.Sign(key)
+
+		if err := store.StoreEvent(event); err != nil {
+			t.Fatalf("failed to store event: %v", err)
+		}
+
+		events = append(events, event)
+	}
+
+	if err := store.DeleteEvent(events[7].ID); err != nil {
+		t.Fatalf("failed to delete event: %v", err)
+	}
+
+	since := events[2].CreatedAt
+	until := events[8].CreatedAt
+
+	found, err := store.QueryEvents(nostr.Filter{Kinds: []int{1}, Since: &since, Until: &until, Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := []string{}
+	for _, event := range found {
+		contents = append(contents, event.Content)
+	}
+
+	if strings.Join(contents, ",") != "8,6,5" {
+		t.Fatalf("expected the newest events in range without the deleted one, got %v", contents)
+	}
+
+	if count, err := store.CountEvents(nostr.Filter{Kinds: []int{1}}); err != nil || count != 9 {
+		t.Fatalf("expected 9 events to be counted, got %d %v", count, err)
+	}
+}
+
+// An index built by an older version is rebuilt on open, committing as it goes, and answers the same queries
+func TestGravitonIndexRebuild(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gravitondb")
+
+	store := &stores_graviton.GravitonStore{}
+
+	err := store.InitStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := nostr.GeneratePrivateKey()
+
+	batch := store.NewBatch()
+	for i := 0; i < 1500; i++ {
+		event := &nostr.Event{CreatedAt: nostr.Timestamp(1700000000 + i*100), Kind: 1, Tags: nostr.Tags{{"t", strconv.Itoa(i % 3)}}, Content: strconv.Itoa(i)}
+		event.Sign(key)
+
+		if err := batch.StoreEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("failed to store events: %v", err)
+	}
+
+	snapshot, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := snapshot.GetTree("idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Put([]byte("version"), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := graviton.Commit(tree); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := &stores_graviton.GravitonStore{}
+
+	err = reopened.InitStore(path)
+	if err != nil {
+		t.Fatalf("failed to rebuild indexes: %v", err)
+	}
+
+	if count, err := reopened.CountEvents(nostr.Filter{Kinds: []int{1}}); err != nil || count != 1500 {
+		t.Fatalf("expected 1500 events after the rebuild, got %d %v", count, err)
+	}
+
+	events, err := reopened.QueryEvents(nostr.Filter{Tags: nostr.TagMap{"t": []string{"2"}}, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[0].Content != "1499" || events[1].Content != "1496" {
+		t.Fatalf("expected the newest tagged events after the rebuild, got %v", events)
+	}
+}
+
+// Leaves stored before reference counting have no count and must survive deleting one of the dags sharing them
+func TestGravitonDeleteDagUncountedLeaves(t *testing.T) {
+	store := &stores_graviton.GravitonStore{}
+
+	err := store.InitStore(filepath.Join(t.TempDir(), "gravitondb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "legacy")
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "shared.txt"), []byte("shared between dags"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dags := []*types.DagData{}
+	for _, label := range []string{"first", "second"} {
+		dag, err := merkle_dag.CreateDagAdvanced(dir, map[string]string{"label": label})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := &types.DagData{PublicKey: nostr.GeneratePrivateKey(), Signature: "legacy-signature", Dag: *dag}
+
+		err = store.StoreDag(data)
+		if err != nil {
+			t.Fatalf("failed to store dag: %v", err)
+		}
+
+		dags = append(dags, data)
+	}
+
+	// Strip the leaf counts so the stored leaves look like they predate reference counting
+	snapshot, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := snapshot.GetTree("refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dagRefs, err := snapshot.GetTree("dagrefs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tree := range []*graviton.Tree{refs, dagRefs} {
+		keys := [][]byte{}
+
+		cursor := tree.Cursor()
+		for key, _, err := cursor.First(); err == nil; key, _, err = cursor.Next() {
+			if tree == dagRefs || strings.HasPrefix(string(key), "leaf:") {
+				keys = append(keys, append([]byte{}, key...))
+			}
+		}
+
+		for _, key := range keys {
+			if err := tree.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if _, err := graviton.Commit(refs, dagRefs); err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.DeleteDag(dags[0].Dag.Root)
+	if err != nil {
+		t.Fatalf("failed to delete dag: %v", err)
+	}
+
+	if _, err := store.CollectGarbage(); err != nil {
+		t.Fatalf("failed to collect garbage: %v", err)
+	}
+
+	built, err := store.BuildDagFromStore(dags[1].Dag.Root, true)
+	if err != nil {
+		t.Fatalf("failed to build a dag sharing uncounted leaves with a deleted dag: %v", err)
+	}
+
+	err = built.Dag.Verify()
+	if err != nil {
+		t.Fatalf("dag sharing uncounted leaves with a deleted dag failed verification: %v", err)
+	}
+}
+
+// Every graviton commit is listed, including the ones made while the store is opened, with graviton's own numbering
+func TestGravitonVersionsMatchCommits(t *testing.T) {
+	store := &stores_graviton.GravitonStore{}
+
+	err := store.InitStore(filepath.Join(t.TempDir(), "gravitondb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := &nostr.Event{CreatedAt: 1000, Kind: 1, Tags: nostr.Tags{}, Content: "versioned"}
+	event.Sign(nostr.GeneratePrivateKey())
+
+	if err := store.StoreEvent(event); err != nil {
+		t.Fatalf("failed to store event: %v", err)
+	}
+
+	versions, err := store.ListVersions(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := store.Database.LoadSnapshot(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uint64(len(versions)) != snapshot.GetVersion() {
+		t.Fatalf("expected %d versions to be listed, got %d", snapshot.GetVersion(), len(versions))
+	}
+
+	for i, version := range versions {
+		if version.Version != uint64(i+1) {
+			t.Fatalf("expected version %d at position %d, got %d", i+1, i, version.Version)
+		}
+	}
+}
+
+// A backup taken while events keep being stored opens as one of the committed versions
+func TestGravitonBackupDuringWrites(t *testing.T) {
+	store := &stores_graviton.GravitonStore{}
+
+	err := store.InitStore(filepath.Join(t.TempDir(), "gravitondb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := nostr.GeneratePrivateKey()
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 200; i++ {
+			event := &nostr.Event{CreatedAt: nostr.Timestamp(1000 + i), Kind: 1, Tags: nostr.Tags{}, Content: strconv.Itoa(i)}
+			event.Sign(key)
+
+			if err := store.StoreEvent(event); err != nil {
+				done <- err
+				return
+			}
+		}
+
+		done <- nil
+	}()
+
+	dir := t.TempDir()
+
+	err = store.Backup(dir)
+	if err != nil {
+		t.Fatalf("failed to back up store: %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("failed to store event: %v", err)
+	}
+
+	restored := &stores_graviton.GravitonStore{}
+
+	err = restored.InitStore(filepath.Join(dir, "gravitondb"))
+	if err != nil {
+		t.Fatalf("failed to open backup: %v", err)
+	}
+
+	events, err := restored.QueryEvents(nostr.Filter{Kinds: []int{1}})
+	if err != nil {
+		t.Fatalf("failed to query backup: %v", err)
+	}
+
+	// Events are stored oldest first, so the backup holds an unbroken prefix of them
+	seen := map[string]bool{}
+	for _, event := range events {
+		seen[event.Content] = true
+	}
+
+	for i := range events {
+		if !seen[strconv.Itoa(i)] {
+			t.Fatalf("backup of %d events is missing event %d", len(events), i)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/viper"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	"github.com/HORNET-Storage/hornet-storage/lib/backup"
+	"github.com/HORNET-Storage/hornet-storage/lib/handlers/blossom"
+	stores_graviton "github.com/HORNET-Storage/hornet-storage/lib/stores/graviton"
+	stores_memory "github.com/HORNET-Storage/hornet-storage/lib/stores/memory"
+	"github.com/HORNET-Storage/hornet-storage/lib/transfer"
+	merkle_dag "github.com/HORNET-Storage/scionic-merkletree/dag"
+)
+
+func createTransferDag(t *testing.T) *types.DagData {
+	root := filepath.Join(t.TempDir(), "transfer")
+
+	err := os.MkdirAll(filepath.Join(root, "nested"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"hello.txt":          []byte("hello world"),
+		"nested/chunked.bin": bytes.Repeat([]byte("car archive "), merkle_dag.ChunkSize/12+1),
+	}
+
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(root, name), content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dag, err := merkle_dag.CreateDag(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &types.DagData{
+		PublicKey: nostr.GeneratePrivateKey(),
+		Signature: "transfer-signature",
+		Dag:       *dag,
+	}
+}
+
+func newMemoryStore(t *testing.T) *stores_memory.GravitonMemoryStore {
+	store := &stores_memory.GravitonMemoryStore{}
+
+	err := store.InitStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+func TestCarRoundTrip(t *testing.T) {
+	data := createTransferDag(t)
+
+	source := newMemoryStore(t)
+
+	err := source.StoreDag(data)
+	if err != nil {
+		t.Fatalf("failed to store dag: %v", err)
+	}
+
+	var archive bytes.Buffer
+
+	blocks, err := transfer.ExportCar(source, data.Dag.Root, &archive)
+	if err != nil {
+		t.Fatalf("failed to export car: %v", err)
+	}
+
+	if blocks != len(data.Dag.Leafs) {
+		t.Fatalf("expected %d blocks, got %d", len(data.Dag.Leafs), blocks)
+	}
+
+	destination := newMemoryStore(t)
+
+	imported, err := transfer.ImportCar(destination, bytes.NewReader(archive.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("failed to import car: %v", err)
+	}
+
+	if imported.Dag.Root != data.Dag.Root {
+		t.Fatalf("expected root %s, got %s", data.Dag.Root, imported.Dag.Root)
+	}
+
+	built, err := destination.BuildDagFromStore(data.Dag.Root, true)
+	if err != nil {
+		t.Fatalf("failed to build imported dag: %v", err)
+	}
+
+	if built.PublicKey != data.PublicKey || built.Signature != data.Signature {
+		t.Fatalf("public key and signature were not preserved")
+	}
+
+	if len(built.Dag.Leafs) != len(data.Dag.Leafs) {
+		t.Fatalf("expected %d leaves, got %d", len(data.Dag.Leafs), len(built.Dag.Leafs))
+	}
+
+	err = built.Dag.Verify()
+	if err != nil {
+		t.Fatalf("imported dag failed verification: %v", err)
+	}
+
+	// A dag the caller refuses is not stored
+	refused := newMemoryStore(t)
+
+	_, err = transfer.ImportCar(refused, bytes.NewReader(archive.Bytes()), func(rootLeaf *merkle_dag.DagLeaf, pubKey *string, signature *string) bool {
+		return false
+	})
+	if err == nil {
+		t.Fatalf("expected a refused import to fail")
+	}
+
+	if _, err := refused.BuildDagFromStore(data.Dag.Root, false); err == nil {
+		t.Fatalf("a refused dag was stored")
+	}
+
+	// An archive missing blocks fails verification and stores nothing
+	truncated := archive.Bytes()[:archive.Len()-1]
+
+	incomplete := newMemoryStore(t)
+
+	_, err = transfer.ImportCar(incomplete, bytes.NewReader(truncated), nil)
+	if err == nil {
+		t.Fatalf("expected a truncated archive to fail")
+	}
+
+	if _, err := incomplete.BuildDagFromStore(data.Dag.Root, false); err == nil {
+		t.Fatalf("a truncated archive was stored")
+	}
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	data := createTransferDag(t)
+
+	source := &stores_graviton.GravitonStore{}
+
+	err := source.InitStore(filepath.Join(t.TempDir(), "gravitondb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = source.StoreDag(data)
+	if err != nil {
+		t.Fatalf("failed to store dag: %v", err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "relay.tar.gz")
+
+	manifest, err := backup.Create(source, archive)
+	if err != nil {
+		t.Fatalf("failed to create backup: %v", err)
+	}
+
+	if len(manifest.Files) == 0 {
+		t.Fatalf("backup manifest lists no files")
+	}
+
+	dir := t.TempDir()
+
+	t.Cleanup(func() {
+		viper.Set("data_dir", nil)
+	})
+
+	viper.Set("data_dir", dir)
+
+	_, err = backup.Restore(archive, false)
+	if err != nil {
+		t.Fatalf("failed to restore backup: %v", err)
+	}
+
+	// Restoring over the same files again is refused unless forced
+	if _, err := backup.Restore(archive, false); err == nil {
+		t.Fatalf("expected a restore over existing files to fail")
+	}
+
+	if _, err := backup.Restore(archive, true); err != nil {
+		t.Fatalf("failed to force restore backup: %v", err)
+	}
+
+	restored := &stores_graviton.GravitonStore{}
+
+	err = restored.InitStore(filepath.Join(dir, "gravitondb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	built, err := restored.BuildDagFromStore(data.Dag.Root, true)
+	if err != nil {
+		t.Fatalf("failed to build restored dag: %v", err)
+	}
+
+	err = built.Dag.Verify()
+	if err != nil {
+		t.Fatalf("restored dag failed verification: %v", err)
+	}
+}
+
+func TestBackupFilesystemBlobs(t *testing.T) {
+	t.Cleanup(func() {
+		viper.Set("blossom_storage", nil)
+		viper.Set("blossom_dir", nil)
+		viper.Set("data_dir", nil)
+	})
+
+	viper.Set("blossom_storage", "filesystem")
+	viper.Set("blossom_dir", filepath.Join(t.TempDir(), "blobs"))
+
+	source := &stores_graviton.GravitonStore{}
+
+	err := source.InitStore(filepath.Join(t.TempDir(), "gravitondb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := blossom.NewStorage(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := bytes.Repeat([]byte("filesystem blob "), 1000)
+
+	descriptor, err := storage.Put(bytes.NewReader(content), "application/octet-stream", nostr.GeneratePrivateKey())
+	if err != nil {
+		t.Fatalf("failed to store blob: %v", err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "relay.tar.gz")
+
+	manifest, err := backup.Create(source, archive)
+	if err != nil {
+		t.Fatalf("failed to create backup: %v", err)
+	}
+
+	if manifest.BlobDir != "blobs" {
+		t.Fatalf("expected the blob directory in the manifest, got %q", manifest.BlobDir)
+	}
+
+	dir := t.TempDir()
+
+	// Without an override the blobs are restored into the data directory under the name they were backed up with
+	viper.Set("data_dir", dir)
+	viper.Set("blossom_dir", nil)
+
+	_, err = backup.Restore(archive, false)
+	if err != nil {
+		t.Fatalf("failed to restore backup: %v", err)
+	}
+
+	restored := &stores_graviton.GravitonStore{}
+
+	err = restored.InitStore(filepath.Join(dir, "gravitondb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("blossom_dir", filepath.Join(dir, manifest.BlobDir))
+
+	restoredStorage, err := blossom.NewStorage(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, _, err := restoredStorage.Get(descriptor.SHA256)
+	if err != nil {
+		t.Fatalf("failed to get restored blob: %v", err)
+	}
+
+	read, err := io.ReadAll(reader)
+	reader.Close()
+
+	if err != nil || !bytes.Equal(read, content) {
+		t.Fatalf("restored blob content was not preserved: %v", err)
+	}
+}
+
+func TestBackupRestorePathOverrides(t *testing.T) {
+	t.Cleanup(func() {
+		viper.Set("blossom_storage", nil)
+		viper.Set("blossom_dir", nil)
+		viper.Set("data_dir", nil)
+		viper.Set("graviton_dir", nil)
+		viper.Set("relay_stats_db", nil)
+	})
+
+	viper.Set("blossom_storage", "filesystem")
+	viper.Set("blossom_dir", filepath.Join(t.TempDir(), "blobs"))
+
+	source := &stores_graviton.GravitonStore{}
+
+	err := source.InitStore(filepath.Join(t.TempDir(), "gravitondb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := blossom.NewStorage(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	descriptor, err := storage.Put(bytes.NewReader([]byte("overridden blob")), "application/octet-stream", nostr.GeneratePrivateKey())
+	if err != nil {
+		t.Fatalf("failed to store blob: %v", err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "relay.tar.gz")
+
+	_, err = backup.Create(source, archive)
+	if err != nil {
+		t.Fatalf("failed to create backup: %v", err)
+	}
+
+	dir := t.TempDir()
+	elsewhere := t.TempDir()
+
+	viper.Set("data_dir", dir)
+	viper.Set("graviton_dir", filepath.Join(elsewhere, "store"))
+	viper.Set("relay_stats_db", filepath.Join(elsewhere, "stats", "stats.db"))
+	viper.Set("blossom_dir", "media")
+
+	_, err = backup.Restore(archive, false)
+	if err != nil {
+		t.Fatalf("failed to restore backup: %v", err)
+	}
+
+	for _, path := range []string{
+		filepath.Join(elsewhere, "store"),
+		filepath.Join(elsewhere, "stats", "stats.db"),
+		filepath.Join(dir, "media", descriptor.SHA256[0:2], descriptor.SHA256[2:4], descriptor.SHA256),
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %s to be restored: %v", path, err)
+		}
+	}
+
+	for _, name := range []string{"gravitondb", "relay_stats.db", "blobs"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Fatalf("expected %s not to be restored to its default location", name)
+		}
+	}
+
+	restored := &stores_graviton.GravitonStore{}
+
+	err = restored.InitStore(filepath.Join(elsewhere, "store"))
+	if err != nil {
+		t.Fatalf("failed to open restored store: %v", err)
+	}
+}
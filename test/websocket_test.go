@@ -0,0 +1,406 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fasthttp_websocket "github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/viper"
+
+	types "github.com/HORNET-Storage/hornet-storage/lib"
+	lib_nostr "github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr"
+	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/ephemeral"
+	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/filter"
+	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/kind1"
+	"github.com/HORNET-Storage/hornet-storage/lib/handlers/nostr/universal"
+	"github.com/HORNET-Storage/hornet-storage/lib/settings"
+	stores_memory "github.com/HORNET-Storage/hornet-storage/lib/stores/memory"
+	"github.com/HORNET-Storage/hornet-storage/lib/transports/websocket"
+)
+
+var (
+	websocketOnce  sync.Once
+	websocketURL   string
+	websocketStore *stores_memory.GravitonMemoryStore
+)
+
+// startWebsocketServer starts a single websocket relay backed by a memory store for the tests that need one
+func startWebsocketServer(t *testing.T) (string, *stores_memory.GravitonMemoryStore) {
+	websocketOnce.Do(func() {
+		websocketStore = newMemoryStore(t)
+
+		// Events of every kind go to the universal handler unless a test switches to smart mode
+		if err := settings.Apply(types.RelaySettings{Mode: "unlimited"}); err != nil {
+			t.Fatal(err)
+		}
+
+		lib_nostr.RegisterHandler("universal", universal.BuildUniversalHandler(websocketStore))
+		lib_nostr.RegisterHandler("ephemeral", ephemeral.BuildEphemeralHandler())
+		lib_nostr.RegisterStreamHandler("filter", filter.BuildFilterStreamHandler(websocketStore))
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+
+		// The websocket server listens one port above the configured one
+		viper.Set("port", strconv.Itoa(port-1))
+
+		go websocket.StartServer(websocketStore)
+
+		websocketURL = fmt.Sprintf("ws://127.0.0.1:%d", port)
+		for i := 0; i < 50; i++ {
+			if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+				conn.Close()
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+
+	if websocketStore == nil {
+		t.Fatal("websocket server failed to start")
+	}
+
+	return websocketURL, websocketStore
+}
+
+func connectRelay(t *testing.T) *nostr.Relay {
+	url, _ := startWebsocketServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relay, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		t.Fatalf("failed to connect to relay: %v", err)
+	}
+	t.Cleanup(func() { relay.Close() })
+
+	return relay
+}
+
+func createSignedEvent(t *testing.T, kind int, content string) nostr.Event {
+	event := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      kind,
+		Tags:      nostr.Tags{},
+		Content:   content,
+	}
+
+	if err := event.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	return event
+}
+
+func TestWebsocketForgedID(t *testing.T) {
+	relay := connectRelay(t)
+	_, store := startWebsocketServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	real := createSignedEvent(t, 1, "the real event")
+
+	// A validly signed event claiming the real event's id must not take its place
+	forged := createSignedEvent(t, 1, "a forged event")
+	forged.ID = real.ID
+
+	err := relay.Publish(ctx, forged)
+	if err == nil || !strings.Contains(err.Error(), lib_nostr.PrefixInvalid) {
+		t.Fatalf("expected the forged event to be rejected as invalid, got %v", err)
+	}
+
+	if err := relay.Publish(ctx, real); err != nil {
+		t.Fatalf("expected the real event to be accepted, got %v", err)
+	}
+
+	events, err := store.QueryEvents(nostr.Filter{IDs: []string{real.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Content != real.Content {
+		t.Fatalf("expected the real event to be stored, got %v", events)
+	}
+}
+
+func TestWebsocketPowAuthenticated(t *testing.T) {
+	viper.Set("min_pow_difficulty", 8)
+	t.Cleanup(func() { viper.Set("min_pow_difficulty", nil) })
+
+	key := nostr.GeneratePrivateKey()
+	conn := authenticatedConnection(t, key)
+
+	own := nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Tags: nostr.Tags{}, Content: "no work needed"}
+	if err := own.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok := publishRaw(t, conn, own); !ok.OK {
+		t.Fatalf("expected the authenticated pubkey's own event to skip pow, got %s", ok.Reason)
+	}
+
+	// Another pubkey's event still needs work even on an authenticated connection
+	other := createSignedEvent(t, 1, "someone else")
+	if ok := publishRaw(t, conn, other); ok.OK || !strings.HasPrefix(ok.Reason, lib_nostr.PrefixPow) {
+		t.Fatalf("expected another pubkey's event to need pow, got %v", ok)
+	}
+
+	// Being authenticated on one connection exempts nothing sent over another
+	again := nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Tags: nostr.Tags{}, Content: "from another connection"}
+	if err := again.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := connectRelay(t).Publish(ctx, again); err == nil || !strings.Contains(err.Error(), lib_nostr.PrefixPow) {
+		t.Fatalf("expected an unauthenticated connection to need pow, got %v", err)
+	}
+}
+
+// authenticatedConnection opens a raw connection and answers its AUTH challenge, the go-nostr client drops the
+// challenge the relay sends as soon as it connects so it can't be used here
+func authenticatedConnection(t *testing.T, key string) *fasthttp_websocket.Conn {
+	url, _ := startWebsocketServer(t)
+
+	conn, _, err := fasthttp_websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("failed to connect to relay: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var challenge nostr.AuthEnvelope
+	if err := challenge.UnmarshalJSON(readRaw(t, conn)); err != nil || challenge.Challenge == nil {
+		t.Fatalf("expected an AUTH challenge, got %v", err)
+	}
+
+	auth := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindClientAuthentication,
+		Tags:      nostr.Tags{{"relay", url}, {"challenge", *challenge.Challenge}},
+	}
+	if err := auth.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok := writeRaw(t, conn, &nostr.AuthEnvelope{Event: auth}); !ok.OK {
+		t.Fatalf("failed to authenticate: %s", ok.Reason)
+	}
+
+	return conn
+}
+
+func publishRaw(t *testing.T, conn *fasthttp_websocket.Conn, event nostr.Event) nostr.OKEnvelope {
+	return writeRaw(t, conn, &nostr.EventEnvelope{Event: event})
+}
+
+// writeRaw sends an envelope and waits for the OK that answers it
+func writeRaw(t *testing.T, conn *fasthttp_websocket.Conn, envelope nostr.Envelope) nostr.OKEnvelope {
+	message, err := envelope.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.WriteMessage(fasthttp_websocket.TextMessage, message); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if ok, isOK := nostr.ParseMessage(readRaw(t, conn)).(*nostr.OKEnvelope); isOK {
+			return *ok
+		}
+	}
+}
+
+func readRaw(t *testing.T, conn *fasthttp_websocket.Conn) []byte {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read from relay: %v", err)
+	}
+
+	return message
+}
+
+func TestWebsocketRelayInfo(t *testing.T) {
+	url, store := startWebsocketServer(t)
+
+	previous := *settings.Get()
+	t.Cleanup(func() {
+		settings.Apply(previous)
+	})
+
+	// Other tests check the supported NIPs so the handler registered here is put back the way it was
+	registered, wasRegistered := lib_nostr.KindHandlers["kind/1"]
+	t.Cleanup(func() {
+		if wasRegistered {
+			lib_nostr.KindHandlers["kind/1"] = registered
+		} else {
+			delete(lib_nostr.KindHandlers, "kind/1")
+		}
+	})
+
+	lib_nostr.RegisterHandler("kind/1", kind1.BuildKind1Handler(store))
+
+	relayInfo := func() map[string]json.RawMessage {
+		request, err := http.NewRequest(http.MethodGet, strings.Replace(url, "ws://", "http://", 1), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Accept", "application/nostr+json")
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		info := map[string]json.RawMessage{}
+		if err := json.NewDecoder(response.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+
+		return info
+	}
+
+	relaySettings := func(info map[string]json.RawMessage) map[string]json.RawMessage {
+		block := map[string]json.RawMessage{}
+		if err := json.Unmarshal(info["relay_settings"], &block); err != nil {
+			t.Fatalf("expected the relay settings in the relay information document: %v", err)
+		}
+
+		return block
+	}
+
+	if err := settings.Apply(types.RelaySettings{Mode: "unlimited"}); err != nil {
+		t.Fatal(err)
+	}
+
+	info := relayInfo()
+
+	if retention := string(info["retention"]); retention != `[{"kinds":[[20000,29999]],"time":0}]` {
+		t.Fatalf("expected only ephemeral kinds to go unstored in unlimited mode, got %s", retention)
+	}
+
+	if block := relaySettings(info); string(block["mode"]) != `"unlimited"` || block["accepted_kinds"] != nil {
+		t.Fatalf("expected unlimited mode without a list of accepted kinds, got %v", block)
+	}
+
+	// Smart mode stores only the kinds that are allowed and have a handler
+	if err := settings.Apply(types.RelaySettings{Mode: "smart", Kinds: []string{"kind1", "kind40"}, Photos: []string{"png"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	info = relayInfo()
+
+	if retention := string(info["retention"]); retention != `[{"kinds":[0,[2,65535]],"time":0}]` {
+		t.Fatalf("expected every kind but kind 1 to go unstored in smart mode, got %s", retention)
+	}
+
+	block := relaySettings(info)
+
+	if kinds := string(block["accepted_kinds"]); kinds != `[1]` {
+		t.Fatalf("expected only kind 1 to be accepted in smart mode, got %s", kinds)
+	}
+
+	if media := string(block["blocked_media"]); media != `{"photos":["png"]}` {
+		t.Fatalf("expected the blocked media types to be listed, got %s", media)
+	}
+
+	// Proof of work is only advertised while some kind needs it
+	supportsPow := func() bool {
+		nips := []int{}
+		if err := json.Unmarshal(relayInfo()["supported_nips"], &nips); err != nil {
+			t.Fatal(err)
+		}
+
+		return slices.Contains(nips, 13)
+	}
+
+	if supportsPow() {
+		t.Fatalf("expected NIP-13 not to be advertised without a minimum difficulty")
+	}
+
+	t.Cleanup(func() {
+		viper.Set("min_pow_difficulty_kinds", nil)
+	})
+
+	viper.Set("min_pow_difficulty_kinds", map[string]interface{}{"1": 8})
+
+	if !supportsPow() {
+		t.Fatalf("expected NIP-13 to be advertised with a per kind minimum difficulty")
+	}
+}
+
+// A client that pauses while its own REQ is answered gets every stored result, only events from other connections are
+// dropped when it falls behind
+func TestWebsocketSlowRequestReader(t *testing.T) {
+	url, store := startWebsocketServer(t)
+
+	key := nostr.GeneratePrivateKey()
+	content := strings.Repeat("x", 120*1024)
+
+	for i := 0; i < 500; i++ {
+		event := nostr.Event{CreatedAt: nostr.Timestamp(1700000000 + i), Kind: 7777, Tags: nostr.Tags{}, Content: content}
+		if err := event.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.StoreEvent(&event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, _, err := fasthttp_websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("failed to connect to relay: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// The AUTH challenge sent on connect
+	readRaw(t, conn)
+
+	request, err := (&nostr.ReqEnvelope{SubscriptionID: "slow", Filters: nostr.Filters{{Kinds: []int{7777}, Limit: 500}}}).MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.WriteMessage(fasthttp_websocket.TextMessage, request); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	received := 0
+	for {
+		switch envelope := nostr.ParseMessage(readRaw(t, conn)).(type) {
+		case *nostr.EventEnvelope:
+			received++
+		case *nostr.EOSEEnvelope:
+			if received != 500 {
+				t.Fatalf("expected 500 events before EOSE, got %d", received)
+			}
+			return
+		default:
+			t.Fatalf("expected only events and EOSE, got %v", envelope)
+		}
+	}
+}